@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	// 活動の集計の対象期間
+	activityDays = 365
+	// 投稿やコメントで捨てるので長めに持つ
+	activityTTL = 10 * time.Minute
+)
+
+// 1日の投稿とコメントの数
+type activityDay struct {
+	Date     string `json:"date" db:"date"`
+	Posts    int    `json:"posts" db:"posts"`
+	Comments int    `json:"comments" db:"comments"`
+}
+
+// プロフィールのヒートマップ用の活動の記録
+// Daysは投稿かコメントがあった日だけを古い順に持つ
+type userActivity struct {
+	From string        `json:"from"`
+	To   string        `json:"to"`
+	Days []activityDay `json:"days"`
+	// 1日あたりの投稿とコメントの合計の最大（色の濃さの基準）
+	Max int `json:"max"`
+}
+
+func userActivityKey(userID int) string {
+	return "activity:" + strconv.Itoa(userID)
+}
+
+// 過去1年の日ごとの投稿とコメントの数を1回のクエリで集計する
+func fetchUserActivity(ctx context.Context, userID int, now time.Time) (userActivity, error) {
+	to := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	from := to.AddDate(0, 0, -(activityDays - 1))
+
+	days := []activityDay{}
+	err := db.SelectContext(ctx, &days,
+		"SELECT DATE_FORMAT(`d`, '%Y-%m-%d') AS `date`, SUM(`p`) AS `posts`, SUM(`c`) AS `comments` FROM ("+
+			"SELECT DATE(`created_at`) AS `d`, 1 AS `p`, 0 AS `c` FROM `posts` WHERE `user_id` = ? AND `created_at` >= ?"+
+			" UNION ALL "+
+			"SELECT DATE(`created_at`) AS `d`, 0 AS `p`, 1 AS `c` FROM `comments` WHERE `user_id` = ? AND `created_at` >= ?"+
+			") t GROUP BY `d` ORDER BY `d`",
+		userID, from, userID, from,
+	)
+	if err != nil {
+		return userActivity{}, err
+	}
+
+	a := userActivity{From: from.Format(time.DateOnly), To: to.Format(time.DateOnly), Days: days}
+	for _, d := range days {
+		a.Max = max(a.Max, d.Posts+d.Comments)
+	}
+	return a, nil
+}
+
+func getUserActivityCached(ctx context.Context, userID int) (userActivity, error) {
+	if a, err := cacheGet[userActivity](ctx, userActivityKey(userID)); err == nil {
+		return a, nil
+	}
+	a, err := fetchUserActivity(ctx, userID, time.Now())
+	if err != nil {
+		return userActivity{}, err
+	}
+	if err := cacheSet(ctx, userActivityKey(userID), a, activityTTL); err != nil {
+		logger("cache").Error("failed to set activity cache", "err", err)
+	}
+	return a, nil
+}
+
+func subscribeActivityCache() {
+	expire := func(userID int) {
+		if err := cacheStore.Delete(context.Background(), userActivityKey(userID)); err != nil {
+			logger("cache").Error("failed to expire activity cache", "err", err)
+		}
+	}
+	subscribe(events, func(e PostCreated) { expire(e.UserID) })
+	subscribe(events, func(e CommentCreated) { expire(e.UserID) })
+}
+
+// GET /api/v1/users/{accountName}/activity
+// プロフィールのヒートマップ用に過去1年の日ごとの投稿とコメントの数を返す
+func getAPIUserActivity(w http.ResponseWriter, r *http.Request) error {
+	user, err := getActiveUserByAccountName(r.Context(), r.PathValue("accountName"))
+	if err != nil {
+		return err
+	}
+
+	a, err := getUserActivityCached(r.Context(), user.ID)
+	if err != nil {
+		return err
+	}
+
+	w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", int(activityTTL.Seconds())))
+	return writeJSON(w, http.StatusOK, struct {
+		AccountName string `json:"account_name"`
+		userActivity
+	}{user.AccountName, a})
+}
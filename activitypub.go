@@ -0,0 +1,593 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"database/sql"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// ActivityPubの最小限の実装
+// アクター、投稿をNoteとして返すアウトボックス、WebFinger、
+// 署名付きのフォロー（とその取り消し）を受け付けるインボックスだけに対応する
+
+const (
+	activityStreamsContext = "https://www.w3.org/ns/activitystreams"
+	securityContext        = "https://w3id.org/security/v1"
+	publicAddressing       = "https://www.w3.org/ns/activitystreams#Public"
+	activityJSONType       = "application/activity+json"
+	// リモートから取得するドキュメントの最大サイズ
+	remoteObjectLimit = 1 * 1024 * 1024 // 1mb
+)
+
+// リモートのサーバーへのリクエストに使うクライアント
+// 誰でもインボックスに送れるkeyIdやinboxのURLに接続するので、内部のアドレスには接続しない
+// 名前解決した後の接続先で確認するので、リダイレクト先やDNSの書き換えにも効く
+var activityPubClient = &http.Client{
+	Timeout: 5 * time.Second,
+	Transport: &http.Transport{
+		DialContext: (&net.Dialer{
+			Timeout: 5 * time.Second,
+			Control: rejectNonPublicAddr,
+		}).DialContext,
+		TLSHandshakeTimeout: 5 * time.Second,
+		MaxIdleConns:        100,
+		IdleConnTimeout:     90 * time.Second,
+	},
+}
+
+var errNonPublicAddr = errors.New("refusing to connect to a non-public address")
+
+// ループバック、プライベート、リンクローカル（169.254.169.254のメタデータなど）のアドレスへの接続を拒む
+func rejectNonPublicAddr(network, address string, _ syscall.RawConn) error {
+	ap, err := netip.ParseAddrPort(address)
+	if err != nil {
+		return err
+	}
+	if !isPublicAddr(ap.Addr()) {
+		return fmt.Errorf("%w: %s", errNonPublicAddr, address)
+	}
+	return nil
+}
+
+// IsGlobalUnicastとIsPrivateで除けない共有アドレスなど
+var nonPublicPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),
+	netip.MustParsePrefix("100.64.0.0/10"),
+	netip.MustParsePrefix("192.0.0.0/24"),
+	netip.MustParsePrefix("198.18.0.0/15"),
+	netip.MustParsePrefix("64:ff9b::/96"),
+	netip.MustParsePrefix("64:ff9b:1::/48"),
+}
+
+func isPublicAddr(ip netip.Addr) bool {
+	ip = ip.Unmap()
+	if !ip.IsGlobalUnicast() || ip.IsPrivate() {
+		return false
+	}
+	for _, p := range nonPublicPrefixes {
+		if p.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// インスタンス共通の署名鍵
+// 複数台で同じ鍵を使うようDBに保存する
+var activityPubKey = struct {
+	sync.Mutex
+	key *rsa.PrivateKey
+}{}
+
+type apPublicKey struct {
+	ID           string `json:"id"`
+	Owner        string `json:"owner"`
+	PublicKeyPem string `json:"publicKeyPem"`
+}
+
+type apActor struct {
+	Context           []string    `json:"@context"`
+	ID                string      `json:"id"`
+	Type              string      `json:"type"`
+	PreferredUsername string      `json:"preferredUsername"`
+	URL               string      `json:"url"`
+	Inbox             string      `json:"inbox"`
+	Outbox            string      `json:"outbox"`
+	PublicKey         apPublicKey `json:"publicKey"`
+}
+
+type apAttachment struct {
+	Type      string `json:"type"`
+	MediaType string `json:"mediaType"`
+	URL       string `json:"url"`
+	Width     int    `json:"width,omitempty"`
+	Height    int    `json:"height,omitempty"`
+}
+
+type apNote struct {
+	ID           string         `json:"id"`
+	Type         string         `json:"type"`
+	AttributedTo string         `json:"attributedTo"`
+	Content      string         `json:"content"`
+	Published    time.Time      `json:"published"`
+	URL          string         `json:"url"`
+	To           []string       `json:"to"`
+	Attachment   []apAttachment `json:"attachment"`
+}
+
+type apActivity struct {
+	Context   string    `json:"@context,omitempty"`
+	ID        string    `json:"id"`
+	Type      string    `json:"type"`
+	Actor     string    `json:"actor"`
+	Published time.Time `json:"published,omitzero"`
+	To        []string  `json:"to,omitempty"`
+	Object    any       `json:"object"`
+}
+
+type apOrderedCollection struct {
+	Context      string       `json:"@context"`
+	ID           string       `json:"id"`
+	Type         string       `json:"type"`
+	OrderedItems []apActivity `json:"orderedItems"`
+	Next         string       `json:"next,omitempty"`
+}
+
+// インボックスで受け取るアクティビティ
+type apInboundActivity struct {
+	ID     string          `json:"id"`
+	Type   string          `json:"type"`
+	Actor  string          `json:"actor"`
+	Object json.RawMessage `json:"object"`
+}
+
+// リモートのアクターまたは鍵のドキュメント
+type apRemoteDocument struct {
+	ID           string      `json:"id"`
+	Inbox        string      `json:"inbox"`
+	PublicKey    apPublicKey `json:"publicKey"`
+	Owner        string      `json:"owner"`
+	PublicKeyPem string      `json:"publicKeyPem"`
+}
+
+func actorURL(base, accountName string) string {
+	return base + "/users/" + url.PathEscape(accountName)
+}
+
+// 署名鍵を取得する。なければ作成して保存する
+func getActivityPubKey() (*rsa.PrivateKey, error) {
+	activityPubKey.Lock()
+	defer activityPubKey.Unlock()
+	if activityPubKey.key != nil {
+		return activityPubKey.key, nil
+	}
+
+	var keyPEM string
+	err := db.Get(&keyPEM, "SELECT `private_key` FROM `activitypub_keys` WHERE `id` = 1")
+	if errors.Is(err, sql.ErrNoRows) {
+		key, err := rsa.GenerateKey(rand.Reader, 2048)
+		if err != nil {
+			return nil, err
+		}
+		der, err := x509.MarshalPKCS8PrivateKey(key)
+		if err != nil {
+			return nil, err
+		}
+		// 他のサーバーが先に作成していた場合はそちらを使う
+		_, err = db.Exec("INSERT IGNORE INTO `activitypub_keys` (`id`, `private_key`) VALUES (1, ?)",
+			string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})))
+		if err != nil {
+			return nil, err
+		}
+		err = db.Get(&keyPEM, "SELECT `private_key` FROM `activitypub_keys` WHERE `id` = 1")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode([]byte(keyPEM))
+	if block == nil {
+		return nil, errors.New("invalid activitypub key")
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	key, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("activitypub key is not rsa")
+	}
+	activityPubKey.key = key
+	return key, nil
+}
+
+func writeActivityJSON(w http.ResponseWriter, status int, v any) error {
+	w.Header().Set("Content-Type", activityJSONType+"; charset=utf-8")
+	w.WriteHeader(status)
+	return json.NewEncoder(w).Encode(v)
+}
+
+// GET /.well-known/webfinger?resource=acct:name@host
+func getWebfinger(w http.ResponseWriter, r *http.Request) error {
+	base := baseURL(r)
+	u, err := url.Parse(base)
+	if err != nil {
+		return err
+	}
+
+	resource := r.URL.Query().Get("resource")
+	acct, ok := strings.CutPrefix(resource, "acct:")
+	if !ok {
+		return newHTTPError(http.StatusBadRequest, errors.New("resource must be an acct uri"))
+	}
+	accountName, host, ok := strings.Cut(acct, "@")
+	if !ok || !strings.EqualFold(host, u.Host) {
+		return errNotFound
+	}
+
+	user, err := getActiveUserByAccountName(r.Context(), accountName)
+	if err != nil {
+		return err
+	}
+
+	type link struct {
+		Rel  string `json:"rel"`
+		Type string `json:"type"`
+		Href string `json:"href"`
+	}
+	w.Header().Set("Content-Type", "application/jrd+json; charset=utf-8")
+	return json.NewEncoder(w).Encode(struct {
+		Subject string   `json:"subject"`
+		Aliases []string `json:"aliases"`
+		Links   []link   `json:"links"`
+	}{
+		Subject: "acct:" + user.AccountName + "@" + u.Host,
+		Aliases: []string{actorURL(base, user.AccountName)},
+		Links: []link{
+			{Rel: "self", Type: activityJSONType, Href: actorURL(base, user.AccountName)},
+			{Rel: "http://webfinger.net/rel/profile-page", Type: "text/html", Href: base + "/@" + user.AccountName},
+		},
+	})
+}
+
+// GET /users/{accountName}
+func getActivityPubActor(w http.ResponseWriter, r *http.Request) error {
+	user, err := getActiveUserByAccountName(r.Context(), r.PathValue("accountName"))
+	if err != nil {
+		return err
+	}
+
+	key, err := getActivityPubKey()
+	if err != nil {
+		return err
+	}
+	pubPEM, err := encodePublicKeyPEM(&key.PublicKey)
+	if err != nil {
+		return err
+	}
+
+	base := baseURL(r)
+	id := actorURL(base, user.AccountName)
+	return writeActivityJSON(w, http.StatusOK, apActor{
+		Context:           []string{activityStreamsContext, securityContext},
+		ID:                id,
+		Type:              "Person",
+		PreferredUsername: user.AccountName,
+		URL:               base + "/@" + user.AccountName,
+		Inbox:             id + "/inbox",
+		Outbox:            id + "/outbox",
+		PublicKey: apPublicKey{
+			ID:           id + "#main-key",
+			Owner:        id,
+			PublicKeyPem: pubPEM,
+		},
+	})
+}
+
+// GET /users/{accountName}/outbox?cursor=
+// 投稿をNoteのCreateとして返す。ページングはGET /postsと同じ
+func getActivityPubOutbox(w http.ResponseWriter, r *http.Request) error {
+	user, err := getActiveUserByAccountName(r.Context(), r.PathValue("accountName"))
+	if err != nil {
+		return err
+	}
+
+	cursor, err := parsePageCursor(r.URL.Query().Get("cursor"))
+	if err != nil {
+		return newHTTPError(http.StatusBadRequest, err)
+	}
+
+	results, err := fetchUserPosts(r.Context(), user.ID, cursor)
+	if err != nil {
+		return err
+	}
+
+	base := baseURL(r)
+	actor := actorURL(base, user.AccountName)
+	items := make([]apActivity, 0, len(results))
+	for _, p := range results {
+		permalink := base + "/posts/" + strconv.Itoa(p.ID)
+		items = append(items, apActivity{
+			ID:        permalink + "#create",
+			Type:      "Create",
+			Actor:     actor,
+			Published: p.CreatedAt,
+			To:        []string{publicAddressing},
+			Object: apNote{
+				ID:           permalink,
+				Type:         "Note",
+				AttributedTo: actor,
+				Content:      "<p>" + template.HTMLEscapeString(p.Body) + "</p>",
+				Published:    p.CreatedAt,
+				URL:          permalink,
+				To:           []string{publicAddressing},
+				Attachment: []apAttachment{{
+					Type:      "Document",
+					MediaType: p.Mime,
+					URL:       base + imagePath(p),
+					Width:     p.Width,
+					Height:    p.Height,
+				}},
+			},
+		})
+	}
+
+	collection := apOrderedCollection{
+		Context:      activityStreamsContext,
+		ID:           actor + "/outbox",
+		Type:         "OrderedCollection",
+		OrderedItems: items,
+	}
+	if next := nextPageCursor(results).String(); next != "" {
+		collection.Next = actor + "/outbox?cursor=" + url.QueryEscape(next)
+	}
+	return writeActivityJSON(w, http.StatusOK, collection)
+}
+
+// POST /users/{accountName}/inbox
+// 署名を検証した上でFollowとUndo(Follow)だけを処理する
+func postActivityPubInbox(w http.ResponseWriter, r *http.Request) error {
+	user, err := getActiveUserByAccountName(r.Context(), r.PathValue("accountName"))
+	if err != nil {
+		return err
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return newHTTPError(http.StatusBadRequest, err)
+	}
+
+	activity, sender, err := authenticateInboxActivity(r, body)
+	if err != nil {
+		return err
+	}
+
+	actor := actorURL(baseURL(r), user.AccountName)
+	switch activity.Type {
+	case "Follow":
+		if activityObjectID(activity.Object) != actor {
+			return newHTTPError(http.StatusBadRequest, errors.New("follow object is not this actor"))
+		}
+		inbox := sender.Inbox
+		if inbox == "" {
+			return newHTTPError(http.StatusBadRequest, errors.New("actor has no inbox"))
+		}
+
+		_, err = db.ExecContext(context.WithoutCancel(r.Context()),
+			"INSERT INTO `activitypub_followers` (`user_id`, `actor`, `inbox`) VALUES (?,?,?) ON DUPLICATE KEY UPDATE `inbox` = VALUES(`inbox`)",
+			user.ID,
+			activity.Actor,
+			inbox,
+		)
+		if err != nil {
+			return err
+		}
+
+		accept := apActivity{
+			Context: activityStreamsContext,
+			ID:      actor + "#accepts/" + secureRandomStr(8),
+			Type:    "Accept",
+			Actor:   actor,
+			Object:  json.RawMessage(body),
+		}
+		go deliverActivity(inbox, actor+"#main-key", accept)
+	case "Undo":
+		var undone apInboundActivity
+		if err := json.Unmarshal(activity.Object, &undone); err != nil || undone.Type != "Follow" {
+			break
+		}
+		_, err = db.ExecContext(context.WithoutCancel(r.Context()), "DELETE FROM `activitypub_followers` WHERE `user_id` = ? AND `actor` = ?", user.ID, activity.Actor)
+		if err != nil {
+			return err
+		}
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+	return nil
+}
+
+// インボックスに届いたアクティビティの署名を検証し、アクティビティと送り主のアクターのドキュメントを返す
+// 鍵のドキュメントが名乗るownerは誰でも書けるので信用せず、
+// actorのドキュメントが公開している鍵で署名されていることを確認する
+func authenticateInboxActivity(r *http.Request, body []byte) (apInboundActivity, apRemoteDocument, error) {
+	var signer apRemoteDocument
+	keyID, err := verifyRequest(r, body, func(keyID string) (*rsa.PublicKey, error) {
+		doc, err := fetchRemoteKey(keyID)
+		if err != nil {
+			return nil, newHTTPError(http.StatusUnauthorized, err)
+		}
+		signer = doc
+		return parsePublicKeyPEM(doc.PublicKey.PublicKeyPem)
+	})
+	if err != nil {
+		return apInboundActivity{}, apRemoteDocument{}, err
+	}
+
+	activity := apInboundActivity{}
+	if err := json.Unmarshal(body, &activity); err != nil {
+		return apInboundActivity{}, apRemoteDocument{}, newHTTPError(http.StatusBadRequest, err)
+	}
+	if activity.Actor == "" || !sameOrigin(activity.Actor, keyID) {
+		return apInboundActivity{}, apRemoteDocument{}, errInvalidSignature
+	}
+
+	// 鍵のIDがアクターのURLにフラグメントを付けたものなら、鍵と一緒に取得したのがアクターのドキュメント
+	sender := signer
+	if withoutFragment(keyID) != activity.Actor {
+		sender, err = fetchRemoteDocument(activity.Actor)
+		if err != nil {
+			return apInboundActivity{}, apRemoteDocument{}, newHTTPError(http.StatusUnauthorized, err)
+		}
+	}
+	if sender.ID != activity.Actor || sender.PublicKey.ID != keyID {
+		return apInboundActivity{}, apRemoteDocument{}, errInvalidSignature
+	}
+	return activity, sender, nil
+}
+
+// スキームとホスト（ポートを含む）が同じか
+func sameOrigin(a, b string) bool {
+	ua, err := url.Parse(a)
+	if err != nil {
+		return false
+	}
+	ub, err := url.Parse(b)
+	if err != nil {
+		return false
+	}
+	return ua.Scheme != "" && ua.Scheme == ub.Scheme && ua.Host != "" && strings.EqualFold(ua.Host, ub.Host)
+}
+
+func withoutFragment(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return rawURL
+	}
+	u.Fragment, u.RawFragment = "", ""
+	return u.String()
+}
+
+// objectはIDの文字列か、idを持つオブジェクト
+func activityObjectID(raw json.RawMessage) string {
+	var id string
+	if err := json.Unmarshal(raw, &id); err == nil {
+		return id
+	}
+	var obj struct {
+		ID string `json:"id"`
+	}
+	json.Unmarshal(raw, &obj)
+	return obj.ID
+}
+
+// リモートのActivityPubのドキュメントを取得する
+func fetchRemoteDocument(rawURL string) (apRemoteDocument, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return apRemoteDocument{}, err
+	}
+	if u.Scheme != "https" && u.Scheme != "http" {
+		return apRemoteDocument{}, fmt.Errorf("unsupported url scheme: %s", u.Scheme)
+	}
+	u.Fragment = ""
+
+	req, err := http.NewRequest(http.MethodGet, u.String(), nil)
+	if err != nil {
+		return apRemoteDocument{}, err
+	}
+	req.Header.Set("Accept", activityJSONType)
+
+	res, err := activityPubClient.Do(req)
+	if err != nil {
+		return apRemoteDocument{}, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return apRemoteDocument{}, fmt.Errorf("failed to fetch %s: %s", u, res.Status)
+	}
+	if res.ContentLength > remoteObjectLimit {
+		return apRemoteDocument{}, fmt.Errorf("%s is too large: %d bytes", u, res.ContentLength)
+	}
+
+	doc := apRemoteDocument{}
+	if err := json.NewDecoder(io.LimitReader(res.Body, remoteObjectLimit)).Decode(&doc); err != nil {
+		return apRemoteDocument{}, err
+	}
+	return doc, nil
+}
+
+// 鍵のIDから公開鍵を取得する
+// 鍵のIDはアクターのURLにフラグメントを付けたものか、鍵単体のドキュメントのURL
+func fetchRemoteKey(keyID string) (apRemoteDocument, error) {
+	doc, err := fetchRemoteDocument(keyID)
+	if err != nil {
+		return apRemoteDocument{}, err
+	}
+	if doc.PublicKey.ID != keyID && doc.PublicKeyPem != "" {
+		// 鍵単体のドキュメント
+		doc.PublicKey = apPublicKey{ID: doc.ID, Owner: doc.Owner, PublicKeyPem: doc.PublicKeyPem}
+	}
+	if doc.PublicKey.ID != keyID || doc.PublicKey.PublicKeyPem == "" {
+		return apRemoteDocument{}, fmt.Errorf("key %s not found", keyID)
+	}
+	return doc, nil
+}
+
+// アクティビティを署名してリモートのインボックスに送る
+func deliverActivity(inbox, keyID string, activity apActivity) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	err := func() error {
+		key, err := getActivityPubKey()
+		if err != nil {
+			return err
+		}
+		body, err := json.Marshal(activity)
+		if err != nil {
+			return err
+		}
+
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, inbox, bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", activityJSONType)
+		if err := signRequest(req, body, keyID, key); err != nil {
+			return err
+		}
+
+		res, err := activityPubClient.Do(req)
+		if err != nil {
+			return err
+		}
+		defer res.Body.Close()
+		// 接続を使い回せるよう読み捨てる。大きな応答は最後まで読まない
+		io.Copy(io.Discard, io.LimitReader(res.Body, remoteObjectLimit))
+		if res.StatusCode >= 300 {
+			return fmt.Errorf("unexpected status: %s", res.Status)
+		}
+		return nil
+	}()
+	if err != nil {
+		logger("activitypub").Warn("failed to deliver activity", "type", activity.Type, "inbox", inbox, "err", err)
+	}
+}
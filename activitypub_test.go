@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+)
+
+func newTestKey(t *testing.T) (*rsa.PrivateKey, string) {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub, err := encodePublicKeyPEM(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key, pub
+}
+
+func serveJSON(mux *http.ServeMux, pattern string, doc func() any) {
+	mux.HandleFunc(pattern, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", activityJSONType)
+		json.NewEncoder(w).Encode(doc())
+	})
+}
+
+// 鍵のドキュメントがownerに他人のアクターを書いても、そのアクターとしては受け付けない
+func TestAuthenticateInboxActivity(t *testing.T) {
+	// テストのサーバーはループバックで動くので、接続先を制限しないクライアントに替える
+	origClient := activityPubClient
+	activityPubClient = &http.Client{}
+	t.Cleanup(func() { activityPubClient = origClient })
+
+	aliceKey, alicePEM := newTestKey(t)
+	malloryKey, malloryPEM := newTestKey(t)
+
+	victimMux, evilMux := http.NewServeMux(), http.NewServeMux()
+	victim, evil := httptest.NewServer(victimMux), httptest.NewServer(evilMux)
+	t.Cleanup(victim.Close)
+	t.Cleanup(evil.Close)
+	alice := victim.URL + "/users/alice"
+
+	serveJSON(victimMux, "/users/alice", func() any {
+		return apActor{
+			ID:        alice,
+			Type:      "Person",
+			Inbox:     alice + "/inbox",
+			PublicKey: apPublicKey{ID: alice + "#main-key", Owner: alice, PublicKeyPem: alicePEM},
+		}
+	})
+	// 同じホストに置かれた、aliceのものだと名乗る別の鍵
+	serveJSON(victimMux, "/keys/mallory", func() any {
+		return apPublicKey{ID: victim.URL + "/keys/mallory", Owner: alice, PublicKeyPem: malloryPEM}
+	})
+	serveJSON(evilMux, "/key", func() any {
+		return apPublicKey{ID: evil.URL + "/key", Owner: alice, PublicKeyPem: malloryPEM}
+	})
+
+	body, _ := json.Marshal(apInboundActivity{ID: evil.URL + "/follow", Type: "Follow", Actor: alice, Object: json.RawMessage(`"https://example.com/users/bob"`)})
+
+	tests := []struct {
+		name  string
+		keyID string
+		key   *rsa.PrivateKey
+		ok    bool
+	}{
+		{"actor key", alice + "#main-key", aliceKey, true},
+		{"owner on another host", evil.URL + "/key", malloryKey, false},
+		{"owner on the same host", victim.URL + "/keys/mallory", malloryKey, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "/users/bob/inbox", bytes.NewReader(body))
+			if err := signRequest(r, body, tt.keyID, tt.key); err != nil {
+				t.Fatal(err)
+			}
+			activity, sender, err := authenticateInboxActivity(r, body)
+			if !tt.ok {
+				if !errors.Is(err, errInvalidSignature) {
+					t.Fatalf("err = %v, want %v", err, errInvalidSignature)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if activity.Actor != alice || sender.Inbox != alice+"/inbox" {
+				t.Errorf("actor = %q, inbox = %q", activity.Actor, sender.Inbox)
+			}
+		})
+	}
+}
+
+func TestIsPublicAddr(t *testing.T) {
+	tests := []struct {
+		addr string
+		want bool
+	}{
+		{"93.184.216.34", true},
+		{"2606:2800:220:1:248:1893:25c8:1946", true},
+		{"127.0.0.1", false},
+		{"::1", false},
+		{"10.1.2.3", false},
+		{"172.16.0.1", false},
+		{"192.168.1.1", false},
+		{"169.254.169.254", false},
+		{"fe80::1", false},
+		{"fd00::1", false},
+		{"100.64.0.1", false},
+		{"0.0.0.0", false},
+		{"::ffff:127.0.0.1", false},
+		{"::ffff:169.254.169.254", false},
+		{"64:ff9b::a9fe:a9fe", false},
+	}
+	for _, tt := range tests {
+		if got := isPublicAddr(netip.MustParseAddr(tt.addr)); got != tt.want {
+			t.Errorf("isPublicAddr(%s) = %v, want %v", tt.addr, got, tt.want)
+		}
+	}
+}
+
+// keyIdにループバックのURLを書かれても取得しに行かない
+func TestFetchRemoteDocumentRejectsLoopback(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("request reached the loopback server")
+	}))
+	t.Cleanup(srv.Close)
+
+	if _, err := fetchRemoteDocument(srv.URL + "/key"); !errors.Is(err, errNonPublicAddr) {
+		t.Fatalf("err = %v, want %v", err, errNonPublicAddr)
+	}
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/catatsuy/private-isu/webapp/golang/apperror"
+)
+
+const (
+	announcementMaxLength = 500
+	// フォームのdatetime-localの形式
+	announcementTimeFormat = "2006-01-02T15:04"
+)
+
+// 管理者からのお知らせ
+// 表示期間（StartsAtからEndsAtまで）の間、全てのページの上部に表示する
+type announcement struct {
+	ID   int    `db:"id"`
+	Body string `db:"body"`
+	// info（通常）かwarning（注意）
+	Level    string       `db:"level"`
+	StartsAt time.Time    `db:"starts_at"`
+	EndsAt   sql.NullTime `db:"ends_at"`
+	// 作成時に全ユーザーへ通知したか
+	Notify    bool      `db:"notify"`
+	CreatedBy int       `db:"created_by"`
+	CreatedAt time.Time `db:"created_at"`
+}
+
+func (a announcement) ActiveAt(t time.Time) bool {
+	return !a.StartsAt.After(t) && (!a.EndsAt.Valid || a.EndsAt.Time.After(t))
+}
+
+func validAnnouncementLevel(level string) bool {
+	return level == "info" || level == "warning"
+}
+
+// 終了していないお知らせ（これから始まるものを含む）をプロセス内にキャッシュする
+// 表示期間は描画のたびに見るので、作成・終了したときだけ読み直せばよい
+var announcementCache = struct {
+	sync.Mutex
+	loaded bool
+	list   []announcement
+}{}
+
+// 表示期間中のお知らせ。読み込みに失敗した場合は表示しない
+func activeAnnouncements(ctx context.Context) []announcement {
+	announcementCache.Lock()
+	defer announcementCache.Unlock()
+	if !announcementCache.loaded {
+		list := []announcement{}
+		err := db.SelectContext(ctx, &list, "SELECT * FROM `announcements` WHERE `ends_at` IS NULL OR `ends_at` > NOW() ORDER BY `starts_at` DESC")
+		if err != nil {
+			logger("settings").Error("failed to load announcements", "err", err)
+			return nil
+		}
+		announcementCache.list = list
+		announcementCache.loaded = true
+	}
+
+	now := time.Now()
+	var active []announcement
+	for _, a := range announcementCache.list {
+		if a.ActiveAt(now) {
+			active = append(active, a)
+		}
+	}
+	return active
+}
+
+func registerAnnouncementInvalidation() {
+	registerInvalidation("announcements", func(string) {
+		announcementCache.Lock()
+		announcementCache.loaded = false
+		announcementCache.Unlock()
+		clearIndexPage()
+	})
+}
+
+func createAnnouncement(a announcement) error {
+	res, err := db.Exec(
+		"INSERT INTO `announcements` (`body`, `level`, `starts_at`, `ends_at`, `notify`, `created_by`) VALUES (?,?,?,?,?,?)",
+		a.Body, a.Level, a.StartsAt, a.EndsAt, a.Notify, a.CreatedBy,
+	)
+	if err != nil {
+		return err
+	}
+	if a.Notify {
+		id, err := res.LastInsertId()
+		if err != nil {
+			return err
+		}
+		// BANされていない全てのユーザーの未読のお知らせにする
+		_, err = db.Exec(
+			"INSERT IGNORE INTO `announcement_notifications` (`user_id`, `announcement_id`) SELECT `id`, ? FROM `users` WHERE `del_flg` = 0",
+			id,
+		)
+		if err != nil {
+			return err
+		}
+	}
+	invalidate("announcements", "")
+	return nil
+}
+
+// ユーザーに通知された未読のお知らせ（表示期間が過ぎたものも含む）
+func fetchUnreadAnnouncements(ctx context.Context, userID int) ([]announcement, error) {
+	list := []announcement{}
+	err := db.SelectContext(ctx, &list,
+		"SELECT a.* FROM `announcement_notifications` n JOIN `announcements` a ON a.`id` = n.`announcement_id`"+
+			" WHERE n.`user_id` = ? AND n.`read_at` IS NULL ORDER BY a.`id` DESC",
+		userID,
+	)
+	return list, err
+}
+
+func markAnnouncementsRead(userID int) error {
+	_, err := db.Exec("UPDATE `announcement_notifications` SET `read_at` = NOW() WHERE `user_id` = ? AND `read_at` IS NULL", userID)
+	return err
+}
+
+// フォームの値からお知らせを組み立てる。開始日時が空の場合はすぐに表示する
+func parseAnnouncementForm(r *http.Request) (announcement, error) {
+	a := announcement{
+		Body:     r.FormValue("body"),
+		Level:    r.FormValue("level"),
+		StartsAt: time.Now(),
+		Notify:   r.FormValue("notify") == "1",
+	}
+	if a.Body == "" || utf8.RuneCountInString(a.Body) > announcementMaxLength || !validText(a.Body) {
+		return a, apperror.Validationf("お知らせは%d文字以内で入力してください", announcementMaxLength)
+	}
+	if !validAnnouncementLevel(a.Level) {
+		return a, apperror.Validation("種類が不正です")
+	}
+	if v := r.FormValue("starts_at"); v != "" {
+		t, err := time.ParseInLocation(announcementTimeFormat, v, time.Local)
+		if err != nil {
+			return a, apperror.Validation("開始日時が不正です")
+		}
+		a.StartsAt = t
+	}
+	if v := r.FormValue("ends_at"); v != "" {
+		t, err := time.ParseInLocation(announcementTimeFormat, v, time.Local)
+		if err != nil || !t.After(a.StartsAt) {
+			return a, apperror.Validation("終了日時は開始日時より後にしてください")
+		}
+		a.EndsAt = sql.NullTime{Time: t, Valid: true}
+	}
+	return a, nil
+}
+
+func getAdminAnnouncements(w http.ResponseWriter, r *http.Request) error {
+	me := currentUser(r)
+	if !isLogin(me) {
+		redirect(w, r, "/", http.StatusFound)
+		return nil
+	}
+
+	if me.Authority == 0 {
+		return errForbidden
+	}
+
+	list := []announcement{}
+	if err := db.SelectContext(r.Context(), &list, "SELECT * FROM `announcements` ORDER BY `id` DESC LIMIT 50"); err != nil {
+		return err
+	}
+
+	data := newViewData(w, r).
+		With("List", list).
+		With("Now", time.Now()).
+		With("MaxLength", announcementMaxLength)
+	return renderTemplate(w, r, http.StatusOK, templates.announcements, "layout.html", data)
+}
+
+// お知らせの作成（action=create）と、表示の終了（action=end）
+func postAdminAnnouncements(w http.ResponseWriter, r *http.Request) error {
+	me := currentUser(r)
+	if !isLogin(me) {
+		redirect(w, r, "/", http.StatusFound)
+		return nil
+	}
+
+	if me.Authority == 0 {
+		return errForbidden
+	}
+
+	if !validCSRFToken(r, r.FormValue("csrf_token")) {
+		return errInvalidCSRFToken
+	}
+
+	switch r.FormValue("action") {
+	case "create":
+		a, err := parseAnnouncementForm(r)
+		if err != nil {
+			addErrorFlash(w, r, err)
+			break
+		}
+		a.CreatedBy = me.ID
+		if err := createAnnouncement(a); err != nil {
+			return err
+		}
+		addFlash(w, r, flashSuccess, "お知らせを作成しました")
+	case "end":
+		id, err := strconv.Atoi(r.FormValue("id"))
+		if err != nil {
+			return newHTTPError(http.StatusBadRequest, err)
+		}
+		res, err := db.ExecContext(context.WithoutCancel(r.Context()), "UPDATE `announcements` SET `ends_at` = NOW() WHERE `id` = ? AND (`ends_at` IS NULL OR `ends_at` > NOW())", id)
+		if err != nil {
+			return err
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			return apperror.NotFound("公開中のお知らせが見つかりません")
+		}
+		invalidate("announcements", "")
+		addFlash(w, r, flashSuccess, "お知らせの表示を終了しました")
+	default:
+		return newHTTPError(http.StatusBadRequest, errors.New("unknown action"))
+	}
+
+	redirect(w, r, "/admin/announcements", http.StatusFound)
+	return nil
+}
@@ -0,0 +1,434 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var errUnauthorized = newHTTPError(http.StatusUnauthorized, nil)
+
+// APIで返すユーザー
+type apiUser struct {
+	ID          int    `json:"id"`
+	AccountName string `json:"account_name"`
+	Verified    bool   `json:"verified"`
+}
+
+// APIで返すコメント
+type apiComment struct {
+	ID        int       `json:"id"`
+	PostID    int       `json:"post_id"`
+	Comment   string    `json:"comment"`
+	CreatedAt time.Time `json:"created_at"`
+	User      apiUser   `json:"user"`
+}
+
+// APIで返す投稿
+type apiPost struct {
+	ID           int          `json:"id"`
+	Body         string       `json:"body"`
+	Language     string       `json:"language,omitempty"`
+	ImageURL     string       `json:"image_url"`
+	ImageWidth   int          `json:"image_width,omitempty"`
+	ImageHeight  int          `json:"image_height,omitempty"`
+	CommentCount int          `json:"comment_count"`
+	Comments     []apiComment `json:"comments"`
+	// commentsが一部だけの場合はtrue
+	HasMoreComments bool      `json:"has_more_comments"`
+	CreatedAt       time.Time `json:"created_at"`
+	User            apiUser   `json:"user"`
+}
+
+// APIで返すタイムライン
+type apiTimeline struct {
+	Posts      []apiPost `json:"posts"`
+	NextCursor string    `json:"next_cursor,omitempty"`
+}
+
+// APIで返す投稿のコメント
+type apiComments struct {
+	PostID   int          `json:"post_id"`
+	Comments []apiComment `json:"comments"`
+}
+
+// APIで返すユーザーの統計情報
+type apiUserStats struct {
+	AccountName    string `json:"account_name"`
+	PostCount      int    `json:"post_count"`
+	CommentCount   int    `json:"comment_count"`
+	CommentedCount int    `json:"commented_count"`
+}
+
+func newAPIUser(u User) apiUser {
+	return apiUser{
+		ID:          u.ID,
+		AccountName: u.AccountName,
+		Verified:    u.Verified(),
+	}
+}
+
+func newAPIComment(c Comment) apiComment {
+	return apiComment{
+		ID:        c.ID,
+		PostID:    c.PostID,
+		Comment:   c.Comment,
+		CreatedAt: c.CreatedAt,
+		User:      newAPIUser(c.User),
+	}
+}
+
+func newAPIPost(p Post) apiPost {
+	comments := make([]apiComment, 0, len(p.Comments))
+	for _, c := range p.Comments {
+		comments = append(comments, newAPIComment(c))
+	}
+	return apiPost{
+		ID:              p.ID,
+		Body:            p.Body,
+		Language:        p.Language,
+		ImageURL:        imageURL(p),
+		ImageWidth:      p.Width,
+		ImageHeight:     p.Height,
+		CommentCount:    p.CommentCount,
+		Comments:        comments,
+		HasMoreComments: p.HasMoreComments,
+		CreatedAt:       p.CreatedAt,
+		User:            newAPIUser(p.User),
+	}
+}
+
+func newAPIPosts(posts []Post) []apiPost {
+	res := make([]apiPost, 0, len(posts))
+	for _, p := range posts {
+		res = append(res, newAPIPost(p))
+	}
+	return res
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) error {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	return json.NewEncoder(w).Encode(v)
+}
+
+// JSONを要求しているかどうか
+func acceptsJSON(r *http.Request) bool {
+	return strings.Contains(r.Header.Get("Accept"), "application/json")
+}
+
+// APIリクエストのCSRFトークン（ヘッダーまたはフォーム）
+func requestCSRFToken(r *http.Request) string {
+	if token := r.Header.Get("X-CSRF-Token"); token != "" {
+		return token
+	}
+	return r.FormValue("csrf_token")
+}
+
+// フィードなどに埋め込む絶対URLの起点（ISUCONP_PATH_PREFIXを含む）
+func baseURL(r *http.Request) string {
+	if config.PublicURL != "" {
+		return config.PublicURL + config.PathPrefix
+	}
+	return requestScheme(r) + "://" + r.Host + config.PathPrefix
+}
+
+// GET /api/v1/timeline?cursor=&lang=
+// 無限スクロール用のタイムライン。GET /postsと同じページングを使う
+// langを指定した場合（カンマ区切りで複数可）はその言語の投稿だけを返す
+func getAPITimeline(w http.ResponseWriter, r *http.Request) error {
+	cursor, err := parsePageCursor(r.URL.Query().Get("cursor"))
+	if err != nil {
+		return newHTTPError(http.StatusBadRequest, err)
+	}
+
+	results, err := fetchTimelinePostsInLanguages(r.Context(), cursor, requestLanguages(r))
+	if err != nil {
+		return err
+	}
+
+	posts, err := makePosts(r.Context(), results, "", config.CommentPreviewCount)
+	if err != nil {
+		return err
+	}
+
+	return writeJSON(w, http.StatusOK, apiTimeline{
+		Posts:      newAPIPosts(posts),
+		NextCursor: nextPageCursor(results).String(),
+	})
+}
+
+// GET /api/v1/posts?cursor=&lang=&account_name=
+// 投稿の一覧。account_nameを指定した場合はそのユーザーの投稿だけを返す
+func getAPIPosts(w http.ResponseWriter, r *http.Request) error {
+	q := r.URL.Query()
+	cursor, err := parsePageCursor(q.Get("cursor"))
+	if err != nil {
+		return newHTTPError(http.StatusBadRequest, err)
+	}
+
+	var results []Post
+	if accountName := q.Get("account_name"); accountName != "" {
+		user, err := getActiveUserByAccountName(r.Context(), accountName)
+		if err != nil {
+			return err
+		}
+		results, err = fetchUserPosts(r.Context(), user.ID, cursor)
+		if err != nil {
+			return err
+		}
+	} else {
+		results, err = fetchTimelinePostsInLanguages(r.Context(), cursor, requestLanguages(r))
+		if err != nil {
+			return err
+		}
+	}
+
+	posts, err := makePosts(r.Context(), results, "", config.CommentPreviewCount)
+	if err != nil {
+		return err
+	}
+
+	return writeJSON(w, http.StatusOK, apiTimeline{
+		Posts:      newAPIPosts(posts),
+		NextCursor: nextPageCursor(results).String(),
+	})
+}
+
+// GET /api/v1/posts/{id}
+// 全てのコメントを付けた投稿
+func getAPIPost(w http.ResponseWriter, r *http.Request) error {
+	pid, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		return errNotFound
+	}
+
+	p, err := fetchVisiblePost(r.Context(), pid, currentUser(r), "")
+	if err != nil {
+		return err
+	}
+	return writeJSON(w, http.StatusOK, newAPIPost(p))
+}
+
+// GET /api/v1/posts/{id}/comments
+// 投稿の全てのコメント（古い順）
+func getAPIPostComments(w http.ResponseWriter, r *http.Request) error {
+	pid, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		return errNotFound
+	}
+
+	p, err := fetchVisiblePost(r.Context(), pid, currentUser(r), "")
+	if err != nil {
+		return err
+	}
+	return writeJSON(w, http.StatusOK, apiComments{PostID: p.ID, Comments: newAPIPost(p).Comments})
+}
+
+// GET /api/v1/users/{accountName}/stats
+// プロフィール用ウィジェット向けの統計情報。短時間キャッシュする
+func getAPIUserStats(w http.ResponseWriter, r *http.Request) error {
+	user, err := getActiveUserByAccountName(r.Context(), r.PathValue("accountName"))
+	if err != nil {
+		return err
+	}
+
+	stats, err := getUserStatsCached(r.Context(), user.ID)
+	if err != nil {
+		return err
+	}
+
+	w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", int(userStatsTTL.Seconds())))
+	return writeJSON(w, http.StatusOK, apiUserStats{
+		AccountName:    user.AccountName,
+		PostCount:      stats.PostCount,
+		CommentCount:   stats.CommentCount,
+		CommentedCount: stats.CommentedCount,
+	})
+}
+
+// GET /api/v1/admin/jobs
+// 定期ジョブの実行状況。管理者だけが見られる
+func getAPIAdminJobs(w http.ResponseWriter, r *http.Request) error {
+	me := currentUser(r)
+	if !isLogin(me) {
+		return errUnauthorized
+	}
+	if me.Authority == 0 {
+		return errForbidden
+	}
+	return writeJSON(w, http.StatusOK, jobs.Stats())
+}
+
+// GET /api/v1/limits
+// クライアントで文字数のカウンターを表示するための入力の上限
+func getAPILimits(w http.ResponseWriter, r *http.Request) error {
+	return writeJSON(w, http.StatusOK, struct {
+		MaxPostBodyLength int   `json:"max_post_body_length"`
+		MaxCommentLength  int   `json:"max_comment_length"`
+		MaxUploadBytes    int64 `json:"max_upload_bytes"`
+	}{config.MaxPostBodyLength, config.MaxCommentLength, currentSettings().UploadLimit})
+}
+
+// GET /api/v1/admin/images
+// 投稿画像を再エンコードせずに保存した回数など（このプロセスの起動からの累計）
+func getAPIAdminImages(w http.ResponseWriter, r *http.Request) error {
+	me := currentUser(r)
+	if !isLogin(me) {
+		return errUnauthorized
+	}
+	if me.Authority == 0 {
+		return errForbidden
+	}
+	return writeJSON(w, http.StatusOK, map[string]int64{
+		"passthrough": uploadImageStats.Passthrough.Load(),
+		"reencoded":   uploadImageStats.Reencoded.Load(),
+		"failed":      uploadImageStats.Failed.Load(),
+	})
+}
+
+// POST /api/v1/posts/{id}/comments
+// ページを再読み込みせずにコメントを追加するためのエンドポイント
+// Acceptに応じて描画済みのコメントかJSONを返す
+func postAPIPostComments(w http.ResponseWriter, r *http.Request) error {
+	me := currentUser(r)
+	if !isLogin(me) {
+		return errUnauthorized
+	}
+
+	if !validCSRFToken(r, requestCSRFToken(r)) {
+		return errInvalidCSRFToken
+	}
+
+	postID, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		return errNotFound
+	}
+
+	comment, err := createCommentOnce(r, me, postID, r.FormValue("comment"))
+	if err != nil {
+		return err
+	}
+
+	if acceptsJSON(r) {
+		return writeJSON(w, http.StatusCreated, newAPIComment(comment))
+	}
+
+	return renderTemplate(w, r, http.StatusCreated, templates.comment, "comment.html", comment)
+}
+
+// POST /api/v1/comments
+// アプリ向けのコメントの投稿。本文はJSON（{"post_id": 1, "comment": "..."}）かフォーム
+// Authorization: Bearerのトークンで認証する（ブラウザからはセッションとCSRFトークンでもよい）
+func postAPIComments(w http.ResponseWriter, r *http.Request) error {
+	me, err := apiRequestUser(r)
+	if err != nil {
+		return err
+	}
+
+	var req struct {
+		PostID  int    `json:"post_id"`
+		Comment string `json:"comment"`
+	}
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			return newHTTPError(http.StatusBadRequest, err)
+		}
+	} else {
+		req.PostID, err = strconv.Atoi(r.FormValue("post_id"))
+		if err != nil {
+			return newHTTPError(http.StatusBadRequest, errors.New("post_idは整数のみです"))
+		}
+		req.Comment = r.FormValue("comment")
+	}
+
+	comment, err := createCommentOnce(r, me, req.PostID, req.Comment)
+	if err != nil {
+		return err
+	}
+	return writeJSON(w, http.StatusCreated, newAPIComment(comment))
+}
+
+// APIで書き込むユーザー
+// Authorizationヘッダーがあればトークンで、なければセッションで認証する（セッションの場合はCSRFトークンも確かめる）
+func apiRequestUser(r *http.Request) (User, error) {
+	if r.Header.Get("Authorization") != "" {
+		return apiTokenUser(r)
+	}
+	me := currentUser(r)
+	if !isLogin(me) {
+		return User{}, errUnauthorized
+	}
+	if !validCSRFToken(r, requestCSRFToken(r)) {
+		return User{}, errInvalidCSRFToken
+	}
+	return me, nil
+}
+
+// Idempotency-Keyを予約してコメントを保存する
+// 同じキーで再送された場合は保存せずに先に作ったコメントを返す
+func createCommentOnce(r *http.Request, me User, postID int, text string) (Comment, error) {
+	claim, replay, err := claimIdempotencyKey(r.Context(), me.ID, "comment:"+strconv.Itoa(postID), requestIdempotencyKey(r))
+	if err != nil {
+		return Comment{}, err
+	}
+	defer claim.release(context.WithoutCancel(r.Context()))
+
+	var comment Comment
+	if replay != "" {
+		err = db.GetContext(r.Context(), &comment, "SELECT * FROM `comments` WHERE `id` = ?", replay)
+		comment.User = me
+	} else {
+		comment, err = createComment(r.Context(), postID, me, text)
+	}
+	if err != nil {
+		return Comment{}, err
+	}
+	claim.complete(context.WithoutCancel(r.Context()), strconv.Itoa(comment.ID))
+	return comment, nil
+}
+
+// コメントを保存して保存後の値を返す
+// 投稿が存在しない場合はsql.ErrNoRowsを返す
+func createComment(ctx context.Context, postID int, me User, text string) (Comment, error) {
+	if err := validateComment(text); err != nil {
+		return Comment{}, err
+	}
+
+	postUserID := 0
+	err := db.GetContext(ctx, &postUserID, "SELECT `user_id` FROM `posts` WHERE `id` = ?", postID)
+	if err != nil {
+		return Comment{}, err
+	}
+
+	query := "INSERT INTO `comments` (`post_id`, `user_id`, `comment`) VALUES (?,?,?)"
+	result, err := db.ExecContext(context.WithoutCancel(ctx), query, postID, me.ID, text)
+	if err != nil {
+		return Comment{}, err
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		return Comment{}, err
+	}
+
+	comment := Comment{}
+	err = db.GetContext(ctx, &comment, "SELECT * FROM `comments` WHERE `id` = ?", id)
+	if err != nil {
+		return Comment{}, err
+	}
+	comment.User = me
+
+	if err := incrCommentStats(postID, postUserID, me.ID); err != nil {
+		logger("stats").Error("failed to update user stats", "err", err)
+	}
+
+	events.Publish(CommentCreated{CommentID: comment.ID, PostID: postID, UserID: me.ID, PostUserID: postUserID})
+
+	return comment, nil
+}
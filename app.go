@@ -2,13 +2,17 @@ package main
 
 import (
 	"bytes"
+	"context"
 	crand "crypto/rand"
 	"crypto/sha256"
 	"crypto/sha512"
+	"database/sql"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"html/template"
 	"image"
+	"image/draw"
 	"image/gif"
 	_ "image/gif"
 	"image/jpeg"
@@ -16,19 +20,22 @@ import (
 	"image/png"
 	_ "image/png"
 	"io"
-	"log"
 	"net/http"
 	"net/url"
 	"os"
+	"os/signal"
 	"path"
 	"regexp"
+	"slices"
 	"strconv"
 	"strings"
-	"sync"
+	"syscall"
 	"time"
+	"unicode/utf8"
 
 	"github.com/bradfitz/gomemcache/memcache"
 	gsm "github.com/bradleypeabody/gorilla-sessions-memcache"
+	"github.com/catatsuy/private-isu/webapp/golang/apperror"
 	"github.com/go-chi/chi/v5"
 	_ "github.com/go-sql-driver/mysql"
 	"github.com/gorilla/sessions"
@@ -39,38 +46,43 @@ import (
 var (
 	db    *sqlx.DB
 	store *gsm.MemcacheStore
+	// セッションとキャッシュ（Redisを使わない場合）を置くmemcached
+	memcacheClient *memcache.Client
 
 	// テンプレートのキャッシュ
 	templates = struct {
-		layout *template.Template
-		index  *template.Template
-		user   *template.Template
-		posts  *template.Template
-		post   *template.Template
+		index    *template.Template
+		user     *template.Template
+		posts    *template.Template
+		post     *template.Template
+		postID   *template.Template
+		comment  *template.Template
+		login    *template.Template
+		register *template.Template
+		banned   *template.Template
+		appeal   *template.Template
+		settings *template.Template
+		invites  *template.Template
+
+		subscriptions *template.Template
+		perf          *template.Template
+		moderation    *template.Template
+		announcements *template.Template
+		backup        *template.Template
+		readOnly      *template.Template
+		evasion       *template.Template
+		welcome       *template.Template
+
+		headerMenu *template.Template
 	}{}
-
-	// 画像のキャッシュ
-	imageCache = struct {
-		sync.RWMutex
-		data    map[string]*cacheEntry
-		maxSize int64
-		curSize int64
-	}{
-		data:    make(map[string]*cacheEntry),
-		maxSize: 100 * 1024 * 1024, // 100MB
-	}
 )
 
-type cacheEntry struct {
-	data    []byte
-	lastUse time.Time
-}
-
 const (
-	postsPerPage  = 20
 	ISO8601Format = "2006-01-02T15:04:05-07:00"
 	UploadLimit   = 10 * 1024 * 1024 // 10mb
-	MaxImageSize  = 800              // 最大画像サイズ
+	allComments   = 0                // makePostsでコメントを全件取得する
+	// ルーティングで受け付けるアカウント名（validateUserで登録できる文字）
+	accountNamePattern = `[0-9a-zA-Z_]+`
 )
 
 type User struct {
@@ -89,10 +101,18 @@ type Post struct {
 	Body         string    `db:"body"`
 	Mime         string    `db:"mime"`
 	CreatedAt    time.Time `db:"created_at"`
+	Width        int       `db:"width"`      // 画像の幅（不明な場合は0）
+	Height       int       `db:"height"`     // 画像の高さ（不明な場合は0）
+	Language     string    `db:"lang"`       // 本文の言語（不明な場合は空）
+	Moderation   string    `db:"moderation"` // 公開前の審査の状態（pending, rejected。公開済みの場合は空）
 	CommentCount int
 	Comments     []Comment
-	User         User
-	CSRFToken    string
+	// Commentsに含まれていないコメントがあるか（CommentCountが全件の数）
+	HasMoreComments bool
+	User            User
+	CSRFToken       string
+	// コメントフォームの冪等キー
+	FormKey string
 }
 
 type Comment struct {
@@ -102,51 +122,149 @@ type Comment struct {
 	Comment   string    `db:"comment"`
 	CreatedAt time.Time `db:"created_at"`
 	User      User
+	// いいねから報告を引いた評価と、報告が多いため折りたたんで表示するか（makePostsで付ける）
+	Score     int  `db:"-"`
+	Collapsed bool `db:"-"`
+}
+
+func memcachedAddress() string {
+	return getEnv("ISUCONP_MEMCACHED_ADDRESS", "localhost:11211")
 }
 
 func init() {
-	memdAddr := os.Getenv("ISUCONP_MEMCACHED_ADDRESS")
-	if memdAddr == "" {
-		memdAddr = "localhost:11211"
-	}
-	memcacheClient := memcache.New(memdAddr)
+	memcacheClient = memcache.New(memcachedAddress())
 	store = gsm.NewMemcacheStore(memcacheClient, "iscogram_", []byte("sendagaya"))
-	log.SetFlags(log.Ldate | log.Ltime | log.Lshortfile)
+	store.Options.Path = appPath("/")
+	setupCacheBackend(memcacheClient, os.Getenv("ISUCONP_REDIS_ADDRESS"))
+	cacheStore = traceCacheBackend(cacheStore)
+	setupLogger()
+	setupImageStore()
 
-	// テンプレートの初期化
-	fmap := template.FuncMap{
-		"imageURL": imageURL,
-	}
-
-	// レイアウトテンプレート
-	templates.layout = template.Must(template.New("layout.html").Funcs(fmap).ParseFiles(
-		getTemplPath("layout.html"),
-	))
+	// テンプレートの初期化（使える関数はtemplate_funcs.goのtemplateFuncs）
 
 	// インデックスページ
-	templates.index = template.Must(template.New("index.html").Funcs(fmap).ParseFiles(
-		getTemplPath("index.html"),
-		getTemplPath("posts.html"),
-		getTemplPath("post.html"),
-	))
+	templates.index = parseTemplates("layout.html",
+		"layout.html",
+		"flash.html",
+		"index.html",
+		"posts.html",
+	)
 
 	// ユーザーページ
-	templates.user = template.Must(template.New("user.html").Funcs(fmap).ParseFiles(
-		getTemplPath("user.html"),
-		getTemplPath("posts.html"),
-		getTemplPath("post.html"),
-	))
-
-	// 投稿一覧
-	templates.posts = template.Must(template.New("posts.html").Funcs(fmap).ParseFiles(
-		getTemplPath("posts.html"),
-		getTemplPath("post.html"),
-	))
+	templates.user = parseTemplates("layout.html",
+		"layout.html",
+		"flash.html",
+		"user.html",
+		"posts.html",
+	)
+
+	// 投稿一覧（描画済みの投稿をつなげたもの）
+	templates.posts = parseTemplates("posts.html",
+		"posts.html",
+	)
+
+	// 一覧の中の投稿1件
+	templates.post = parseTemplates("post.html",
+		"post.html",
+		"comment.html",
+	)
 
 	// 個別投稿
-	templates.post = template.Must(template.New("post.html").Funcs(fmap).ParseFiles(
-		getTemplPath("post.html"),
-	))
+	templates.postID = parseTemplates("layout.html",
+		"layout.html",
+		"flash.html",
+		"post_id.html",
+		"post.html",
+		"comment.html",
+	)
+
+	// ヘッダーのメニュー（ページとは別に描画して埋め込む）
+	templates.headerMenu = parseTemplates("header_menu.html",
+		"header_menu.html",
+	)
+
+	// コメント単体（APIから返すフラグメント）
+	templates.comment = parseTemplates("comment.html",
+		"comment.html",
+	)
+
+	// ログイン・登録・管理画面
+	// リクエストごとに読み込むと壊れたテンプレートでパニックするので起動時に読み込む
+	templates.login = parseTemplates("layout.html",
+		"layout.html",
+		"flash.html",
+		"login.html",
+	)
+	templates.register = parseTemplates("layout.html",
+		"layout.html",
+		"flash.html",
+		"register.html",
+	)
+	templates.banned = parseTemplates("layout.html",
+		"layout.html",
+		"flash.html",
+		"banned.html",
+	)
+	templates.settings = parseTemplates("layout.html",
+		"layout.html",
+		"flash.html",
+		"admin_settings.html",
+	)
+	templates.invites = parseTemplates("layout.html",
+		"layout.html",
+		"flash.html",
+		"admin_invites.html",
+	)
+	templates.perf = parseTemplates("layout.html",
+		"layout.html",
+		"flash.html",
+		"admin_perf.html",
+	)
+	templates.appeal = parseTemplates("layout.html",
+		"layout.html",
+		"flash.html",
+		"appeal.html",
+	)
+	templates.readOnly = parseTemplates("layout.html",
+		"layout.html",
+		"flash.html",
+		"read_only.html",
+	)
+	templates.backup = parseTemplates("layout.html",
+		"layout.html",
+		"flash.html",
+		"admin_backup.html",
+	)
+	templates.announcements = parseTemplates("layout.html",
+		"layout.html",
+		"flash.html",
+		"admin_announcements.html",
+	)
+	templates.moderation = parseTemplates("layout.html",
+		"layout.html",
+		"flash.html",
+		"admin_moderation.html",
+	)
+	templates.evasion = parseTemplates("layout.html",
+		"layout.html",
+		"flash.html",
+		"admin_evasion.html",
+	)
+
+	// 登録した直後の案内
+	templates.welcome = parseTemplates("layout.html",
+		"layout.html",
+		"flash.html",
+		"welcome.html",
+	)
+
+	// 購読
+	templates.subscriptions = parseTemplates("layout.html",
+		"layout.html",
+		"flash.html",
+		"subscriptions.html",
+		"posts.html",
+	)
 }
 
 func dbInitialize() {
@@ -154,6 +272,24 @@ func dbInitialize() {
 		"DELETE FROM users WHERE id > 1000",
 		"DELETE FROM posts WHERE id > 10000",
 		"DELETE FROM comments WHERE id > 100000",
+		"DELETE FROM comment_votes WHERE comment_id > 100000 OR user_id > 1000",
+		"DELETE FROM post_views WHERE post_id > 10000",
+		"DELETE FROM post_image_sizes WHERE post_id > 10000",
+		"DELETE FROM post_languages WHERE post_id > 10000",
+		"DELETE FROM pending_posts WHERE post_id > 10000",
+		"DELETE FROM post_tags WHERE post_id > 10000",
+		"DELETE FROM post_image_hashes WHERE post_id > 10000",
+		"DELETE FROM subscriptions WHERE user_id > 1000",
+		"DELETE FROM notifications WHERE user_id > 1000 OR post_id > 10000",
+		"DELETE FROM api_tokens WHERE user_id > 1000",
+		"DELETE FROM activitypub_followers WHERE user_id > 1000",
+		"DELETE FROM user_fingerprints WHERE user_id > 1000",
+		"DELETE FROM user_profiles WHERE user_id > 1000",
+		"DELETE FROM user_onboarding WHERE user_id > 1000",
+		"DELETE FROM user_bans",
+		"DELETE FROM ban_appeals",
+		"DELETE FROM announcements",
+		"DELETE FROM announcement_notifications",
 		"UPDATE users SET del_flg = 0",
 		"UPDATE users SET del_flg = 1 WHERE id % 50 = 0",
 	}
@@ -163,17 +299,22 @@ func dbInitialize() {
 	}
 }
 
-func tryLogin(accountName, password string) *User {
+// アカウント名とパスワードが一致すればユーザーを返す。一致しなければnil
+// DBのエラーは「パスワードが間違っている」と区別できるようエラーとして返す
+func tryLogin(ctx context.Context, accountName, password string) (*User, error) {
 	u := User{}
-	err := db.Get(&u, "SELECT * FROM users WHERE account_name = ? AND del_flg = 0", accountName)
+	err := db.GetContext(ctx, &u, "SELECT * FROM users WHERE account_name = ? AND del_flg = 0", accountName)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
 	if err != nil {
-		return nil
+		return nil, apperror.Internal(err)
 	}
 
 	if calculatePasshash(u.AccountName, password) == u.Passhash {
-		return &u
+		return &u, nil
 	} else {
-		return nil
+		return nil, nil
 	}
 }
 
@@ -182,6 +323,35 @@ func validateUser(accountName, password string) bool {
 		regexp.MustCompile(`\A[0-9a-zA-Z_]{6,}\z`).MatchString(password)
 }
 
+// URLのパスや機能の名前と紛らわしいので登録させないアカウント名か
+func isReservedAccountName(accountName string) bool {
+	return slices.ContainsFunc(config.ReservedAccountNames, func(name string) bool {
+		return strings.EqualFold(name, accountName)
+	})
+}
+
+// 投稿の本文の長さを確認する（文字数で数える）
+func validatePostBody(body string) error {
+	if !validText(body) {
+		return apperror.Validation("本文に使えない文字が含まれています")
+	}
+	if utf8.RuneCountInString(body) > config.MaxPostBodyLength {
+		return apperror.Validationf("本文は%d文字以内で入力してください", config.MaxPostBodyLength)
+	}
+	return nil
+}
+
+// コメントの長さを確認する（文字数で数える）
+func validateComment(text string) error {
+	if !validText(text) {
+		return apperror.Validation("コメントに使えない文字が含まれています")
+	}
+	if utf8.RuneCountInString(text) > config.MaxCommentLength {
+		return apperror.Validationf("コメントは%d文字以内で入力してください", config.MaxCommentLength)
+	}
+	return nil
+}
+
 // 今回のGo実装では言語側のエスケープの仕組みが使えないのでOSコマンドインジェクション対策できない
 // 取り急ぎPHPのescapeshellarg関数を参考に自前で実装
 // cf: http://jp2.php.net/manual/ja/function.escapeshellarg.php
@@ -203,47 +373,75 @@ func calculatePasshash(accountName, password string) string {
 	return digest(password + ":" + calculateSalt(accountName))
 }
 
-func getSession(r *http.Request) *sessions.Session {
+func loadSession(r *http.Request) *sessions.Session {
 	session, err := store.Get(r, "isuconp-go.session")
 	if err != nil {
-		log.Printf("Failed to get session: %v", err)
+		logger("session").WarnContext(r.Context(), "failed to get session", "err", err)
 		// エラー時は新しいセッションを作成
 		session, _ = store.New(r, "isuconp-go.session")
 	}
+	migrateSession(r, session)
 	return session
 }
 
 func getSessionUser(r *http.Request) User {
 	session := getSession(r)
-	uid, ok := session.Values["user_id"]
-	if !ok || uid == nil {
+	id, ok := session.Values["user_id"].(int)
+	if !ok {
 		return User{}
 	}
 
-	u := User{}
-	err := db.Get(&u, "SELECT * FROM `users` WHERE `id` = ? AND `del_flg` = 0", uid)
+	u, err := getUserByID(r.Context(), id)
 	if err != nil {
-		log.Printf("Failed to get user: %v", err)
+		logger("session").ErrorContext(r.Context(), "failed to get user", "err", err)
+		return User{}
+	}
+	if u.DelFlg != 0 {
 		return User{}
 	}
 
 	return u
 }
 
-func getFlash(w http.ResponseWriter, r *http.Request, key string) string {
-	session := getSession(r)
-	value, ok := session.Values[key]
-
-	if !ok || value == nil {
-		return ""
-	} else {
-		delete(session.Values, key)
-		session.Save(r, w)
-		return value.(string)
-	}
+// commentLimitは投稿ごとに取得するコメントの数（allCommentsの場合は全件）
+// makePostsで投稿ごとに取得する投稿者とコメント数
+type postUserRow struct {
+	PostID       int  `db:"post_id"`
+	CommentCount int  `db:"comment_count"`
+	UserID       int  `db:"user_id"`
+	User         User `db:"-"`
 }
 
-func makePosts(results []Post, csrfToken string, allComments bool) ([]Post, error) {
+// makePostsで取得するユーザーの列（User型の"user."に対応させる）
+const postUserColumns = "u.`id` AS `user.id`, u.`account_name` AS `user.account_name`, u.`authority` AS `user.authority`, " +
+	"u.`del_flg` AS `user.del_flg`, u.`created_at` AS `user.created_at`"
+
+// fetchPostUsersのクエリ
+const postUsersQuery = "SELECT p.`id` AS `post_id`, COALESCE(pc.`comment_count`, 0) AS `comment_count`, p.`user_id`" +
+	" FROM `posts` p" +
+	" LEFT JOIN `post_comment_counts` pc ON pc.`post_id` = p.`id`" +
+	" WHERE p.`id` IN (?)"
+
+// fetchPostCommentsのクエリ
+// 件数で絞る場合は、投稿ごとに新しい順の番号を振ってから絞る
+const (
+	postCommentColumns = "c.`id`, c.`post_id`, c.`user_id`, c.`comment`, c.`created_at`, " + postUserColumns
+
+	postCommentsQuery = "SELECT " + postCommentColumns +
+		" FROM `comments` c" +
+		" JOIN `users` u ON c.`user_id` = u.`id`" +
+		" WHERE c.`post_id` IN (?)" +
+		" ORDER BY c.`created_at`, c.`id`"
+
+	latestPostCommentsQuery = "SELECT " + postCommentColumns +
+		" FROM (SELECT *, ROW_NUMBER() OVER (PARTITION BY `post_id` ORDER BY `created_at` DESC, `id` DESC) AS `rn`" +
+		" FROM `comments` WHERE `post_id` IN (?)) c" +
+		" JOIN `users` u ON c.`user_id` = u.`id`" +
+		" WHERE c.`rn` <= ?" +
+		" ORDER BY c.`created_at`, c.`id`"
+)
+
+func makePosts(ctx context.Context, results []Post, csrfToken string, commentLimit int) ([]Post, error) {
 	var posts []Post
 	if len(results) == 0 {
 		return posts, nil
@@ -255,164 +453,122 @@ func makePosts(results []Post, csrfToken string, allComments bool) ([]Post, erro
 		postIDs = append(postIDs, p.ID)
 	}
 
-	// コメント数とユーザー情報を一括取得
-	query := `
-		SELECT 
-			p.id as post_id,
-			COUNT(c.id) as comment_count,
-			u.id as user_id,
-			u.account_name,
-			u.authority,
-			u.del_flg,
-			u.created_at as user_created_at
-		FROM posts p
-		LEFT JOIN users u ON p.user_id = u.id
-		LEFT JOIN comments c ON p.id = c.post_id
-		WHERE p.id IN (?)
-		GROUP BY p.id, u.id
-	`
-	query, args, err := sqlx.In(query, postIDs)
+	users, err := fetchPostUsers(ctx, postIDs)
 	if err != nil {
 		return nil, err
 	}
 
-	// 投稿情報をマップに格納
-	postMap := make(map[int]*Post)
-	for _, p := range results {
-		postMap[p.ID] = &p
-	}
-
-	rows, err := db.Queryx(query, args...)
+	comments, err := fetchPostCommentsCached(ctx, postIDs, commentLimit)
 	if err != nil {
 		return nil, err
 	}
-	defer rows.Close()
-
-	for rows.Next() {
-		var postID, userID, commentCount int
-		var accountName string
-		var authority, delFlg int
-		var userCreatedAt time.Time
 
-		err := rows.Scan(&postID, &commentCount, &userID, &accountName, &authority, &delFlg, &userCreatedAt)
-		if err != nil {
-			return nil, err
-		}
+	if err := applyCommentScores(ctx, comments); err != nil {
+		return nil, err
+	}
 
-		if post, ok := postMap[postID]; ok {
-			post.CommentCount = commentCount
-			post.User = User{
-				ID:          userID,
-				AccountName: accountName,
-				Authority:   authority,
-				DelFlg:      delFlg,
-				CreatedAt:   userCreatedAt,
-			}
+	// 結果を組み立てる
+	for _, p := range results {
+		row, ok := users[p.ID]
+		if !ok || row.User.DelFlg != 0 {
+			continue
 		}
+		p.User = row.User
+		p.CommentCount = row.CommentCount
+		p.Comments = comments[p.ID]
+		p.HasMoreComments = p.CommentCount > len(p.Comments)
+		p.CSRFToken = csrfToken
+		posts = append(posts, p)
 	}
 
-	// コメントを一括取得
-	commentQuery := `
-		SELECT 
-			c.*,
-			u.id as user_id,
-			u.account_name,
-			u.authority,
-			u.del_flg,
-			u.created_at as user_created_at
-		FROM comments c
-		JOIN users u ON c.user_id = u.id
-		WHERE c.post_id IN (?)
-	`
-	if !allComments {
-		commentQuery += ` AND c.id IN (
-			SELECT id FROM comments 
-			WHERE post_id = c.post_id 
-			ORDER BY created_at DESC 
-			LIMIT 3
-		)`
-	}
-	commentQuery += ` ORDER BY c.created_at DESC LIMIT ?`
-
-	commentQuery, args, err = sqlx.In(commentQuery, postIDs)
+	return posts, nil
+}
+
+// 投稿ごとの投稿者とコメント数を一括取得する
+func fetchPostUsers(ctx context.Context, postIDs []int) (map[int]postUserRow, error) {
+	query, args, err := sqlx.In(postUsersQuery, postIDs)
 	if err != nil {
 		return nil, err
 	}
 
-	// コメントの最大数を計算（投稿数 × 3）
-	maxComments := len(postIDs) * 3
-	args = append(args, maxComments)
+	rows := []postUserRow{}
+	if err := db.SelectContext(ctx, &rows, query, args...); err != nil {
+		return nil, err
+	}
 
-	rows, err = db.Queryx(commentQuery, args...)
+	userIDs := make([]int, 0, len(rows))
+	for _, row := range rows {
+		userIDs = append(userIDs, row.UserID)
+	}
+	// ユーザーはキャッシュからまとめて取得する
+	users, err := getUsersByIDs(ctx, userIDs)
 	if err != nil {
 		return nil, err
 	}
-	defer rows.Close()
-
-	commentsMap := make(map[int][]Comment)
-	for rows.Next() {
-		var comment Comment
-		var user User
-		err := rows.Scan(
-			&comment.ID,
-			&comment.PostID,
-			&comment.UserID,
-			&comment.Comment,
-			&comment.CreatedAt,
-			&user.ID,
-			&user.AccountName,
-			&user.Authority,
-			&user.DelFlg,
-			&user.CreatedAt,
-		)
-		if err != nil {
-			return nil, err
+
+	res := make(map[int]postUserRow, len(rows))
+	for _, row := range rows {
+		u, ok := users[row.UserID]
+		if !ok {
+			continue
 		}
-		comment.User = user
-		commentsMap[comment.PostID] = append(commentsMap[comment.PostID], comment)
+		row.User = u
+		res[row.PostID] = row
 	}
+	return res, nil
+}
 
-	// 結果を組み立てる
-	for _, p := range results {
-		if post, ok := postMap[p.ID]; ok {
-			post.Comments = commentsMap[p.ID]
-			post.CSRFToken = csrfToken
-			if post.User.DelFlg == 0 {
-				posts = append(posts, *post)
-			}
-		}
+// 投稿ごとのコメントをコメントしたユーザーと一緒に古い順で一括取得する
+// commentLimitがallComments以外の場合は投稿ごとに最新のcommentLimit件だけを取得する
+func fetchPostComments(ctx context.Context, postIDs []int, commentLimit int) (map[int][]Comment, error) {
+	q := postCommentsQuery
+	args := []any{postIDs}
+	if commentLimit != allComments {
+		q = latestPostCommentsQuery
+		args = append(args, commentLimit)
 	}
 
-	return posts, nil
+	query, args, err := sqlx.In(q, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	rows := []Comment{}
+	if err := db.SelectContext(ctx, &rows, query, args...); err != nil {
+		return nil, err
+	}
+
+	comments := make(map[int][]Comment)
+	for _, c := range rows {
+		comments[c.PostID] = append(comments[c.PostID], c)
+	}
+	return comments, nil
 }
 
 func imageURL(p Post) string {
-	ext := ""
-	if p.Mime == "image/jpeg" {
-		ext = ".jpg"
-	} else if p.Mime == "image/png" {
-		ext = ".png"
-	} else if p.Mime == "image/gif" {
-		ext = ".gif"
-	}
+	return appPath(imagePath(p))
+}
 
-	return "/image/" + strconv.Itoa(p.ID) + ext
+// プレフィックスを含まない画像のパス。絶対URLを組み立てる場合や、画像キャッシュのキーに使う
+func imagePath(p Post) string {
+	return "/image/" + strconv.Itoa(p.ID) + imageExt(p.Mime)
+}
+
+// 画像キャッシュのキー（/image/の後ろ）
+func imageCacheKey(p Post) string {
+	return strings.TrimPrefix(imagePath(p), "/image/")
 }
 
 func isLogin(u User) bool {
 	return u.ID != 0
 }
 
+// セッションのCSRFトークンを返す
+// トークンはログイン時かwithCSRFTokenで発行済みなので、ここではセッションに書き込まない
 func getCSRFToken(r *http.Request) string {
 	session := getSession(r)
-	csrfToken, ok := session.Values["csrf_token"]
-	if !ok || csrfToken == nil {
-		// CSRFトークンが存在しない場合は新しく生成
-		csrfToken = secureRandomStr(16)
-		session.Values["csrf_token"] = csrfToken
-		session.Save(r, nil)
-	}
-	return csrfToken.(string)
+	csrfToken, _ := session.Values["csrf_token"].(string)
+	return csrfToken
 }
 
 func secureRandomStr(b int) string {
@@ -427,515 +583,957 @@ func getTemplPath(filename string) string {
 	return path.Join("templates", filename)
 }
 
-func getInitialize(w http.ResponseWriter, r *http.Request) {
+func getInitialize(w http.ResponseWriter, r *http.Request) error {
+	// 削除やBANの解除でキャッシュと食い違うユーザーを先に控えておく
+	users := []User{}
+	if err := db.SelectContext(r.Context(), &users, "SELECT `id`, `account_name` FROM `users`"); err != nil {
+		return err
+	}
+
 	dbInitialize()
-	w.WriteHeader(http.StatusOK)
+	for _, u := range users {
+		invalidateUserCache(r.Context(), u)
+	}
+	if err := cacheStore.Delete(r.Context(), indexPostsKey); err != nil {
+		return err
+	}
+	clearIndexPage()
+	if err := clearCommentCache(r.Context()); err != nil {
+		return err
+	}
+	if err := clearRelatedPostsCache(r.Context()); err != nil {
+		return err
+	}
+	touchLastModified(r.Context(), siteLastModifiedKey, bannedLastModifiedKey)
+
+	// 集計の作り直しやキャッシュの準備は裏で行い、進み具合は/initialize/statusで返す
+	task := startInitTask()
+	return writeJSON(w, http.StatusOK, struct {
+		TaskID    string `json:"task_id"`
+		StatusURL string `json:"status_url"`
+	}{task.ID, appPath("/initialize/status?id=" + task.ID)})
 }
 
-func getLogin(w http.ResponseWriter, r *http.Request) {
-	me := getSessionUser(r)
+func getLogin(w http.ResponseWriter, r *http.Request) error {
+	me := currentUser(r)
 
 	if isLogin(me) {
-		http.Redirect(w, r, "/", http.StatusFound)
-		return
+		redirect(w, r, loginRedirectPath(r), http.StatusFound)
+		return nil
 	}
 
-	template.Must(template.ParseFiles(
-		getTemplPath("layout.html"),
-		getTemplPath("login.html")),
-	).Execute(w, struct {
-		Me    User
-		Flash string
-	}{me, getFlash(w, r, "notice")})
+	data := newViewData(w, r).With("Next", loginNextPath(r.URL.Query().Get("next")))
+	return renderTemplate(w, r, http.StatusOK, templates.login, "layout.html", data)
 }
 
-func postLogin(w http.ResponseWriter, r *http.Request) {
-	if isLogin(getSessionUser(r)) {
-		http.Redirect(w, r, "/", http.StatusFound)
-		return
+func postLogin(w http.ResponseWriter, r *http.Request) error {
+	if isLogin(currentUser(r)) {
+		redirect(w, r, loginRedirectPath(r), http.StatusFound)
+		return nil
 	}
 
-	u := tryLogin(r.FormValue("account_name"), r.FormValue("password"))
-
+	u, err := tryLogin(r.Context(), r.FormValue("account_name"), r.FormValue("password"))
+	if err != nil {
+		return err
+	}
 	if u != nil {
 		session := getSession(r)
 		session.Values["user_id"] = u.ID
 		session.Values["csrf_token"] = secureRandomStr(16)
 		session.Save(r, w)
+		issueCSRFCookie(w)
 
-		http.Redirect(w, r, "/", http.StatusFound)
-	} else {
+		redirect(w, r, loginRedirectPath(r), http.StatusFound)
+		return nil
+	}
+
+	banned, err := tryBannedLogin(r.Context(), r.FormValue("account_name"), r.FormValue("password"))
+	if err != nil {
+		return err
+	}
+	if banned != nil {
+		// BANされたユーザーはログインさせずに異議申し立てのページへ案内する
 		session := getSession(r)
-		session.Values["notice"] = "アカウント名かパスワードが間違っています"
+		session.Values["appeal_user_id"] = banned.ID
 		session.Save(r, w)
 
-		http.Redirect(w, r, "/login", http.StatusFound)
+		redirect(w, r, "/appeal", http.StatusFound)
+		return nil
 	}
+
+	addFlash(w, r, flashError, "アカウント名かパスワードが間違っています")
+
+	redirectToLogin(w, r, r.FormValue("next"))
+	return nil
 }
 
-func getRegister(w http.ResponseWriter, r *http.Request) {
-	if isLogin(getSessionUser(r)) {
-		http.Redirect(w, r, "/", http.StatusFound)
-		return
+func getRegister(w http.ResponseWriter, r *http.Request) error {
+	if isLogin(currentUser(r)) {
+		redirect(w, r, "/", http.StatusFound)
+		return nil
 	}
 
-	template.Must(template.ParseFiles(
-		getTemplPath("layout.html"),
-		getTemplPath("register.html")),
-	).Execute(w, struct {
-		Me    User
-		Flash string
-	}{User{}, getFlash(w, r, "notice")})
+	// 招待のリンク（/register?invite=...）から来た場合はコードを入れておく
+	data := newViewData(w, r).With("InviteCode", r.URL.Query().Get("invite"))
+	return renderTemplate(w, r, http.StatusOK, templates.register, "layout.html", data)
 }
 
-func postRegister(w http.ResponseWriter, r *http.Request) {
-	if isLogin(getSessionUser(r)) {
-		http.Redirect(w, r, "/", http.StatusFound)
-		return
+func postRegister(w http.ResponseWriter, r *http.Request) error {
+	if isLogin(currentUser(r)) {
+		redirect(w, r, "/", http.StatusFound)
+		return nil
+	}
+
+	settings := currentSettings()
+	// 入力をやり直すときも招待コードは入れたままにする
+	retryURL := "/register"
+	if code := r.FormValue("invite_code"); settings.InviteOnly() && code != "" {
+		retryURL += "?invite=" + url.QueryEscape(code)
+	}
+	if !settings.RegistrationOpen() {
+		addFlash(w, r, flashError, "現在ユーザー登録を受け付けていません")
+
+		redirect(w, r, retryURL, http.StatusFound)
+		return nil
 	}
 
 	accountName, password := r.FormValue("account_name"), r.FormValue("password")
 
 	validated := validateUser(accountName, password)
 	if !validated {
-		session := getSession(r)
-		session.Values["notice"] = "アカウント名は3文字以上、パスワードは6文字以上である必要があります"
-		session.Save(r, w)
+		addFlash(w, r, flashError, "アカウント名は3文字以上、パスワードは6文字以上である必要があります")
 
-		http.Redirect(w, r, "/register", http.StatusFound)
-		return
+		redirect(w, r, retryURL, http.StatusFound)
+		return nil
+	}
+
+	if isReservedAccountName(accountName) {
+		addFlash(w, r, flashError, "このアカウント名は使えません")
+
+		redirect(w, r, retryURL, http.StatusFound)
+		return nil
 	}
 
 	exists := 0
 	// ユーザーが存在しない場合はエラーになるのでエラーチェックはしない
-	db.Get(&exists, "SELECT 1 FROM users WHERE `account_name` = ?", accountName)
+	db.GetContext(r.Context(), &exists, "SELECT 1 FROM users WHERE `account_name` = ?", accountName)
 
 	if exists == 1 {
-		session := getSession(r)
-		session.Values["notice"] = "アカウント名がすでに使われています"
-		session.Save(r, w)
+		addFlash(w, r, flashError, "アカウント名がすでに使われています")
 
-		http.Redirect(w, r, "/register", http.StatusFound)
-		return
+		redirect(w, r, retryURL, http.StatusFound)
+		return nil
 	}
 
-	query := "INSERT INTO `users` (`account_name`, `passhash`) VALUES (?,?)"
-	result, err := db.Exec(query, accountName, calculatePasshash(accountName, password))
+	tx, err := db.BeginTxx(r.Context(), nil)
 	if err != nil {
-		log.Print(err)
-		return
+		return err
 	}
+	defer tx.Rollback()
 
-	session := getSession(r)
+	if settings.InviteOnly() {
+		if err := useInviteCode(tx, r.FormValue("invite_code")); err != nil {
+			if !errors.Is(err, errInvalidInviteCode) {
+				return err
+			}
+			addErrorFlash(w, r, err)
+
+			redirect(w, r, retryURL, http.StatusFound)
+			return nil
+		}
+	}
+
+	query := "INSERT INTO `users` (`account_name`, `passhash`) VALUES (?,?)"
+	result, err := tx.ExecContext(r.Context(), query, accountName, calculatePasshash(accountName, password))
+	if err != nil {
+		return err
+	}
 	uid, err := result.LastInsertId()
 	if err != nil {
-		log.Print(err)
-		return
+		return err
 	}
-	session.Values["user_id"] = uid
+	if err := startOnboarding(tx, int(uid)); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	session := getSession(r)
+	recordUserFingerprint(w, r, int(uid), "register")
+
+	session.Values["user_id"] = int(uid)
 	session.Values["csrf_token"] = secureRandomStr(16)
 	session.Save(r, w)
+	issueCSRFCookie(w)
 
-	http.Redirect(w, r, "/", http.StatusFound)
+	// アイコンや自己紹介を設定する案内へ（飛ばせる）
+	redirect(w, r, "/welcome", http.StatusFound)
+	return nil
 }
 
-func getLogout(w http.ResponseWriter, r *http.Request) {
+func getLogout(w http.ResponseWriter, r *http.Request) error {
 	session := getSession(r)
 	delete(session.Values, "user_id")
-	session.Options = &sessions.Options{MaxAge: -1}
+	session.Options = &sessions.Options{Path: appPath("/"), MaxAge: -1}
 	session.Save(r, w)
 
-	http.Redirect(w, r, "/", http.StatusFound)
+	redirect(w, r, "/", http.StatusFound)
+	return nil
 }
 
-func getIndex(w http.ResponseWriter, r *http.Request) {
-	me := getSessionUser(r)
+func getIndex(w http.ResponseWriter, r *http.Request) error {
+	modified := lastModified(r.Context(), siteLastModifiedKey)
+	if checkNotModified(w, r, modified) {
+		return nil
+	}
+	// 最新の一覧はフラッシュがなければページ全体のキャッシュから返す
+	if r.URL.Query().Get("cursor") == "" && len(currentFlashes(w, r)) == 0 {
+		return writeCachedIndexPage(w, r, modified)
+	}
+	return renderIndex(w, r, http.StatusOK, uploadFormInput{})
+}
 
-	results := []Post{}
+// 投稿に失敗したときにフォームに戻す入力内容とエラー
+type uploadFormInput struct {
+	Body string
+	// 投稿者が選んだ言語（空は自動）
+	Language  string
+	FileError string
+	BodyError string
+	// 二重送信を防ぐためのキー（描画のたびに作る）
+	IdempotencyKey string
+}
 
-	err := db.Select(&results, "SELECT `id`, `user_id`, `body`, `mime`, `created_at` FROM `posts` ORDER BY `created_at` DESC LIMIT ?", postsPerPage)
+// トップページを描画する
+// 投稿に失敗した場合は入力内容を残したフォームとエラーを表示する
+func renderIndex(w http.ResponseWriter, r *http.Request, status int, form uploadFormInput) error {
+	var posts []Post
+	var err error
+	// cursorが指定された場合はその時刻以前の投稿から表示する（コメント投稿後の戻り先）
+	if t, ok := parseCursor(r.URL.Query().Get("cursor")); ok {
+		var results []Post
+		results, err = fetchTimelinePosts(r.Context(), pageCursor{maxCreatedAt: t})
+		if err != nil {
+			return err
+		}
+		posts, err = makePosts(r.Context(), results, "", config.CommentPreviewCount)
+	} else {
+		// 最新の一覧はワーカーが組み立てたものを使う
+		posts, err = getIndexPosts(r.Context())
+	}
 	if err != nil {
-		log.Print(err)
-		return
+		return err
 	}
 
-	posts, err := makePosts(results, getCSRFToken(r), false)
+	postsHTML, err := renderPosts(posts, formCSRFToken(r))
 	if err != nil {
-		log.Print(err)
-		return
+		return err
 	}
 
-	templates.layout.ExecuteTemplate(w, "layout.html", struct {
-		Posts     []Post
-		Me        User
-		CSRFToken string
-		Flash     string
-	}{posts, me, getCSRFToken(r), getFlash(w, r, "notice")})
+	form.IdempotencyKey = newIdempotencyKey()
+	data := newViewData(w, r).With("Form", form).With("Posts", postsHTML)
+	return renderTemplate(w, r, status, templates.index, "layout.html", data)
 }
 
-func getAccountName(w http.ResponseWriter, r *http.Request) {
+// ユーザーページの正規のURL（登録された表記）へリダイレクトする
+// 末尾のスラッシュはwithCanonicalURLで取り除かれている
+func redirectAccountName(w http.ResponseWriter, r *http.Request) {
 	accountName := r.PathValue("accountName")
-	user := User{}
+	if u, err := getUserByAccountName(r.Context(), accountName); err == nil {
+		accountName = u.AccountName
+	}
+	location := "/@" + accountName
+	if r.URL.RawQuery != "" {
+		location += "?" + r.URL.RawQuery
+	}
+	redirect(w, r, location, http.StatusMovedPermanently)
+}
 
-	err := db.Get(&user, "SELECT * FROM `users` WHERE `account_name` = ? AND `del_flg` = 0", accountName)
+func getAccountName(w http.ResponseWriter, r *http.Request) error {
+	accountName := r.PathValue("accountName")
+	user, err := getActiveUserByAccountName(r.Context(), accountName)
 	if err != nil {
-		log.Print(err)
-		return
+		return err
 	}
 
 	if user.ID == 0 {
-		w.WriteHeader(http.StatusNotFound)
-		return
+		return errNotFound
 	}
 
-	results := []Post{}
+	// 大文字小文字が異なるURLは登録された表記に揃える
+	if user.AccountName != accountName {
+		redirectAccountName(w, r)
+		return nil
+	}
 
-	err = db.Select(&results, "SELECT `id`, `user_id`, `body`, `mime`, `created_at` FROM `posts` WHERE `user_id` = ? ORDER BY `created_at` DESC LIMIT ?", user.ID, postsPerPage)
+	// 変更がなければ投稿や統計情報を取得せずに304を返す
+	modified := lastModified(r.Context(), userLastModifiedKey(user.ID), bannedLastModifiedKey)
+	if user.CreatedAt.After(modified) {
+		modified = user.CreatedAt
+	}
+	if checkNotModified(w, r, modified) {
+		return nil
+	}
+
+	stats, err := fetchUserStats(r.Context(), user.ID)
+	if err != nil {
+		return err
+	}
+	profile, err := fetchUserProfile(r.Context(), user.ID)
+	if err != nil {
+		return err
+	}
+
+	// Tabによって投稿（Posts）かコメント（Comments）のどちらかを表示する
+	data := newViewData(w, r).
+		With("User", user).
+		With("Profile", profile).
+		With("PostCount", stats.PostCount).
+		With("CommentCount", stats.CommentCount).
+		With("CommentedCount", stats.CommentedCount)
+
+	switch tab := r.URL.Query().Get("tab"); tab {
+	case "", "posts":
+		results, err := fetchUserPosts(r.Context(), user.ID, pageCursor{})
+		if err != nil {
+			return err
+		}
+		posts, err := makePosts(r.Context(), results, "", config.CommentPreviewCount)
+		if err != nil {
+			return err
+		}
+		postsHTML, err := renderPosts(posts, formCSRFToken(r))
+		if err != nil {
+			return err
+		}
+		data.With("Tab", "posts").With("Posts", postsHTML)
+		// 公開前の投稿は本人にだけ表示する
+		if me := currentUser(r); me.ID == user.ID {
+			pending, err := fetchPendingPostsOf(r.Context(), user.ID)
+			if err != nil {
+				return err
+			}
+			data.With("PendingPosts", pending)
+		}
+	case "comments":
+		cursor, err := parsePageCursor(r.URL.Query().Get("cursor"))
+		if err != nil {
+			return newHTTPError(http.StatusBadRequest, err)
+		}
+		comments, err := fetchUserComments(r.Context(), user.ID, cursor)
+		if err != nil {
+			return err
+		}
+		data.With("Tab", tab).
+			With("Canonical", canonicalURL("/@"+user.AccountName+"?tab=comments")).
+			With("Comments", comments).
+			With("NextCursor", nextCommentPageCursor(comments).String())
+	default:
+		return errNotFound
+	}
+
+	return renderTemplate(w, r, http.StatusOK, templates.user, "layout.html", data)
+}
+
+func getPosts(w http.ResponseWriter, r *http.Request) error {
+	m, err := url.ParseQuery(r.URL.RawQuery)
 	if err != nil {
-		log.Print(err)
-		return
+		return newHTTPError(http.StatusBadRequest, err)
+	}
+	maxCreatedAt := m.Get("max_created_at")
+	if maxCreatedAt == "" {
+		return nil
 	}
 
-	posts, err := makePosts(results, getCSRFToken(r), false)
+	t, err := time.Parse(ISO8601Format, maxCreatedAt)
 	if err != nil {
-		log.Print(err)
-		return
+		return newHTTPError(http.StatusBadRequest, err)
 	}
 
-	// ユーザーの統計情報を1つのクエリで取得
-	type UserStats struct {
-		PostCount      int `db:"post_count"`
-		CommentCount   int `db:"comment_count"`
-		CommentedCount int `db:"commented_count"`
+	if checkNotModified(w, r, lastModified(r.Context(), siteLastModifiedKey)) {
+		return nil
 	}
 
-	var stats UserStats
-	err = db.Get(&stats, `
-		SELECT 
-			(SELECT COUNT(*) FROM posts WHERE user_id = ?) as post_count,
-			(SELECT COUNT(*) FROM comments WHERE user_id = ?) as comment_count,
-			(SELECT COUNT(DISTINCT post_id) FROM comments WHERE post_id IN (SELECT id FROM posts WHERE user_id = ?)) as commented_count
-	`, user.ID, user.ID, user.ID)
+	results, err := fetchTimelinePosts(r.Context(), pageCursor{maxCreatedAt: t})
 	if err != nil {
-		log.Print(err)
-		return
+		return err
 	}
 
-	me := getSessionUser(r)
+	posts, err := makePosts(r.Context(), results, "", config.CommentPreviewCount)
+	if err != nil {
+		return err
+	}
+
+	if len(posts) == 0 {
+		return errNotFound
+	}
+
+	postsHTML, err := renderPosts(posts, formCSRFToken(r))
+	if err != nil {
+		return err
+	}
 
-	templates.layout.ExecuteTemplate(w, "layout.html", struct {
-		Posts          []Post
-		User           User
-		PostCount      int
-		CommentCount   int
-		CommentedCount int
-		Me             User
-	}{posts, user, stats.PostCount, stats.CommentCount, stats.CommentedCount, me})
+	return renderTemplate(w, r, http.StatusOK, templates.posts, "posts.html", postsHTML)
 }
 
-func getPosts(w http.ResponseWriter, r *http.Request) {
-	m, err := url.ParseQuery(r.URL.RawQuery)
+// ユーザーページの無限スクロール用にそのユーザーの投稿一覧の続きを返す
+func getAccountNamePosts(w http.ResponseWriter, r *http.Request) error {
+	user, err := getActiveUserByAccountName(r.Context(), r.PathValue("accountName"))
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		log.Print(err)
-		return
+		return err
 	}
-	maxCreatedAt := m.Get("max_created_at")
+
+	maxCreatedAt := r.URL.Query().Get("max_created_at")
 	if maxCreatedAt == "" {
-		return
+		return nil
 	}
 
 	t, err := time.Parse(ISO8601Format, maxCreatedAt)
 	if err != nil {
-		log.Print(err)
-		return
+		return newHTTPError(http.StatusBadRequest, err)
 	}
 
-	results := []Post{}
-	err = db.Select(&results, "SELECT `id`, `user_id`, `body`, `mime`, `created_at` FROM `posts` WHERE `created_at` <= ? ORDER BY `created_at` DESC", t.Format(ISO8601Format))
+	results, err := fetchUserPosts(r.Context(), user.ID, pageCursor{maxCreatedAt: t})
 	if err != nil {
-		log.Print(err)
-		return
+		return err
 	}
 
-	posts, err := makePosts(results, getCSRFToken(r), false)
+	posts, err := makePosts(r.Context(), results, "", config.CommentPreviewCount)
 	if err != nil {
-		log.Print(err)
-		return
+		return err
 	}
 
 	if len(posts) == 0 {
-		w.WriteHeader(http.StatusNotFound)
-		return
+		return errNotFound
 	}
 
-	templates.posts.ExecuteTemplate(w, "posts.html", posts)
+	postsHTML, err := renderPosts(posts, formCSRFToken(r))
+	if err != nil {
+		return err
+	}
+
+	return renderTemplate(w, r, http.StatusOK, templates.posts, "posts.html", postsHTML)
 }
 
-func getPostsID(w http.ResponseWriter, r *http.Request) {
+func getPostsID(w http.ResponseWriter, r *http.Request) error {
 	pidStr := r.PathValue("id")
 	pid, err := strconv.Atoi(pidStr)
 	if err != nil {
-		w.WriteHeader(http.StatusNotFound)
-		return
+		return errNotFound
 	}
 
-	results := []Post{}
-	err = db.Select(&results, "SELECT * FROM `posts` WHERE `id` = ?", pid)
+	if checkNotModified(w, r, lastModified(r.Context(), postLastModifiedKey(pid), bannedLastModifiedKey)) {
+		postViewCounter.Incr(pid, 1)
+		return nil
+	}
+
+	p, err := fetchVisiblePost(r.Context(), pid, currentUser(r), formCSRFToken(r))
 	if err != nil {
-		log.Print(err)
-		return
+		return err
 	}
+	p.FormKey = newIdempotencyKey()
+	postViewCounter.Incr(p.ID, 1)
 
-	posts, err := makePosts(results, getCSRFToken(r), true)
+	related, err := relatedPostsFor(r.Context(), p)
 	if err != nil {
-		log.Print(err)
-		return
+		return err
 	}
 
-	if len(posts) == 0 {
-		w.WriteHeader(http.StatusNotFound)
-		return
+	return renderTemplate(w, r, http.StatusOK, templates.postID, "layout.html", newViewData(w, r).With("Post", p).With("Related", related))
+}
+
+// 全てのコメントを付けた投稿を返す
+// 公開前の投稿は投稿者と管理者にだけ見せ、それ以外のユーザーにはerrNotFoundを返す
+func fetchVisiblePost(ctx context.Context, pid int, me User, csrfToken string) (Post, error) {
+	results := []Post{}
+	err := db.SelectContext(ctx, &results, "SELECT p.`id`, p.`user_id`, p.`body`, p.`mime`, p.`created_at`, "+postImageSizeColumns+", "+postLanguageColumn+
+		", COALESCE(m.`status`, '') AS `moderation`"+
+		" FROM `posts` p LEFT JOIN `post_image_sizes` s ON s.`post_id` = p.`id`"+
+		" LEFT JOIN `post_languages` l ON l.`post_id` = p.`id`"+
+		" LEFT JOIN `pending_posts` m ON m.`post_id` = p.`id` WHERE p.`id` = ?", pid)
+	if err != nil {
+		return Post{}, err
 	}
 
-	p := posts[0]
+	if len(results) > 0 && results[0].Moderation != "" {
+		if me.ID != results[0].UserID && me.Authority == 0 {
+			return Post{}, errNotFound
+		}
+	}
 
-	me := getSessionUser(r)
+	posts, err := makePosts(ctx, results, csrfToken, allComments)
+	if err != nil {
+		return Post{}, err
+	}
 
-	templates.layout.ExecuteTemplate(w, "layout.html", struct {
-		Post Post
-		Me   User
-	}{p, me})
+	if len(posts) == 0 {
+		return Post{}, errNotFound
+	}
+	return posts[0], nil
 }
 
 // 画像をリサイズする関数
-func resizeImage(imgData []byte, mime string) ([]byte, error) {
+// WebPで配信する場合は、縮小した画像からWebP版も作る
+// WebP版を作れなかった場合はwebpをnilにし、最初に配信するときに作る
+func resizeImage(ctx context.Context, imgData []byte, mime string) (data, webp []byte, err error) {
+	data, err = shrinkImage(imgData, mime)
+	if err != nil {
+		return nil, nil, err
+	}
+	// アニメーションが失われるのでGIFは変換しない
+	if webpEnabled() && mime != "image/gif" {
+		if webp, err = encodeWebP(ctx, data); err != nil {
+			logger("image").WarnContext(ctx, "failed to encode webp", "err", err)
+			webp = nil
+		}
+	}
+	return data, webp, nil
+}
+
+// 画像を最大サイズに収まるよう縮小する
+func shrinkImage(imgData []byte, mime string) ([]byte, error) {
+	// 縮小が不要で十分小さい画像は再エンコードせずそのまま使う
+	if canStoreAsIs(imgData, mime) {
+		uploadImageStats.Passthrough.Add(1)
+		return imgData, nil
+	}
+
 	// 画像をデコード
 	img, _, err := image.Decode(bytes.NewReader(imgData))
 	if err != nil {
+		uploadImageStats.Failed.Add(1)
 		return nil, err
 	}
 
-	// 画像をリサイズ
-	resized := resize.Resize(MaxImageSize, MaxImageSize, img, resize.Lanczos3)
+	// 縦横比を保ったまま最大サイズに収まるよう縮小する（小さい画像は拡大しない）
+	resized := resize.Thumbnail(uint(config.MaxImageWidth), uint(config.MaxImageHeight), img, resize.Lanczos3)
 
 	// リサイズした画像をエンコード
-	var buf bytes.Buffer
+	data, err := encodeImage(resized, mime)
+	if err != nil {
+		uploadImageStats.Failed.Add(1)
+		return nil, err
+	}
+	uploadImageStats.Reencoded.Add(1)
+	return data, nil
+}
+
+// 再エンコードせずに保存できるか
+// 位置情報などが残らないよう、Exifを含む画像は対象にしない
+func canStoreAsIs(imgData []byte, mime string) bool {
+	if len(imgData) > config.ImagePassthroughMaxBytes || hasExif(imgData, mime) {
+		return false
+	}
+	width, height, err := imageSize(imgData)
+	if err != nil {
+		return false
+	}
+	return width <= config.MaxImageWidth && height <= config.MaxImageHeight
+}
+
+// 画像をmimeの形式でエンコードする
+// エンコードにはプールのバッファを使い、結果だけをコピーして返す
+func encodeImage(img image.Image, mime string) ([]byte, error) {
+	buf := getBuffer()
+	defer putBuffer(buf)
+
 	switch mime {
 	case "image/jpeg":
-		if err := jpeg.Encode(&buf, resized, &jpeg.Options{Quality: 85}); err != nil {
+		if err := jpeg.Encode(buf, img, &jpeg.Options{Quality: config.JPEGQuality}); err != nil {
 			return nil, err
 		}
+		if len(config.JPEGProgressiveCommand) > 0 {
+			return makeProgressiveJPEG(bytes.Clone(buf.Bytes())), nil
+		}
 	case "image/png":
-		if err := png.Encode(&buf, resized); err != nil {
+		enc := png.Encoder{CompressionLevel: config.PNGCompression}
+		if err := enc.Encode(buf, img); err != nil {
 			return nil, err
 		}
 	case "image/gif":
-		if err := gif.Encode(&buf, resized, nil); err != nil {
+		opts := &gif.Options{NumColors: config.GIFNumColors, Drawer: draw.Src}
+		if config.GIFDither {
+			opts.Drawer = draw.FloydSteinberg
+		}
+		if err := gif.Encode(buf, img, opts); err != nil {
 			return nil, err
 		}
 	default:
 		return nil, fmt.Errorf("unsupported image type: %s", mime)
 	}
 
-	return buf.Bytes(), nil
+	return bytes.Clone(buf.Bytes()), nil
 }
 
-func postIndex(w http.ResponseWriter, r *http.Request) {
-	me := getSessionUser(r)
-	if !isLogin(me) {
-		http.Redirect(w, r, "/login", http.StatusFound)
-		return
+// 画像の幅と高さをヘッダーだけ読んで取得する
+func imageSize(imgData []byte) (int, int, error) {
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(imgData))
+	if err != nil {
+		return 0, 0, err
 	}
+	return cfg.Width, cfg.Height, nil
+}
 
-	if r.FormValue("csrf_token") != getCSRFToken(r) {
-		w.WriteHeader(http.StatusUnprocessableEntity)
-		return
+func postIndex(w http.ResponseWriter, r *http.Request) error {
+	me := currentUser(r)
+	if !isLogin(me) {
+		redirectToLogin(w, r, refererPath(r))
+		return nil
 	}
 
-	file, header, err := r.FormFile("file")
+	form, err := parseUploadForm(r)
 	if err != nil {
-		session := getSession(r)
-		session.Values["notice"] = "画像が必須です"
-		session.Save(r, w)
-
-		http.Redirect(w, r, "/", http.StatusFound)
-		return
-	}
-
-	mime := ""
-	if file != nil {
-		contentType := header.Header["Content-Type"][0]
-		if strings.Contains(contentType, "jpeg") {
-			mime = "image/jpeg"
-		} else if strings.Contains(contentType, "png") {
-			mime = "image/png"
-		} else if strings.Contains(contentType, "gif") {
-			mime = "image/gif"
-		} else {
-			session := getSession(r)
-			session.Values["notice"] = "投稿できる画像形式はjpgとpngとgifだけです"
-			session.Save(r, w)
-
-			http.Redirect(w, r, "/", http.StatusFound)
-			return
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			// 本文も読めていないので、エラーだけを表示する
+			return renderIndex(w, r, http.StatusRequestEntityTooLarge, uploadFormInput{
+				FileError: "ファイルサイズが大きすぎます",
+			})
 		}
+		return newHTTPError(http.StatusBadRequest, err)
+	}
+
+	if !validCSRFToken(r, form.CSRFToken) {
+		return errInvalidCSRFToken
 	}
 
-	filedata, err := io.ReadAll(file)
+	// 再送された場合は先に作った投稿へ移動する
+	claim, replay, err := claimIdempotencyKey(r.Context(), me.ID, "post", form.IdempotencyKey)
 	if err != nil {
-		log.Print(err)
-		return
+		return err
+	}
+	if replay != "" {
+		redirect(w, r, replay, http.StatusFound)
+		return nil
+	}
+	defer claim.release(context.WithoutCancel(r.Context()))
+
+	// 入力した本文が消えないよう、リダイレクトせずにフォームを表示し直す
+	input := uploadFormInput{Body: form.Body, Language: form.Language}
+	status := http.StatusUnprocessableEntity
+	switch form.fileErr {
+	case nil:
+	case errUploadNoFile:
+		input.FileError = "画像が必須です"
+	case errUploadUnsupported:
+		input.FileError = "投稿できる画像形式は" + uploadFormatNames() + "だけです"
+	case errUploadTooLarge:
+		input.FileError = "ファイルサイズが大きすぎます"
+		status = http.StatusRequestEntityTooLarge
+	default:
+		return form.fileErr
+	}
+	if err := validatePostBody(form.Body); err != nil {
+		input.BodyError = apperror.UserMessage(err)
+	}
+	if input.FileError != "" || input.BodyError != "" {
+		return renderIndex(w, r, status, input)
 	}
 
-	if len(filedata) > UploadLimit {
-		session := getSession(r)
-		session.Values["notice"] = "ファイルサイズが大きすぎます"
-		session.Save(r, w)
+	mime, filedata := form.Mime, form.Filedata
 
-		http.Redirect(w, r, "/", http.StatusFound)
-		return
+	// HEIC/HEIFはブラウザで表示できないのでJPEGにしてから保存する
+	if isHEIFMime(mime) {
+		converted, err := convertHEICToJPEG(r.Context(), filedata)
+		if err != nil {
+			logger("image").WarnContext(r.Context(), "failed to convert HEIC image", "err", err)
+			input.FileError = "画像を変換できませんでした"
+			return renderIndex(w, r, http.StatusUnprocessableEntity, input)
+		}
+		mime, filedata = "image/jpeg", converted
 	}
 
 	// 画像をリサイズ
-	resizedData, err := resizeImage(filedata, mime)
+	// WebP版もここで作っておき、トランザクションの中で変換を待たないようにする
+	resizedData, webpData, err := resizeImage(r.Context(), filedata, mime)
 	if err != nil {
-		log.Printf("Failed to resize image: %v", err)
+		logger("image").WarnContext(r.Context(), "failed to resize image", "err", err)
 		// リサイズに失敗した場合は元の画像を使用
 		resizedData = filedata
 	}
 
-	query := "INSERT INTO `posts` (`user_id`, `mime`, `imgdata`, `body`) VALUES (?,?,?,?)"
-	result, err := db.Exec(
+	width, height, err := imageSize(resizedData)
+	if err != nil {
+		logger("image").WarnContext(r.Context(), "failed to read image size", "err", err)
+	}
+
+	pending, err := needsModeration(r.Context(), me)
+	if err != nil {
+		return err
+	}
+
+	tx, err := db.BeginTxx(r.Context(), nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// 投稿を作れずに戻る場合は、書いた画像を消す
+	// 接続が切れても消せるよう、リクエストのキャンセルは引き継がない
+	var pid int64
+	stored := false
+	defer func() {
+		if stored {
+			deletePostImage(context.WithoutCancel(r.Context()), int(pid), mime)
+		}
+	}()
+
+	// 画像はDBに入れずにファイルに書く（imgdataは空のまま）
+	query := "INSERT INTO `posts` (`user_id`, `mime`, `imgdata`, `body`) VALUES (?,?,'',?)"
+	result, err := tx.ExecContext(r.Context(),
 		query,
 		me.ID,
 		mime,
-		resizedData,
-		r.FormValue("body"),
+		form.Body,
 	)
 	if err != nil {
-		log.Print(err)
-		return
+		return err
 	}
 
-	// キャッシュをクリア
-	clearImageCache()
-
-	pid, err := result.LastInsertId()
+	pid, err = result.LastInsertId()
 	if err != nil {
-		log.Print(err)
-		return
+		return err
 	}
-
-	http.Redirect(w, r, "/posts/"+strconv.FormatInt(pid, 10), http.StatusFound)
-}
-
-// キャッシュのエントリを追加
-func addToCache(key string, data []byte) {
-	imageCache.Lock()
-	defer imageCache.Unlock()
-
-	// 新しいデータのサイズ
-	newSize := int64(len(data))
-
-	// キャッシュが一杯の場合、古いエントリを削除
-	for imageCache.curSize+newSize > imageCache.maxSize {
-		var oldestKey string
-		var oldestTime time.Time
-		for k, v := range imageCache.data {
-			if oldestKey == "" || v.lastUse.Before(oldestTime) {
-				oldestKey = k
-				oldestTime = v.lastUse
-			}
+	// 書きかけで失敗した場合も消す
+	stored = true
+	if err := putPostImage(r.Context(), int(pid), mime, resizedData); err != nil {
+		return err
+	}
+	// WebP版も保存しておき、最初の配信で変換を待たせないようにする
+	if webpData != nil {
+		if err := imageStore.Put(r.Context(), webpImageKey(int(pid)), webpData, "image/webp"); err != nil {
+			logger("image").WarnContext(r.Context(), "failed to store webp", "post_id", pid, "err", err)
 		}
-		if oldestKey != "" {
-			imageCache.curSize -= int64(len(imageCache.data[oldestKey].data))
-			delete(imageCache.data, oldestKey)
-		} else {
-			break
+	}
+	// 審査待ちの状態にする前に一覧に出ないよう、投稿と同時に記録する
+	if pending {
+		if err := holdPostForReview(tx, int(pid), me.ID); err != nil {
+			return err
 		}
 	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	stored = false
 
-	// 新しいエントリを追加
-	imageCache.data[key] = &cacheEntry{
-		data:    data,
-		lastUse: time.Now(),
+	if err := incrUserPostCount(me.ID); err != nil {
+		logger("stats").ErrorContext(r.Context(), "failed to update user stats", "err", err)
 	}
-	imageCache.curSize += newSize
-}
 
-// キャッシュからエントリを取得
-func getFromCache(key string) ([]byte, bool) {
-	imageCache.RLock()
-	entry, found := imageCache.data[key]
-	imageCache.RUnlock()
+	if width > 0 && height > 0 {
+		_, err = db.ExecContext(context.WithoutCancel(r.Context()),
+			"INSERT INTO `post_image_sizes` (`post_id`, `width`, `height`) VALUES (?,?,?)",
+			pid,
+			width,
+			height,
+		)
+		if err != nil {
+			return err
+		}
+	}
 
-	if !found {
-		return nil, false
+	if lang := postLanguage(form.Language, form.Body); lang != "" {
+		_, err = db.ExecContext(context.WithoutCancel(r.Context()), "INSERT INTO `post_languages` (`post_id`, `lang`) VALUES (?,?)", pid, lang)
+		if err != nil {
+			return err
+		}
 	}
 
-	// 最終使用時間を更新
-	imageCache.Lock()
-	entry.lastUse = time.Now()
-	imageCache.Unlock()
+	// 審査待ちの投稿は承認したときに公開のイベントを発行する
+	if pending {
+		addFlash(w, r, flashSuccess, "投稿は管理者の承認後に公開されます")
+	} else {
+		events.Publish(PostCreated{PostID: int(pid), UserID: me.ID})
+	}
+	recordUserFingerprint(w, r, me.ID, "post")
+
+	location := "/posts/" + strconv.FormatInt(pid, 10)
+	claim.complete(context.WithoutCancel(r.Context()), location)
 
-	return entry.data, true
+	redirect(w, r, location, http.StatusFound)
+	return nil
 }
 
-func getImage(w http.ResponseWriter, r *http.Request) {
+func getImage(w http.ResponseWriter, r *http.Request) error {
 	pidStr := r.PathValue("id")
 	pid, err := strconv.Atoi(pidStr)
 	if err != nil {
-		w.WriteHeader(http.StatusNotFound)
-		return
+		return errNotFound
 	}
 
 	ext := r.PathValue("ext")
 	cacheKey := fmt.Sprintf("%d.%s", pid, ext)
 
+	if isMissingImage(cacheKey) {
+		return errNotFound
+	}
+
 	// キャッシュから画像を取得
-	imgdata, found := getFromCache(cacheKey)
+	imgdata, etag, found := getFromCache(cacheKey)
 
 	if !found {
-		// キャッシュにない場合はDBから取得
-		post := Post{}
-		err := db.Get(&post, "SELECT * FROM `posts` WHERE `id` = ?", pid)
+		// キャッシュにない場合はファイルかDBから取得
+		imgdata, err = fetchImage(r.Context(), pid, ext)
+		if errors.Is(err, errNotFound) {
+			markMissingImage(cacheKey)
+		}
 		if err != nil {
-			log.Print(err)
-			return
+			return err
 		}
-
-		if ext == "jpg" && post.Mime == "image/jpeg" ||
-			ext == "png" && post.Mime == "image/png" ||
-			ext == "gif" && post.Mime == "image/gif" {
-			imgdata = post.Imgdata
-
-			// キャッシュに保存
-			addToCache(cacheKey, imgdata)
-		} else {
-			w.WriteHeader(http.StatusNotFound)
-			return
+		etag = imageETag(imgdata)
+
+		// キャッシュに保存
+		addToCache(cacheKey, imgdata, etag)
+	}
+
+	contentType := getMimeType(ext)
+	// アニメーションが失われるのでGIFは変換しない
+	// AVIF、WebPの順に受け付ける形式で返し、どちらも受け付けないか変換できない場合は元の形式で返す
+	if (avifEnabled() || webpEnabled()) && ext != "gif" {
+		w.Header().Set("Vary", "Accept")
+		converted := false
+		if avifEnabled() && acceptsAVIF(r) {
+			if data, avifETag, ok := getAVIFVariant(r.Context(), pid, cacheKey, imgdata); ok {
+				imgdata, etag, contentType = data, avifETag, "image/avif"
+				converted = true
+			}
+		}
+		if !converted && webpEnabled() && acceptsWebP(r) {
+			if data, webpETag, ok := getWebPVariant(r.Context(), pid, cacheKey, imgdata); ok {
+				imgdata, etag, contentType = data, webpETag, "image/webp"
+			}
 		}
 	}
 
+	return writeImage(w, r, contentType, imgdata, etag)
+}
+
+// 画像をキャッシュヘッダー付きで書き出す
+func writeImage(w http.ResponseWriter, r *http.Request, contentType string, data []byte, etag string) error {
 	// キャッシュヘッダーを設定
-	w.Header().Set("Content-Type", getMimeType(ext))
+	w.Header().Set("Content-Type", contentType)
 	w.Header().Set("Cache-Control", "public, max-age=31536000") // 1年間キャッシュ
-	w.Header().Set("ETag", fmt.Sprintf(`"%x"`, sha256.Sum256(imgdata)))
+	w.Header().Set("ETag", etag)
 
 	// If-None-Matchヘッダーをチェック
-	if match := r.Header.Get("If-None-Match"); match != "" {
-		if match == fmt.Sprintf(`"%x"`, sha256.Sum256(imgdata)) {
-			w.WriteHeader(http.StatusNotModified)
-			return
+	if match := r.Header.Get("If-None-Match"); match != "" && match == etag {
+		w.WriteHeader(http.StatusNotModified)
+		return nil
+	}
+
+	w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	_, err := io.Copy(w, bytes.NewReader(data))
+	return err
+}
+
+// 変換した版の取得と変換は同時に来たリクエストで1回だけ行う
+var imageVariantFlight flightGroup[[]byte]
+
+// 画像のAVIF版をキャッシュか保存先から取得し、なければ変換して保存する
+// 変換できなかった場合は元の形式で配信する
+func getAVIFVariant(ctx context.Context, pid int, cacheKey string, original []byte) ([]byte, string, bool) {
+	key := avifVariantKey(cacheKey)
+	if data, etag, found := getFromCache(key); found {
+		return data, etag, true
+	}
+
+	// 最初のリクエストが切れても待っている他のリクエストに返せるよう、キャンセルは引き継がない
+	data, err := imageVariantFlight.Do(key, func() ([]byte, error) {
+		ctx := context.WithoutCancel(ctx)
+		data, err := imageStore.Get(ctx, avifImageKey(pid))
+		if err == nil {
+			return data, nil
+		}
+		if !errors.Is(err, errImageNotFound) {
+			logger("image").WarnContext(ctx, "failed to get avif", "key", cacheKey, "err", err)
 		}
+		return putAVIFVariant(ctx, pid, original)
+	})
+	if err != nil {
+		logger("image").WarnContext(ctx, "failed to encode avif", "key", cacheKey, "err", err)
+		return nil, "", false
+	}
+	etag := imageETag(data)
+	addToCache(key, data, etag)
+	return data, etag, true
+}
+
+// 画像のWebP版をキャッシュか保存先から取得し、なければ変換して保存する
+// 変換できなかった場合は元の形式で配信する
+func getWebPVariant(ctx context.Context, pid int, cacheKey string, original []byte) ([]byte, string, bool) {
+	key := webpVariantKey(cacheKey)
+	if data, etag, found := getFromCache(key); found {
+		return data, etag, true
 	}
 
-	_, err = w.Write(imgdata)
+	data, err := imageVariantFlight.Do(key, func() ([]byte, error) {
+		ctx := context.WithoutCancel(ctx)
+		data, err := imageStore.Get(ctx, webpImageKey(pid))
+		if err == nil {
+			return data, nil
+		}
+		if !errors.Is(err, errImageNotFound) {
+			logger("image").WarnContext(ctx, "failed to get webp", "key", cacheKey, "err", err)
+		}
+		// WebPで配信する前に投稿した画像は、ここで作って保存する
+		return putWebPVariant(ctx, pid, original)
+	})
 	if err != nil {
-		log.Print(err)
-		return
+		logger("image").WarnContext(ctx, "failed to encode webp", "key", cacheKey, "err", err)
+		return nil, "", false
 	}
+	etag := imageETag(data)
+	addToCache(key, data, etag)
+	return data, etag, true
+}
+
+// fetchImageで投稿の画像を読むクエリ
+const postImageQuery = "SELECT `mime`, `imgdata` FROM `posts` WHERE `id` = ?"
+
+// 投稿の画像データを保存先から取得する。まだ書き出していない投稿はDBから取得する
+// 拡張子がMIMEタイプと一致しない場合は存在しないものとして扱う
+// 削除した投稿の画像が保存先に残っていても配信しないよう、先に投稿があることを確かめる
+func fetchImage(ctx context.Context, pid int, ext string) ([]byte, error) {
+	if getMimeType(ext) == "" {
+		return nil, errNotFound
+	}
+
+	release, err := dbSlots.acquire(ctx, dbClassAnonymous)
+	if err != nil {
+		return nil, err
+	}
+	var post struct {
+		Mime    string `db:"mime"`
+		Imgdata []byte `db:"imgdata"`
+	}
+	err = db.GetContext(ctx, &post, postImageQuery, pid)
+	release()
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, errNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if post.Mime != getMimeType(ext) {
+		return nil, errNotFound
+	}
+	if len(post.Imgdata) > 0 {
+		return post.Imgdata, nil
+	}
+
+	data, err := imageStore.Get(ctx, postImageKey(pid, ext))
+	if errors.Is(err, errImageNotFound) {
+		// 書き出し済みなのに保存先に無い
+		logger("image").WarnContext(ctx, "image is missing in the store", "post_id", pid, "key", postImageKey(pid, ext))
+		return nil, errNotFound
+	}
+	return data, err
+}
+
+// 画像データのETag
+func imageETag(data []byte) string {
+	return fmt.Sprintf(`"%x"`, sha256.Sum256(data))
 }
 
 func getMimeType(ext string) string {
@@ -951,161 +1549,340 @@ func getMimeType(ext string) string {
 	}
 }
 
-// キャッシュをクリアする関数
-func clearImageCache() {
-	imageCache.Lock()
-	imageCache.data = make(map[string]*cacheEntry)
-	imageCache.curSize = 0
-	imageCache.Unlock()
-}
-
-func postComment(w http.ResponseWriter, r *http.Request) {
-	me := getSessionUser(r)
+func postComment(w http.ResponseWriter, r *http.Request) error {
+	me := currentUser(r)
 	if !isLogin(me) {
-		http.Redirect(w, r, "/login", http.StatusFound)
-		return
+		// ログインした後はコメントしようとした投稿に戻す
+		next := refererPath(r)
+		if postID, err := strconv.Atoi(r.FormValue("post_id")); err == nil {
+			next = fmt.Sprintf("/posts/%d", postID)
+		}
+		redirectToLogin(w, r, next)
+		return nil
 	}
 
-	if r.FormValue("csrf_token") != getCSRFToken(r) {
-		w.WriteHeader(http.StatusUnprocessableEntity)
-		return
+	if !validCSRFToken(r, r.FormValue("csrf_token")) {
+		return errInvalidCSRFToken
 	}
 
 	postID, err := strconv.Atoi(r.FormValue("post_id"))
 	if err != nil {
-		log.Print("post_idは整数のみです")
-		return
+		return newHTTPError(http.StatusBadRequest, errors.New("post_idは整数のみです"))
+	}
+
+	// 再送された場合は先に作ったコメントへ移動する
+	claim, replay, err := claimIdempotencyKey(r.Context(), me.ID, "comment:"+strconv.Itoa(postID), requestIdempotencyKey(r))
+	if err != nil {
+		return err
+	}
+	if replay != "" {
+		redirect(w, r, replay, http.StatusFound)
+		return nil
+	}
+	defer claim.release(context.WithoutCancel(r.Context()))
+
+	text := r.FormValue("comment")
+	if err := validateComment(text); err != nil {
+		addErrorFlash(w, r, err)
+
+		redirect(w, r, fmt.Sprintf("/posts/%d", postID), http.StatusFound)
+		return nil
 	}
 
-	query := "INSERT INTO `comments` (`post_id`, `user_id`, `comment`) VALUES (?,?,?)"
-	_, err = db.Exec(query, postID, me.ID, r.FormValue("comment"))
+	comment, err := createComment(r.Context(), postID, me, text)
 	if err != nil {
-		log.Print(err)
-		return
+		return err
 	}
 
-	http.Redirect(w, r, fmt.Sprintf("/posts/%d", postID), http.StatusFound)
+	location := commentRedirectURL(r, postID, comment.ID)
+	claim.complete(context.WithoutCancel(r.Context()), location)
+
+	redirect(w, r, location, http.StatusFound)
+	return nil
+}
+
+// コメント投稿後の戻り先
+// インデックスから投稿された場合は元の位置（cursor）へ、それ以外は投稿ページのコメントへ戻す
+func commentRedirectURL(r *http.Request, postID, commentID int) string {
+	anchor := fmt.Sprintf("#comment_%d", commentID)
+
+	if ref, err := url.Parse(r.Referer()); err == nil && ref.Path == appPath("/") && (ref.Host == "" || ref.Host == r.Host) {
+		if cursor, ok := parseCursor(r.FormValue("cursor")); ok {
+			return "/?cursor=" + url.QueryEscape(cursor.Format(ISO8601Format)) + anchor
+		}
+	}
+
+	return fmt.Sprintf("/posts/%d", postID) + anchor
+}
+
+// ページ位置を表すcursor（投稿のcreated_at）をパースする
+func parseCursor(s string) (time.Time, bool) {
+	if s == "" {
+		return time.Time{}, false
+	}
+	t, err := time.Parse(ISO8601Format, s)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return t, true
 }
 
-func getAdminBanned(w http.ResponseWriter, r *http.Request) {
-	me := getSessionUser(r)
+func getAdminBanned(w http.ResponseWriter, r *http.Request) error {
+	me := currentUser(r)
 	if !isLogin(me) {
-		http.Redirect(w, r, "/", http.StatusFound)
-		return
+		redirect(w, r, "/", http.StatusFound)
+		return nil
 	}
 
 	if me.Authority == 0 {
-		w.WriteHeader(http.StatusForbidden)
-		return
+		return errForbidden
 	}
 
 	users := []User{}
-	err := db.Select(&users, "SELECT * FROM `users` WHERE `authority` = 0 AND `del_flg` = 0 ORDER BY `created_at` DESC")
+	err := db.SelectContext(r.Context(), &users, "SELECT * FROM `users` WHERE `authority` = 0 AND `del_flg` = 0 ORDER BY `created_at` DESC")
 	if err != nil {
-		log.Print(err)
-		return
-	}
-
-	template.Must(template.ParseFiles(
-		getTemplPath("layout.html"),
-		getTemplPath("banned.html")),
-	).Execute(w, struct {
-		Users     []User
-		Me        User
-		CSRFToken string
-	}{users, me, getCSRFToken(r)})
+		return err
+	}
+
+	return renderTemplate(w, r, http.StatusOK, templates.banned, "layout.html", newViewData(w, r).With("Users", users))
 }
 
-func postAdminBanned(w http.ResponseWriter, r *http.Request) {
-	me := getSessionUser(r)
+func postAdminBanned(w http.ResponseWriter, r *http.Request) error {
+	me := currentUser(r)
 	if !isLogin(me) {
-		http.Redirect(w, r, "/", http.StatusFound)
-		return
+		redirect(w, r, "/", http.StatusFound)
+		return nil
 	}
 
 	if me.Authority == 0 {
-		w.WriteHeader(http.StatusForbidden)
-		return
+		return errForbidden
 	}
 
-	if r.FormValue("csrf_token") != getCSRFToken(r) {
-		w.WriteHeader(http.StatusUnprocessableEntity)
-		return
+	if !validCSRFToken(r, r.FormValue("csrf_token")) {
+		return errInvalidCSRFToken
 	}
 
 	query := "UPDATE `users` SET `del_flg` = ? WHERE `id` = ?"
 
 	err := r.ParseForm()
 	if err != nil {
-		log.Print(err)
-		return
+		return err
 	}
 
 	for _, id := range r.Form["uid[]"] {
-		db.Exec(query, 1, id)
+		uid, err := strconv.Atoi(id)
+		if err != nil {
+			continue
+		}
+		if _, err := db.ExecContext(context.WithoutCancel(r.Context()), query, 1, uid); err != nil {
+			return err
+		}
+		if _, err := db.ExecContext(context.WithoutCancel(r.Context()), "INSERT IGNORE INTO `user_bans` (`user_id`) VALUES (?)", uid); err != nil {
+			return err
+		}
+		events.Publish(UserBanned{UserID: uid})
+	}
+	if len(r.Form["uid[]"]) > 0 {
+		addFlash(w, r, flashSuccess, fmt.Sprintf("%d件のユーザーをBANしました", len(r.Form["uid[]"])))
 	}
 
-	http.Redirect(w, r, "/admin/banned", http.StatusFound)
+	// BAN逃れの一覧などから送られた場合は元のページに戻す
+	location := "/admin/banned"
+	if returnTo := r.FormValue("return_to"); strings.HasPrefix(returnTo, "/admin/") {
+		location = returnTo
+	}
+	redirect(w, r, location, http.StatusFound)
+	return nil
 }
 
 func main() {
-	host := os.Getenv("ISUCONP_DB_HOST")
-	if host == "" {
-		host = "localhost"
-	}
-	port := os.Getenv("ISUCONP_DB_PORT")
-	if port == "" {
-		port = "3306"
-	}
-	_, err := strconv.Atoi(port)
+	setupGC()
+
+	_, err := strconv.Atoi(dbConn.Port)
 	if err != nil {
-		log.Fatalf("Failed to read DB port number from an environment variable ISUCONP_DB_PORT.\nError: %s", err.Error())
-	}
-	user := os.Getenv("ISUCONP_DB_USER")
-	if user == "" {
-		user = "root"
-	}
-	password := os.Getenv("ISUCONP_DB_PASSWORD")
-	dbname := os.Getenv("ISUCONP_DB_NAME")
-	if dbname == "" {
-		dbname = "isuconp"
+		logger("db").Error("failed to read DB port number from ISUCONP_DB_PORT", "err", err)
+		os.Exit(1)
 	}
 
 	dsn := fmt.Sprintf(
 		"%s:%s@tcp(%s:%s)/%s?charset=utf8mb4&parseTime=true&loc=Local",
-		user,
-		password,
-		host,
-		port,
-		dbname,
+		dbConn.User,
+		dbConn.Password,
+		dbConn.Host,
+		dbConn.Port,
+		dbConn.Name,
 	)
 
-	db, err = sqlx.Open("mysql", dsn)
+	db, err = openDB(dsn)
 	if err != nil {
-		log.Fatalf("Failed to connect to DB: %s.", err.Error())
+		logger("db").Error("failed to connect to DB", "err", err)
+		os.Exit(1)
 	}
 	defer db.Close()
 
-	r := chi.NewRouter()
+	// isuconp doctor: 起動に必要なものを確かめて結果を表示するだけで、サーバーは起動しない
+	if len(os.Args) > 1 && os.Args[1] == "doctor" {
+		os.Exit(runDoctor(os.Stdout))
+	}
+
+	if err := dbMigrate(); err != nil {
+		logger("db").Error("failed to migrate DB", "err", err)
+		os.Exit(1)
+	}
+	// リクエストの途中で失敗しないよう、必要なものが揃っていなければ起動しない
+	if config.StartupCheck && !startupCheck() {
+		os.Exit(1)
+	}
+
+	subscribeCacheInvalidation()
+	subscribeIndexCache()
+	subscribeLastModified()
+	subscribeCommentCache()
+	subscribeUserCache()
+	subscribeFollowSuggestions()
+	subscribeRelatedPosts()
+	registerPostFragmentInvalidation()
+	registerSettingsInvalidation()
+	registerAnnouncementInvalidation()
+	subscribeVerification()
+	subscribeSubscriptionMatcher()
+	subscribeActivityCache()
 
-	r.Get("/initialize", getInitialize)
-	r.Get("/login", getLogin)
-	r.Post("/login", postLogin)
-	r.Get("/register", getRegister)
-	r.Post("/register", postRegister)
-	r.Get("/logout", getLogout)
-	r.Get("/", getIndex)
-	r.Get("/posts", getPosts)
-	r.Get("/posts/{id}", getPostsID)
-	r.Post("/", postIndex)
-	r.Get("/image/{id}.{ext}", getImage)
-	r.Post("/comment", postComment)
-	r.Get("/admin/banned", getAdminBanned)
-	r.Post("/admin/banned", postAdminBanned)
-	r.Get(`/@{accountName:[a-zA-Z]+}`, getAccountName)
-	r.Get("/*", func(w http.ResponseWriter, r *http.Request) {
-		http.FileServer(http.Dir("../public")).ServeHTTP(w, r)
+	r := chi.NewRouter()
+	r.Use(withForwardedHeaders)
+	r.Use(withRequestID)
+	r.Use(withRecovery)
+	r.Use(withRouteStats)
+	r.Use(withSlowRequestLog)
+	r.Use(withLoadShedding)
+	r.Use(withCanonicalURL)
+	r.Use(withCrawlerThrottle)
+	r.Use(withLayoutData)
+
+	// 画像アップロードだけは大きなボディと長めのタイムアウトを許可する
+	r.With(withRouteLimit(uploadRouteLimit), withReadOnlyGuard, withDBPriority).Method(http.MethodPost, "/", handler(postIndex))
+	r.With(withRouteLimit(uploadRouteLimit), withReadOnlyGuard, withDBPriority).Method(http.MethodPost, "/welcome", handler(postWelcome))
+	r.With(withRouteLimit(backupRouteLimit)).Method(http.MethodPost, "/admin/backup", handler(postAdminBackup))
+
+	r.Group(func(r chi.Router) {
+		r.Use(withRouteLimit(defaultRouteLimit))
+		r.Use(withDBPriority)
+
+		// フォームを含むページは初回訪問時にCSRFトークンを発行する
+		r.Group(func(r chi.Router) {
+			r.Use(withCSRFToken)
+			r.Use(withOnlineTracking)
+
+			r.Method(http.MethodGet, "/login", handler(getLogin))
+			r.Method(http.MethodGet, "/register", handler(getRegister))
+			r.Method(http.MethodGet, "/appeal", handler(getAppeal))
+			r.Method(http.MethodGet, "/", handler(getIndex))
+			r.Method(http.MethodGet, "/posts/{id}", handler(getPostsID))
+			r.Method(http.MethodGet, "/admin/banned", handler(getAdminBanned))
+			r.Method(http.MethodGet, "/admin/settings", handler(getAdminSettings))
+			r.Method(http.MethodGet, "/admin/invites", handler(getAdminInvites))
+			r.Method(http.MethodGet, "/admin/perf", handler(getAdminPerf))
+			r.Method(http.MethodGet, "/admin/evasion", handler(getAdminEvasion))
+			r.Method(http.MethodGet, "/admin/moderation", handler(getAdminModeration))
+			r.Method(http.MethodGet, "/admin/announcements", handler(getAdminAnnouncements))
+			r.Method(http.MethodGet, "/admin/backup", handler(getAdminBackup))
+			r.Method(http.MethodGet, "/subscriptions", handler(getSubscriptions))
+			r.Method(http.MethodGet, "/welcome", handler(getWelcome))
+			r.Method(http.MethodGet, "/@{accountName:"+accountNamePattern+"}", handler(getAccountName))
+		})
+
+		r.Method(http.MethodGet, "/initialize", handler(getInitialize))
+		r.Method(http.MethodGet, "/initialize/status", handler(getInitializeStatus))
+		r.Method(http.MethodGet, "/robots.txt", handler(getRobotsTxt))
+		r.Method(http.MethodPost, "/login", handler(postLogin))
+		r.With(withReadOnlyGuard).Method(http.MethodPost, "/register", handler(postRegister))
+		r.With(withReadOnlyGuard).Method(http.MethodPost, "/appeal", handler(postAppeal))
+		r.Method(http.MethodGet, "/logout", handler(getLogout))
+		r.Method(http.MethodGet, "/posts", handler(getPosts))
+		r.Method(http.MethodGet, "/p/{id:[0-9A-Za-z]+}", handler(getShortPermalink))
+		r.With(withSurrogateControl("image")).Method(http.MethodGet, "/image/{id}.{ext}", handler(getImage))
+		r.With(withSurrogateControl("image")).Method(http.MethodGet, "/image/{id}/square.{ext}", handler(getImageSquare))
+		r.Method(http.MethodGet, "/avatar/{id}.{ext}", handler(getAvatar))
+		r.With(withReadOnlyGuard).Method(http.MethodPost, "/comment", handler(postComment))
+		r.Method(http.MethodPost, "/beacon", handler(postBeacon))
+		r.With(withSurrogateControl("timeline")).Method(http.MethodGet, "/api/v1/timeline", handler(getAPITimeline))
+		r.With(withSurrogateControl("user_stats")).Method(http.MethodGet, "/api/v1/users/{accountName}/stats", handler(getAPIUserStats))
+		r.With(withSurrogateControl("user_activity")).Method(http.MethodGet, "/api/v1/users/{accountName}/activity", handler(getAPIUserActivity))
+		r.With(withSurrogateControl("timeline")).Method(http.MethodGet, "/api/v1/posts", handler(getAPIPosts))
+		r.Method(http.MethodGet, "/api/v1/posts/trending", handler(getAPITrendingPosts))
+		r.Method(http.MethodGet, "/api/v1/posts/{id}", handler(getAPIPost))
+		r.Method(http.MethodGet, "/api/v1/posts/{id}/comments", handler(getAPIPostComments))
+		r.With(withReadOnlyGuard).Method(http.MethodPost, "/api/v1/posts/{id}/comments", handler(postAPIPostComments))
+		r.With(withReadOnlyGuard).Method(http.MethodPost, "/api/v1/comments", handler(postAPIComments))
+		r.With(withReadOnlyGuard).Method(http.MethodPost, "/api/v1/comments/{id}/votes", handler(postAPICommentVotes))
+		r.Method(http.MethodPost, "/api/v1/tokens", handler(postAPITokens))
+		r.Method(http.MethodGet, "/api/v1/tags", handler(getAPITags))
+		r.Method(http.MethodGet, "/api/v1/limits", handler(getAPILimits))
+		r.Method(http.MethodGet, "/api/v1/suggestions/follows", handler(getAPIFollowSuggestions))
+		r.Method(http.MethodGet, "/api/v1/csrf-token", handler(getAPICSRFToken))
+		r.Method(http.MethodGet, "/api/v1/admin/jobs", handler(getAPIAdminJobs))
+		r.Method(http.MethodGet, "/api/v1/admin/images", handler(getAPIAdminImages))
+		r.Method(http.MethodGet, "/api/v1/admin/perf", handler(getAPIAdminPerf))
+		r.Method(http.MethodPost, "/api/v1/admin/config/reload", handler(postAPIAdminConfigReload))
+		r.Method(http.MethodPut, "/api/v1/admin/users/{accountName}/verified", handler(setAPIAdminUserVerified))
+		r.Method(http.MethodDelete, "/api/v1/admin/users/{accountName}/verified", handler(setAPIAdminUserVerified))
+		r.Method(http.MethodGet, "/api/v1/me/feed.{format}", handler(getAPIMeFeed))
+		r.Method(http.MethodGet, "/.well-known/webfinger", handler(getWebfinger))
+		r.Method(http.MethodGet, "/users/{accountName:"+accountNamePattern+"}", handler(getActivityPubActor))
+		r.With(withSurrogateControl("outbox")).Method(http.MethodGet, "/users/{accountName:"+accountNamePattern+"}/outbox", handler(getActivityPubOutbox))
+		r.Method(http.MethodPost, "/users/{accountName:"+accountNamePattern+"}/inbox", handler(postActivityPubInbox))
+		r.Method(http.MethodPost, "/admin/banned", handler(postAdminBanned))
+		r.Method(http.MethodPost, "/admin/settings", handler(postAdminSettings))
+		r.Method(http.MethodPost, "/admin/invites", handler(postAdminInvites))
+		r.Method(http.MethodPost, "/admin/moderation", handler(postAdminModeration))
+		r.Method(http.MethodPost, "/admin/appeals", handler(postAdminAppeals))
+		r.Method(http.MethodPost, "/admin/announcements", handler(postAdminAnnouncements))
+		r.With(withReadOnlyGuard).Method(http.MethodPost, "/subscriptions", handler(postSubscriptions))
+		r.Method(http.MethodGet, "/@{accountName:"+accountNamePattern+"}/posts", handler(getAccountNamePosts))
+		r.Get("/*", func(w http.ResponseWriter, r *http.Request) {
+			http.FileServer(http.Dir("../public")).ServeHTTP(w, r)
+		})
 	})
 
-	log.Fatal(http.ListenAndServe(":8080", r))
+	server := &http.Server{
+		Handler: withPathPrefix(r),
+		// ルートごとの値はwithRouteLimitで上書きされる
+		ReadHeaderTimeout: 5 * time.Second,
+		ReadTimeout:       defaultRouteLimit.readTimeout,
+		WriteTimeout:      defaultRouteLimit.writeTimeout,
+		IdleTimeout:       120 * time.Second,
+		MaxHeaderBytes:    64 * 1024,
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	startInvalidationWatcher()
+	watchReloadSignal()
+	go runIndexWorker(ctx)
+	go runSubscriptionMatcher(ctx)
+	go runRelatedIndexer(ctx)
+
+	// カウンターは終了時にも書き込むので、サーバーを止めてからジョブの終了を待つ
+	registerJobs()
+	jobsDone := make(chan struct{})
+	go func() {
+		jobs.Run(ctx)
+		close(jobsDone)
+	}()
+
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if err := server.Shutdown(shutdownCtx); err != nil {
+			logger("server").Error("failed to shutdown server", "err", err)
+		}
+	}()
+
+	if err := serveAll(server, config.ListenAddrs); err != nil {
+		logger("server").Error("failed to serve", "err", err)
+		os.Exit(1)
+	}
+	<-jobsDone
 }
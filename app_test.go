@@ -0,0 +1,515 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// makePostsなどのクエリに答えるテスト用のデータ
+// 答えるクエリはfixtureQueriesに本体のクエリの定数で登録したものだけ
+type fixtureTables struct {
+	users         []fixtureRow
+	posts         []fixtureRow
+	comments      []fixtureRow
+	commentCounts map[int]int
+	profiles      []fixtureRow
+}
+
+type fixtureRow map[string]driver.Value
+
+var fixtureTime = time.Date(2024, 4, 1, 12, 0, 0, 0, time.UTC)
+
+func fixtureUser(id int, name string, authority, delFlg int) fixtureRow {
+	return fixtureRow{
+		"id": int64(id), "account_name": name, "passhash": "x", "authority": int64(authority),
+		"del_flg": int64(delFlg), "created_at": fixtureTime.Add(time.Duration(id) * time.Hour),
+	}
+}
+
+func fixturePost(id, userID int) fixtureRow {
+	return fixtureRow{"id": int64(id), "user_id": int64(userID), "mime": "image/jpeg", "imgdata": []byte{}}
+}
+
+func fixtureComment(id, postID, userID, minute int) fixtureRow {
+	return fixtureRow{
+		"id": int64(id), "post_id": int64(postID), "user_id": int64(userID),
+		"comment": fmt.Sprintf("comment %d", id), "created_at": fixtureTime.Add(time.Duration(minute) * time.Minute),
+	}
+}
+
+// ユーザー9は存在せず、ユーザー3はBANされている
+// 投稿11の画像はまだ保存先に書き出していない
+func newFixtureTables() *fixtureTables {
+	post11 := fixturePost(11, 2)
+	post11["mime"], post11["imgdata"] = "image/png", []byte("png in db")
+	return &fixtureTables{
+		users: []fixtureRow{
+			fixtureUser(1, "alice", 0, 0),
+			fixtureUser(2, "bob", 1, 0),
+			fixtureUser(3, "carol", 0, 1),
+		},
+		posts: []fixtureRow{
+			fixturePost(10, 1),
+			post11,
+			fixturePost(12, 9),
+			fixturePost(13, 3),
+		},
+		comments: []fixtureRow{
+			fixtureComment(100, 10, 2, 1),
+			fixtureComment(101, 10, 1, 2),
+			fixtureComment(102, 10, 9, 3),
+			fixtureComment(103, 10, 2, 4),
+			fixtureComment(110, 11, 1, 5),
+		},
+		commentCounts: map[int]int{10: 4, 11: 1},
+		profiles: []fixtureRow{
+			{"user_id": int64(1), "avatar_mime": "image/png"},
+		},
+	}
+}
+
+func (f *fixtureTables) user(id int64) (fixtureRow, bool) {
+	i := slices.IndexFunc(f.users, func(u fixtureRow) bool { return u["id"] == id })
+	if i < 0 {
+		return nil, false
+	}
+	return f.users[i], true
+}
+
+func argIDs(args []driver.Value) []int64 {
+	ids := make([]int64, 0, len(args))
+	for _, a := range args {
+		ids = append(ids, a.(int64))
+	}
+	return ids
+}
+
+func filterRows(rows []fixtureRow, col string, ids []int64) []fixtureRow {
+	found := []fixtureRow{}
+	for _, row := range rows {
+		if slices.Contains(ids, row[col].(int64)) {
+			found = append(found, row)
+		}
+	}
+	return found
+}
+
+// 投稿ごとの投稿者とコメント数
+func (f *fixtureTables) postUsers(args []driver.Value) []fixtureRow {
+	rows := []fixtureRow{}
+	for _, p := range filterRows(f.posts, "id", argIDs(args)) {
+		id := p["id"].(int64)
+		rows = append(rows, fixtureRow{"post_id": id, "comment_count": int64(f.commentCounts[int(id)]), "user_id": p["user_id"]})
+	}
+	return rows
+}
+
+// 投稿ごとのコメント。limitが0でなければ最新のlimit件に絞ってから、SQLと同じくユーザーとJOINする
+func (f *fixtureTables) postComments(args []driver.Value, limit int) []fixtureRow {
+	ids := argIDs(args)
+	byPost := map[int64][]fixtureRow{}
+	for _, c := range f.comments {
+		if pid := c["post_id"].(int64); slices.Contains(ids, pid) {
+			byPost[pid] = append(byPost[pid], c)
+		}
+	}
+	selected := []fixtureRow{}
+	for _, cs := range byPost {
+		if limit > 0 && len(cs) > limit {
+			cs = cs[len(cs)-limit:]
+		}
+		selected = append(selected, cs...)
+	}
+	slices.SortFunc(selected, func(a, b fixtureRow) int {
+		return a["created_at"].(time.Time).Compare(b["created_at"].(time.Time))
+	})
+
+	rows := []fixtureRow{}
+	for _, c := range selected {
+		u, ok := f.user(c["user_id"].(int64))
+		if !ok {
+			continue
+		}
+		row := fixtureRow{}
+		for k, v := range c {
+			row[k] = v
+		}
+		for k, v := range u {
+			row["user."+k] = v
+		}
+		rows = append(rows, row)
+	}
+	return rows
+}
+
+// クエリが返す列と、その行
+type fixtureQuery struct {
+	cols []string
+	rows func(f *fixtureTables, args []driver.Value) []fixtureRow
+}
+
+var (
+	userTableColumns  = []string{"id", "account_name", "passhash", "authority", "del_flg", "created_at"}
+	commentRowColumns = []string{
+		"id", "post_id", "user_id", "comment", "created_at",
+		"user.id", "user.account_name", "user.authority", "user.del_flg", "user.created_at",
+	}
+)
+
+// 本体のクエリと一字一句同じものにだけ答える
+var fixtureQueries = map[string]fixtureQuery{
+	usersByIDsQuery: {userTableColumns, func(f *fixtureTables, args []driver.Value) []fixtureRow {
+		return filterRows(f.users, "id", argIDs(args))
+	}},
+	postUsersQuery: {[]string{"post_id", "comment_count", "user_id"}, (*fixtureTables).postUsers},
+	postCommentsQuery: {commentRowColumns, func(f *fixtureTables, args []driver.Value) []fixtureRow {
+		return f.postComments(args, 0)
+	}},
+	latestPostCommentsQuery: {commentRowColumns, func(f *fixtureTables, args []driver.Value) []fixtureRow {
+		last := len(args) - 1
+		return f.postComments(args[:last], int(args[last].(int64)))
+	}},
+	commentScoresQuery: {[]string{"comment_id", "score"}, func(*fixtureTables, []driver.Value) []fixtureRow {
+		return nil
+	}},
+	postImageQuery: {[]string{"mime", "imgdata"}, func(f *fixtureTables, args []driver.Value) []fixtureRow {
+		return filterRows(f.posts, "id", argIDs(args))
+	}},
+	livePostsQuery: {[]string{"id", "mime"}, func(f *fixtureTables, args []driver.Value) []fixtureRow {
+		return filterRows(f.posts, "id", argIDs(args))
+	}},
+	liveAvatarsQuery: {[]string{"user_id", "avatar_mime"}, func(f *fixtureTables, args []driver.Value) []fixtureRow {
+		return filterRows(f.profiles, "user_id", argIDs(args))
+	}},
+}
+
+// sqlx.InでIN (?)を引数の数だけ展開したクエリを、展開する前のクエリに戻す
+func unexpandIn(q string) string {
+	return strings.ReplaceAll(q, "?, ", "")
+}
+
+type fixtureConnector struct{ tables *fixtureTables }
+
+func (c fixtureConnector) Connect(context.Context) (driver.Conn, error) { return fixtureConn(c), nil }
+func (c fixtureConnector) Driver() driver.Driver                        { return nil }
+
+type fixtureConn struct{ tables *fixtureTables }
+
+func (fixtureConn) Prepare(string) (driver.Stmt, error) { return nil, driver.ErrSkip }
+func (fixtureConn) Close() error                        { return nil }
+func (fixtureConn) Begin() (driver.Tx, error)           { return nil, driver.ErrSkip }
+
+func (c fixtureConn) QueryContext(_ context.Context, q string, named []driver.NamedValue) (driver.Rows, error) {
+	args := make([]driver.Value, 0, len(named))
+	for _, a := range named {
+		args = append(args, a.Value)
+	}
+	fq, ok := fixtureQueries[unexpandIn(q)]
+	if !ok {
+		return nil, fmt.Errorf("unexpected query: %s", q)
+	}
+	rows, cols := fq.rows(c.tables, args), fq.cols
+	values := make([][]driver.Value, 0, len(rows))
+	for _, row := range rows {
+		v := make([]driver.Value, len(cols))
+		for i, col := range cols {
+			val, ok := row[col]
+			if !ok {
+				return nil, fmt.Errorf("fixture has no column %q for query: %s", col, q)
+			}
+			v[i] = val
+		}
+		values = append(values, v)
+	}
+	return &fixtureRows{cols: cols, values: values}, nil
+}
+
+type fixtureRows struct {
+	cols   []string
+	values [][]driver.Value
+}
+
+func (r *fixtureRows) Columns() []string { return r.cols }
+func (r *fixtureRows) Close() error      { return nil }
+func (r *fixtureRows) Next(dest []driver.Value) error {
+	if len(r.values) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.values[0])
+	r.values = r.values[1:]
+	return nil
+}
+
+// キャッシュは常に見つからないものとして扱う
+type missCache struct{}
+
+func (missCache) Get(context.Context, string) ([]byte, error)                       { return nil, errCacheMiss }
+func (missCache) GetMulti(context.Context, []string) (map[string][]byte, error)     { return nil, nil }
+func (missCache) Set(context.Context, string, []byte, time.Duration) error          { return nil }
+func (missCache) SetMulti(context.Context, map[string][]byte, time.Duration) error  { return nil }
+func (missCache) Delete(context.Context, string) error                              { return nil }
+func (missCache) Incr(context.Context, string, int64, time.Duration) (int64, error) { return 0, nil }
+
+func useFixtureDB(t *testing.T, tables *fixtureTables) {
+	t.Helper()
+	origDB, origCache := db, cacheStore
+	db = sqlx.NewDb(sql.OpenDB(fixtureConnector{tables}), "mysql")
+	cacheStore = missCache{}
+	t.Cleanup(func() {
+		db.Close()
+		db, cacheStore = origDB, origCache
+	})
+}
+
+func commentIDs(cs []Comment) []int {
+	ids := []int{}
+	for _, c := range cs {
+		ids = append(ids, c.ID)
+	}
+	return ids
+}
+
+func TestFetchPostComments(t *testing.T) {
+	useFixtureDB(t, newFixtureTables())
+
+	tests := []struct {
+		name         string
+		postIDs      []int
+		commentLimit int
+		want         map[int][]int
+	}{
+		// ユーザーのいないコメントはJOINで落ちる
+		{"all", []int{10, 11}, allComments, map[int][]int{10: {100, 101, 103}, 11: {110}}},
+		// 最新の2件（103と102）から、ユーザーのいない102が落ちる
+		{"latest 2", []int{10, 11}, 2, map[int][]int{10: {103}, 11: {110}}},
+		{"latest 3", []int{10}, 3, map[int][]int{10: {101, 103}}},
+		{"no comments", []int{12}, allComments, map[int][]int{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := fetchPostComments(context.Background(), tt.postIDs, tt.commentLimit)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("got comments for %d posts, want %d", len(got), len(tt.want))
+			}
+			for pid, want := range tt.want {
+				if ids := commentIDs(got[pid]); !slices.Equal(ids, want) {
+					t.Errorf("post %d: got %v, want %v", pid, ids, want)
+				}
+			}
+		})
+	}
+}
+
+// コメントに付けるユーザーの全ての列が読み込まれること
+func TestFetchPostCommentsUser(t *testing.T) {
+	useFixtureDB(t, newFixtureTables())
+
+	got, err := fetchPostComments(context.Background(), []int{10}, allComments)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := got[10][0]
+	want := Comment{
+		ID: 100, PostID: 10, UserID: 2, Comment: "comment 100", CreatedAt: fixtureTime.Add(time.Minute),
+		User: User{ID: 2, AccountName: "bob", Authority: 1, CreatedAt: fixtureTime.Add(2 * time.Hour)},
+	}
+	if c != want {
+		t.Errorf("got %+v, want %+v", c, want)
+	}
+}
+
+func TestFetchPostUsers(t *testing.T) {
+	useFixtureDB(t, newFixtureTables())
+
+	got, err := fetchPostUsers(context.Background(), []int{10, 11, 12, 13})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		postID       int
+		found        bool
+		accountName  string
+		commentCount int
+	}{
+		{10, true, "alice", 4},
+		{11, true, "bob", 1},
+		// 投稿者がいない投稿は含めない
+		{12, false, "", 0},
+		// BANされたユーザーは含め、makePostsで除く
+		{13, true, "carol", 0},
+	}
+	for _, tt := range tests {
+		row, ok := got[tt.postID]
+		if ok != tt.found {
+			t.Errorf("post %d: found = %v, want %v", tt.postID, ok, tt.found)
+			continue
+		}
+		if row.User.AccountName != tt.accountName || row.CommentCount != tt.commentCount {
+			t.Errorf("post %d: got %+v", tt.postID, row)
+		}
+	}
+}
+
+func TestMakePosts(t *testing.T) {
+	useFixtureDB(t, newFixtureTables())
+
+	results := []Post{{ID: 10, UserID: 1}, {ID: 11, UserID: 2}, {ID: 12, UserID: 9}, {ID: 13, UserID: 3}}
+	tests := []struct {
+		name         string
+		commentLimit int
+		want         map[int][]int
+		hasMore      map[int]bool
+	}{
+		{"all comments", allComments, map[int][]int{10: {100, 101, 103}, 11: {110}}, map[int]bool{10: true, 11: false}},
+		{"preview", config.CommentPreviewCount, map[int][]int{10: {101, 103}, 11: {110}}, map[int]bool{10: true, 11: false}},
+		{"latest 1", 1, map[int][]int{10: {103}, 11: {110}}, map[int]bool{10: true, 11: false}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			posts, err := makePosts(context.Background(), results, "token", tt.commentLimit)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// 投稿者のいない投稿とBANされたユーザーの投稿は除く
+			if len(posts) != 2 || posts[0].ID != 10 || posts[1].ID != 11 {
+				t.Fatalf("got posts %+v", posts)
+			}
+			for _, p := range posts {
+				if ids := commentIDs(p.Comments); !slices.Equal(ids, tt.want[p.ID]) {
+					t.Errorf("post %d: got comments %v, want %v", p.ID, ids, tt.want[p.ID])
+				}
+				if p.HasMoreComments != tt.hasMore[p.ID] {
+					t.Errorf("post %d: HasMoreComments = %v", p.ID, p.HasMoreComments)
+				}
+				if p.User.ID != p.UserID || p.CSRFToken != "token" {
+					t.Errorf("post %d: got user %+v, token %q", p.ID, p.User, p.CSRFToken)
+				}
+			}
+		})
+	}
+}
+
+// Userに列を足したときに、コメントのユーザーで読み込み忘れないようにする
+// パスワードのハッシュは一覧で使わないので読み込まない
+func TestPostUserColumnsCoverUser(t *testing.T) {
+	m := sqlx.NewDb(nil, "mysql").Mapper
+	for _, f := range m.TypeMap(reflect.TypeFor[User]()).Index {
+		if f.Name == "" || f.Name == "passhash" || len(f.Index) != 1 {
+			continue
+		}
+		if !strings.Contains(postUserColumns, "u.`"+f.Name+"` AS `user."+f.Name+"`") {
+			t.Errorf("postUserColumns does not select %q", f.Name)
+		}
+	}
+}
+
+func TestFetchImage(t *testing.T) {
+	useFixtureDB(t, newFixtureTables())
+	origStore := imageStore
+	imageStore = &fsImageStore{dir: t.TempDir()}
+	t.Cleanup(func() { imageStore = origStore })
+
+	ctx := context.Background()
+	for _, pid := range []int{10, 99} {
+		if err := putPostImage(ctx, pid, "image/jpeg", []byte(fmt.Sprintf("jpeg %d", pid))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name    string
+		postID  int
+		ext     string
+		want    string
+		wantErr error
+	}{
+		{"stored", 10, "jpg", "jpeg 10", nil},
+		{"not exported", 11, "png", "png in db", nil},
+		// 拡張子が投稿のMIMEタイプと違う
+		{"wrong ext", 10, "png", "", errNotFound},
+		{"unknown ext", 10, "bmp", "", errNotFound},
+		// 保存先に残っていても、投稿が無ければ配信しない
+		{"deleted post", 99, "jpg", "", errNotFound},
+		// 投稿はあるが保存先に画像が無い
+		{"missing blob", 13, "jpg", "", errNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := fetchImage(ctx, tt.postID, tt.ext)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("got error %v, want %v", err, tt.wantErr)
+			}
+			if string(got) != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// 2回続けて孤立していた画像だけを消す
+func TestSweepOrphanImages(t *testing.T) {
+	useFixtureDB(t, newFixtureTables())
+	origStore, origDryRun, origCandidates := imageStore, config.ImageGCDryRun, orphanImageCandidates
+	imageStore = &fsImageStore{dir: t.TempDir()}
+	orphanImageCandidates = map[string]bool{}
+	t.Cleanup(func() {
+		imageStore, config.ImageGCDryRun, orphanImageCandidates = origStore, origDryRun, origCandidates
+	})
+
+	ctx := context.Background()
+	live := []string{"10.jpg", "10.webp", "11.png", "avatars/1.png"}
+	orphans := []string{"10.png", "99.jpg", "99.webp", "avatars/1.jpg", "avatars/2.png"}
+	for _, key := range append(append([]string{"README"}, live...), orphans...) {
+		if err := imageStore.Put(ctx, key, []byte(key), ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+	storedKeys := func() []string {
+		keys := []string{}
+		for _, dir := range []string{"", "avatars/"} {
+			list, err := imageStore.List(ctx, dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			keys = append(keys, list...)
+		}
+		slices.Sort(keys)
+		return keys
+	}
+	all := storedKeys()
+
+	tests := []struct {
+		name   string
+		dryRun bool
+		want   []string
+	}{
+		{"first run", false, all},
+		{"dry run", true, all},
+		{"second run", false, append([]string{"README"}, live...)},
+	}
+	for _, tt := range tests {
+		config.ImageGCDryRun = tt.dryRun
+		if err := sweepOrphanImages(ctx); err != nil {
+			t.Fatal(err)
+		}
+		want := slices.Clone(tt.want)
+		slices.Sort(want)
+		if got := storedKeys(); !slices.Equal(got, want) {
+			t.Errorf("%s: got %v, want %v", tt.name, got, want)
+		}
+	}
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+	"unicode/utf8"
+
+	"github.com/catatsuy/private-isu/webapp/golang/apperror"
+)
+
+const (
+	appealPending  = "pending"
+	appealAccepted = "accepted"
+	appealDeclined = "declined"
+
+	// 異議申し立ての本文の最大文字数
+	appealMaxLength = 1000
+)
+
+// BANされたユーザーからの異議申し立て
+type banAppeal struct {
+	ID         int          `db:"id"`
+	UserID     int          `db:"user_id"`
+	Message    string       `db:"message"`
+	Status     string       `db:"status"`
+	CreatedAt  time.Time    `db:"created_at"`
+	ReviewedAt sql.NullTime `db:"reviewed_at"`
+	User       User         `db:"-"`
+}
+
+// BANされたユーザーのアカウント名とパスワードが正しいか
+// ログインはさせず、異議申し立てのページだけを使えるようにする
+func tryBannedLogin(ctx context.Context, accountName, password string) (*User, error) {
+	u := User{}
+	err := db.GetContext(ctx, &u, "SELECT * FROM `users` WHERE `account_name` = ? AND `del_flg` = 1", accountName)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, apperror.Internal(err)
+	}
+	if calculatePasshash(u.AccountName, password) != u.Passhash {
+		return nil, nil
+	}
+	return &u, nil
+}
+
+// 異議申し立てのページを使えるユーザー（ログインを試みたBAN済みのユーザー）のID
+func appealUserID(r *http.Request) int {
+	id, _ := getSession(r).Values["appeal_user_id"].(int)
+	return id
+}
+
+func latestAppeal(ctx context.Context, userID int) (banAppeal, bool, error) {
+	a := banAppeal{}
+	err := db.GetContext(ctx, &a, "SELECT * FROM `ban_appeals` WHERE `user_id` = ? ORDER BY `id` DESC LIMIT 1", userID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return a, false, nil
+	}
+	return a, err == nil, err
+}
+
+func getAppeal(w http.ResponseWriter, r *http.Request) error {
+	uid := appealUserID(r)
+	if uid == 0 {
+		redirect(w, r, "/login", http.StatusFound)
+		return nil
+	}
+	u, err := getUserByID(r.Context(), uid)
+	if err != nil {
+		return err
+	}
+	appeal, found, err := latestAppeal(r.Context(), uid)
+	if err != nil {
+		return err
+	}
+
+	data := newViewData(w, r).With("BannedUser", u).With("MaxLength", appealMaxLength)
+	if found {
+		data.With("Appeal", appeal)
+	}
+	return renderTemplate(w, r, http.StatusOK, templates.appeal, "layout.html", data)
+}
+
+func postAppeal(w http.ResponseWriter, r *http.Request) error {
+	uid := appealUserID(r)
+	if uid == 0 {
+		redirect(w, r, "/login", http.StatusFound)
+		return nil
+	}
+
+	if !validCSRFToken(r, r.FormValue("csrf_token")) {
+		return errInvalidCSRFToken
+	}
+
+	message := r.FormValue("message")
+	switch {
+	case message == "":
+		addFlash(w, r, flashError, "理由を入力してください")
+	case utf8.RuneCountInString(message) > appealMaxLength || !validText(message):
+		addFlash(w, r, flashError, "理由は"+strconv.Itoa(appealMaxLength)+"文字以内で入力してください")
+	default:
+		appeal, found, err := latestAppeal(r.Context(), uid)
+		if err != nil {
+			return err
+		}
+		if found && appeal.Status == appealPending {
+			addFlash(w, r, flashError, "申し立ては審査中です")
+			break
+		}
+		_, err = db.ExecContext(context.WithoutCancel(r.Context()), "INSERT INTO `ban_appeals` (`user_id`, `message`, `status`) VALUES (?,?,?)", uid, message, appealPending)
+		if err != nil {
+			return err
+		}
+		addFlash(w, r, flashSuccess, "異議申し立てを受け付けました")
+	}
+
+	redirect(w, r, "/appeal", http.StatusFound)
+	return nil
+}
+
+// 審査待ちの異議申し立て（古い順）
+func fetchPendingAppeals(ctx context.Context) ([]banAppeal, error) {
+	appeals := []banAppeal{}
+	err := db.SelectContext(ctx, &appeals, "SELECT * FROM `ban_appeals` WHERE `status` = ? ORDER BY `id` LIMIT ?", appealPending, moderationQueueLimit)
+	if err != nil {
+		return nil, err
+	}
+	userIDs := make([]int, 0, len(appeals))
+	for _, a := range appeals {
+		userIDs = append(userIDs, a.UserID)
+	}
+	users, err := getUsersByIDs(ctx, userIDs)
+	if err != nil {
+		return nil, err
+	}
+	for i := range appeals {
+		appeals[i].User = users[appeals[i].UserID]
+	}
+	return appeals, nil
+}
+
+// 異議申し立てを認めてBANを解除する
+func acceptAppeal(ctx context.Context, appealID int) error {
+	tx, err := db.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var userID int
+	err = tx.GetContext(ctx, &userID, "SELECT `user_id` FROM `ban_appeals` WHERE `id` = ? AND `status` = ? FOR UPDATE", appealID, appealPending)
+	if errors.Is(err, sql.ErrNoRows) {
+		return apperror.NotFound("審査中の異議申し立てが見つかりません")
+	}
+	if err != nil {
+		return err
+	}
+	sqls := []string{
+		"UPDATE `users` SET `del_flg` = 0 WHERE `id` = ?",
+		"DELETE FROM `user_bans` WHERE `user_id` = ?",
+	}
+	for _, q := range sqls {
+		if _, err := tx.ExecContext(ctx, q, userID); err != nil {
+			return err
+		}
+	}
+	_, err = tx.ExecContext(ctx, "UPDATE `ban_appeals` SET `status` = ?, `reviewed_at` = NOW() WHERE `id` = ?", appealAccepted, appealID)
+	if err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	events.Publish(UserUnbanned{UserID: userID})
+	return nil
+}
+
+func declineAppeal(appealID int) error {
+	res, err := db.Exec(
+		"UPDATE `ban_appeals` SET `status` = ?, `reviewed_at` = NOW() WHERE `id` = ? AND `status` = ?",
+		appealDeclined, appealID, appealPending,
+	)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return apperror.NotFound("審査中の異議申し立てが見つかりません")
+	}
+	return nil
+}
+
+// 異議申し立ての承認（action=accept）と却下（action=decline）
+func postAdminAppeals(w http.ResponseWriter, r *http.Request) error {
+	me := currentUser(r)
+	if !isLogin(me) {
+		redirect(w, r, "/", http.StatusFound)
+		return nil
+	}
+
+	if me.Authority == 0 {
+		return errForbidden
+	}
+
+	if !validCSRFToken(r, r.FormValue("csrf_token")) {
+		return errInvalidCSRFToken
+	}
+
+	appealID, err := strconv.Atoi(r.FormValue("appeal_id"))
+	if err != nil {
+		return newHTTPError(http.StatusBadRequest, err)
+	}
+
+	switch r.FormValue("action") {
+	case "accept":
+		if err := acceptAppeal(r.Context(), appealID); err != nil {
+			return err
+		}
+		addFlash(w, r, flashSuccess, "異議申し立てを認めてBANを解除しました")
+	case "decline":
+		if err := declineAppeal(appealID); err != nil {
+			return err
+		}
+		addFlash(w, r, flashSuccess, "異議申し立てを却下しました")
+	default:
+		return newHTTPError(http.StatusBadRequest, errors.New("unknown action"))
+	}
+
+	redirect(w, r, "/admin/moderation", http.StatusFound)
+	return nil
+}
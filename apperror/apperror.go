@@ -0,0 +1,119 @@
+// Package apperror はハンドラーやDBの処理が返すエラーの種類を表す
+// 利用者に見せるメッセージと、ログにだけ出す原因を分けて持つ
+package apperror
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// エラーの種類。ステータスコードはこれで決まる
+type Kind int
+
+const (
+	// 予期しないエラー。原因は利用者に見せない
+	KindInternal Kind = iota
+	KindNotFound
+	KindForbidden
+	// 入力の誤り。メッセージをそのまま利用者に見せる
+	KindValidation
+)
+
+func (k Kind) Status() int {
+	switch k {
+	case KindNotFound:
+		return http.StatusNotFound
+	case KindForbidden:
+		return http.StatusForbidden
+	case KindValidation:
+		return http.StatusUnprocessableEntity
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+func (k Kind) String() string {
+	switch k {
+	case KindNotFound:
+		return "not_found"
+	case KindForbidden:
+		return "forbidden"
+	case KindValidation:
+		return "validation"
+	default:
+		return "internal"
+	}
+}
+
+type Error struct {
+	Kind Kind
+	// 利用者に見せるメッセージ。空の場合はステータスコードの説明を使う
+	Message string
+	// ログにだけ出す原因
+	Err error
+}
+
+func (e *Error) Error() string {
+	switch {
+	case e.Err == nil && e.Message == "":
+		return http.StatusText(e.Kind.Status())
+	case e.Err == nil:
+		return e.Message
+	case e.Message == "":
+		return e.Err.Error()
+	default:
+		return e.Message + ": " + e.Err.Error()
+	}
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// メッセージも原因も持たないErrorは種類だけを比べる
+// errors.Is(err, errNotFound)のように、種類の判定に使える
+func (e *Error) Is(target error) bool {
+	t, ok := target.(*Error)
+	return ok && t.Message == "" && t.Err == nil && t.Kind == e.Kind
+}
+
+func NotFound(message string) *Error {
+	return &Error{Kind: KindNotFound, Message: message}
+}
+
+func Forbidden(message string) *Error {
+	return &Error{Kind: KindForbidden, Message: message}
+}
+
+func Validation(message string) *Error {
+	return &Error{Kind: KindValidation, Message: message}
+}
+
+func Validationf(format string, args ...any) *Error {
+	return Validation(fmt.Sprintf(format, args...))
+}
+
+// 予期しないエラーを包む。利用者にはステータスコードの説明だけを見せる
+func Internal(err error) *Error {
+	return &Error{Kind: KindInternal, Err: err}
+}
+
+// errの種類。Errorを含まないエラーは予期しないものとして扱う
+func KindOf(err error) Kind {
+	var e *Error
+	if errors.As(err, &e) {
+		return e.Kind
+	}
+	return KindInternal
+}
+
+// 利用者に見せてよいメッセージ
+// 予期しないエラーや、Errorを含まないエラーの原因は見せない
+func UserMessage(err error) string {
+	var e *Error
+	if !errors.As(err, &e) || e.Kind == KindInternal || e.Message == "" {
+		return http.StatusText(KindOf(err).Status())
+	}
+	return e.Message
+}
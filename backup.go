@@ -0,0 +1,286 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// バックアップ全体の制限時間
+	backupTimeout = time.Hour
+	// 進み具合を書き出す間隔
+	backupProgressInterval = 2 * time.Second
+)
+
+// バックアップは時間がかかるので、書き込みのタイムアウトを長くする
+var backupRouteLimit = routeLimit{
+	readTimeout:  10 * time.Second,
+	writeTimeout: backupTimeout,
+	maxBodyBytes: 1 * 1024 * 1024,
+}
+
+// バックアップの取り方（ISUCONP_BACKUP_STRATEGYで選ぶ）
+type backupStrategy interface {
+	Name() string
+	// progressに進み具合を書きながらバックアップを取り、保存先（ファイルのパスやスナップショットのID）を返す
+	Run(ctx context.Context, progress io.Writer) (string, error)
+}
+
+// 設定されたバックアップの取り方。offの場合や設定が足りない場合はnil
+func newBackupStrategy() backupStrategy {
+	switch config.BackupStrategy {
+	case "mysqldump":
+		return mysqldumpBackup{dir: config.BackupDir, conn: dbConn}
+	case "snapshot":
+		if config.BackupSnapshotURL == "" {
+			return nil
+		}
+		return snapshotBackup{url: config.BackupSnapshotURL, token: config.BackupSnapshotToken}
+	default:
+		return nil
+	}
+}
+
+// mysqldumpでdirにSQLのファイルを書き出す
+type mysqldumpBackup struct {
+	dir  string
+	conn dbConnParams
+}
+
+func (mysqldumpBackup) Name() string { return "mysqldump" }
+
+func (b mysqldumpBackup) Run(ctx context.Context, progress io.Writer) (string, error) {
+	if err := os.MkdirAll(b.dir, 0o700); err != nil {
+		return "", err
+	}
+	path := filepath.Join(b.dir, "isuconp-"+time.Now().Format("20060102-150405")+".sql")
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	out := &countingWriter{w: f}
+	cmd := exec.CommandContext(ctx, "mysqldump",
+		"--single-transaction", "--quick",
+		"-h", b.conn.Host, "-P", b.conn.Port, "-u", b.conn.User,
+		b.conn.Name,
+	)
+	// パスワードはコマンドラインに出さない
+	cmd.Env = append(os.Environ(), "MYSQL_PWD="+b.conn.Password)
+	cmd.Stdout = out
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+
+	fmt.Fprintf(progress, "mysqldump: %s に書き出します\n", path)
+	if err := cmd.Start(); err != nil {
+		os.Remove(path)
+		return "", err
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- cmd.Wait() }()
+	ticker := time.NewTicker(backupProgressInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case err := <-done:
+			if err != nil {
+				os.Remove(path)
+				return "", fmt.Errorf("mysqldump: %w: %s", err, bytes.TrimSpace(stderr.Bytes()))
+			}
+			if err := f.Sync(); err != nil {
+				return "", err
+			}
+			fmt.Fprintf(progress, "完了 %.1fMB\n", float64(out.n.Load())/(1024*1024))
+			return path, nil
+		case <-ticker.C:
+			fmt.Fprintf(progress, "%.1fMB\n", float64(out.n.Load())/(1024*1024))
+		}
+	}
+}
+
+type countingWriter struct {
+	w io.Writer
+	n atomic.Int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n.Add(int64(n))
+	return n, err
+}
+
+// クラウドのスナップショットAPIにスナップショットの作成を依頼する
+// APIはPOSTで作成を受け付け、{"id": "...", "status": "..."}を返すものとする
+type snapshotBackup struct {
+	url   string
+	token string
+}
+
+func (snapshotBackup) Name() string { return "snapshot" }
+
+func (b snapshotBackup) Run(ctx context.Context, progress io.Writer) (string, error) {
+	body, err := json.Marshal(map[string]string{"database": dbConn.Name, "reason": "admin backup"})
+	if err != nil {
+		return "", err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, b.url, bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if b.token != "" {
+		req.Header.Set("Authorization", "Bearer "+b.token)
+	}
+
+	fmt.Fprintf(progress, "snapshot: %s に作成を依頼します\n", b.url)
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+	if res.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(res.Body, 1024))
+		return "", fmt.Errorf("snapshot: %s: %s", res.Status, bytes.TrimSpace(msg))
+	}
+
+	var snapshot struct {
+		ID     string `json:"id"`
+		Status string `json:"status"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&snapshot); err != nil {
+		return "", fmt.Errorf("snapshot: %w", err)
+	}
+	fmt.Fprintf(progress, "スナップショット %s（%s）\n", snapshot.ID, snapshot.Status)
+	return snapshot.ID, nil
+}
+
+// バックアップの履歴
+type backupRecord struct {
+	ID         int          `db:"id"`
+	Strategy   string       `db:"strategy"`
+	Status     string       `db:"status"`
+	Location   string       `db:"location"`
+	Error      string       `db:"error"`
+	StartedBy  int          `db:"started_by"`
+	StartedAt  time.Time    `db:"started_at"`
+	FinishedAt sql.NullTime `db:"finished_at"`
+}
+
+// 同時に取るバックアップは1つだけ
+var backupRunning sync.Mutex
+
+// 応答を書くたびに送り出す（進み具合を少しずつ見せる）
+// クライアントが切断しても書き込みの失敗は無視して、バックアップは続ける
+type flushWriter struct {
+	w  io.Writer
+	rc *http.ResponseController
+}
+
+func (f flushWriter) Write(p []byte) (int, error) {
+	f.w.Write(p)
+	f.rc.Flush()
+	return len(p), nil
+}
+
+func getAdminBackup(w http.ResponseWriter, r *http.Request) error {
+	me := currentUser(r)
+	if !isLogin(me) {
+		redirect(w, r, "/", http.StatusFound)
+		return nil
+	}
+
+	if me.Authority == 0 {
+		return errForbidden
+	}
+
+	history := []backupRecord{}
+	if err := db.SelectContext(r.Context(), &history, "SELECT * FROM `backups` ORDER BY `id` DESC LIMIT 50"); err != nil {
+		return err
+	}
+
+	// 設定されていない場合はボタンを出さない
+	name := ""
+	if s := newBackupStrategy(); s != nil {
+		name = s.Name()
+	}
+	data := newViewData(w, r).With("History", history).With("Strategy", name)
+	return renderTemplate(w, r, http.StatusOK, templates.backup, "layout.html", data)
+}
+
+// バックアップを取り、進み具合をテキストで流す
+func postAdminBackup(w http.ResponseWriter, r *http.Request) error {
+	me := currentUser(r)
+	if !isLogin(me) {
+		return errUnauthorized
+	}
+
+	if me.Authority == 0 {
+		return errForbidden
+	}
+
+	if !validCSRFToken(r, requestCSRFToken(r)) {
+		return errInvalidCSRFToken
+	}
+
+	strategy := newBackupStrategy()
+	if strategy == nil {
+		return newHTTPError(http.StatusServiceUnavailable, errors.New("バックアップの取り方が設定されていません"))
+	}
+	if !backupRunning.TryLock() {
+		return newHTTPError(http.StatusConflict, errors.New("バックアップを取っています"))
+	}
+	defer backupRunning.Unlock()
+
+	res, err := db.ExecContext(context.WithoutCancel(r.Context()), "INSERT INTO `backups` (`strategy`, `status`, `error`, `started_by`) VALUES (?, 'running', '', ?)", strategy.Name(), me.ID)
+	if err != nil {
+		return err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return err
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(http.StatusOK)
+	progress := flushWriter{w: w, rc: http.NewResponseController(w)}
+
+	// 画面を閉じても最後まで取る
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(r.Context()), backupTimeout)
+	defer cancel()
+	location, runErr := strategy.Run(ctx, progress)
+
+	status, errMsg := "succeeded", ""
+	if runErr != nil {
+		status, errMsg = "failed", runErr.Error()
+		fmt.Fprintf(progress, "失敗しました: %v\n", runErr)
+	}
+	_, err = db.ExecContext(context.WithoutCancel(r.Context()),
+		"UPDATE `backups` SET `status` = ?, `location` = ?, `error` = ?, `finished_at` = NOW() WHERE `id` = ?",
+		status, location, errMsg, id,
+	)
+	// ヘッダーは送信済みなので、記録の失敗はログと進み具合に残すだけにする
+	if err != nil {
+		logger("backup").Error("failed to record backup", "backup_id", id, "err", err)
+		fmt.Fprintf(progress, "履歴を記録できませんでした: %v\n", err)
+		return nil
+	}
+	if runErr == nil {
+		fmt.Fprintf(progress, "保存先: %s\n", location)
+	}
+	return nil
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"bytes"
+	"sync"
+)
+
+// これより大きくなったバッファはプールに戻さない
+// 大きな画像をエンコードしたバッファを持ち続けないようにする
+const maxPooledBufferSize = 4 * 1024 * 1024
+
+// 画像のエンコードやテンプレートの描画で使うバッファのプール
+var bufferPool = sync.Pool{
+	New: func() any { return new(bytes.Buffer) },
+}
+
+func getBuffer() *bytes.Buffer {
+	buf := bufferPool.Get().(*bytes.Buffer)
+	buf.Reset()
+	return buf
+}
+
+// バッファをプールに戻す。戻した後はbuf.Bytes()の内容を使ってはいけない
+func putBuffer(buf *bytes.Buffer) {
+	if buf.Cap() > maxPooledBufferSize {
+		return
+	}
+	bufferPool.Put(buf)
+}
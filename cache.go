@@ -0,0 +1,206 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/bradfitz/gomemcache/memcache"
+)
+
+var errCacheMiss = errors.New("cache: miss")
+
+// キャッシュやカウンターの保存先
+// ISUCONP_REDIS_ADDRESSが設定されていればRedis、なければmemcachedを使う
+type cacheBackend interface {
+	// ctxはISUCONP_SLOW_REQUEST_MSでリクエストの内訳に数えるために使う
+	Get(ctx context.Context, key string) ([]byte, error)
+	// 見つかったキーの値だけを返す
+	GetMulti(ctx context.Context, keys []string) (map[string][]byte, error)
+	Set(ctx context.Context, key string, value []byte, ttl time.Duration) error
+	SetMulti(ctx context.Context, items map[string][]byte, ttl time.Duration) error
+	Delete(ctx context.Context, key string) error
+	// keyの値をdelta（正の値）だけ増やす。存在しない場合はttl付きで作成する
+	Incr(ctx context.Context, key string, delta int64, ttl time.Duration) (int64, error)
+}
+
+var (
+	cacheStore   cacheBackend
+	redisEnabled bool
+)
+
+// 環境変数からバックエンドを選ぶ
+func setupCacheBackend(memcacheClient *memcache.Client, redisAddr string) {
+	if redisAddr != "" {
+		cacheStore = &redisBackend{client: newRedisClient(redisAddr, 64)}
+		redisEnabled = true
+		return
+	}
+	cacheStore = &memcacheBackend{client: memcacheClient}
+}
+
+// memcachedのバックエンド
+type memcacheBackend struct {
+	client *memcache.Client
+}
+
+func (m *memcacheBackend) Get(_ context.Context, key string) ([]byte, error) {
+	item, err := m.client.Get(key)
+	if errors.Is(err, memcache.ErrCacheMiss) {
+		return nil, errCacheMiss
+	}
+	if err != nil {
+		return nil, err
+	}
+	return item.Value, nil
+}
+
+func (m *memcacheBackend) GetMulti(_ context.Context, keys []string) (map[string][]byte, error) {
+	items, err := m.client.GetMulti(keys)
+	if err != nil {
+		return nil, err
+	}
+	values := make(map[string][]byte, len(items))
+	for key, item := range items {
+		values[key] = item.Value
+	}
+	return values, nil
+}
+
+func (m *memcacheBackend) Set(_ context.Context, key string, value []byte, ttl time.Duration) error {
+	return m.client.Set(&memcache.Item{Key: key, Value: value, Expiration: int32(ttl.Seconds())})
+}
+
+// memcachedには複数のキーをまとめて保存するコマンドがないので1つずつ保存する
+func (m *memcacheBackend) SetMulti(ctx context.Context, items map[string][]byte, ttl time.Duration) error {
+	for key, value := range items {
+		if err := m.Set(ctx, key, value, ttl); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *memcacheBackend) Delete(_ context.Context, key string) error {
+	err := m.client.Delete(key)
+	if errors.Is(err, memcache.ErrCacheMiss) {
+		return nil
+	}
+	return err
+}
+
+func (m *memcacheBackend) Incr(_ context.Context, key string, delta int64, ttl time.Duration) (int64, error) {
+	v, err := m.client.Increment(key, uint64(delta))
+	if err == nil {
+		return int64(v), nil
+	}
+	if !errors.Is(err, memcache.ErrCacheMiss) {
+		return 0, err
+	}
+
+	// 存在しない場合は作成する。他のリクエストと競合した場合はもう一度増やす
+	err = m.client.Add(&memcache.Item{Key: key, Value: []byte(strconv.FormatInt(delta, 10)), Expiration: int32(ttl.Seconds())})
+	if errors.Is(err, memcache.ErrNotStored) {
+		v, err := m.client.Increment(key, uint64(delta))
+		return int64(v), err
+	}
+	if err != nil {
+		return 0, err
+	}
+	return delta, nil
+}
+
+// Redisのバックエンド
+// スコアはsorted setで管理する
+type redisBackend struct {
+	client *redisClient
+}
+
+func (b *redisBackend) Get(_ context.Context, key string) ([]byte, error) {
+	v, err := redisBytes(b.client.Do("GET", key))
+	if errors.Is(err, errRedisNil) {
+		return nil, errCacheMiss
+	}
+	return v, err
+}
+
+func (b *redisBackend) GetMulti(_ context.Context, keys []string) (map[string][]byte, error) {
+	values := make(map[string][]byte, len(keys))
+	if len(keys) == 0 {
+		return values, nil
+	}
+	reply, err := b.client.Do(append([]string{"MGET"}, keys...)...)
+	if err != nil {
+		return nil, err
+	}
+	items, ok := reply.([]any)
+	if !ok || len(items) != len(keys) {
+		return nil, fmt.Errorf("redis: unexpected reply to MGET")
+	}
+	for i, item := range items {
+		v, err := redisBytes(item, nil)
+		if errors.Is(err, errRedisNil) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		values[keys[i]] = v
+	}
+	return values, nil
+}
+
+func (b *redisBackend) Set(_ context.Context, key string, value []byte, ttl time.Duration) error {
+	if ttl > 0 {
+		_, err := b.client.Do("SET", key, string(value), "PX", strconv.FormatInt(ttl.Milliseconds(), 10))
+		return err
+	}
+	_, err := b.client.Do("SET", key, string(value))
+	return err
+}
+
+// 有効期限付きで保存するためMSETではなくSETをパイプラインで送る
+func (b *redisBackend) SetMulti(_ context.Context, items map[string][]byte, ttl time.Duration) error {
+	if len(items) == 0 {
+		return nil
+	}
+	cmds := make([][]string, 0, len(items))
+	for key, value := range items {
+		cmd := []string{"SET", key, string(value)}
+		if ttl > 0 {
+			cmd = append(cmd, "PX", strconv.FormatInt(ttl.Milliseconds(), 10))
+		}
+		cmds = append(cmds, cmd)
+	}
+	_, err := b.client.Pipeline(cmds)
+	return err
+}
+
+func (b *redisBackend) Delete(_ context.Context, key string) error {
+	_, err := b.client.Do("DEL", key)
+	return err
+}
+
+func (b *redisBackend) Incr(_ context.Context, key string, delta int64, ttl time.Duration) (int64, error) {
+	v, err := redisInt(b.client.Do("INCRBY", key, strconv.FormatInt(delta, 10)))
+	if err != nil {
+		return 0, err
+	}
+	// 作成されたときだけ有効期限を付ける
+	if v == delta && ttl > 0 {
+		if _, err := b.client.Do("PEXPIRE", key, strconv.FormatInt(ttl.Milliseconds(), 10)); err != nil {
+			return 0, err
+		}
+	}
+	return v, nil
+}
+
+// 固定ウィンドウでのレート制限用カウンター
+// windowごとにキーを分けて、現在のウィンドウでの回数を返す
+func incrRateCounter(ctx context.Context, name string, window time.Duration) (int64, error) {
+	slot := time.Now().UnixNano() / int64(window)
+	key := fmt.Sprintf("ratelimit:%s:%d", name, slot)
+	return cacheStore.Incr(ctx, key, 1, window)
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"time"
+)
+
+// cacheStoreにgobでシリアライズした値を保存する
+// 投稿やコメントの一覧などGoの値をそのままキャッシュするときに使う
+
+func encodeCacheValue[T any](v T) ([]byte, error) {
+	buf := getBuffer()
+	defer putBuffer(buf)
+	if err := gob.NewEncoder(buf).Encode(v); err != nil {
+		return nil, err
+	}
+	return bytes.Clone(buf.Bytes()), nil
+}
+
+func decodeCacheValue[T any](b []byte) (T, error) {
+	var v T
+	err := gob.NewDecoder(bytes.NewReader(b)).Decode(&v)
+	return v, err
+}
+
+// 値を取得する。ない場合はerrCacheMissを返す
+func cacheGet[T any](ctx context.Context, key string) (T, error) {
+	b, err := cacheStore.Get(ctx, key)
+	if err != nil {
+		var zero T
+		return zero, err
+	}
+	return decodeCacheValue[T](b)
+}
+
+func cacheSet[T any](ctx context.Context, key string, v T, ttl time.Duration) error {
+	b, err := encodeCacheValue(v)
+	if err != nil {
+		return err
+	}
+	return cacheStore.Set(ctx, key, b, ttl)
+}
+
+// 複数の値をまとめて取得する
+// 見つからないキーや読めない値は結果に含めない
+func cacheGetMulti[T any](ctx context.Context, keys []string) (map[string]T, error) {
+	raw, err := cacheStore.GetMulti(ctx, keys)
+	if err != nil {
+		return nil, err
+	}
+	values := make(map[string]T, len(raw))
+	for key, b := range raw {
+		v, err := decodeCacheValue[T](b)
+		if err != nil {
+			continue
+		}
+		values[key] = v
+	}
+	return values, nil
+}
+
+func cacheSetMulti[T any](ctx context.Context, items map[string]T, ttl time.Duration) error {
+	raw := make(map[string][]byte, len(items))
+	for key, v := range items {
+		b, err := encodeCacheValue(v)
+		if err != nil {
+			return err
+		}
+		raw[key] = b
+	}
+	return cacheStore.SetMulti(ctx, raw, ttl)
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// ページの正規のURL（rel=canonicalに使う）
+// ISUCONP_PUBLIC_URLが未設定の場合はパスだけを返す
+func canonicalURL(path string) string {
+	return config.PublicURL + appPath(path)
+}
+
+// 正規のURL以外でアクセスされたGETをリダイレクトするミドルウェア
+// 同じページが別のURLでキャッシュされないよう、次の揺れを揃える
+//   - ホストとスキーム（ISUCONP_CANONICAL_REDIRECTがtrueのとき、ISUCONP_PUBLIC_URLに揃える）
+//   - 末尾のスラッシュ（/以外）
+//
+// アカウント名の大文字小文字はユーザーを引かないと分からないので、getAccountNameで揃える
+func withCanonicalURL(next http.Handler) http.Handler {
+	var public *url.URL
+	if config.CanonicalRedirect && config.PublicURL != "" {
+		public, _ = url.Parse(config.PublicURL)
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		u := *r.URL
+		redirect := false
+		if public != nil {
+			if requestScheme(r) != public.Scheme || !strings.EqualFold(r.Host, public.Host) {
+				u.Scheme, u.Host = public.Scheme, public.Host
+				redirect = true
+			}
+		}
+		if len(u.Path) > 1 && strings.HasSuffix(u.Path, "/") {
+			u.Path = strings.TrimRight(u.Path, "/")
+			if u.Path == "" {
+				u.Path = "/"
+			}
+			u.RawPath = ""
+			redirect = true
+		}
+
+		if !redirect {
+			next.ServeHTTP(w, r)
+			return
+		}
+		u.Path, u.RawPath = appPath(singleLeadingSlash(u.Path)), ""
+		http.Redirect(w, r, u.String(), http.StatusMovedPermanently)
+	})
+}
+
+// 先頭に続くスラッシュ（とバックスラッシュ）を1つにまとめる
+// //evil.com や /\evil.com のままLocationに入れると、ブラウザは別のホストへのURLとして扱う
+func singleLeadingSlash(p string) string {
+	return "/" + strings.TrimLeft(p, `/\`)
+}
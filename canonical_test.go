@@ -0,0 +1,39 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// 末尾のスラッシュを取り除くリダイレクトで、別のホストへ飛ばさない
+func TestCanonicalURLRedirectStaysOnHost(t *testing.T) {
+	h := withCanonicalURL(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	tests := []struct {
+		target   string
+		location string
+	}{
+		{"/posts/", "/posts"},
+		{"//evil.com/", "/evil.com"},
+		{"///evil.com/", "/evil.com"},
+		{`/\evil.com/`, "/evil.com"},
+		{`/\/evil.com/`, "/evil.com"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.target, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, tt.target, nil)
+			r.URL.Scheme, r.URL.Host = "", ""
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+			if w.Code != http.StatusMovedPermanently {
+				t.Fatalf("status = %d, want %d", w.Code, http.StatusMovedPermanently)
+			}
+			if got := w.Header().Get("Location"); got != tt.location {
+				t.Errorf("Location = %q, want %q", got, tt.location)
+			}
+		})
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"strconv"
+	"time"
+)
+
+const (
+	// /initializeでまとめて捨てられるよう、キーに含める世代のキー
+	commentCacheGenKey = "comments:gen"
+	// 書き込みと競合して古い一覧が残っても長く表示しないようにする
+	commentCacheTTL = 60 * time.Second
+)
+
+func postCommentsKey(gen string, postID int) string {
+	return "comments:" + gen + ":post:" + strconv.Itoa(postID)
+}
+
+func commentCacheGeneration(ctx context.Context) string {
+	b, err := cacheStore.Get(ctx, commentCacheGenKey)
+	if err != nil {
+		return "0"
+	}
+	return string(b)
+}
+
+// コメントのキャッシュを全て無効にする
+func clearCommentCache(ctx context.Context) error {
+	_, err := cacheStore.Incr(ctx, commentCacheGenKey, 1, 0)
+	return err
+}
+
+// コメントが増えた投稿のキャッシュを捨てる
+func subscribeCommentCache() {
+	subscribe(events, func(e CommentCreated) {
+		ctx := context.Background()
+		if err := cacheStore.Delete(ctx, postCommentsKey(commentCacheGeneration(ctx), e.PostID)); err != nil {
+			logger("cache").Error("failed to expire comment cache", "err", err)
+		}
+	})
+}
+
+// 投稿ごとの最新commentLimit件のコメントを取得する
+// 一覧用の件数の場合はキャッシュからまとめて取得し、ないものだけDBから取得する
+func fetchPostCommentsCached(ctx context.Context, postIDs []int, commentLimit int) (map[int][]Comment, error) {
+	if commentLimit != config.CommentPreviewCount {
+		return fetchPostComments(ctx, postIDs, commentLimit)
+	}
+
+	gen := commentCacheGeneration(ctx)
+	keys := make([]string, 0, len(postIDs))
+	for _, id := range postIDs {
+		keys = append(keys, postCommentsKey(gen, id))
+	}
+	cached, err := cacheGetMulti[[]Comment](ctx, keys)
+	if err != nil {
+		logger("cache").Error("failed to get comment cache", "err", err)
+	}
+
+	comments := make(map[int][]Comment, len(postIDs))
+	missing := make([]int, 0, len(postIDs))
+	for i, id := range postIDs {
+		cs, found := cached[keys[i]]
+		if !found {
+			missing = append(missing, id)
+			continue
+		}
+		comments[id] = cs
+	}
+	if len(missing) == 0 {
+		return comments, nil
+	}
+
+	fetched, err := fetchPostComments(ctx, missing, commentLimit)
+	if err != nil {
+		return nil, err
+	}
+	items := make(map[string][]Comment, len(missing))
+	for _, id := range missing {
+		// コメントのない投稿も空の一覧としてキャッシュする
+		comments[id] = fetched[id]
+		items[postCommentsKey(gen, id)] = fetched[id]
+	}
+	if err := cacheSetMulti(ctx, items, commentCacheTTL); err != nil {
+		logger("cache").Error("failed to set comment cache", "err", err)
+	}
+	return comments, nil
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// コメントへの評価（1人1コメントにつき1つ）
+const (
+	commentVoteLike   = 1
+	commentVoteReport = -1
+)
+
+var errUnknownCommentVote = newHTTPError(http.StatusBadRequest, errors.New("valueはlike, report, noneのいずれかです"))
+
+// fetchCommentScoresのクエリ
+const commentScoresQuery = "SELECT `comment_id`, SUM(`value`) AS `score` FROM `comment_votes` WHERE `comment_id` IN (?) GROUP BY `comment_id`"
+
+// コメントの評価の合計（いいね - 報告）
+func fetchCommentScores(ctx context.Context, commentIDs []int) (map[int]int, error) {
+	scores := make(map[int]int, len(commentIDs))
+	if len(commentIDs) == 0 {
+		return scores, nil
+	}
+	query, args, err := sqlx.In(commentScoresQuery, commentIDs)
+	if err != nil {
+		return nil, err
+	}
+	rows := []struct {
+		CommentID int `db:"comment_id"`
+		Score     int `db:"score"`
+	}{}
+	if err := db.SelectContext(ctx, &rows, query, args...); err != nil {
+		return nil, err
+	}
+	for _, row := range rows {
+		scores[row.CommentID] = row.Score
+	}
+	return scores, nil
+}
+
+// 投稿ごとのコメントに評価を付け、報告の多いコメントを折りたたむ
+// 報告がいいねよりISUCONP_COMMENT_COLLAPSE_SCORE以上多いコメントが対象
+func applyCommentScores(ctx context.Context, comments map[int][]Comment) error {
+	ids := []int{}
+	for _, cs := range comments {
+		for _, c := range cs {
+			ids = append(ids, c.ID)
+		}
+	}
+	scores, err := fetchCommentScores(ctx, ids)
+	if err != nil {
+		return err
+	}
+	for _, cs := range comments {
+		for i := range cs {
+			cs[i].Score = scores[cs[i].ID]
+			cs[i].Collapsed = -cs[i].Score >= reloadable().CommentCollapseScore
+		}
+	}
+	return nil
+}
+
+// 自分の評価を変える。valueがnoneの場合は取り消す
+func setCommentVote(commentID, userID int, value string) error {
+	var v int
+	switch value {
+	case "like":
+		v = commentVoteLike
+	case "report":
+		v = commentVoteReport
+	case "none":
+		_, err := db.Exec("DELETE FROM `comment_votes` WHERE `comment_id` = ? AND `user_id` = ?", commentID, userID)
+		return err
+	default:
+		return errUnknownCommentVote
+	}
+	_, err := db.Exec(
+		"INSERT INTO `comment_votes` (`comment_id`, `user_id`, `value`) VALUES (?,?,?)"+
+			" ON DUPLICATE KEY UPDATE `value` = VALUES(`value`)",
+		commentID, userID, v,
+	)
+	return err
+}
+
+// POST /api/v1/comments/{id}/votes
+// フォームから送られた場合（JSONを受け付けない場合）はコメントの位置に戻す
+func postAPICommentVotes(w http.ResponseWriter, r *http.Request) error {
+	me := currentUser(r)
+	if !isLogin(me) {
+		return errUnauthorized
+	}
+
+	if !validCSRFToken(r, requestCSRFToken(r)) {
+		return errInvalidCSRFToken
+	}
+
+	commentID, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		return errNotFound
+	}
+
+	var postID int
+	if err := db.GetContext(r.Context(), &postID, "SELECT `post_id` FROM `comments` WHERE `id` = ?", commentID); err != nil {
+		return err
+	}
+
+	if err := setCommentVote(commentID, me.ID, r.FormValue("value")); err != nil {
+		return err
+	}
+	events.Publish(CommentVoted{CommentID: commentID, PostID: postID})
+
+	if !acceptsJSON(r) {
+		redirect(w, r, "/posts/"+strconv.Itoa(postID)+"#comment_"+strconv.Itoa(commentID), http.StatusSeeOther)
+		return nil
+	}
+
+	scores, err := fetchCommentScores(r.Context(), []int{commentID})
+	if err != nil {
+		return err
+	}
+	score := scores[commentID]
+	return writeJSON(w, http.StatusOK, struct {
+		Score     int  `json:"score"`
+		Collapsed bool `json:"collapsed"`
+	}{score, -score >= reloadable().CommentCollapseScore})
+}
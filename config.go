@@ -0,0 +1,405 @@
+package main
+
+import (
+	"image/png"
+	"net/netip"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// 環境変数で変更できる設定
+type appConfig struct {
+	// 一覧の1ページあたりの投稿数
+	PostsPerPage int
+	// 一覧で投稿ごとに表示するコメントの数
+	CommentPreviewCount int
+	// 集計テーブルを作り直す間隔（秒）
+	StatsJobIntervalSec int
+	// BANしたユーザーのデータを削除するまでの日数
+	BanRetentionDays int
+	// 実行しない定期ジョブの名前（ISUCONP_DISABLED_JOBSにカンマ区切りで指定）
+	DisabledJobs []string
+	// 外部に公開しているURL（例: https://example.com）
+	// 未設定の場合はリクエストのHostから組み立てる
+	PublicURL string
+	// 別のホストやスキームでのアクセスをPublicURLにリダイレクトする
+	CanonicalRedirect bool
+	// アプリ全体を公開するパスのプレフィックス（例: /iscogram）
+	// 共有のリバースプロキシの下に置く場合に使う。未設定の場合はルートで公開する
+	PathPrefix string
+	// 投稿を受け付ける画像形式（ISUCONP_UPLOAD_MIME_TYPESにカンマ区切りで指定）
+	UploadMimeTypes []string
+	// HEIC/HEIFをJPEGに変換するコマンド。標準入力から読み、標準出力に書くもの
+	HEICConvertCommand []string
+	// 画像をAVIFに変換するコマンド（例: convert - avif:-）
+	// 設定した場合、image/avifを受け付けるクライアントにはAVIFで配信する
+	AVIFEncodeCommand []string
+	// 画像をWebPに変換するコマンド（例: cwebp -quiet -o - -- -）
+	// 設定した場合、AVIFで配信しないimage/webpを受け付けるクライアントにはWebPで配信する
+	WebPEncodeCommand []string
+	// 投稿画像の最大の幅と高さ。超える画像は縦横比を保って縮小する
+	MaxImageWidth  int
+	MaxImageHeight int
+	// 最大サイズに収まる画像を再エンコードせずに保存する上限のバイト数
+	ImagePassthroughMaxBytes int
+	// JPEGの品質（1〜100）
+	JPEGQuality int
+	// JPEGをプログレッシブに変換するコマンド（例: jpegtran -progressive -copy none）
+	// 標準ライブラリのエンコーダーはベースラインしか出力できないため
+	JPEGProgressiveCommand []string
+	// PNGの圧縮レベル（default, none, speed, best）
+	PNGCompression png.CompressionLevel
+	// GIFのパレットの色数（1〜256）
+	GIFNumColors int
+	// GIFの減色でディザリングするか
+	GIFDither bool
+	// 投稿の本文とコメントの最大文字数
+	MaxPostBodyLength int
+	MaxCommentLength  int
+	// 登録できないアカウント名（大文字小文字は区別しない）
+	ReservedAccountNames []string
+	// ルートの名前ごとのSurrogate-Controlの値（空の場合は付けない）
+	SurrogateControl map[string]string
+	// 画像キャッシュとリクエストごとのデコードでGCが頻発するので、負荷に合わせて調整できるようにする
+	// GOGCと同じ（offで-1、未設定で0）
+	GCPercent int
+	// GOMEMLIMITと同じ（MB単位、0で未設定）
+	MemoryLimitMB int
+	// GCの頻度を下げるためのバラストの大きさ（MB単位）
+	GCBallastMB int
+	// 正方形のサムネイルの一辺のピクセル数
+	ThumbnailSize int
+	// サムネイルの切り抜き方（smart: 輪郭の多い部分を残す、center: 中央を切り抜く）
+	ThumbnailCrop string
+	// ユーザー登録の受け付け方の既定値（open, invite, closed）
+	// 管理画面で変更した場合はそちらが優先される
+	RegistrationMode string
+	// 投稿に付けられる言語（languageNamesにあるもの）
+	PostLanguages []string
+	// オンライン人数に数える、最後にページを見てからの時間（分）
+	OnlineWindowMinutes int
+	// /robots.txtで返す内容（ISUCONP_ROBOTS_TXT_FILEのファイル）
+	RobotsTxt string
+	// クローラーとして扱うUser-Agentに含まれる文字列（小文字）
+	CrawlerUserAgents []string
+	// 端末やIPアドレスをハッシュにするときの鍵
+	FingerprintSalt string
+	// 前段のプロキシのアドレス（ISUCONP_TRUSTED_PROXIESにCIDRかIPアドレスをカンマ区切りで指定）
+	// ここから来たリクエストだけX-Forwarded-*を信用する。未設定の場合は同じホストのプロキシだけ
+	TrustedProxies []netip.Prefix
+	// クライアントのIPアドレスが入っているヘッダー（X-Forwarded-For以外を使うプロキシの場合に設定する）
+	ClientIPHeader string
+	// 投稿画像を保存するディレクトリ
+	ImageDir string
+	// 投稿画像とアイコンの保存先（fs: ImageDir、s3: S3互換のストレージ）
+	ImageStore string
+	// S3互換のストレージのエンドポイント（未設定の場合はS3RegionのAWS S3）とバケット、キーに付けるプレフィックス
+	S3Endpoint string
+	S3Bucket   string
+	S3Region   string
+	S3Prefix   string
+	// アクセスキー（未設定の場合はAWS_ACCESS_KEY_IDとAWS_SECRET_ACCESS_KEY）
+	S3AccessKeyID     string
+	S3SecretAccessKey string
+	// 孤立した画像を消さずにログに出すだけにする
+	ImageGCDryRun bool
+	// /admin/backupでのバックアップの取り方（mysqldump, snapshot, off）
+	BackupStrategy string
+	// mysqldumpの書き出し先のディレクトリ
+	BackupDir string
+	// スナップショットの作成を依頼するAPIとそのトークン
+	BackupSnapshotURL   string
+	BackupSnapshotToken string
+	// DBの応答時間がこのミリ秒を超え続けたら自動で読み取り専用にする（0の場合はしない）
+	ReadOnlyDBLatencyMS int
+	// DBを使うリクエストの同時実行数の上限（0の場合は制限しない）
+	// 書き込み・ログイン中・未ログインのそれぞれの上限も決められる（0の場合はDBSlotsと同じ）
+	DBSlots      int
+	DBClassSlots [dbClassCount]int
+	// このミリ秒以上かかったリクエストのクエリやキャッシュ、描画の内訳をログに出す（0の場合は記録しない）
+	SlowRequestMS int
+	// 待ち受けるアドレス（ISUCONP_LISTEN_ADDRSにカンマ区切りで指定）
+	// host:port（[::]:8080のようなIPv6も可）のほか、tcp4:かtcp6:を付けるとそのIPのバージョンだけ、unix:/pathはUNIXドメインソケットで待ち受ける
+	ListenAddrs []string
+	// ログの形式（textかjson）
+	LogFormat string
+	// エラーを送るSentry互換のサービスのDSN（未設定の場合は送らない）
+	ErrorReportDSN string
+	// レポートに付ける環境の名前（productionなど）
+	ErrorReportEnvironment string
+	// 起動時にDBやテンプレートなどを確かめ、足りなければ起動しない（isuconp doctorと同じチェック）
+	StartupCheck bool
+}
+
+var config = loadConfig()
+
+// DBへの接続先。バックアップのコマンドにも渡す
+type dbConnParams struct {
+	Host     string
+	Port     string
+	User     string
+	Password string
+	Name     string
+}
+
+var dbConn = dbConnParams{
+	Host:     getEnv("ISUCONP_DB_HOST", "localhost"),
+	Port:     getEnv("ISUCONP_DB_PORT", "3306"),
+	User:     getEnv("ISUCONP_DB_USER", "root"),
+	Password: os.Getenv("ISUCONP_DB_PASSWORD"),
+	Name:     getEnv("ISUCONP_DB_NAME", "isuconp"),
+}
+
+func loadConfig() appConfig {
+	configFileOnce.Do(func() { applyConfigFile() })
+	return appConfig{
+		PostsPerPage:             getEnvInt("ISUCONP_POSTS_PER_PAGE", 20),
+		CommentPreviewCount:      getEnvInt("ISUCONP_COMMENT_PREVIEW_COUNT", 3),
+		StatsJobIntervalSec:      getEnvInt("ISUCONP_STATS_JOB_INTERVAL_SEC", 300),
+		BanRetentionDays:         getEnvInt("ISUCONP_BAN_RETENTION_DAYS", 30),
+		DisabledJobs:             getEnvList("ISUCONP_DISABLED_JOBS"),
+		PublicURL:                strings.TrimSuffix(os.Getenv("ISUCONP_PUBLIC_URL"), "/"),
+		CanonicalRedirect:        getEnv("ISUCONP_CANONICAL_REDIRECT", "false") == "true",
+		PathPrefix:               loadPathPrefix(),
+		UploadMimeTypes:          loadUploadMimeTypes(),
+		HEICConvertCommand:       strings.Fields(getEnv("ISUCONP_HEIC_CONVERT_COMMAND", "convert heic:- jpeg:-")),
+		AVIFEncodeCommand:        strings.Fields(os.Getenv("ISUCONP_AVIF_ENCODE_COMMAND")),
+		WebPEncodeCommand:        strings.Fields(os.Getenv("ISUCONP_WEBP_ENCODE_COMMAND")),
+		MaxImageWidth:            getEnvInt("ISUCONP_MAX_IMAGE_WIDTH", 800),
+		MaxImageHeight:           getEnvInt("ISUCONP_MAX_IMAGE_HEIGHT", 800),
+		ImagePassthroughMaxBytes: getEnvInt("ISUCONP_IMAGE_PASSTHROUGH_MAX_BYTES", 200*1024),
+		JPEGQuality:              min(getEnvInt("ISUCONP_JPEG_QUALITY", 85), 100),
+		JPEGProgressiveCommand:   strings.Fields(os.Getenv("ISUCONP_JPEG_PROGRESSIVE_COMMAND")),
+		PNGCompression:           loadPNGCompression(),
+		GIFNumColors:             min(getEnvInt("ISUCONP_GIF_NUM_COLORS", 256), 256),
+		GIFDither:                getEnv("ISUCONP_GIF_DITHER", "true") == "true",
+		MaxPostBodyLength:        getEnvInt("ISUCONP_MAX_POST_BODY_LENGTH", 1000),
+		MaxCommentLength:         getEnvInt("ISUCONP_MAX_COMMENT_LENGTH", 300),
+		ReservedAccountNames:     getEnvListDefault("ISUCONP_RESERVED_ACCOUNT_NAMES", defaultReservedAccountNames),
+		SurrogateControl:         loadSurrogateControl(),
+		GCPercent:                loadGCPercent(),
+		MemoryLimitMB:            getEnvInt("ISUCONP_MEMORY_LIMIT_MB", 0),
+		GCBallastMB:              getEnvInt("ISUCONP_GC_BALLAST_MB", 0),
+		ThumbnailSize:            getEnvInt("ISUCONP_THUMBNAIL_SIZE", 320),
+		ThumbnailCrop:            getEnv("ISUCONP_THUMBNAIL_CROP", "smart"),
+		RegistrationMode:         loadRegistrationMode(),
+		PostLanguages:            loadPostLanguages(),
+		OnlineWindowMinutes:      getEnvInt("ISUCONP_ONLINE_WINDOW_MINUTES", 5),
+		RobotsTxt:                loadRobotsTxt(),
+		CrawlerUserAgents:        loadCrawlerUserAgents(),
+		FingerprintSalt:          getEnv("ISUCONP_FINGERPRINT_SALT", "isuconp-fingerprint"),
+		TrustedProxies:           loadTrustedProxies(),
+		ClientIPHeader:           os.Getenv("ISUCONP_CLIENT_IP_HEADER"),
+		ImageDir:                 getEnv("ISUCONP_IMAGE_DIR", "../public/image"),
+		ImageStore:               getEnv("ISUCONP_IMAGE_STORE", "fs"),
+		S3Endpoint:               os.Getenv("ISUCONP_S3_ENDPOINT"),
+		S3Bucket:                 os.Getenv("ISUCONP_S3_BUCKET"),
+		S3Region:                 getEnv("ISUCONP_S3_REGION", "us-east-1"),
+		S3Prefix:                 os.Getenv("ISUCONP_S3_PREFIX"),
+		S3AccessKeyID:            getEnv("ISUCONP_S3_ACCESS_KEY_ID", os.Getenv("AWS_ACCESS_KEY_ID")),
+		S3SecretAccessKey:        getEnv("ISUCONP_S3_SECRET_ACCESS_KEY", os.Getenv("AWS_SECRET_ACCESS_KEY")),
+		ImageGCDryRun:            getEnv("ISUCONP_IMAGE_GC_DRY_RUN", "false") == "true",
+		BackupStrategy:           getEnv("ISUCONP_BACKUP_STRATEGY", "mysqldump"),
+		BackupDir:                getEnv("ISUCONP_BACKUP_DIR", "/var/backups/isuconp"),
+		BackupSnapshotURL:        os.Getenv("ISUCONP_BACKUP_SNAPSHOT_URL"),
+		BackupSnapshotToken:      os.Getenv("ISUCONP_BACKUP_SNAPSHOT_TOKEN"),
+		ReadOnlyDBLatencyMS:      getEnvInt("ISUCONP_READ_ONLY_DB_LATENCY_MS", 0),
+		DBSlots:                  getEnvInt("ISUCONP_DB_SLOTS", 0),
+		DBClassSlots: [dbClassCount]int{
+			dbClassWrite:     getEnvInt("ISUCONP_DB_SLOTS_WRITE", 0),
+			dbClassMember:    getEnvInt("ISUCONP_DB_SLOTS_MEMBER", 0),
+			dbClassAnonymous: getEnvInt("ISUCONP_DB_SLOTS_ANONYMOUS", 0),
+		},
+		SlowRequestMS:          getEnvInt("ISUCONP_SLOW_REQUEST_MS", 0),
+		ListenAddrs:            getEnvListDefault("ISUCONP_LISTEN_ADDRS", []string{":8080"}),
+		LogFormat:              loadLogFormat(),
+		ErrorReportDSN:         os.Getenv("ISUCONP_ERROR_REPORT_DSN"),
+		ErrorReportEnvironment: os.Getenv("ISUCONP_ENVIRONMENT"),
+		StartupCheck:           getEnv("ISUCONP_STARTUP_CHECK", "true") == "true",
+	}
+}
+
+func loadRegistrationMode() string {
+	mode := getEnv("ISUCONP_REGISTRATION_MODE", registrationOpen)
+	if !validRegistrationMode(mode) {
+		logger("config").Warn("invalid ISUCONP_REGISTRATION_MODE", "value", mode, "using", registrationOpen)
+		return registrationOpen
+	}
+	return mode
+}
+
+// 表示名のない言語は読み飛ばす
+func loadPostLanguages() []string {
+	langs := []string{}
+	for _, lang := range getEnvListDefault("ISUCONP_POST_LANGUAGES", []string{"ja", "en", "zh", "ko"}) {
+		if _, ok := languageNames[lang]; !ok {
+			logger("config").Warn("unknown post language", "value", lang)
+			continue
+		}
+		langs = append(langs, lang)
+	}
+	return langs
+}
+
+// 読めない値は読み飛ばす
+func loadTrustedProxies() []netip.Prefix {
+	var prefixes []netip.Prefix
+	for _, v := range getEnvListDefault("ISUCONP_TRUSTED_PROXIES", []string{"127.0.0.1/32", "::1/128"}) {
+		if addr, err := netip.ParseAddr(v); err == nil {
+			prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(v)
+		if err != nil {
+			logger("config").Warn("invalid trusted proxy in ISUCONP_TRUSTED_PROXIES", "value", v)
+			continue
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes
+}
+
+func loadRobotsTxt() string {
+	path := os.Getenv("ISUCONP_ROBOTS_TXT_FILE")
+	if path == "" {
+		return defaultRobotsTxt
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		logger("config").Warn("failed to read robots.txt", "err", err)
+		return defaultRobotsTxt
+	}
+	return string(b)
+}
+
+// 先頭に/を付け、末尾の/は取り除く。/だけの場合はプレフィックスなし
+func loadPathPrefix() string {
+	p := strings.Trim(os.Getenv("ISUCONP_PATH_PREFIX"), "/")
+	if p == "" {
+		return ""
+	}
+	return "/" + p
+}
+
+func loadCrawlerUserAgents() []string {
+	list := getEnvListDefault("ISUCONP_CRAWLER_USER_AGENTS", []string{"bot", "crawler", "spider", "slurp", "facebookexternalhit"})
+	for i, p := range list {
+		list[i] = strings.ToLower(p)
+	}
+	return list
+}
+
+// 未知の形式は読み飛ばす。未設定の場合は対応している全ての形式を許可する
+func loadUploadMimeTypes() []string {
+	list := getEnvList("ISUCONP_UPLOAD_MIME_TYPES")
+	if len(list) == 0 {
+		return supportedUploadMimeTypes
+	}
+	mimes := make([]string, 0, len(list))
+	for _, mime := range list {
+		if !slices.Contains(supportedUploadMimeTypes, mime) {
+			logger("config").Warn("unsupported upload mime type in ISUCONP_UPLOAD_MIME_TYPES", "value", mime)
+			continue
+		}
+		mimes = append(mimes, mime)
+	}
+	return mimes
+}
+
+func loadPNGCompression() png.CompressionLevel {
+	switch v := getEnv("ISUCONP_PNG_COMPRESSION", "default"); v {
+	case "default":
+		return png.DefaultCompression
+	case "none":
+		return png.NoCompression
+	case "speed":
+		return png.BestSpeed
+	case "best":
+		return png.BestCompression
+	default:
+		logger("config").Warn("invalid ISUCONP_PNG_COMPRESSION, using default", "value", v)
+		return png.DefaultCompression
+	}
+}
+
+// 前段のキャッシュに任せるルートと既定のSurrogate-Control
+// 画像は変わらないので長く、一覧は短く持たせて更新中は古いものを返させる
+var defaultSurrogateControl = map[string]string{
+	"image":      "max-age=86400, stale-while-revalidate=3600",
+	"timeline":   "max-age=5, stale-while-revalidate=30",
+	"outbox":     "max-age=60, stale-while-revalidate=300",
+	"user_stats": "max-age=30, stale-while-revalidate=60",
+	// 過去1年の集計なので数分遅れてもよい
+	"user_activity": "max-age=300, stale-while-revalidate=600",
+}
+
+// ISUCONP_SURROGATE_CONTROL_<NAME>で上書きする。offの場合は付けない
+func loadSurrogateControl() map[string]string {
+	m := make(map[string]string, len(defaultSurrogateControl))
+	for route, def := range defaultSurrogateControl {
+		v := getEnv("ISUCONP_SURROGATE_CONTROL_"+strings.ToUpper(route), def)
+		if v == "off" {
+			continue
+		}
+		m[route] = v
+	}
+	return m
+}
+
+func loadGCPercent() int {
+	if os.Getenv("ISUCONP_GC_PERCENT") == "off" {
+		return -1
+	}
+	return getEnvInt("ISUCONP_GC_PERCENT", 0)
+}
+
+func getEnv(key, def string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return def
+}
+
+// 既存や今後追加するトップレベルのパス、運営を装えそうな名前
+var defaultReservedAccountNames = []string{
+	"admin", "administrator", "root", "system", "support", "help", "about",
+	"login", "logout", "register", "signup", "settings", "initialize",
+	"posts", "post", "comment", "comments", "image", "images", "img",
+	"api", "users", "user", "me", "feed", "search", "explore",
+	"static", "assets", "css", "js", "favicon",
+}
+
+// カンマ区切りの環境変数を読む。未設定の場合はdefを返す
+func getEnvListDefault(key string, def []string) []string {
+	if list := getEnvList(key); len(list) > 0 {
+		return list
+	}
+	return def
+}
+
+// カンマ区切りの環境変数を読む
+func getEnvList(key string) []string {
+	var list []string
+	for _, v := range strings.Split(os.Getenv(key), ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			list = append(list, v)
+		}
+	}
+	return list
+}
+
+// 正の整数の環境変数を読む。未設定や不正な値の場合はdefを返す
+func getEnvInt(key string, def int) int {
+	v := os.Getenv(key)
+	if v == "" {
+		return def
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n <= 0 {
+		logger("config").Warn("invalid integer setting", "key", key, "value", v, "using", def)
+		return def
+	}
+	return n
+}
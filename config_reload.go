@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+)
+
+// 再起動せずに読み直せる設定
+// リクエストの処理中に読むものだけを置く（起動時に使い終わる設定はappConfig）
+type reloadableConfig struct {
+	// 画像キャッシュに入れる1枚あたりの最大バイト数
+	ImageCacheMaxEntryBytes int `json:"image_cache_max_entry_bytes"`
+	// ページにCSRFトークンを埋め込むか
+	// falseの場合はクッキーのトークンをJavaScriptでフォームに写す（ダブルサブミット）
+	CSRFInject bool `json:"csrf_inject"`
+	// ルートごとの応答時間を記録するリクエストの割合（%）
+	RouteStatsSamplePercent int `json:"route_stats_sample_percent"`
+	// クローラーのパターンごとの1分あたりのリクエスト数の上限
+	CrawlerRequestsPerMinute int `json:"crawler_requests_per_minute"`
+	// 投稿を公開前に審査する、登録からの日数と公開済みの投稿数（0の場合はその条件で審査しない）
+	ModerationNewAccountDays int `json:"moderation_new_account_days"`
+	ModerationFirstPosts     int `json:"moderation_first_posts"`
+	// 報告がいいねをこの数以上上回ったコメントを折りたたむ
+	CommentCollapseScore int `json:"comment_collapse_score"`
+	// 同時に処理中のリクエスト数の上限と直近のp99のしきい値（ミリ秒）
+	// 超えたら優先度の低いリクエストを断る（0の場合はその条件で断らない）
+	LoadShedMaxInFlight int `json:"load_shed_max_in_flight"`
+	LoadShedP99MS       int `json:"load_shed_p99_ms"`
+	// 500になったエラーのうち送る割合（%）
+	ErrorReportSamplePercent int `json:"error_report_sample_percent"`
+	// ログに出す最低のレベル（debug, info, warn, error）
+	LogLevel slog.Level `json:"log_level"`
+}
+
+// 読み直せる設定の環境変数。これ以外を設定ファイルで変えた場合は再起動が必要
+var reloadableEnvKeys = []string{
+	"ISUCONP_IMAGE_CACHE_MAX_ENTRY_BYTES",
+	"ISUCONP_CSRF_INJECT",
+	"ISUCONP_ROUTE_STATS_SAMPLE_PERCENT",
+	"ISUCONP_CRAWLER_REQUESTS_PER_MINUTE",
+	"ISUCONP_MODERATION_NEW_ACCOUNT_DAYS",
+	"ISUCONP_MODERATION_FIRST_POSTS",
+	"ISUCONP_COMMENT_COLLAPSE_SCORE",
+	"ISUCONP_LOAD_SHED_MAX_IN_FLIGHT",
+	"ISUCONP_LOAD_SHED_P99_MS",
+	"ISUCONP_ERROR_REPORT_SAMPLE_PERCENT",
+	"ISUCONP_LOG_LEVEL",
+}
+
+func loadReloadableConfig() *reloadableConfig {
+	configFileOnce.Do(func() { applyConfigFile() })
+	return &reloadableConfig{
+		ImageCacheMaxEntryBytes:  getEnvInt("ISUCONP_IMAGE_CACHE_MAX_ENTRY_BYTES", 2*1024*1024),
+		CSRFInject:               getEnv("ISUCONP_CSRF_INJECT", "true") == "true",
+		RouteStatsSamplePercent:  min(getEnvInt("ISUCONP_ROUTE_STATS_SAMPLE_PERCENT", 100), 100),
+		CrawlerRequestsPerMinute: getEnvInt("ISUCONP_CRAWLER_REQUESTS_PER_MINUTE", 60),
+		ModerationNewAccountDays: getEnvInt("ISUCONP_MODERATION_NEW_ACCOUNT_DAYS", 0),
+		ModerationFirstPosts:     getEnvInt("ISUCONP_MODERATION_FIRST_POSTS", 0),
+		CommentCollapseScore:     getEnvInt("ISUCONP_COMMENT_COLLAPSE_SCORE", 3),
+		LoadShedMaxInFlight:      getEnvInt("ISUCONP_LOAD_SHED_MAX_IN_FLIGHT", 0),
+		LoadShedP99MS:            getEnvInt("ISUCONP_LOAD_SHED_P99_MS", 0),
+		ErrorReportSamplePercent: min(getEnvInt("ISUCONP_ERROR_REPORT_SAMPLE_PERCENT", 100), 100),
+		LogLevel:                 loadLogLevel(),
+	}
+}
+
+var liveConfig = func() *atomic.Pointer[reloadableConfig] {
+	var p atomic.Pointer[reloadableConfig]
+	p.Store(loadReloadableConfig())
+	return &p
+}()
+
+// 今の読み直せる設定。読み直すと別の値に入れ替わるので、1回の処理の中では同じ戻り値を使う
+func reloadable() *reloadableConfig {
+	return liveConfig.Load()
+}
+
+// ISUCONP_CONFIG_FILEは起動時に一度だけ環境変数に反映し、以降は読み直すときに反映する
+var configFileOnce sync.Once
+
+// ISUCONP_CONFIG_FILE（KEY=VALUEの行。systemdのEnvironmentFileと同じ形式）を読み、環境変数より優先して反映する
+// 値を変えた環境変数の名前を返す。ファイルから消した項目は元の値に戻らない
+func applyConfigFile() ([]string, error) {
+	file := os.Getenv("ISUCONP_CONFIG_FILE")
+	if file == "" {
+		return nil, nil
+	}
+	values, err := readConfigFile(file)
+	if err != nil {
+		logger("config").Error("failed to read ISUCONP_CONFIG_FILE", "file", file, "err", err)
+		return nil, err
+	}
+	var changed []string
+	for k, v := range values {
+		if old, ok := os.LookupEnv(k); ok && old == v {
+			continue
+		}
+		os.Setenv(k, v)
+		changed = append(changed, k)
+	}
+	slices.Sort(changed)
+	return changed, nil
+}
+
+func readConfigFile(file string) (map[string]string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	values := map[string]string{}
+	sc := bufio.NewScanner(f)
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		k, v, ok := strings.Cut(strings.TrimPrefix(line, "export "), "=")
+		if !ok {
+			return nil, fmt.Errorf("line %d: missing =", n)
+		}
+		v = strings.TrimSpace(v)
+		if uq, err := strconv.Unquote(v); err == nil {
+			v = uq
+		} else if len(v) >= 2 && v[0] == '\'' && v[len(v)-1] == '\'' {
+			v = v[1 : len(v)-1]
+		}
+		values[strings.TrimSpace(k)] = v
+	}
+	return values, sc.Err()
+}
+
+// 設定を読み直した結果
+type configReloadResult struct {
+	// 値を変えた環境変数
+	Changed []string `json:"changed"`
+	// 変わったが、再起動するまで反映されない環境変数
+	RestartRequired []string          `json:"restart_required"`
+	Config          *reloadableConfig `json:"config"`
+}
+
+var configReloadMu sync.Mutex
+
+// ISUCONP_CONFIG_FILEを読み直して、読み直せる設定を入れ替える
+// キャッシュやカウンターは作り直さないので、再起動と違って温まった状態のまま続けられる
+func reloadConfig() (configReloadResult, error) {
+	configReloadMu.Lock()
+	defer configReloadMu.Unlock()
+
+	changed, err := applyConfigFile()
+	if err != nil {
+		return configReloadResult{}, err
+	}
+	c := loadReloadableConfig()
+	liveConfig.Store(c)
+	logLevel.Set(c.LogLevel)
+
+	res := configReloadResult{Changed: []string{}, RestartRequired: []string{}, Config: c}
+	for _, k := range changed {
+		res.Changed = append(res.Changed, k)
+		if !slices.Contains(reloadableEnvKeys, k) {
+			res.RestartRequired = append(res.RestartRequired, k)
+		}
+	}
+	logger("config").Info("config reloaded", "changed", res.Changed, "restart_required", res.RestartRequired)
+	return res, nil
+}
+
+// SIGHUPを受け取ったら設定を読み直す
+func watchReloadSignal() {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGHUP)
+	go func() {
+		for range ch {
+			reloadConfig()
+		}
+	}()
+}
+
+// POST /api/v1/admin/config/reload
+// SIGHUPと同じく設定を読み直し、変わった項目と読み直した後の設定を返す
+// 複数台で動かしている場合は受け付けたサーバーだけが読み直す
+func postAPIAdminConfigReload(w http.ResponseWriter, r *http.Request) error {
+	me := currentUser(r)
+	if !isLogin(me) {
+		return errUnauthorized
+	}
+	if me.Authority == 0 {
+		return errForbidden
+	}
+	if !validCSRFToken(r, requestCSRFToken(r)) {
+		return errInvalidCSRFToken
+	}
+
+	res, err := reloadConfig()
+	if err != nil {
+		return fmt.Errorf("failed to reload config: %w", err)
+	}
+	return writeJSON(w, http.StatusOK, res)
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// カウンターをDBに書き出す間隔
+	counterFlushInterval = 5 * time.Second
+	// 1回のUPSERTで書き込む最大行数
+	counterFlushBatchSize = 500
+)
+
+// 閲覧数のような頻繁に更新されるカウンターをメモリに溜めておき、
+// 定期的に複数行のUPSERTでまとめて書き込む
+type counterBuffer struct {
+	mu      sync.Mutex
+	pending map[int]int64
+
+	table       string
+	keyColumn   string
+	valueColumn string
+}
+
+func newCounterBuffer(table, keyColumn, valueColumn string) *counterBuffer {
+	return &counterBuffer{
+		pending:     make(map[int]int64),
+		table:       table,
+		keyColumn:   keyColumn,
+		valueColumn: valueColumn,
+	}
+}
+
+var (
+	// 投稿の閲覧数
+	postViewCounter = newCounterBuffer("post_views", "post_id", "view_count")
+
+	counterBuffers = []*counterBuffer{postViewCounter}
+)
+
+func (c *counterBuffer) Incr(id int, delta int64) {
+	c.mu.Lock()
+	c.pending[id] += delta
+	c.mu.Unlock()
+}
+
+// 溜まっている差分を書き込む
+// 書き込みに失敗した分は次回に持ち越す
+func (c *counterBuffer) Flush() error {
+	c.mu.Lock()
+	pending := c.pending
+	c.pending = make(map[int]int64)
+	c.mu.Unlock()
+
+	if len(pending) == 0 {
+		return nil
+	}
+
+	ids := make([]int, 0, len(pending))
+	for id := range pending {
+		ids = append(ids, id)
+	}
+
+	for start := 0; start < len(ids); start += counterFlushBatchSize {
+		end := min(start+counterFlushBatchSize, len(ids))
+		chunk := ids[start:end]
+
+		args := make([]any, 0, len(chunk)*2)
+		for _, id := range chunk {
+			args = append(args, id, pending[id])
+		}
+
+		query := "INSERT INTO `" + c.table + "` (`" + c.keyColumn + "`, `" + c.valueColumn + "`) VALUES " +
+			strings.TrimSuffix(strings.Repeat("(?,?),", len(chunk)), ",") +
+			" ON DUPLICATE KEY UPDATE `" + c.valueColumn + "` = `" + c.valueColumn + "` + VALUES(`" + c.valueColumn + "`)"
+
+		if _, err := db.Exec(query, args...); err != nil {
+			c.restore(ids[start:], pending)
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (c *counterBuffer) restore(ids []int, pending map[int]int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, id := range ids {
+		c.pending[id] += pending[id]
+	}
+}
+
+// 全カウンターを書き込む
+func flushCounters() error {
+	var errs []error
+	for _, c := range counterBuffers {
+		if err := c.Flush(); err != nil {
+			errs = append(errs, fmt.Errorf("failed to flush %s: %w", c.table, err))
+		}
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// クローラーのリクエスト数を数える単位
+const crawlerRateWindow = time.Minute
+
+// ISUCONP_ROBOTS_TXT_FILEが未設定の場合のrobots.txt
+// 管理画面とAPI、ページ送りの断片はクロールさせない
+const defaultRobotsTxt = `User-agent: *
+Disallow: /admin/
+Disallow: /api/
+Disallow: /posts?
+Disallow: /beacon
+Crawl-delay: 1
+`
+
+func getRobotsTxt(w http.ResponseWriter, r *http.Request) error {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Cache-Control", "public, max-age=3600")
+	_, err := w.Write([]byte(config.RobotsTxt))
+	return err
+}
+
+// User-Agentが一致したクローラーのパターン。クローラーでなければ空
+func crawlerPattern(userAgent string) string {
+	ua := strings.ToLower(userAgent)
+	for _, p := range config.CrawlerUserAgents {
+		if strings.Contains(ua, p) {
+			return p
+		}
+	}
+	return ""
+}
+
+// クローラーのリクエストをパターンごとに1分あたりISUCONP_CRAWLER_REQUESTS_PER_MINUTE回までに制限するミドルウェア
+// 同じクローラーが多数のIPアドレスから来ることが多いので、IPアドレスではなくパターンごとに数える
+// 人のリクエストは数えない。キャッシュが使えない場合は制限しない
+func withCrawlerThrottle(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		pattern := crawlerPattern(r.UserAgent())
+		if pattern == "" || r.URL.Path == "/robots.txt" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		n, err := incrRateCounter(r.Context(), "crawler:"+pattern, crawlerRateWindow)
+		if err != nil {
+			logger("crawler").ErrorContext(r.Context(), "failed to count crawler requests", "err", err)
+		} else if n > int64(reloadable().CrawlerRequestsPerMinute) {
+			retryAfter := crawlerRateWindow - time.Duration(time.Now().UnixNano()%int64(crawlerRateWindow))
+			w.Header().Set("Retry-After", strconv.Itoa(int(retryAfter.Seconds())+1))
+			http.Error(w, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
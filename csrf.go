@@ -0,0 +1,63 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net/http"
+)
+
+// ダブルサブミット用のCSRFトークンのクッキー
+// JavaScriptからフォームに写せるようHttpOnlyにしない
+const csrfCookieName = "isu_csrf"
+
+func csrfCookieToken(r *http.Request) string {
+	c, err := r.Cookie(csrfCookieName)
+	if err != nil {
+		return ""
+	}
+	return c.Value
+}
+
+// 新しいトークンをクッキーに発行して返す
+func issueCSRFCookie(w http.ResponseWriter) string {
+	token := secureRandomStr(16)
+	http.SetCookie(w, &http.Cookie{
+		Name:     csrfCookieName,
+		Value:    token,
+		Path:     appPath("/"),
+		SameSite: http.SameSiteLaxMode,
+	})
+	return token
+}
+
+// ページに埋め込むCSRFトークン
+// ISUCONP_CSRF_INJECT=falseの場合は埋め込まず、クッキーからJavaScriptで写す（ページをキャッシュしやすくなる）
+func formCSRFToken(r *http.Request) string {
+	if !reloadable().CSRFInject {
+		return ""
+	}
+	return currentCSRFToken(r)
+}
+
+// フォームから送られたトークンが、クッキーかセッションのものと一致するか
+// クッキーと一致すればセッションを読まずに済む
+func validCSRFToken(r *http.Request, token string) bool {
+	if token == "" {
+		return false
+	}
+	if cookie := csrfCookieToken(r); cookie != "" && subtle.ConstantTimeCompare([]byte(token), []byte(cookie)) == 1 {
+		return true
+	}
+	expected := currentCSRFToken(r)
+	return expected != "" && subtle.ConstantTimeCompare([]byte(token), []byte(expected)) == 1
+}
+
+// GET /api/v1/csrf-token
+// キャッシュされたページのフォームにトークンを入れるためのエンドポイント
+func getAPICSRFToken(w http.ResponseWriter, r *http.Request) error {
+	token := csrfCookieToken(r)
+	if token == "" {
+		token = issueCSRFCookie(w)
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	return writeJSON(w, http.StatusOK, map[string]string{"csrf_token": token})
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DBを使うリクエストの種類。値が小さいほど優先する
+type dbClass int
+
+const (
+	// 書き込み（GET・HEAD以外）
+	dbClassWrite dbClass = iota
+	// ログイン中のユーザーのページ
+	dbClassMember
+	// ログインしていないユーザーのページと画像
+	dbClassAnonymous
+	dbClassCount
+)
+
+var dbClassNames = [dbClassCount]string{"write", "member", "anonymous"}
+
+// 空きを待つ最大の時間。超えたら混雑として断る
+const dbSlotMaxWait = 3 * time.Second
+
+// DBを使う処理の同時実行数を種類ごとに制限するセマフォ
+// 空きができたら優先度の高い種類の待ちから順に割り当てる
+type dbGate struct {
+	mu       sync.Mutex
+	capacity int
+	limits   [dbClassCount]int
+	inUse    int
+	held     [dbClassCount]int
+	waiters  [dbClassCount][]chan struct{}
+	timeouts [dbClassCount]atomic.Int64
+}
+
+// ISUCONP_DB_SLOTSが0ならnil（制限しない）
+var dbSlots = newDBGate()
+
+func newDBGate() *dbGate {
+	if config.DBSlots <= 0 {
+		return nil
+	}
+	g := &dbGate{capacity: config.DBSlots}
+	for c, limit := range config.DBClassSlots {
+		g.limits[c] = config.DBSlots
+		if limit > 0 {
+			g.limits[c] = min(limit, config.DBSlots)
+		}
+	}
+	return g
+}
+
+func (g *dbGate) canTake(c dbClass) bool {
+	return g.inUse < g.capacity && g.held[c] < g.limits[c]
+}
+
+func (g *dbGate) take(c dbClass) {
+	g.inUse++
+	g.held[c]++
+}
+
+// 種類cの枠を1つ取る。戻り値の関数で返す
+// ctxが終わるかdbSlotMaxWaitを過ぎても空かなければerrOverloadedを返す
+func (g *dbGate) acquire(ctx context.Context, c dbClass) (func(), error) {
+	if g == nil {
+		return func() {}, nil
+	}
+
+	g.mu.Lock()
+	if g.canTake(c) && len(g.waiters[c]) == 0 {
+		g.take(c)
+		g.mu.Unlock()
+		return func() { g.release(c) }, nil
+	}
+	ch := make(chan struct{})
+	g.waiters[c] = append(g.waiters[c], ch)
+	g.mu.Unlock()
+
+	timer := time.NewTimer(dbSlotMaxWait)
+	defer timer.Stop()
+	select {
+	case <-ch:
+		return func() { g.release(c) }, nil
+	case <-ctx.Done():
+	case <-timer.C:
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	select {
+	case <-ch:
+		// 諦めるのと同時に割り当てられていた
+		g.releaseLocked(c)
+	default:
+		for i, w := range g.waiters[c] {
+			if w == ch {
+				g.waiters[c] = append(g.waiters[c][:i], g.waiters[c][i+1:]...)
+				break
+			}
+		}
+	}
+	g.timeouts[c].Add(1)
+	return nil, errOverloaded
+}
+
+func (g *dbGate) release(c dbClass) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.releaseLocked(c)
+}
+
+func (g *dbGate) releaseLocked(c dbClass) {
+	g.inUse--
+	g.held[c]--
+	for wc := range dbClassCount {
+		for len(g.waiters[wc]) > 0 && g.canTake(wc) {
+			ch := g.waiters[wc][0]
+			g.waiters[wc] = g.waiters[wc][1:]
+			g.take(wc)
+			close(ch)
+		}
+	}
+}
+
+func requestDBClass(r *http.Request) dbClass {
+	switch {
+	case r.Method != http.MethodGet && r.Method != http.MethodHead:
+		return dbClassWrite
+	case isLogin(currentUser(r)):
+		return dbClassMember
+	default:
+		return dbClassAnonymous
+	}
+}
+
+// リクエストの間、種類に応じたDBの枠を取るミドルウェア
+// 画像はキャッシュから返せることが多いので、DBから読むとき（fetchImage）だけ枠を取る
+func withDBPriority(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if dbSlots == nil || strings.HasPrefix(r.URL.Path, "/image/") {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		release, err := dbSlots.acquire(r.Context(), requestDBClass(r))
+		if err != nil {
+			w.Header().Set("Retry-After", loadShedRetryAfter)
+			handleError(w, r, err)
+			return
+		}
+		defer release()
+		next.ServeHTTP(w, r)
+	})
+}
+
+// 管理画面に出す種類ごとの枠の使われ方
+type dbClassSummary struct {
+	Class    string `json:"class"`
+	Limit    int    `json:"limit"`
+	InUse    int    `json:"in_use"`
+	Waiting  int    `json:"waiting"`
+	TimedOut int64  `json:"timed_out"`
+}
+
+func (g *dbGate) summary() []dbClassSummary {
+	if g == nil {
+		return nil
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	res := make([]dbClassSummary, 0, dbClassCount)
+	for c := range dbClassCount {
+		res = append(res, dbClassSummary{
+			Class:    dbClassNames[c],
+			Limit:    g.limits[c],
+			InUse:    g.held[c],
+			Waiting:  len(g.waiters[c]),
+			TimedOut: g.timeouts[c].Load(),
+		})
+	}
+	return res
+}
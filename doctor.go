@@ -0,0 +1,367 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+)
+
+// 1つのチェックにかける時間の上限
+const doctorCheckTimeout = 5 * time.Second
+
+// 初期データと一緒に作られる前提のテーブル（起動時には作らない）
+var baseTables = []string{"users", "posts", "comments"}
+
+// 無くても動くが、無いと一覧やコメントの表示が遅くなるインデックス（テーブルと先頭の列）
+var recommendedIndexes = []struct{ table, column string }{
+	{"posts", "created_at"},
+	{"posts", "user_id"},
+	{"comments", "post_id"},
+	{"comments", "user_id"},
+}
+
+var (
+	schemaTableNamePattern = regexp.MustCompile("CREATE TABLE IF NOT EXISTS `([a-z_]+)`")
+	schemaIndexNamePattern = regexp.MustCompile("(?:UNIQUE )?KEY `([a-z_]+)`")
+)
+
+// 起動前に確かめる項目
+// requiredのチェックが失敗した場合は起動しない（警告はログに出して起動する）
+type doctorCheck struct {
+	name     string
+	required bool
+	run      func(ctx context.Context) (string, error)
+}
+
+// 失敗したときの、直し方の付いたエラー
+type doctorError struct {
+	err  error
+	hint string
+}
+
+func (e *doctorError) Error() string {
+	return e.err.Error()
+}
+
+func withHint(err error, hint string) error {
+	return &doctorError{err: err, hint: hint}
+}
+
+var doctorChecks = []doctorCheck{
+	{"templates", true, checkTemplates},
+	{"db", true, checkDB},
+	{"tables", true, checkBaseTables},
+	{"app_tables", false, checkAppTables},
+	{"indexes", false, checkIndexes},
+	{"memcached", true, checkMemcached},
+	{"cache", true, checkCacheBackend},
+	{"image_store", true, checkImageStore},
+	{"backup_dir", false, checkBackupDir},
+}
+
+type doctorResult struct {
+	name     string
+	required bool
+	detail   string
+	err      error
+}
+
+func runDoctorChecks(ctx context.Context) []doctorResult {
+	results := make([]doctorResult, 0, len(doctorChecks))
+	for _, c := range doctorChecks {
+		cctx, cancel := context.WithTimeout(ctx, doctorCheckTimeout)
+		detail, err := c.run(cctx)
+		cancel()
+		results = append(results, doctorResult{name: c.name, required: c.required, detail: detail, err: err})
+	}
+	return results
+}
+
+// isuconp doctor
+// 全てのチェックの結果を直し方と一緒にwに書く。requiredのチェックが失敗した場合は1を返す
+func runDoctor(w io.Writer) int {
+	code := 0
+	for _, res := range runDoctorChecks(context.Background()) {
+		switch {
+		case res.err == nil:
+			fmt.Fprintf(w, "[ OK ] %s: %s\n", res.name, res.detail)
+			continue
+		case res.required:
+			fmt.Fprintf(w, "[FAIL] %s: %v\n", res.name, res.err)
+			code = 1
+		default:
+			fmt.Fprintf(w, "[WARN] %s: %v\n", res.name, res.err)
+		}
+		var de *doctorError
+		if errors.As(res.err, &de) && de.hint != "" {
+			fmt.Fprintf(w, "       -> %s\n", de.hint)
+		}
+	}
+	return code
+}
+
+// 起動時のチェック。結果をログに出し、requiredのチェックが全て通ったか返す
+func startupCheck() bool {
+	ok := true
+	for _, res := range runDoctorChecks(context.Background()) {
+		if res.err == nil {
+			continue
+		}
+		var hint string
+		var de *doctorError
+		if errors.As(res.err, &de) {
+			hint = de.hint
+		}
+		if res.required {
+			logger("doctor").Error("startup check failed", "check", res.name, "err", res.err, "hint", hint)
+			ok = false
+		} else {
+			logger("doctor").Warn("startup check warning", "check", res.name, "err", res.err, "hint", hint)
+		}
+	}
+	return ok
+}
+
+func checkTemplates(context.Context) (string, error) {
+	if len(templateErrors) > 0 {
+		return "", withHint(errors.Join(templateErrors...),
+			"start the app from the directory that contains templates/ (the working directory is "+workingDir()+")")
+	}
+	return "all templates loaded", nil
+}
+
+func workingDir() string {
+	wd, err := os.Getwd()
+	if err != nil {
+		return "unknown"
+	}
+	return wd
+}
+
+func checkDB(ctx context.Context) (string, error) {
+	if err := db.PingContext(ctx); err != nil {
+		return "", withHint(err, fmt.Sprintf("check that MySQL is running at %s:%s and ISUCONP_DB_USER/ISUCONP_DB_PASSWORD/ISUCONP_DB_NAME are correct", dbConn.Host, dbConn.Port))
+	}
+	var version string
+	if err := db.GetContext(ctx, &version, "SELECT VERSION()"); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("connected to %s:%s/%s (MySQL %s)", dbConn.Host, dbConn.Port, dbConn.Name, version), nil
+}
+
+// 今のDBにあるテーブル
+func existingTables(ctx context.Context) ([]string, error) {
+	var tables []string
+	err := db.SelectContext(ctx, &tables, "SELECT `TABLE_NAME` FROM information_schema.`TABLES` WHERE `TABLE_SCHEMA` = DATABASE()")
+	return tables, err
+}
+
+func missingTables(ctx context.Context, want []string) ([]string, error) {
+	tables, err := existingTables(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var missing []string
+	for _, t := range want {
+		if !slices.Contains(tables, t) {
+			missing = append(missing, t)
+		}
+	}
+	return missing, nil
+}
+
+func checkBaseTables(ctx context.Context) (string, error) {
+	missing, err := missingTables(ctx, baseTables)
+	if err != nil {
+		return "", err
+	}
+	if len(missing) > 0 {
+		return "", withHint(fmt.Errorf("missing tables: %s", strings.Join(missing, ", ")),
+			"load the initial data (dump.sql) into "+dbConn.Name)
+	}
+	return strings.Join(baseTables, ", "), nil
+}
+
+// schema.goで作るテーブルの名前
+func schemaTableNames() []string {
+	var names []string
+	for _, sql := range schemaTables {
+		if m := schemaTableNamePattern.FindStringSubmatch(sql); m != nil {
+			names = append(names, m[1])
+		}
+	}
+	return names
+}
+
+func checkAppTables(ctx context.Context) (string, error) {
+	names := schemaTableNames()
+	missing, err := missingTables(ctx, names)
+	if err != nil {
+		return "", err
+	}
+	if len(missing) > 0 {
+		return "", withHint(fmt.Errorf("missing tables: %s", strings.Join(missing, ", ")),
+			"they are created when the app starts; check that the DB user has CREATE privilege")
+	}
+	return fmt.Sprintf("%d tables", len(names)), nil
+}
+
+// テーブルごとのインデックスと、その先頭の列
+func existingIndexes(ctx context.Context) (map[string]map[string]string, error) {
+	var rows []struct {
+		Table  string `db:"TABLE_NAME"`
+		Index  string `db:"INDEX_NAME"`
+		Column string `db:"COLUMN_NAME"`
+	}
+	err := db.SelectContext(ctx, &rows,
+		"SELECT `TABLE_NAME`, `INDEX_NAME`, `COLUMN_NAME` FROM information_schema.`STATISTICS`"+
+			" WHERE `TABLE_SCHEMA` = DATABASE() AND `SEQ_IN_INDEX` = 1")
+	if err != nil {
+		return nil, err
+	}
+	indexes := map[string]map[string]string{}
+	for _, r := range rows {
+		if indexes[r.Table] == nil {
+			indexes[r.Table] = map[string]string{}
+		}
+		indexes[r.Table][r.Index] = r.Column
+	}
+	return indexes, nil
+}
+
+// schema.goで宣言したインデックスと、初期データのテーブルに推奨するインデックスがあるか
+// テーブルが無い場合はtablesのチェックで報告するので、ここでは見ない
+func checkIndexes(ctx context.Context) (string, error) {
+	indexes, err := existingIndexes(ctx)
+	if err != nil {
+		return "", err
+	}
+	var problems []string
+	checked := 0
+	for _, sql := range schemaTables {
+		m := schemaTableNamePattern.FindStringSubmatch(sql)
+		if m == nil || indexes[m[1]] == nil {
+			continue
+		}
+		for _, km := range schemaIndexNamePattern.FindAllStringSubmatch(sql, -1) {
+			checked++
+			if _, ok := indexes[m[1]][km[1]]; !ok {
+				problems = append(problems, m[1]+"."+km[1])
+			}
+		}
+	}
+	if len(problems) > 0 {
+		return "", withHint(fmt.Errorf("missing indexes: %s", strings.Join(problems, ", ")),
+			"the tables predate the current schema; add the keys with ALTER TABLE or drop the tables so they are recreated on startup")
+	}
+
+	var slow []string
+	for _, ri := range recommendedIndexes {
+		if indexes[ri.table] == nil {
+			continue
+		}
+		checked++
+		found := false
+		for _, column := range indexes[ri.table] {
+			if column == ri.column {
+				found = true
+				break
+			}
+		}
+		if !found {
+			slow = append(slow, ri.table+"("+ri.column+")")
+		}
+	}
+	if len(slow) > 0 {
+		return "", withHint(fmt.Errorf("no index starting with %s", strings.Join(slow, ", ")),
+			"listing posts and comments scans the whole table; add the indexes with ALTER TABLE ... ADD KEY")
+	}
+	return fmt.Sprintf("%d indexes", checked), nil
+}
+
+func checkMemcached(context.Context) (string, error) {
+	if err := memcacheClient.Ping(); err != nil {
+		return "", withHint(err, "sessions are stored in memcached; check that it is running at "+memcachedAddress()+" (ISUCONP_MEMCACHED_ADDRESS)")
+	}
+	return "reachable at " + memcachedAddress(), nil
+}
+
+// キャッシュのバックエンドに読みに行く。無いキーを読んでミスになれば届いている
+func checkCacheBackend(ctx context.Context) (string, error) {
+	name := "memcached"
+	if redisEnabled {
+		name = "redis"
+	}
+	if _, err := cacheStore.Get(ctx, "doctor_probe"); err != nil && !errors.Is(err, errCacheMiss) {
+		return "", withHint(err, "check that "+name+" is running (ISUCONP_MEMCACHED_ADDRESS / ISUCONP_REDIS_ADDRESS)")
+	}
+	return "using " + name, nil
+}
+
+// mysqldumpでバックアップを取る場合は、書き出す先に書けるか
+func checkBackupDir(context.Context) (string, error) {
+	if config.BackupStrategy != "mysqldump" {
+		return "not used (ISUCONP_BACKUP_STRATEGY=" + config.BackupStrategy + ")", nil
+	}
+	if _, err := exec.LookPath("mysqldump"); err != nil {
+		return "", withHint(err, "install the MySQL client tools or change ISUCONP_BACKUP_STRATEGY")
+	}
+	// まだ無い場合はバックアップのときに作る
+	if err := checkWritableDir(config.BackupDir); err != nil {
+		return "", withHint(err, "make "+config.BackupDir+" writable by the app user or change ISUCONP_BACKUP_DIR")
+	}
+	return config.BackupDir + " is writable", nil
+}
+
+// 投稿画像を書き込めるか
+func checkImageStore(ctx context.Context) (string, error) {
+	switch s := imageStore.(type) {
+	case *fsImageStore:
+		// まだ無い場合は最初の投稿のときに作る
+		if err := checkWritableDir(s.dir); err != nil {
+			return "", withHint(err, "uploads will fail; make "+s.dir+" writable by the app user or change ISUCONP_IMAGE_DIR")
+		}
+		return s.dir + " is writable", nil
+	case *s3ImageStore:
+		// 実際に書いて消せるか試す
+		const probeKey = ".doctor-probe"
+		err := s.Put(ctx, probeKey, []byte("ok"), "text/plain")
+		if err == nil {
+			err = s.Delete(ctx, probeKey)
+		}
+		if err != nil {
+			return "", withHint(err, "uploads will fail; check ISUCONP_S3_ENDPOINT, ISUCONP_S3_BUCKET and the access key")
+		}
+		return "bucket " + s.bucket + " at " + s.endpoint.Host + " is writable", nil
+	}
+	return "", fmt.Errorf("unknown image store %T", imageStore)
+}
+
+// dirにファイルを書けるか。まだ無い場合は作れる一番近い親を見る
+func checkWritableDir(dir string) error {
+	for {
+		if _, err := os.Stat(dir); err == nil {
+			break
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			break
+		}
+		dir = parent
+	}
+	f, err := os.CreateTemp(dir, ".doctor-*")
+	if err != nil {
+		return err
+	}
+	f.Close()
+	os.Remove(f.Name())
+	return nil
+}
@@ -0,0 +1,292 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"runtime"
+	"runtime/debug"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+const (
+	// 送信を待てるレポートの数（超えた分は捨てる）
+	errorReportQueueSize = 100
+	errorReportTimeout   = 5 * time.Second
+	// レポートに載せるスタックトレースのフレーム数
+	errorReportMaxFrames = 50
+)
+
+// レポートに載せるクエリパラメーターのうち、値を伏せるもの
+// アカウント名やパスワード、トークンは利用者を特定できるので送らない
+var errorReportSensitiveParams = []string{"account_name", "password", "csrf_token", "token", "code", "invite", "idempotency_key"}
+
+// 本文に紛れたメールアドレスを伏せる
+var errorReportEmailPattern = regexp.MustCompile(`[A-Za-z0-9._%+-]+@[A-Za-z0-9.-]+\.[A-Za-z]{2,}`)
+
+// Sentry互換のサービスにエラーを送る
+// ISUCONP_ERROR_REPORT_DSNが未設定の場合はnil（reportErrorは何もしない）
+type errorReporter struct {
+	endpoint string
+	auth     string
+	dsn      string
+	client   *http.Client
+	queue    chan errorReportEvent
+}
+
+var errorReports = newErrorReporter(config.ErrorReportDSN)
+
+// DSN（https://<key>@<host>/<project>）から送信先を組み立てる
+func newErrorReporter(dsn string) *errorReporter {
+	if dsn == "" {
+		return nil
+	}
+	u, err := url.Parse(dsn)
+	if err != nil || u.User == nil || u.User.Username() == "" || u.Host == "" {
+		logger("error_report").Warn("invalid ISUCONP_ERROR_REPORT_DSN, error reporting is disabled")
+		return nil
+	}
+	// パスの付いたDSN（https://<key>@<host>/<path>/<project>）の場合は、送信先にもパスを付ける
+	p := strings.TrimSuffix(u.Path, "/")
+	i := strings.LastIndex(p, "/")
+	if i < 0 || p[i+1:] == "" {
+		logger("error_report").Warn("ISUCONP_ERROR_REPORT_DSN has no project, error reporting is disabled")
+		return nil
+	}
+
+	rep := &errorReporter{
+		endpoint: fmt.Sprintf("%s://%s%s/api/%s/envelope/", u.Scheme, u.Host, p[:i], p[i+1:]),
+		auth:     "Sentry sentry_version=7, sentry_client=isuconp/1.0, sentry_key=" + u.User.Username(),
+		dsn:      dsn,
+		client:   &http.Client{Timeout: errorReportTimeout},
+		queue:    make(chan errorReportEvent, errorReportQueueSize),
+	}
+	go rep.run()
+	return rep
+}
+
+// Sentryのイベントのうち使うもの
+type errorReportEvent struct {
+	EventID     string                `json:"event_id"`
+	Timestamp   time.Time             `json:"timestamp"`
+	Level       string                `json:"level"`
+	Platform    string                `json:"platform"`
+	ServerName  string                `json:"server_name,omitempty"`
+	Environment string                `json:"environment,omitempty"`
+	Exception   errorReportExceptions `json:"exception"`
+	Request     *errorReportRequest   `json:"request,omitempty"`
+	User        *errorReportUser      `json:"user,omitempty"`
+	Tags        map[string]string     `json:"tags,omitempty"`
+}
+
+type errorReportExceptions struct {
+	Values []errorReportException `json:"values"`
+}
+
+type errorReportException struct {
+	Type       string                 `json:"type"`
+	Value      string                 `json:"value"`
+	Stacktrace *errorReportStacktrace `json:"stacktrace,omitempty"`
+}
+
+type errorReportStacktrace struct {
+	Frames []errorReportFrame `json:"frames"`
+}
+
+type errorReportFrame struct {
+	Function string `json:"function"`
+	Filename string `json:"filename"`
+	Lineno   int    `json:"lineno"`
+	InApp    bool   `json:"in_app"`
+}
+
+// リクエストの情報。クッキーや本文、IPアドレスは送らない
+type errorReportRequest struct {
+	Method      string            `json:"method"`
+	URL         string            `json:"url"`
+	QueryString string            `json:"query_string,omitempty"`
+	Headers     map[string]string `json:"headers,omitempty"`
+}
+
+type errorReportUser struct {
+	ID string `json:"id"`
+}
+
+// withRecoveryが拾ったpanic。panicした時点のスタックトレースを持つ
+type panicError struct {
+	value any
+	stack *errorReportStacktrace
+}
+
+func (e *panicError) Error() string {
+	return fmt.Sprintf("panic: %v", e.value)
+}
+
+// リクエストの処理中に起きたエラーを送る
+// ISUCONP_ERROR_REPORT_SAMPLE_PERCENTの割合だけ送り、送信は裏で行うので呼び出し元を待たせない
+func reportError(r *http.Request, err error) {
+	if errorReports == nil {
+		return
+	}
+	if reloadable().ErrorReportSamplePercent < 100 && rand.IntN(100) >= reloadable().ErrorReportSamplePercent {
+		return
+	}
+	e := newErrorReportEvent(err)
+	if r != nil {
+		e.Request = newErrorReportRequest(r)
+		e.Tags = map[string]string{"method": r.Method}
+		if rctx := chi.RouteContext(r.Context()); rctx != nil && rctx.RoutePattern() != "" {
+			e.Tags["route"] = rctx.RoutePattern()
+		}
+		if a, ok := r.Context().Value(requestLogContextKey).(*requestLogAttrs); ok {
+			e.Tags["request_id"] = a.id
+			if uid := a.userID.Load(); uid != 0 {
+				e.User = &errorReportUser{ID: fmt.Sprint(uid)}
+			}
+		}
+	}
+	select {
+	case errorReports.queue <- e:
+	default:
+		logger("error_report").Warn("error report queue is full, dropping report")
+	}
+}
+
+// 種類は包まれた一番内側のエラーの型で表す
+func newErrorReportEvent(err error) errorReportEvent {
+	ex := errorReportException{Value: scrubErrorReportText(err.Error())}
+	if pe, ok := err.(*panicError); ok {
+		ex.Type, ex.Stacktrace = "panic", pe.stack
+	} else {
+		cause := err
+		for errors.Unwrap(cause) != nil {
+			cause = errors.Unwrap(cause)
+		}
+		// reportErrorとこの関数を除く
+		ex.Type, ex.Stacktrace = fmt.Sprintf("%T", cause), errorReportStack(2)
+	}
+	host, _ := os.Hostname()
+	return errorReportEvent{
+		EventID:     secureRandomStr(16),
+		Timestamp:   time.Now().UTC(),
+		Level:       "error",
+		Platform:    "go",
+		ServerName:  host,
+		Environment: config.ErrorReportEnvironment,
+		Exception:   errorReportExceptions{Values: []errorReportException{ex}},
+	}
+}
+
+// 呼び出し元のスタックトレース（Sentryに合わせて古い呼び出しから並べる）
+// skipは除く呼び出し元の数
+func errorReportStack(skip int) *errorReportStacktrace {
+	pcs := make([]uintptr, errorReportMaxFrames)
+	n := runtime.Callers(skip+2, pcs)
+	frames := runtime.CallersFrames(pcs[:n])
+	var st errorReportStacktrace
+	for {
+		f, more := frames.Next()
+		st.Frames = append(st.Frames, errorReportFrame{
+			Function: f.Function,
+			Filename: f.File,
+			Lineno:   f.Line,
+			InApp:    strings.HasPrefix(f.Function, "main."),
+		})
+		if !more {
+			break
+		}
+	}
+	for i, j := 0, len(st.Frames)-1; i < j; i, j = i+1, j-1 {
+		st.Frames[i], st.Frames[j] = st.Frames[j], st.Frames[i]
+	}
+	return &st
+}
+
+func newErrorReportRequest(r *http.Request) *errorReportRequest {
+	req := &errorReportRequest{
+		Method: r.Method,
+		URL:    baseURL(r) + r.URL.Path,
+		Headers: map[string]string{
+			"User-Agent": r.UserAgent(),
+		},
+	}
+	if q := r.URL.Query(); len(q) > 0 {
+		for _, k := range errorReportSensitiveParams {
+			if q.Has(k) {
+				q.Set(k, "[Filtered]")
+			}
+		}
+		req.QueryString = scrubErrorReportText(q.Encode())
+	}
+	return req
+}
+
+func scrubErrorReportText(s string) string {
+	return errorReportEmailPattern.ReplaceAllString(s, "[Filtered]")
+}
+
+func (rep *errorReporter) run() {
+	for e := range rep.queue {
+		if err := rep.send(e); err != nil {
+			logger("error_report").Warn("failed to send error report", "err", err)
+		}
+	}
+}
+
+// エンベロープ（ヘッダー、アイテムのヘッダー、イベントの3行）で送る
+func (rep *errorReporter) send(e errorReportEvent) error {
+	payload, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	var body bytes.Buffer
+	json.NewEncoder(&body).Encode(map[string]any{"event_id": e.EventID, "dsn": rep.dsn, "sent_at": time.Now().UTC()})
+	json.NewEncoder(&body).Encode(map[string]any{"type": "event", "length": len(payload)})
+	body.Write(payload)
+	body.WriteByte('\n')
+
+	req, err := http.NewRequest(http.MethodPost, rep.endpoint, &body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-sentry-envelope")
+	req.Header.Set("X-Sentry-Auth", rep.auth)
+	res, err := rep.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode >= 300 {
+		return fmt.Errorf("error report rejected: %s", res.Status)
+	}
+	return nil
+}
+
+// ハンドラーやミドルウェアのpanicを500のエラーとしてhandleErrorに渡すミドルウェア
+// 接続の中断（http.ErrAbortHandler）はそのまま上に伝える
+func withRecovery(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			p := recover()
+			if p == nil {
+				return
+			}
+			if err, ok := p.(error); ok && errors.Is(err, http.ErrAbortHandler) {
+				panic(p)
+			}
+			logger("http").ErrorContext(r.Context(), "panic in handler", "panic", p, "stack", string(debug.Stack()))
+			// この関数を除いた、panicした時点のスタックトレース
+			handleError(w, r, &panicError{value: p, stack: errorReportStack(1)})
+		}()
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/catatsuy/private-isu/webapp/golang/apperror"
+)
+
+var (
+	errNotFound         = apperror.NotFound("")
+	errForbidden        = apperror.Forbidden("")
+	errInvalidCSRFToken = newHTTPError(http.StatusUnprocessableEntity, errors.New("invalid csrf token"))
+)
+
+// ステータスコード付きのエラー
+// apperrorの種類に当てはまらない、HTTPに固有のもの（認証や混雑など）に使う
+type httpError struct {
+	status int
+	err    error
+}
+
+func newHTTPError(status int, err error) *httpError {
+	return &httpError{status: status, err: err}
+}
+
+func (e *httpError) Error() string {
+	if e.err == nil {
+		return http.StatusText(e.status)
+	}
+	return e.err.Error()
+}
+
+func (e *httpError) Unwrap() error {
+	return e.err
+}
+
+// エラーを返せるハンドラー
+// 返されたエラーはhandleErrorでステータスコードに変換される
+type handler func(w http.ResponseWriter, r *http.Request) error
+
+func (h handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if err := h(w, r); err != nil {
+		handleError(w, r, err)
+	}
+}
+
+// エラーに対応するステータスコードを返す
+func errorStatus(err error) int {
+	var ae *apperror.Error
+	var he *httpError
+	switch {
+	case errors.As(err, &ae):
+		return ae.Kind.Status()
+	case errors.As(err, &he):
+		return he.status
+	case errors.Is(err, sql.ErrNoRows):
+		return http.StatusNotFound
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// 利用者に返すエラーのメッセージ
+// apperrorのエラーは利用者向けのメッセージ、httpErrorはクライアントの誤りのときだけ理由をそのまま返す
+func errorMessage(err error, status int) string {
+	var ae *apperror.Error
+	if errors.As(err, &ae) {
+		return apperror.UserMessage(err)
+	}
+	var he *httpError
+	if errors.As(err, &he) && he.err != nil && status < http.StatusInternalServerError {
+		return he.err.Error()
+	}
+	return http.StatusText(status)
+}
+
+// エラーをレスポンスに変換する
+// /api以下はJSON、フォームの送信で利用者向けのメッセージがあるエラーはフラッシュを付けて元のページへ戻し、
+// それ以外はステータスコードのみを返す
+func handleError(w http.ResponseWriter, r *http.Request, err error) {
+	status := errorStatus(err)
+	if status >= http.StatusInternalServerError {
+		logger("http").ErrorContext(r.Context(), "request failed", "method", r.Method, "path", r.URL.Path, "status", status, "err", err)
+		reportError(r, err)
+	}
+
+	if strings.HasPrefix(r.URL.Path, "/api/") {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(struct {
+			Error string `json:"error"`
+		}{errorMessage(err, status)})
+		return
+	}
+
+	var ae *apperror.Error
+	if r.Method == http.MethodPost && errors.As(err, &ae) && ae.Kind != apperror.KindInternal && ae.Message != "" {
+		addErrorFlash(w, r, err)
+		redirect(w, r, refererPath(r), http.StatusFound)
+		return
+	}
+
+	w.WriteHeader(status)
+}
+
+// 同じサイトのRefererのパス（プレフィックスを除いたもの）。なければトップページ
+func refererPath(r *http.Request) string {
+	ref, err := url.Parse(r.Referer())
+	if err != nil || (ref.Host != "" && ref.Host != r.Host) || !strings.HasPrefix(ref.Path, "/") {
+		return "/"
+	}
+	p, ok := trimPathPrefix(ref.Path)
+	if !ok {
+		return "/"
+	}
+	ref.Path, ref.RawPath = p, ""
+	return ref.RequestURI()
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/netip"
+	"time"
+)
+
+const (
+	// 報告に載せる新しいアカウントの登録からの期間
+	evasionNewAccountPeriod = 7 * 24 * time.Hour
+	// 比べるBAN済みのアカウントのBANからの期間
+	evasionBannedPeriod = 30 * 24 * time.Hour
+	// 報告に載せる組み合わせの最大数
+	evasionReportLimit = 100
+
+	// 端末を見分けるためのクッキー
+	deviceCookieName   = "isu_device"
+	deviceCookieMaxAge = 2 * 365 * 24 * 60 * 60
+)
+
+// 端末とIPアドレスは生の値を残さず、ISUCONP_FINGERPRINT_SALTを鍵にしたハッシュで残す
+func fingerprintHash(v string) string {
+	mac := hmac.New(sha256.New, []byte(config.FingerprintSalt))
+	mac.Write([]byte(v))
+	return hex.EncodeToString(mac.Sum(nil)[:16])
+}
+
+// 端末のID（長く残るクッキーに入れたランダムな値）
+// IPアドレスが変わっても同じ端末から来たことが分かるようにする
+// ヘッダーの組み合わせは同じ機種やブラウザで一致してしまうので使わない
+// まだなければ発行する
+func deviceID(w http.ResponseWriter, r *http.Request) string {
+	if c, err := r.Cookie(deviceCookieName); err == nil && c.Value != "" {
+		return c.Value
+	}
+	id := secureRandomStr(16)
+	http.SetCookie(w, &http.Cookie{
+		Name:     deviceCookieName,
+		Value:    id,
+		Path:     appPath("/"),
+		MaxAge:   deviceCookieMaxAge,
+		Secure:   requestScheme(r) == "https",
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	return id
+}
+
+// IPアドレスを比べる単位
+// IPv6は一時アドレスなどで同じ回線でも下位64ビットが変わるので、/64のネットワークにまとめる
+func clientNetwork(r *http.Request) string {
+	ip, err := netip.ParseAddr(clientIP(r))
+	if err != nil || !ip.Is6() {
+		return clientIP(r)
+	}
+	prefix, _ := ip.Prefix(64)
+	return prefix.String()
+}
+
+// ユーザーが登録や投稿をしたときの端末とIPアドレスを記録する
+// 端末のクッキーを発行することがあるので、レスポンスを書き始める前に呼ぶ
+// 失敗しても登録や投稿は止めない
+func recordUserFingerprint(w http.ResponseWriter, r *http.Request, userID int, action string) {
+	_, err := db.ExecContext(context.WithoutCancel(r.Context()),
+		"INSERT INTO `user_fingerprints` (`user_id`, `device_hash`, `ip_hash`, `first_action`) VALUES (?,?,?,?)"+
+			" ON DUPLICATE KEY UPDATE `last_seen_at` = CURRENT_TIMESTAMP",
+		userID, fingerprintHash(deviceID(w, r)), fingerprintHash(clientNetwork(r)), action,
+	)
+	if err != nil {
+		logger("evasion").ErrorContext(r.Context(), "failed to record user fingerprint", "err", err)
+	}
+}
+
+// 最近BANされたアカウントと端末かIPアドレスが同じ新しいアカウント
+type evasionSuspect struct {
+	NewUser    User
+	BannedUser User
+	SameDevice bool
+	SameIP     bool
+	BannedAt   time.Time
+}
+
+// IPアドレスだけの一致は、同じ回線や共有のネットワークの別人かもしれない
+func (s evasionSuspect) LowConfidence() bool {
+	return !s.SameDevice
+}
+
+func fetchEvasionSuspects(ctx context.Context) ([]evasionSuspect, error) {
+	rows := []struct {
+		NewUserID    int       `db:"new_user_id"`
+		BannedUserID int       `db:"banned_user_id"`
+		SameDevice   bool      `db:"same_device"`
+		SameIP       bool      `db:"same_ip"`
+		BannedAt     time.Time `db:"banned_at"`
+	}{}
+	// ORで結合するとインデックスを使えないので、端末とIPアドレスのそれぞれで結合してまとめる
+	now := time.Now()
+	newSince := now.Add(-evasionNewAccountPeriod)
+	err := db.SelectContext(ctx, &rows,
+		"SELECT m.`new_user_id`, m.`banned_user_id`,"+
+			" MAX(m.`same_device`) AS `same_device`, MAX(m.`same_ip`) AS `same_ip`,"+
+			" MAX(ub.`banned_at`) AS `banned_at`"+
+			" FROM ("+
+			"SELECT n.`user_id` AS `new_user_id`, b.`user_id` AS `banned_user_id`, 1 AS `same_device`, 0 AS `same_ip`, nu.`created_at`"+
+			" FROM `users` nu"+
+			" JOIN `user_fingerprints` n ON n.`user_id` = nu.`id`"+
+			" JOIN `user_fingerprints` b ON b.`device_hash` = n.`device_hash` AND b.`user_id` <> n.`user_id`"+
+			" WHERE nu.`del_flg` = 0 AND nu.`created_at` > ?"+
+			" UNION ALL "+
+			"SELECT n.`user_id`, b.`user_id`, 0, 1, nu.`created_at`"+
+			" FROM `users` nu"+
+			" JOIN `user_fingerprints` n ON n.`user_id` = nu.`id`"+
+			" JOIN `user_fingerprints` b ON b.`ip_hash` = n.`ip_hash` AND b.`user_id` <> n.`user_id`"+
+			" WHERE nu.`del_flg` = 0 AND nu.`created_at` > ?"+
+			") m"+
+			" JOIN `user_bans` ub ON ub.`user_id` = m.`banned_user_id` AND ub.`banned_at` > ?"+
+			" JOIN `users` bu ON bu.`id` = m.`banned_user_id` AND bu.`del_flg` = 1"+
+			" GROUP BY m.`new_user_id`, m.`banned_user_id`"+
+			" ORDER BY MAX(m.`created_at`) DESC, m.`new_user_id` DESC LIMIT ?",
+		newSince, newSince, now.Add(-evasionBannedPeriod), evasionReportLimit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	if len(rows) == 0 {
+		return []evasionSuspect{}, nil
+	}
+
+	ids := make([]int, 0, len(rows)*2)
+	for _, row := range rows {
+		ids = append(ids, row.NewUserID, row.BannedUserID)
+	}
+	users, err := getUsersByIDs(ctx, ids)
+	if err != nil {
+		return nil, err
+	}
+
+	// 集計のあとに削除されたユーザーは載せない
+	suspects := make([]evasionSuspect, 0, len(rows))
+	for _, row := range rows {
+		newUser, ok := users[row.NewUserID]
+		if !ok {
+			continue
+		}
+		bannedUser, ok := users[row.BannedUserID]
+		if !ok {
+			continue
+		}
+		suspects = append(suspects, evasionSuspect{
+			NewUser:    newUser,
+			BannedUser: bannedUser,
+			SameDevice: row.SameDevice,
+			SameIP:     row.SameIP,
+			BannedAt:   row.BannedAt,
+		})
+	}
+	return suspects, nil
+}
+
+// BAN逃れの疑いがあるアカウントの一覧
+// チェックしたアカウントは/admin/bannedに送ってその場でBANできる
+func getAdminEvasion(w http.ResponseWriter, r *http.Request) error {
+	me := currentUser(r)
+	if !isLogin(me) {
+		redirect(w, r, "/", http.StatusFound)
+		return nil
+	}
+
+	if me.Authority == 0 {
+		return errForbidden
+	}
+
+	suspects, err := fetchEvasionSuspects(r.Context())
+	if err != nil {
+		return err
+	}
+
+	data := newViewData(w, r).With("Suspects", suspects)
+	return renderTemplate(w, r, http.StatusOK, templates.evasion, "layout.html", data)
+}
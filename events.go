@@ -0,0 +1,138 @@
+package main
+
+import (
+	"reflect"
+	"runtime/debug"
+	"strconv"
+	"sync"
+)
+
+// アプリケーション内で発生するイベント
+type Event interface {
+	eventName() string
+}
+
+// 投稿が作成された
+type PostCreated struct {
+	PostID int
+	UserID int
+}
+
+// コメントが作成された
+type CommentCreated struct {
+	CommentID  int
+	PostID     int
+	UserID     int
+	PostUserID int // コメントされた投稿のユーザー
+}
+
+// コメントの評価（いいね・報告）が変わった
+type CommentVoted struct {
+	CommentID int
+	PostID    int
+}
+
+// ユーザーがBANされた
+type UserBanned struct {
+	UserID int
+}
+
+// ユーザーのBANが解除された（異議申し立てを認めた）
+type UserUnbanned struct {
+	UserID int
+}
+
+// ユーザーの認証済みのバッジが付いた・外れた
+type UserVerificationChanged struct {
+	UserID   int
+	Verified bool
+}
+
+func (PostCreated) eventName() string             { return "post_created" }
+func (CommentCreated) eventName() string          { return "comment_created" }
+func (CommentVoted) eventName() string            { return "comment_voted" }
+func (UserBanned) eventName() string              { return "user_banned" }
+func (UserUnbanned) eventName() string            { return "user_unbanned" }
+func (UserVerificationChanged) eventName() string { return "user_verification_changed" }
+
+// プロセス内のイベントバス
+// キャッシュの無効化などハンドラー本来の処理ではないものはここから購読する
+type eventBus struct {
+	mu          sync.RWMutex
+	subscribers map[reflect.Type][]func(Event)
+}
+
+var events = &eventBus{
+	subscribers: make(map[reflect.Type][]func(Event)),
+}
+
+// イベントの型ごとに購読する
+func subscribe[T Event](b *eventBus, fn func(T)) {
+	t := reflect.TypeFor[T]()
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.subscribers[t] = append(b.subscribers[t], func(e Event) {
+		fn(e.(T))
+	})
+}
+
+// 購読者を同期的に呼び出す
+// 時間のかかる処理は購読者側でgoroutineに逃がすこと
+func (b *eventBus) Publish(e Event) {
+	b.mu.RLock()
+	subs := b.subscribers[reflect.TypeOf(e)]
+	b.mu.RUnlock()
+
+	for _, fn := range subs {
+		b.call(e, fn)
+	}
+}
+
+// 購読者のpanicで呼び出し元のリクエストを巻き込まない
+func (b *eventBus) call(e Event, fn func(Event)) {
+	defer func() {
+		if err := recover(); err != nil {
+			logger("events").Error("panic in subscriber", "event", e.eventName(), "panic", err, "stack", string(debug.Stack()))
+		}
+	}()
+	fn(e)
+}
+
+// キャッシュの無効化をイベントに紐付ける
+// 無効化は他のアプリケーションサーバーにも伝わる
+func subscribeCacheInvalidation() {
+	registerInvalidation("image", func(key string) {
+		if key == "" {
+			clearImageCache()
+			return
+		}
+		removeFromCache(key)
+		removeFromCache(avifVariantKey(key))
+		removeFromCache(webpVariantKey(key))
+		removeFromCache(squareVariantKey(key))
+	})
+	registerInvalidation("user_stats", func(key string) {
+		if key == "" {
+			clearUserStats()
+			return
+		}
+		if uid, err := strconv.Atoi(key); err == nil {
+			invalidateUserStats(uid)
+		}
+	})
+
+	subscribe(events, func(e PostCreated) {
+		invalidate("image", "")
+		invalidate("user_stats", strconv.Itoa(e.UserID))
+	})
+	subscribe(events, func(e CommentCreated) {
+		invalidate("user_stats", strconv.Itoa(e.UserID))
+	})
+	subscribe(events, func(e UserBanned) {
+		invalidate("user_stats", strconv.Itoa(e.UserID))
+	})
+	subscribe(events, func(e UserUnbanned) {
+		invalidate("user_stats", strconv.Itoa(e.UserID))
+	})
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// APIで返すフィード（自分の投稿と最近のコメント）
+type apiFeed struct {
+	User       apiUser      `json:"user"`
+	Posts      []apiPost    `json:"posts"`
+	Comments   []apiComment `json:"comments"`
+	NextCursor string       `json:"next_cursor,omitempty"`
+}
+
+// Atomのエントリーのタイトルにする本文の文字数
+const atomTitleLength = 40
+
+type atomFeed struct {
+	XMLName xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	ID      string      `xml:"id"`
+	Title   string      `xml:"title"`
+	Updated string      `xml:"updated"`
+	Author  atomPerson  `xml:"author"`
+	Link    []atomLink  `xml:"link"`
+	Entries []atomEntry `xml:"entry"`
+}
+
+type atomPerson struct {
+	Name string `xml:"name"`
+}
+
+type atomLink struct {
+	Rel  string `xml:"rel,attr,omitempty"`
+	Type string `xml:"type,attr,omitempty"`
+	Href string `xml:"href,attr"`
+}
+
+type atomEntry struct {
+	ID        string     `xml:"id"`
+	Title     string     `xml:"title"`
+	Updated   string     `xml:"updated"`
+	Published string     `xml:"published"`
+	Link      []atomLink `xml:"link"`
+	Content   string     `xml:"content"`
+}
+
+// APIトークンはハッシュだけを保存する
+func hashAPIToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// Authorization: Bearer <token> のユーザーを返す
+func apiTokenUser(r *http.Request) (User, error) {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || token == "" {
+		return User{}, errUnauthorized
+	}
+
+	u := User{}
+	err := db.GetContext(r.Context(), &u, "SELECT u.* FROM `api_tokens` t JOIN `users` u ON t.`user_id` = u.`id` WHERE t.`token_hash` = ? AND u.`del_flg` = 0", hashAPIToken(token))
+	if errors.Is(err, sql.ErrNoRows) {
+		return User{}, errUnauthorized
+	}
+	return u, err
+}
+
+// POST /api/v1/tokens
+// ログイン中のユーザーのAPIトークンを発行する。トークンはこのレスポンスでしか返さない
+func postAPITokens(w http.ResponseWriter, r *http.Request) error {
+	me := currentUser(r)
+	if !isLogin(me) {
+		return errUnauthorized
+	}
+
+	if !validCSRFToken(r, requestCSRFToken(r)) {
+		return errInvalidCSRFToken
+	}
+
+	token := secureRandomStr(32)
+	_, err := db.ExecContext(context.WithoutCancel(r.Context()), "INSERT INTO `api_tokens` (`token_hash`, `user_id`) VALUES (?,?)", hashAPIToken(token), me.ID)
+	if err != nil {
+		return err
+	}
+
+	return writeJSON(w, http.StatusCreated, map[string]string{"token": token})
+}
+
+// GET /api/v1/me/feed.{json,atom}?cursor=
+// APIトークンで認証したユーザー自身の投稿と最近のコメントを返す
+func getAPIMeFeed(w http.ResponseWriter, r *http.Request) error {
+	format := r.PathValue("format")
+	if format != "json" && format != "atom" {
+		return errNotFound
+	}
+
+	me, err := apiTokenUser(r)
+	if err != nil {
+		return err
+	}
+
+	cursor, err := parsePageCursor(r.URL.Query().Get("cursor"))
+	if err != nil {
+		return newHTTPError(http.StatusBadRequest, err)
+	}
+
+	results, err := fetchUserPosts(r.Context(), me.ID, cursor)
+	if err != nil {
+		return err
+	}
+
+	posts, err := makePosts(r.Context(), results, "", allComments)
+	if err != nil {
+		return err
+	}
+
+	if format == "atom" {
+		return writeAtomFeed(w, r, me, posts)
+	}
+
+	comments := []Comment{}
+	err = db.SelectContext(r.Context(), &comments, "SELECT * FROM `comments` WHERE `user_id` = ? ORDER BY `created_at` DESC LIMIT ?", me.ID, config.PostsPerPage)
+	if err != nil {
+		return err
+	}
+	apiComments := make([]apiComment, 0, len(comments))
+	for _, c := range comments {
+		c.User = me
+		apiComments = append(apiComments, newAPIComment(c))
+	}
+
+	return writeJSON(w, http.StatusOK, apiFeed{
+		User:       newAPIUser(me),
+		Posts:      newAPIPosts(posts),
+		Comments:   apiComments,
+		NextCursor: nextPageCursor(results).String(),
+	})
+}
+
+func writeAtomFeed(w http.ResponseWriter, r *http.Request, me User, posts []Post) error {
+	base := baseURL(r)
+
+	feed := atomFeed{
+		ID:      base + "/@" + me.AccountName,
+		Title:   me.AccountName + " - Iscogram",
+		Updated: me.CreatedAt.Format(time.RFC3339),
+		Author:  atomPerson{Name: me.AccountName},
+		Link: []atomLink{
+			{Rel: "alternate", Type: "text/html", Href: base + "/@" + me.AccountName},
+			{Rel: "self", Type: "application/atom+xml", Href: base + r.URL.RequestURI()},
+		},
+	}
+	if len(posts) > 0 {
+		feed.Updated = posts[0].CreatedAt.Format(time.RFC3339)
+	}
+
+	for _, p := range posts {
+		permalink := base + "/posts/" + strconv.Itoa(p.ID)
+		title := previewText(p.Body, atomTitleLength)
+		if title == "" {
+			title = "Post #" + strconv.Itoa(p.ID)
+		}
+		feed.Entries = append(feed.Entries, atomEntry{
+			ID:        permalink,
+			Title:     title,
+			Updated:   p.CreatedAt.Format(time.RFC3339),
+			Published: p.CreatedAt.Format(time.RFC3339),
+			Link: []atomLink{
+				{Rel: "alternate", Type: "text/html", Href: permalink},
+				{Rel: "enclosure", Type: p.Mime, Href: base + imagePath(p)},
+			},
+			Content: p.Body,
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/atom+xml; charset=utf-8")
+	if _, err := w.Write([]byte(xml.Header)); err != nil {
+		return err
+	}
+	return xml.NewEncoder(w).Encode(feed)
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/catatsuy/private-isu/webapp/golang/apperror"
+)
+
+// フラッシュメッセージの種類
+type flashCategory string
+
+const (
+	flashSuccess flashCategory = "success"
+	flashError   flashCategory = "error"
+	flashInfo    flashCategory = "info"
+)
+
+// 表示順
+var flashCategories = []flashCategory{flashError, flashInfo, flashSuccess}
+
+type Flash struct {
+	Category flashCategory
+	Message  string
+}
+
+// CSSのクラス名
+func (f Flash) Class() string {
+	switch f.Category {
+	case flashSuccess:
+		return "alert-success"
+	case flashError:
+		return "alert-danger"
+	default:
+		return "alert-info"
+	}
+}
+
+func flashKey(category flashCategory) string {
+	return "_flash_" + string(category)
+}
+
+// 次のリクエストで表示するメッセージを追加する
+// 同じリクエスト内で何度呼んでもよい
+func addFlash(w http.ResponseWriter, r *http.Request, category flashCategory, message string) {
+	session := getSession(r)
+	session.AddFlash(message, flashKey(category))
+	session.Save(r, w)
+}
+
+// エラーを利用者向けのメッセージにして追加する。予期しないエラーの原因は出さない
+func addErrorFlash(w http.ResponseWriter, r *http.Request, err error) {
+	addFlash(w, r, flashError, apperror.UserMessage(err))
+}
+
+// 溜まっているメッセージを取り出して削除する
+func getFlashes(w http.ResponseWriter, r *http.Request) []Flash {
+	session := getSession(r)
+
+	var flashes []Flash
+	for _, category := range flashCategories {
+		for _, v := range session.Flashes(flashKey(category)) {
+			if message, ok := v.(string); ok {
+				flashes = append(flashes, Flash{Category: category, Message: message})
+			}
+		}
+	}
+
+	if len(flashes) > 0 {
+		session.Save(r, w)
+	}
+	return flashes
+}
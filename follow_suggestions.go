@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	followSuggestionsKey = "suggestions:follows"
+	// 候補を作り直す間隔
+	followSuggestionsInterval = 10 * time.Minute
+	// 活動を数える期間
+	followSuggestionsWindow = 7 * 24 * time.Hour
+	// キャッシュする候補の数（フォロー済みのユーザーを除いても足りるよう多めに持つ）
+	followSuggestionsPoolSize = 100
+	// APIで返す数の既定値と上限
+	followSuggestionsDefaultLimit = 10
+	followSuggestionsMaxLimit     = 50
+)
+
+// フォローを勧めるユーザー
+type followSuggestion struct {
+	User           User
+	RecentPosts    int
+	RecentComments int
+}
+
+type apiFollowSuggestion struct {
+	User           apiUser `json:"user"`
+	RecentPosts    int     `json:"recent_posts"`
+	RecentComments int     `json:"recent_comments"`
+}
+
+var followSuggestionsFlight flightGroup[[]followSuggestion]
+
+// 直近の投稿とコメントの多いユーザーを候補としてキャッシュに入れる（定期ジョブ）
+func rebuildFollowSuggestions(ctx context.Context) error {
+	_, err := buildFollowSuggestions(ctx)
+	return err
+}
+
+func buildFollowSuggestions(ctx context.Context) ([]followSuggestion, error) {
+	rows := []struct {
+		UserID         int `db:"user_id"`
+		RecentPosts    int `db:"recent_posts"`
+		RecentComments int `db:"recent_comments"`
+	}{}
+	since := time.Now().Add(-followSuggestionsWindow)
+	err := db.Select(&rows,
+		"SELECT a.`user_id`, SUM(a.`posts`) AS `recent_posts`, SUM(a.`comments`) AS `recent_comments` FROM ("+
+			"SELECT `user_id`, COUNT(*) AS `posts`, 0 AS `comments` FROM `posts` WHERE `created_at` >= ? GROUP BY `user_id`"+
+			" UNION ALL "+
+			"SELECT `user_id`, 0 AS `posts`, COUNT(*) AS `comments` FROM `comments` WHERE `created_at` >= ? GROUP BY `user_id`"+
+			") a JOIN `users` u ON a.`user_id` = u.`id` WHERE u.`del_flg` = 0"+
+			" GROUP BY a.`user_id` ORDER BY `recent_posts` + `recent_comments` DESC, a.`user_id` LIMIT ?",
+		since, since, followSuggestionsPoolSize)
+	if err != nil {
+		return nil, err
+	}
+
+	ids := make([]int, 0, len(rows))
+	for _, row := range rows {
+		ids = append(ids, row.UserID)
+	}
+	users, err := getUsersByIDs(ctx, ids)
+	if err != nil {
+		return nil, err
+	}
+	suggestions := make([]followSuggestion, 0, len(rows))
+	for _, row := range rows {
+		u, ok := users[row.UserID]
+		if !ok {
+			continue
+		}
+		suggestions = append(suggestions, followSuggestion{User: u, RecentPosts: row.RecentPosts, RecentComments: row.RecentComments})
+	}
+
+	// 作り直す前に切れないよう、間隔の倍の間キャッシュする
+	if err := cacheSet(ctx, followSuggestionsKey, suggestions, 2*followSuggestionsInterval); err != nil {
+		logger("cache").Error("failed to store follow suggestions", "err", err)
+	}
+	return suggestions, nil
+}
+
+// BANされたユーザーを勧めないよう、候補を捨てて次のリクエストで作り直す
+func subscribeFollowSuggestions() {
+	subscribe(events, func(e UserBanned) {
+		if err := cacheStore.Delete(context.Background(), followSuggestionsKey); err != nil {
+			logger("cache").Error("failed to expire follow suggestions", "err", err)
+		}
+	})
+}
+
+// キャッシュした候補。無ければ作る
+func cachedFollowSuggestions(ctx context.Context) ([]followSuggestion, error) {
+	suggestions, err := cacheGet[[]followSuggestion](ctx, followSuggestionsKey)
+	if err == nil {
+		return suggestions, nil
+	}
+	if !errors.Is(err, errCacheMiss) {
+		logger("cache").Warn("failed to get follow suggestions", "err", err)
+	}
+	// 同時に来たリクエストで共有するので、最初のリクエストが切れても止めない
+	return followSuggestionsFlight.Do(followSuggestionsKey, func() ([]followSuggestion, error) {
+		return buildFollowSuggestions(context.WithoutCancel(ctx))
+	})
+}
+
+// meに勧めるユーザー。自分とフォロー済みのユーザーは除く
+func followSuggestionsFor(ctx context.Context, me User, limit int) ([]followSuggestion, error) {
+	pool, err := cachedFollowSuggestions(ctx)
+	if err != nil {
+		return nil, err
+	}
+	followed := []string{}
+	err = db.SelectContext(ctx, &followed, "SELECT `value` FROM `subscriptions` WHERE `user_id` = ? AND `kind` = ?", me.ID, subscriptionUser)
+	if err != nil {
+		return nil, err
+	}
+
+	res := []followSuggestion{}
+	for _, s := range pool {
+		if len(res) >= limit {
+			break
+		}
+		if s.User.ID == me.ID || slices.ContainsFunc(followed, func(name string) bool {
+			return strings.EqualFold(name, s.User.AccountName)
+		}) {
+			continue
+		}
+		res = append(res, s)
+	}
+	return res, nil
+}
+
+// GET /api/v1/suggestions/follows?limit=
+// フォローを勧めるユーザー。Authorization: Bearerのトークンかセッションで認証する
+func getAPIFollowSuggestions(w http.ResponseWriter, r *http.Request) error {
+	var me User
+	if r.Header.Get("Authorization") != "" {
+		var err error
+		if me, err = apiTokenUser(r); err != nil {
+			return err
+		}
+	} else if me = currentUser(r); !isLogin(me) {
+		return errUnauthorized
+	}
+
+	limit := followSuggestionsDefaultLimit
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			return newHTTPError(http.StatusBadRequest, errors.New("invalid limit"))
+		}
+		limit = min(n, followSuggestionsMaxLimit)
+	}
+
+	suggestions, err := followSuggestionsFor(r.Context(), me, limit)
+	if err != nil {
+		return err
+	}
+	res := make([]apiFollowSuggestion, 0, len(suggestions))
+	for _, s := range suggestions {
+		res = append(res, apiFollowSuggestion{User: newAPIUser(s.User), RecentPosts: s.RecentPosts, RecentComments: s.RecentComments})
+	}
+	w.Header().Set("Cache-Control", "private, no-cache")
+	return writeJSON(w, http.StatusOK, struct {
+		Users []apiFollowSuggestion `json:"users"`
+	}{res})
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// 前段のプロキシが伝えた、元のリクエストのスキーム
+type forwardedRequest struct {
+	scheme string
+}
+
+// ISUCONP_TRUSTED_PROXIESのプロキシから来たリクエストについて、X-Forwarded-*から元のリクエストを組み立てるミドルウェア
+//   - X-Forwarded-For（ISUCONP_CLIENT_IP_HEADERを設定した場合はそのヘッダー）からクライアントのIPアドレスをRemoteAddrに入れる
+//   - X-Forwarded-Hostをr.Hostに入れる
+//   - X-Forwarded-ProtoはrequestSchemeで返す
+//
+// 信用しないアドレスから来たリクエストのX-Forwarded-*は取り除き、後段で誤って使われないようにする
+func withForwardedHeaders(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !isUnixSocketRequest(r) && !isTrustedProxy(remoteAddr(r.RemoteAddr)) {
+			for _, h := range []string{"X-Forwarded-For", "X-Forwarded-Host", "X-Forwarded-Proto", config.ClientIPHeader} {
+				if h != "" {
+					r.Header.Del(h)
+				}
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if ip, ok := forwardedClientIP(r); ok {
+			r.RemoteAddr = ip.String()
+		}
+		if host := firstHeaderValue(r, "X-Forwarded-Host"); host != "" {
+			r.Host = host
+		}
+		if proto := strings.ToLower(firstHeaderValue(r, "X-Forwarded-Proto")); proto == "http" || proto == "https" {
+			ctx := context.WithValue(r.Context(), forwardedContextKey, &forwardedRequest{scheme: proto})
+			r = r.WithContext(ctx)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// RemoteAddr（host:portか、withForwardedHeadersが入れたIPアドレス）のIPアドレス
+func remoteAddr(addr string) netip.Addr {
+	ip, err := netip.ParseAddr(addr)
+	if ap, perr := netip.ParseAddrPort(addr); perr == nil {
+		ip, err = ap.Addr(), nil
+	}
+	if err != nil {
+		return netip.Addr{}
+	}
+	// リンクローカルアドレスのゾーン（%eth0）は端末ごとの違いではないので除く
+	return ip.Unmap().WithZone("")
+}
+
+func isTrustedProxy(ip netip.Addr) bool {
+	if !ip.IsValid() {
+		return false
+	}
+	for _, p := range config.TrustedProxies {
+		if p.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// 元のクライアントのIPアドレス
+// X-Forwarded-Forはプロキシごとに末尾へ追記されるので、後ろから見て最初の信用しないアドレスを使う
+// （先頭の値はクライアントが自由に書けるため）
+func forwardedClientIP(r *http.Request) (netip.Addr, bool) {
+	header := "X-Forwarded-For"
+	if config.ClientIPHeader != "" {
+		header = config.ClientIPHeader
+	}
+	var ips []netip.Addr
+	for _, v := range r.Header.Values(header) {
+		for _, s := range strings.Split(v, ",") {
+			ip, err := netip.ParseAddr(strings.TrimSpace(s))
+			if err != nil {
+				return netip.Addr{}, false
+			}
+			ips = append(ips, ip.Unmap())
+		}
+	}
+	if len(ips) == 0 {
+		return netip.Addr{}, false
+	}
+	for i := len(ips) - 1; i > 0; i-- {
+		if !isTrustedProxy(ips[i]) {
+			return ips[i], true
+		}
+	}
+	return ips[0], true
+}
+
+func firstHeaderValue(r *http.Request, name string) string {
+	v, _, _ := strings.Cut(r.Header.Get(name), ",")
+	return strings.TrimSpace(v)
+}
+
+// 元のリクエストのスキーム（httpかhttps）
+func requestScheme(r *http.Request) string {
+	if f, ok := r.Context().Value(forwardedContextKey).(*forwardedRequest); ok {
+		return f.scheme
+	}
+	if r.TLS != nil {
+		return "https"
+	}
+	return "http"
+}
+
+// リクエスト元のIPアドレス
+// 前段のプロキシを経由した場合は、withForwardedHeadersがRemoteAddrに入れた元のクライアントのアドレス
+// IPv6は省略した形に揃え、IPv4射影アドレス（::ffff:192.0.2.1）はIPv4として返す
+func clientIP(r *http.Request) string {
+	if ip := remoteAddr(r.RemoteAddr); ip.IsValid() {
+		return ip.String()
+	}
+	return r.RemoteAddr
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bytes"
+	"html/template"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	// キャッシュするフラグメントを描画するときにCSRFトークンと冪等キーの代わりに渡す
+	// csrfFieldとidempotencyFieldはinputの代わりに下の印を出す
+	csrfTokenPlaceholder = "__ISU_CSRF_TOKEN__"
+	formKeyPlaceholder   = "__ISU_FORM_KEY__"
+	// 描画時にユーザーのCSRFトークンのinputに置き換える印
+	// エスケープしたユーザーの入力には<がそのまま含まれないので、本文やコメントが印と一致することはない
+	csrfFieldPlaceholder = "<!--isu:csrf-token-->"
+	// 同様に描画ごとに作るコメントフォームの冪等キーのinputに置き換える
+	formKeyFieldPlaceholder = "<!--isu:form-key-->"
+	// 保持するフラグメントの最大数
+	postFragmentsMax = 20000
+)
+
+// 描画済みのpost.html（一覧用のコメント3件版）のキャッシュ
+var postFragments = struct {
+	sync.RWMutex
+	data map[int][]byte
+}{
+	data: make(map[int][]byte),
+}
+
+func getPostFragment(postID int) ([]byte, bool) {
+	postFragments.RLock()
+	defer postFragments.RUnlock()
+	b, found := postFragments.data[postID]
+	return b, found
+}
+
+func setPostFragment(postID int, b []byte) {
+	postFragments.Lock()
+	defer postFragments.Unlock()
+	if len(postFragments.data) >= postFragmentsMax {
+		// 上限に達したら適当に1件捨てる
+		for k := range postFragments.data {
+			delete(postFragments.data, k)
+			break
+		}
+	}
+	postFragments.data[postID] = b
+}
+
+func removePostFragment(postID int) {
+	postFragments.Lock()
+	delete(postFragments.data, postID)
+	postFragments.Unlock()
+}
+
+func clearPostFragments() {
+	postFragments.Lock()
+	postFragments.data = make(map[int][]byte)
+	postFragments.Unlock()
+}
+
+func registerPostFragmentInvalidation() {
+	registerInvalidation("post_fragment", func(key string) {
+		if key == "" {
+			clearPostFragments()
+			return
+		}
+		if pid, err := strconv.Atoi(key); err == nil {
+			removePostFragment(pid)
+		}
+	})
+	subscribe(events, func(e CommentCreated) {
+		invalidate("post_fragment", strconv.Itoa(e.PostID))
+	})
+	subscribe(events, func(e CommentVoted) {
+		invalidate("post_fragment", strconv.Itoa(e.PostID))
+	})
+}
+
+// 一覧用の投稿をキャッシュ済みのフラグメントをつなげて描画する
+// 変更のない投稿はテンプレートを実行しない
+func renderPosts(posts []Post, csrfToken string) (template.HTML, error) {
+	out, err := renderPostFragments(posts)
+	if err != nil {
+		return "", err
+	}
+	// 冪等キーは投稿ごとに区別して使うので、ページ内の全てのフォームで同じものでよい
+	return template.HTML(fillFormPlaceholders(string(out), csrfToken, newIdempotencyKey())), nil
+}
+
+// フラグメントのCSRFトークンと冪等キーのinputを埋める
+func fillFormPlaceholders(s, csrfToken, formKey string) string {
+	return strings.NewReplacer(
+		csrfFieldPlaceholder, string(csrfField(csrfToken)),
+		formKeyFieldPlaceholder, string(idempotencyField(formKey)),
+	).Replace(s)
+}
+
+// フラグメントをプレースホルダーを残したままつなげる
+func renderPostFragments(posts []Post) (template.HTML, error) {
+	out, buf := getBuffer(), getBuffer()
+	defer putBuffer(out)
+	defer putBuffer(buf)
+	for _, p := range posts {
+		fragment, found := getPostFragment(p.ID)
+		if !found {
+			buf.Reset()
+			p.CSRFToken = csrfTokenPlaceholder
+			p.FormKey = formKeyPlaceholder
+			if err := templates.post.ExecuteTemplate(buf, "post.html", p); err != nil {
+				return "", err
+			}
+			fragment = bytes.Clone(buf.Bytes())
+			setPostFragment(p.ID, fragment)
+		}
+		out.Write(fragment)
+	}
+
+	return template.HTML(out.String()), nil
+}
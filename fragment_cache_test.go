@@ -0,0 +1,43 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// 本文やコメントに印と同じ文字列を書いても、CSRFトークンや冪等キーに置き換えない
+func TestFillFormPlaceholdersIgnoresUserContent(t *testing.T) {
+	useFixtureDB(t, newFixtureTables())
+	clearPostFragments()
+	t.Cleanup(clearPostFragments)
+
+	inputs := []string{
+		csrfTokenPlaceholder, formKeyPlaceholder, headerMenuPlaceholder,
+		csrfFieldPlaceholder, formKeyFieldPlaceholder,
+	}
+	body := strings.Join(inputs, " ")
+	p := Post{
+		ID: 1, UserID: 1, Body: body, Mime: "image/jpeg", CreatedAt: time.Now(),
+		User:     User{ID: 1, AccountName: "alice"},
+		Comments: []Comment{{ID: 1, PostID: 1, UserID: 1, Comment: body, User: User{ID: 1, AccountName: "alice"}}},
+	}
+	html, err := renderPosts([]Post{p}, "SECRET-TOKEN")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := string(html)
+	if n := strings.Count(s, "SECRET-TOKEN"); n != 1 {
+		t.Errorf("csrf token appears %d times, want once (in the comment form):\n%s", n, s)
+	}
+	if !strings.Contains(s, `<input type="hidden" name="csrf_token" value="SECRET-TOKEN">`) {
+		t.Errorf("comment form has no csrf token:\n%s", s)
+	}
+	if n := strings.Count(s, `name="idempotency_key"`); n != 1 {
+		t.Errorf("idempotency key field appears %d times, want once:\n%s", n, s)
+	}
+	// 本文とコメントに書いた文字列はエスケープされたまま残る
+	if n := strings.Count(s, "__ISU_CSRF_TOKEN__"); n != 2 {
+		t.Errorf("user content was replaced:\n%s", s)
+	}
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"math"
+	"runtime/debug"
+	"strconv"
+)
+
+// GCの頻度を下げるためだけに確保しておく領域
+// 触らないので実際のメモリはほとんど消費しない
+var gcBallast []byte
+
+// GCの設定を反映して、実際に使われる値をログに出す
+// 設定しなかったものはGOGC・GOMEMLIMITまたはランタイムの既定値のまま
+func setupGC() {
+	if config.GCPercent != 0 {
+		debug.SetGCPercent(config.GCPercent)
+	}
+	if config.MemoryLimitMB > 0 {
+		debug.SetMemoryLimit(int64(config.MemoryLimitMB) << 20)
+	}
+	if config.GCBallastMB > 0 {
+		gcBallast = make([]byte, config.GCBallastMB<<20)
+	}
+
+	// SetGCPercentは前の値を返すので、読んだら元に戻す
+	percent := debug.SetGCPercent(100)
+	debug.SetGCPercent(percent)
+	limit := "none"
+	if l := debug.SetMemoryLimit(-1); l != math.MaxInt64 {
+		limit = strconv.FormatInt(l>>20, 10) + "MB"
+	}
+	logger("gc").Info("GC settings", "gc_percent", percent, "memory_limit", limit, "ballast_mb", len(gcBallast)>>20)
+}
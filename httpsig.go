@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// HTTP Signatures (draft-cavage-http-signatures) のうちActivityPubで使われる範囲の実装
+// rsa-sha256 と hs2019（鍵がRSAの場合）だけに対応する
+
+const (
+	// 署名するヘッダー
+	signedHeaders = "(request-target) host date digest"
+	// Dateヘッダーの許容するずれ
+	signatureMaxSkew = 1 * time.Hour
+)
+
+var errInvalidSignature = newHTTPError(http.StatusUnauthorized, errors.New("invalid http signature"))
+
+// Signatureヘッダーの中身
+type httpSignature struct {
+	keyID     string
+	algorithm string
+	headers   []string
+	signature []byte
+}
+
+func parseSignatureHeader(v string) (httpSignature, error) {
+	sig := httpSignature{headers: []string{"date"}}
+	for _, part := range strings.Split(v, ",") {
+		k, val, ok := strings.Cut(strings.TrimSpace(part), "=")
+		if !ok {
+			continue
+		}
+		val = strings.Trim(val, `"`)
+		switch k {
+		case "keyId":
+			sig.keyID = val
+		case "algorithm":
+			sig.algorithm = val
+		case "headers":
+			sig.headers = strings.Fields(strings.ToLower(val))
+		case "signature":
+			b, err := base64.StdEncoding.DecodeString(val)
+			if err != nil {
+				return httpSignature{}, err
+			}
+			sig.signature = b
+		}
+	}
+	if sig.keyID == "" || len(sig.signature) == 0 {
+		return httpSignature{}, errors.New("missing keyId or signature")
+	}
+	if sig.algorithm != "" && sig.algorithm != "rsa-sha256" && sig.algorithm != "hs2019" {
+		return httpSignature{}, fmt.Errorf("unsupported signature algorithm: %s", sig.algorithm)
+	}
+	return sig, nil
+}
+
+// 署名対象の文字列を組み立てる
+func signingString(r *http.Request, headers []string) (string, error) {
+	lines := make([]string, 0, len(headers))
+	for _, h := range headers {
+		var v string
+		switch h {
+		case "(request-target)":
+			// ISUCONP_PATH_PREFIXで取り除く前の、送り手が署名したパスを使う
+			v = strings.ToLower(r.Method) + " " + appPath(r.URL.RequestURI())
+		case "host":
+			v = r.Host
+			if v == "" {
+				v = r.URL.Host
+			}
+		default:
+			v = r.Header.Get(h)
+			if v == "" {
+				return "", fmt.Errorf("signed header %q is missing", h)
+			}
+		}
+		lines = append(lines, h+": "+v)
+	}
+	return strings.Join(lines, "\n"), nil
+}
+
+func bodyDigest(body []byte) string {
+	sum := sha256.Sum256(body)
+	return "SHA-256=" + base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// リクエストに署名する
+// bodyはリクエストに設定済みのボディと同じもの
+func signRequest(r *http.Request, body []byte, keyID string, key *rsa.PrivateKey) error {
+	r.Header.Set("Date", time.Now().UTC().Format(http.TimeFormat))
+	r.Header.Set("Digest", bodyDigest(body))
+	if r.Host == "" {
+		r.Host = r.URL.Host
+	}
+
+	headers := strings.Fields(signedHeaders)
+	s, err := signingString(r, headers)
+	if err != nil {
+		return err
+	}
+	sum := sha256.Sum256([]byte(s))
+	sig, err := rsa.SignPKCS1v15(nil, key, crypto.SHA256, sum[:])
+	if err != nil {
+		return err
+	}
+
+	r.Header.Set("Signature", fmt.Sprintf(`keyId="%s",algorithm="rsa-sha256",headers="%s",signature="%s"`,
+		keyID, signedHeaders, base64.StdEncoding.EncodeToString(sig)))
+	return nil
+}
+
+// 受け取ったリクエストの署名を検証し、署名に使われた鍵のIDを返す
+// lookupKeyは鍵のIDから公開鍵を取得する
+func verifyRequest(r *http.Request, body []byte, lookupKey func(keyID string) (*rsa.PublicKey, error)) (string, error) {
+	sig, err := parseSignatureHeader(r.Header.Get("Signature"))
+	if err != nil {
+		return "", newHTTPError(http.StatusUnauthorized, err)
+	}
+
+	// ボディを書き換えられないようDigestも署名に含まれていることを要求する
+	covered := strings.Join(sig.headers, " ")
+	if !strings.Contains(covered, "(request-target)") || !strings.Contains(covered, "digest") {
+		return "", errInvalidSignature
+	}
+	if r.Header.Get("Digest") != bodyDigest(body) {
+		return "", errInvalidSignature
+	}
+
+	date, err := http.ParseTime(r.Header.Get("Date"))
+	if err != nil || time.Since(date).Abs() > signatureMaxSkew {
+		return "", errInvalidSignature
+	}
+
+	s, err := signingString(r, sig.headers)
+	if err != nil {
+		return "", newHTTPError(http.StatusUnauthorized, err)
+	}
+
+	pub, err := lookupKey(sig.keyID)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256([]byte(s))
+	if err := rsa.VerifyPKCS1v15(pub, crypto.SHA256, sum[:], sig.signature); err != nil {
+		return "", errInvalidSignature
+	}
+	return sig.keyID, nil
+}
+
+func encodePublicKeyPEM(pub *rsa.PublicKey) (string, error) {
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return "", err
+	}
+	var buf bytes.Buffer
+	if err := pem.Encode(&buf, &pem.Block{Type: "PUBLIC KEY", Bytes: der}); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+func parsePublicKeyPEM(s string) (*rsa.PublicKey, error) {
+	block, _ := pem.Decode([]byte(s))
+	if block == nil {
+		return nil, errors.New("invalid public key pem")
+	}
+
+	var key any
+	var err error
+	switch block.Type {
+	case "RSA PUBLIC KEY":
+		key, err = x509.ParsePKCS1PublicKey(block.Bytes)
+	default:
+		key, err = x509.ParsePKIXPublicKey(block.Bytes)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	pub, ok := key.(*rsa.PublicKey)
+	if !ok {
+		return nil, errors.New("public key is not rsa")
+	}
+	return pub, nil
+}
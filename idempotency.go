@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	// 同じキーで送られたリクエストを再送とみなす期間
+	idempotencyTTL = time.Hour
+	// 同じキーのリクエストが処理中の場合に結果を待つ時間（二重クリックなど）
+	idempotencyWait = 3 * time.Second
+	// 結果を待つ間にキャッシュを確認する間隔
+	idempotencyPollInterval = 50 * time.Millisecond
+	// キーの最大長
+	idempotencyKeyMaxLen = 128
+)
+
+var errIdempotencyInProgress = newHTTPError(http.StatusConflict, errors.New("同じリクエストを処理中です"))
+
+// 投稿やコメントの二重送信を防ぐためのキーの予約
+// 処理が終わったらcompleteで結果を残す。completeしなかった場合はreleaseで予約を取り消す
+type idempotencyClaim struct {
+	key  string
+	done bool
+}
+
+func idempotencyCacheKey(userID int, scope, key string) string {
+	return "idem:" + strconv.Itoa(userID) + ":" + scope + ":" + key
+}
+
+// リクエストの冪等キー（APIはIdempotency-Keyヘッダー、フォームはidempotency_key）
+func requestIdempotencyKey(r *http.Request) string {
+	if key := r.Header.Get("Idempotency-Key"); key != "" {
+		return key
+	}
+	return r.FormValue("idempotency_key")
+}
+
+// フォームに埋め込む冪等キー
+func newIdempotencyKey() string {
+	return secureRandomStr(16)
+}
+
+// ユーザーのscopeでの冪等キーを予約する
+// 同じキーで処理済みの場合は、そのときに残した結果を2番目の戻り値で返す
+// keyが空の場合やキャッシュが使えない場合は確認せずに処理させる（nilのclaimを返す）
+func claimIdempotencyKey(ctx context.Context, userID int, scope, key string) (*idempotencyClaim, string, error) {
+	if key == "" {
+		return nil, "", nil
+	}
+	if len(key) > idempotencyKeyMaxLen {
+		return nil, "", newHTTPError(http.StatusBadRequest, errors.New("idempotency key is too long"))
+	}
+
+	k := idempotencyCacheKey(userID, scope, key)
+	n, err := cacheStore.Incr(ctx, k+":lock", 1, idempotencyTTL)
+	if err != nil {
+		logger("idempotency").Error("failed to claim idempotency key", "err", err)
+		return nil, "", nil
+	}
+	if n == 1 {
+		return &idempotencyClaim{key: k}, "", nil
+	}
+
+	// 先に来たリクエストの結果を待つ
+	// クライアントが切れたりルートの制限時間を過ぎたりした場合は、待ちきれなかった場合と同じく処理中として返す
+	deadline := time.NewTimer(idempotencyWait)
+	defer deadline.Stop()
+	ticker := time.NewTicker(idempotencyPollInterval)
+	defer ticker.Stop()
+	for {
+		if b, err := cacheStore.Get(ctx, k+":result"); err == nil {
+			return nil, string(b), nil
+		}
+		select {
+		case <-ctx.Done():
+			return nil, "", errIdempotencyInProgress
+		case <-deadline.C:
+			return nil, "", errIdempotencyInProgress
+		case <-ticker.C:
+		}
+	}
+}
+
+// 処理の結果を残す。同じキーの再送にはこの結果を返す
+func (c *idempotencyClaim) complete(ctx context.Context, result string) {
+	if c == nil {
+		return
+	}
+	c.done = true
+	if err := cacheStore.Set(ctx, c.key+":result", []byte(result), idempotencyTTL); err != nil {
+		logger("idempotency").Error("failed to store idempotency result", "err", err)
+	}
+}
+
+// completeしていなければ予約を取り消して、同じキーで送り直せるようにする
+func (c *idempotencyClaim) release(ctx context.Context) {
+	if c == nil || c.done {
+		return
+	}
+	if err := cacheStore.Delete(ctx, c.key+":lock"); err != nil {
+		logger("idempotency").Error("failed to release idempotency key", "err", err)
+	}
+}
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// 先に来たリクエストの結果を待っている間に呼び出し元が切れたら、すぐに待つのをやめる
+func TestClaimIdempotencyKeyStopsWaitingOnCancel(t *testing.T) {
+	origCache := cacheStore
+	// 予約は取れず（Incrが1を返さない）、結果も見つからない
+	cacheStore = missCache{}
+	t.Cleanup(func() { cacheStore = origCache })
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, _, err := claimIdempotencyKey(ctx, 1, "post", "key")
+	if !errors.Is(err, errIdempotencyInProgress) {
+		t.Fatalf("err = %v, want %v", err, errIdempotencyInProgress)
+	}
+	if elapsed := time.Since(start); elapsed >= idempotencyWait {
+		t.Errorf("waited %v after the context was done", elapsed)
+	}
+}
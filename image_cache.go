@@ -0,0 +1,267 @@
+package main
+
+import (
+	"container/list"
+	"hash/fnv"
+	"sync"
+	"time"
+)
+
+// 画像のキャッシュ
+// lruは最近使ったエントリほど前に並べ、一杯になったら後ろから追い出す
+var imageCache = struct {
+	sync.RWMutex
+	data    map[string]*cacheEntry
+	lru     *list.List
+	maxSize int64
+	curSize int64
+}{
+	data:    make(map[string]*cacheEntry),
+	lru:     list.New(),
+	maxSize: 100 * 1024 * 1024, // 100MB
+}
+
+type cacheEntry struct {
+	key  string
+	data []byte
+	etag string
+	elem *list.Element
+}
+
+const (
+	// 存在しない画像を覚えておく時間
+	missingImageTTL = 10 * time.Second
+	// 覚えておく存在しない画像の最大数
+	missingImagesMax = 10000
+)
+
+// 存在しない画像のキャッシュ
+// 削除済みや不正なIDへのリクエストが繰り返されてもDBに問い合わせない
+var missingImages = struct {
+	sync.Mutex
+	data map[string]time.Time
+}{
+	data: make(map[string]time.Time),
+}
+
+// 画像ごとのアクセス頻度の見積もり（Count-Min Sketch）
+// 追い出す画像よりよく見られている画像だけをキャッシュに入れる
+var imageFreq = newFrequencySketch(1 << 16)
+
+type frequencySketch struct {
+	mu        sync.Mutex
+	rows      [4][]uint8
+	mask      uint32
+	additions int
+	// additionsがこの数に達したらカウンタを半分にして古い頻度を忘れる
+	resetAt int
+}
+
+// 頻度カウンタの上限
+const frequencyMax = 15
+
+func newFrequencySketch(width int) *frequencySketch {
+	s := &frequencySketch{
+		mask:    uint32(width - 1),
+		resetAt: width * 10,
+	}
+	for i := range s.rows {
+		s.rows[i] = make([]uint8, width)
+	}
+	return s
+}
+
+func (s *frequencySketch) indexes(key string) [4]uint32 {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	sum := h.Sum64()
+	h1, h2 := uint32(sum), uint32(sum>>32)
+	var idx [4]uint32
+	for i := range idx {
+		idx[i] = (h1 + uint32(i)*h2) & s.mask
+	}
+	return idx
+}
+
+func (s *frequencySketch) increment(key string) {
+	idx := s.indexes(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, j := range idx {
+		if s.rows[i][j] < frequencyMax {
+			s.rows[i][j]++
+		}
+	}
+	s.additions++
+	if s.additions >= s.resetAt {
+		for i := range s.rows {
+			for j := range s.rows[i] {
+				s.rows[i][j] /= 2
+			}
+		}
+		s.additions /= 2
+	}
+}
+
+func (s *frequencySketch) estimate(key string) uint8 {
+	idx := s.indexes(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	est := uint8(frequencyMax)
+	for i, j := range idx {
+		est = min(est, s.rows[i][j])
+	}
+	return est
+}
+
+func (s *frequencySketch) reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := range s.rows {
+		clear(s.rows[i])
+	}
+	s.additions = 0
+}
+
+// キャッシュのエントリを追加
+// 大きすぎる画像と、追い出す画像より頻度の低い画像はキャッシュしない
+func addToCache(key string, data []byte, etag string) {
+	// 新しいデータのサイズ
+	newSize := int64(len(data))
+	if newSize > int64(reloadable().ImageCacheMaxEntryBytes) {
+		return
+	}
+	freq := imageFreq.estimate(key)
+
+	imageCache.Lock()
+	defer imageCache.Unlock()
+
+	// 同じキーのエントリは置き換えるので空くものとして数える
+	// 入れないと決まるまでは消さない（入れない場合は古いエントリを残す）
+	old := imageCache.data[key]
+	size := imageCache.curSize
+	if old != nil {
+		size -= int64(len(old.data))
+	}
+
+	// キャッシュが一杯の場合、最も長く使われていないエントリから追い出す候補を選ぶ
+	var victims []*cacheEntry
+	for e := imageCache.lru.Back(); e != nil && size+newSize > imageCache.maxSize; e = e.Prev() {
+		entry := e.Value.(*cacheEntry)
+		if entry == old {
+			continue
+		}
+		if imageFreq.estimate(entry.key) >= freq {
+			// 候補よりよく使われている画像は追い出さない
+			return
+		}
+		victims = append(victims, entry)
+		size -= int64(len(entry.data))
+	}
+
+	if old != nil {
+		removeCacheEntry(old)
+	}
+	for _, entry := range victims {
+		removeCacheEntry(entry)
+	}
+
+	// 新しいエントリを追加
+	entry := &cacheEntry{key: key, data: data, etag: etag}
+	entry.elem = imageCache.lru.PushFront(entry)
+	imageCache.data[key] = entry
+	imageCache.curSize += newSize
+}
+
+// imageCacheのロックを取った状態で呼ぶ
+func removeCacheEntry(entry *cacheEntry) {
+	imageCache.lru.Remove(entry.elem)
+	delete(imageCache.data, entry.key)
+	imageCache.curSize -= int64(len(entry.data))
+}
+
+// キャッシュからエントリを削除
+func removeFromCache(key string) {
+	imageCache.Lock()
+	if entry, found := imageCache.data[key]; found {
+		removeCacheEntry(entry)
+	}
+	imageCache.Unlock()
+
+	missingImages.Lock()
+	delete(missingImages.data, key)
+	missingImages.Unlock()
+}
+
+// 画像が存在しないことを記録する
+func markMissingImage(key string) {
+	missingImages.Lock()
+	defer missingImages.Unlock()
+	if len(missingImages.data) >= missingImagesMax {
+		// 上限に達したらまとめて忘れる
+		missingImages.data = make(map[string]time.Time)
+	}
+	missingImages.data[key] = time.Now().Add(missingImageTTL)
+}
+
+// 期限の切れた存在しない画像の記録を捨てる
+func purgeExpiredMissingImages() {
+	now := time.Now()
+	missingImages.Lock()
+	defer missingImages.Unlock()
+	for key, expires := range missingImages.data {
+		if now.After(expires) {
+			delete(missingImages.data, key)
+		}
+	}
+}
+
+// 最近存在しないと分かった画像かどうか
+func isMissingImage(key string) bool {
+	missingImages.Lock()
+	defer missingImages.Unlock()
+	expires, found := missingImages.data[key]
+	if !found {
+		return false
+	}
+	if time.Now().After(expires) {
+		delete(missingImages.data, key)
+		return false
+	}
+	return true
+}
+
+// キャッシュからエントリを取得
+// ヒットしなかった場合もアクセス頻度は記録する
+func getFromCache(key string) ([]byte, string, bool) {
+	imageFreq.increment(key)
+
+	imageCache.RLock()
+	entry, found := imageCache.data[key]
+	imageCache.RUnlock()
+
+	if !found {
+		return nil, "", false
+	}
+
+	// 最近使ったエントリとして前に移す（その間に追い出されていた場合は何もしない）
+	imageCache.Lock()
+	imageCache.lru.MoveToFront(entry.elem)
+	imageCache.Unlock()
+
+	return entry.data, entry.etag, true
+}
+
+// キャッシュをクリアする関数
+func clearImageCache() {
+	imageCache.Lock()
+	imageCache.data = make(map[string]*cacheEntry)
+	imageCache.lru = list.New()
+	imageCache.curSize = 0
+	imageCache.Unlock()
+	imageFreq.reset()
+
+	missingImages.Lock()
+	missingImages.data = make(map[string]time.Time)
+	missingImages.Unlock()
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func useImageCache(t *testing.T, maxSize int64) {
+	t.Helper()
+	clearImageCache()
+	orig := imageCache.maxSize
+	imageCache.maxSize = maxSize
+	t.Cleanup(func() {
+		imageCache.maxSize = orig
+		clearImageCache()
+	})
+}
+
+// 一杯になったら最も長く使われていない画像から追い出す
+func TestAddToCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	useImageCache(t, 30)
+
+	for _, key := range []string{"a", "b", "c"} {
+		addToCache(key, bytes.Repeat([]byte(key), 10), key)
+	}
+	getFromCache("a")
+	getFromCache("d")
+	getFromCache("d")
+	addToCache("d", bytes.Repeat([]byte("d"), 10), "d")
+
+	for key, want := range map[string]bool{"a": true, "b": false, "c": true, "d": true} {
+		imageCache.RLock()
+		_, found := imageCache.data[key]
+		imageCache.RUnlock()
+		if found != want {
+			t.Errorf("%s cached = %v, want %v", key, found, want)
+		}
+	}
+	if imageCache.curSize != 30 {
+		t.Errorf("curSize = %d, want 30", imageCache.curSize)
+	}
+}
+
+// 入れないと決めた場合は、同じキーの古いエントリを残す
+func TestAddToCacheKeepsEntryWhenNotAdmitted(t *testing.T) {
+	useImageCache(t, 20)
+
+	addToCache("a", []byte("old-a-data"), "old")
+	addToCache("b", []byte("old-b-data"), "b")
+	for range 3 {
+		getFromCache("a")
+		getFromCache("b")
+	}
+	// bを追い出さないと入らないが、bはaと同じだけ使われている
+	addToCache("a", bytes.Repeat([]byte("n"), 20), "new")
+
+	data, etag, found := getFromCache("a")
+	if !found || etag != "old" || string(data) != "old-a-data" {
+		t.Errorf("getFromCache(a) = %q, %q, %v; want the old entry", data, etag, found)
+	}
+	if _, _, found := getFromCache("b"); !found {
+		t.Error("b was evicted")
+	}
+	if imageCache.curSize != 20 {
+		t.Errorf("curSize = %d, want 20", imageCache.curSize)
+	}
+}
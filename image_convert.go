@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// 変換コマンドが固まってもリクエストを待たせ続けないようにする
+const imageConvertTimeout = 30 * time.Second
+
+// 標準入力から画像を読み、標準出力に書く外部コマンドで画像を変換する
+// 標準ライブラリで扱えない形式（HEIC、AVIF）に使う
+func runImageConvertCommand(ctx context.Context, argv []string, data []byte) ([]byte, error) {
+	if len(argv) == 0 {
+		return nil, errors.New("convert command is not configured")
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, imageConvertTimeout)
+	defer cancel()
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, argv[0], argv[1:]...)
+	cmd.Stdin = bytes.NewReader(data)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("%s: %w: %s", argv[0], err, bytes.TrimSpace(stderr.Bytes()))
+	}
+	return stdout.Bytes(), nil
+}
+
+// HEIC/HEIFの画像をISUCONP_HEIC_CONVERT_COMMANDでJPEGに変換する
+func convertHEICToJPEG(ctx context.Context, data []byte) ([]byte, error) {
+	out, err := runImageConvertCommand(ctx, config.HEICConvertCommand, data)
+	if err != nil {
+		return nil, fmt.Errorf("heic: %w", err)
+	}
+
+	// 変換結果も中身で確かめる
+	if http.DetectContentType(out) != "image/jpeg" {
+		return nil, errors.New("heic: convert command did not output jpeg")
+	}
+	return out, nil
+}
+
+// ベースラインのJPEGをISUCONP_JPEG_PROGRESSIVE_COMMANDでプログレッシブに変換する
+// 変換できなかった場合は元のJPEGを返す
+func makeProgressiveJPEG(data []byte) []byte {
+	out, err := runImageConvertCommand(context.Background(), config.JPEGProgressiveCommand, data)
+	if err == nil && http.DetectContentType(out) != "image/jpeg" {
+		err = errors.New("convert command did not output jpeg")
+	}
+	if err != nil {
+		logger("image").Warn("failed to make progressive jpeg", "err", err)
+		return data
+	}
+	return out
+}
+
+// ISUCONP_AVIF_ENCODE_COMMANDが設定されている場合だけAVIFで配信する
+func avifEnabled() bool {
+	return len(config.AVIFEncodeCommand) > 0
+}
+
+func acceptsAVIF(r *http.Request) bool {
+	return strings.Contains(r.Header.Get("Accept"), "image/avif")
+}
+
+// 画像キャッシュでのAVIF版のキー
+func avifVariantKey(cacheKey string) string {
+	return cacheKey + ".avif"
+}
+
+// 画像をISUCONP_AVIF_ENCODE_COMMANDでAVIFに変換する
+func encodeAVIF(ctx context.Context, data []byte) ([]byte, error) {
+	out, err := runImageConvertCommand(ctx, config.AVIFEncodeCommand, data)
+	if err != nil {
+		return nil, fmt.Errorf("avif: %w", err)
+	}
+
+	// ISOBMFFのftypボックスでAVIFであることを確かめる
+	if len(out) < 12 || string(out[4:8]) != "ftyp" || (string(out[8:12]) != "avif" && string(out[8:12]) != "avis") {
+		return nil, errors.New("avif: encode command did not output avif")
+	}
+	return out, nil
+}
+
+// ISUCONP_WEBP_ENCODE_COMMANDが設定されている場合だけWebPで配信する
+func webpEnabled() bool {
+	return len(config.WebPEncodeCommand) > 0
+}
+
+func acceptsWebP(r *http.Request) bool {
+	return strings.Contains(r.Header.Get("Accept"), "image/webp")
+}
+
+// 画像キャッシュでのWebP版のキー
+func webpVariantKey(cacheKey string) string {
+	return cacheKey + ".webp"
+}
+
+// 画像をISUCONP_WEBP_ENCODE_COMMANDでWebPに変換する
+func encodeWebP(ctx context.Context, data []byte) ([]byte, error) {
+	out, err := runImageConvertCommand(ctx, config.WebPEncodeCommand, data)
+	if err != nil {
+		return nil, fmt.Errorf("webp: %w", err)
+	}
+
+	// RIFFのヘッダーでWebPであることを確かめる
+	if http.DetectContentType(out) != "image/webp" {
+		return nil, errors.New("webp: encode command did not output webp")
+	}
+	return out, nil
+}
@@ -0,0 +1,398 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+var errImageNotFound = errors.New("image store: not found")
+
+// 投稿画像やアイコンの保存先
+// ISUCONP_IMAGE_STOREがs3ならS3互換のストレージ、なければISUCONP_IMAGE_DIRのディレクトリを使う
+// 複数台で動かす場合はS3互換のストレージにすると、どのサーバーでアップロードした画像も配信できる
+type ImageStore interface {
+	Put(ctx context.Context, key string, data []byte, contentType string) error
+	// 無い場合はerrImageNotFound
+	Get(ctx context.Context, key string) ([]byte, error)
+	// 無い場合も成功にする
+	Delete(ctx context.Context, key string) error
+	// dir（""か/で終わるもの）の直下のキー
+	List(ctx context.Context, dir string) ([]string, error)
+}
+
+var imageStore ImageStore
+
+// 一度に書き出す投稿の数
+const imageExportBatchSize = 100
+
+// 環境変数から保存先を選ぶ
+// S3の設定が足りない場合はディレクトリに保存する
+func setupImageStore() {
+	if config.ImageStore == "s3" {
+		s, err := newS3ImageStore(config)
+		if err == nil {
+			imageStore = s
+			return
+		}
+		logger("config").Error("invalid S3 settings, storing images in ISUCONP_IMAGE_DIR", "err", err)
+	} else if config.ImageStore != "fs" {
+		logger("config").Warn("invalid ISUCONP_IMAGE_STORE", "value", config.ImageStore, "using", "fs")
+	}
+	imageStore = &fsImageStore{dir: config.ImageDir}
+}
+
+// 投稿画像のキー（<投稿ID>.<拡張子>）
+// URLの/image/<投稿ID>.<拡張子>と同じ名前にしているので、ディレクトリに保存する場合はnginxからそのまま配信することもできる
+func postImageKey(pid int, ext string) string {
+	return strconv.Itoa(pid) + "." + ext
+}
+
+// 投稿画像のWebP版のキー（<投稿ID>.webp）
+// /image/<投稿ID>.webpでは配信せず、/image/<投稿ID>.<拡張子>をWebPを受け付けるクライアントに返すときに使う
+func webpImageKey(pid int) string {
+	return strconv.Itoa(pid) + ".webp"
+}
+
+// 投稿画像のAVIF版のキー（<投稿ID>.avif）
+// 最初にAVIFで配信するときに作って保存し、再起動やキャッシュから追い出された後に変換し直さないようにする
+func avifImageKey(pid int) string {
+	return strconv.Itoa(pid) + ".avif"
+}
+
+// アイコンのキー（avatars/<ユーザーID>.<拡張子>）
+func avatarImageKey(userID int, mime string) string {
+	return "avatars/" + strconv.Itoa(userID) + imageExt(mime)
+}
+
+// 投稿画像を保存する
+func putPostImage(ctx context.Context, pid int, mime string, data []byte) error {
+	ext := strings.TrimPrefix(imageExt(mime), ".")
+	if ext == "" {
+		return fmt.Errorf("unsupported mime type: %q", mime)
+	}
+	return imageStore.Put(ctx, postImageKey(pid, ext), data, mime)
+}
+
+// 投稿の画像とその変換した版のキー
+func postImageKeys(pid int, mime string) []string {
+	ext := strings.TrimPrefix(imageExt(mime), ".")
+	if ext == "" {
+		return nil
+	}
+	return []string{postImageKey(pid, ext), webpImageKey(pid), avifImageKey(pid)}
+}
+
+func deletePostImage(ctx context.Context, pid int, mime string) {
+	for _, key := range postImageKeys(pid, mime) {
+		if err := imageStore.Delete(ctx, key); err != nil {
+			logger("image").WarnContext(ctx, "failed to remove image", "post_id", pid, "key", key, "err", err)
+		}
+	}
+}
+
+// ユーザーのアイコンを消す
+// 変更したときに前の形式のものが残っている場合もあるので、どの形式も消す
+func deleteAvatarImages(ctx context.Context, userID int) {
+	for _, mime := range []string{"image/jpeg", "image/png", "image/gif"} {
+		key := avatarImageKey(userID, mime)
+		if err := imageStore.Delete(ctx, key); err != nil {
+			logger("image").WarnContext(ctx, "failed to remove avatar", "user_id", userID, "key", key, "err", err)
+		}
+	}
+}
+
+// AVIF版を作って保存する
+func putAVIFVariant(ctx context.Context, pid int, data []byte) ([]byte, error) {
+	avif, err := encodeAVIF(ctx, data)
+	if err != nil {
+		return nil, err
+	}
+	if err := imageStore.Put(ctx, avifImageKey(pid), avif, "image/avif"); err != nil {
+		logger("image").WarnContext(ctx, "failed to store avif", "post_id", pid, "err", err)
+	}
+	return avif, nil
+}
+
+// WebP版を作って保存する。作れなかった場合は配信するときに作り直す
+func putWebPVariant(ctx context.Context, pid int, data []byte) ([]byte, error) {
+	webp, err := encodeWebP(ctx, data)
+	if err != nil {
+		return nil, err
+	}
+	if err := imageStore.Put(ctx, webpImageKey(pid), webp, "image/webp"); err != nil {
+		logger("image").WarnContext(ctx, "failed to store webp", "post_id", pid, "err", err)
+	}
+	return webp, nil
+}
+
+// ディレクトリに保存する
+type fsImageStore struct {
+	dir string
+}
+
+func (s *fsImageStore) filePath(key string) string {
+	return filepath.Join(s.dir, filepath.FromSlash(key))
+}
+
+// 読み込み中のリクエストが書きかけのファイルを読まないよう、一時ファイルに書いてから名前を変える
+func (s *fsImageStore) Put(_ context.Context, key string, data []byte, _ string) error {
+	name := s.filePath(key)
+	if err := os.MkdirAll(filepath.Dir(name), 0o755); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(filepath.Dir(name), ".upload-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	// nginxなど別のユーザーから読めるようにする（CreateTempは0600で作る）
+	if err := os.Chmod(f.Name(), 0o644); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), name)
+}
+
+func (s *fsImageStore) Get(_ context.Context, key string) ([]byte, error) {
+	data, err := os.ReadFile(s.filePath(key))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, errImageNotFound
+	}
+	return data, err
+}
+
+func (s *fsImageStore) Delete(_ context.Context, key string) error {
+	if err := os.Remove(s.filePath(key)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// 書きかけの一時ファイルとディレクトリは含めない
+func (s *fsImageStore) List(_ context.Context, dir string) ([]string, error) {
+	entries, err := os.ReadDir(s.filePath(dir))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	keys := []string{}
+	for _, e := range entries {
+		if e.IsDir() || strings.HasPrefix(e.Name(), ".") {
+			continue
+		}
+		keys = append(keys, dir+e.Name())
+	}
+	return keys, nil
+}
+
+// DBのimgdataに残っている画像を保存先に書き出し、DBからは消す（/initializeの裏の処理）
+// 書き出した投稿はimgdataが空になるので、途中で止まっても次の/initializeで続きから書き出す
+func exportImageBlobs(ctx context.Context) error {
+	removeDeletedImages(ctx)
+
+	lastID := 0
+	for {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		var rows []struct {
+			ID      int    `db:"id"`
+			Mime    string `db:"mime"`
+			Imgdata []byte `db:"imgdata"`
+		}
+		err := db.SelectContext(ctx, &rows,
+			"SELECT `id`, `mime`, `imgdata` FROM `posts` WHERE `id` > ? AND LENGTH(`imgdata`) > 0 ORDER BY `id` LIMIT ?",
+			lastID, imageExportBatchSize)
+		if err != nil {
+			return err
+		}
+		if len(rows) == 0 {
+			return nil
+		}
+
+		ids := make([]int, 0, len(rows))
+		for _, row := range rows {
+			if err := putPostImage(ctx, row.ID, row.Mime, row.Imgdata); err != nil {
+				return fmt.Errorf("failed to export image of post %d: %w", row.ID, err)
+			}
+			ids = append(ids, row.ID)
+		}
+		query, args, err := sqlx.In("UPDATE `posts` SET `imgdata` = '' WHERE `id` IN (?)", ids)
+		if err != nil {
+			return err
+		}
+		if _, err := db.ExecContext(ctx, query, args...); err != nil {
+			return err
+		}
+		lastID = ids[len(ids)-1]
+	}
+}
+
+// dbInitializeで消した投稿（IDが10000より大きい投稿）の画像とユーザー（IDが1000より大きいユーザー）のアイコンを消す
+// 残しておくと消した投稿の画像を配信し続けてしまう
+func removeDeletedImages(ctx context.Context) {
+	removeImagesOverID(ctx, "", 10000)
+	removeImagesOverID(ctx, "avatars/", 1000)
+}
+
+// dirの<ID>.<拡張子>のキーのうち、IDがmaxIDより大きいものを消す
+func removeImagesOverID(ctx context.Context, dir string, maxID int) {
+	keys, err := imageStore.List(ctx, dir)
+	if err != nil {
+		logger("image").WarnContext(ctx, "failed to list images", "dir", dir, "err", err)
+		return
+	}
+	for _, key := range keys {
+		name, _, _ := strings.Cut(strings.TrimPrefix(key, dir), ".")
+		if id, err := strconv.Atoi(name); err == nil && id > maxID {
+			if err := imageStore.Delete(ctx, key); err != nil {
+				logger("image").WarnContext(ctx, "failed to remove image", "key", key, "err", err)
+			}
+		}
+	}
+}
+
+// 孤立した画像を探す間隔
+// 2回続けて孤立していた画像だけを消すので、アップロード中の画像を消さないよう十分に長くする
+const orphanImageSweepInterval = time.Hour
+
+// 前回の実行で孤立していた画像のキー（定期ジョブからしか使わない）
+var orphanImageCandidates = map[string]bool{}
+
+// 投稿やアイコンの行が無い画像を保存先から消す
+// 投稿はDBのトランザクションの中で画像を書くので、コミット前の画像を消さないよう、前回の実行でも孤立していた画像だけを消す
+// ISUCONP_IMAGE_GC_DRY_RUNがtrueの場合は消さずにログに出すだけにする
+func sweepOrphanImages(ctx context.Context) error {
+	orphans := map[string]bool{}
+	for _, dir := range []struct {
+		name string
+		live func(ctx context.Context, ids []int) (map[string]bool, error)
+	}{
+		{"", livePostImageKeys},
+		{"avatars/", liveAvatarImageKeys},
+	} {
+		keys, err := orphanImageKeys(ctx, dir.name, dir.live)
+		if err != nil {
+			return err
+		}
+		for _, key := range keys {
+			orphans[key] = true
+		}
+	}
+
+	for key := range orphans {
+		if !orphanImageCandidates[key] {
+			continue
+		}
+		if config.ImageGCDryRun {
+			logger("image").InfoContext(ctx, "found orphan image", "key", key, "dry_run", true)
+			continue
+		}
+		if err := imageStore.Delete(ctx, key); err != nil {
+			logger("image").WarnContext(ctx, "failed to remove orphan image", "key", key, "err", err)
+			continue
+		}
+		logger("image").InfoContext(ctx, "removed orphan image", "key", key)
+	}
+	orphanImageCandidates = orphans
+	return nil
+}
+
+// dirの<ID>.<拡張子>のキーのうち、liveが返さないもの
+// 名前がIDでないキーは触らない
+func orphanImageKeys(ctx context.Context, dir string, live func(ctx context.Context, ids []int) (map[string]bool, error)) ([]string, error) {
+	keys, err := imageStore.List(ctx, dir)
+	if err != nil {
+		return nil, err
+	}
+	byID := map[int][]string{}
+	ids := []int{}
+	for _, key := range keys {
+		name, _, _ := strings.Cut(strings.TrimPrefix(key, dir), ".")
+		id, err := strconv.Atoi(name)
+		if err != nil {
+			continue
+		}
+		if _, ok := byID[id]; !ok {
+			ids = append(ids, id)
+		}
+		byID[id] = append(byID[id], key)
+	}
+
+	orphans := []string{}
+	for batch := range slices.Chunk(ids, imageExportBatchSize) {
+		liveKeys, err := live(ctx, batch)
+		if err != nil {
+			return nil, err
+		}
+		for _, id := range batch {
+			for _, key := range byID[id] {
+				if !liveKeys[key] {
+					orphans = append(orphans, key)
+				}
+			}
+		}
+	}
+	return orphans, nil
+}
+
+// 保存先の画像に対応する投稿とアバターを探すクエリ
+const (
+	livePostsQuery   = "SELECT `id`, `mime` FROM `posts` WHERE `id` IN (?)"
+	liveAvatarsQuery = "SELECT `user_id`, `avatar_mime` FROM `user_profiles` WHERE `user_id` IN (?) AND `avatar_mime` <> ''"
+)
+
+func livePostImageKeys(ctx context.Context, ids []int) (map[string]bool, error) {
+	query, args, err := sqlx.In(livePostsQuery, ids)
+	if err != nil {
+		return nil, err
+	}
+	posts := []Post{}
+	if err := db.SelectContext(ctx, &posts, query, args...); err != nil {
+		return nil, err
+	}
+	keys := map[string]bool{}
+	for _, p := range posts {
+		for _, key := range postImageKeys(p.ID, p.Mime) {
+			keys[key] = true
+		}
+	}
+	return keys, nil
+}
+
+func liveAvatarImageKeys(ctx context.Context, ids []int) (map[string]bool, error) {
+	query, args, err := sqlx.In(liveAvatarsQuery, ids)
+	if err != nil {
+		return nil, err
+	}
+	profiles := []UserProfile{}
+	if err := db.SelectContext(ctx, &profiles, query, args...); err != nil {
+		return nil, err
+	}
+	keys := map[string]bool{}
+	for _, p := range profiles {
+		keys[avatarImageKey(p.UserID, p.AvatarMime)] = true
+	}
+	return keys, nil
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	s3RequestTimeout = 10 * time.Second
+	// エラーの本文を読む上限
+	s3ErrorBodyLimit = 4096
+)
+
+// S3互換のストレージ（AWS S3、MinIO、GCSのXML APIなど）に保存する
+// https://<エンドポイント>/<バケット>/<プレフィックス><キー>のパス形式でアクセスし、署名バージョン4で署名する
+type s3ImageStore struct {
+	endpoint  *url.URL
+	bucket    string
+	region    string
+	accessKey string
+	secretKey string
+	prefix    string
+	client    *http.Client
+	// 署名に使う時刻（差し替えられるように）
+	now func() time.Time
+}
+
+func newS3ImageStore(c appConfig) (*s3ImageStore, error) {
+	if c.S3Bucket == "" {
+		return nil, errors.New("ISUCONP_S3_BUCKET is not set")
+	}
+	if c.S3AccessKeyID == "" || c.S3SecretAccessKey == "" {
+		return nil, errors.New("ISUCONP_S3_ACCESS_KEY_ID and ISUCONP_S3_SECRET_ACCESS_KEY are required")
+	}
+	endpoint := c.S3Endpoint
+	if endpoint == "" {
+		endpoint = "https://s3." + c.S3Region + ".amazonaws.com"
+	}
+	u, err := url.Parse(strings.TrimSuffix(endpoint, "/"))
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("invalid ISUCONP_S3_ENDPOINT: %q", endpoint)
+	}
+	prefix := strings.Trim(c.S3Prefix, "/")
+	if prefix != "" {
+		prefix += "/"
+	}
+	return &s3ImageStore{
+		endpoint:  u,
+		bucket:    c.S3Bucket,
+		region:    c.S3Region,
+		accessKey: c.S3AccessKeyID,
+		secretKey: c.S3SecretAccessKey,
+		prefix:    prefix,
+		client:    &http.Client{Timeout: s3RequestTimeout},
+		now:       time.Now,
+	}, nil
+}
+
+func (s *s3ImageStore) Put(ctx context.Context, key string, data []byte, contentType string) error {
+	resp, err := s.do(ctx, http.MethodPut, s.prefix+key, nil, data, contentType)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return s3Error(resp, http.MethodPut, key)
+	}
+	return nil
+}
+
+func (s *s3ImageStore) Get(ctx context.Context, key string) ([]byte, error) {
+	resp, err := s.do(ctx, http.MethodGet, s.prefix+key, nil, nil, "")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return io.ReadAll(resp.Body)
+	case http.StatusNotFound:
+		return nil, errImageNotFound
+	}
+	return nil, s3Error(resp, http.MethodGet, key)
+}
+
+func (s *s3ImageStore) Delete(ctx context.Context, key string) error {
+	resp, err := s.do(ctx, http.MethodDelete, s.prefix+key, nil, nil, "")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusNoContent, http.StatusNotFound:
+		return nil
+	}
+	return s3Error(resp, http.MethodDelete, key)
+}
+
+// ListObjectsV2の結果のうち使うもの
+type s3ListResult struct {
+	Contents []struct {
+		Key string `xml:"Key"`
+	} `xml:"Contents"`
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+}
+
+// 1回で返ってくるのは最大1000件なので、続きがある間は繰り返す
+func (s *s3ImageStore) List(ctx context.Context, dir string) ([]string, error) {
+	keys := []string{}
+	token := ""
+	for {
+		query := url.Values{
+			"list-type": {"2"},
+			"prefix":    {s.prefix + dir},
+			"delimiter": {"/"},
+		}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+		resp, err := s.do(ctx, http.MethodGet, "", query, nil, "")
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusOK {
+			err := s3Error(resp, http.MethodGet, dir)
+			resp.Body.Close()
+			return nil, err
+		}
+		var result s3ListResult
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		for _, c := range result.Contents {
+			keys = append(keys, strings.TrimPrefix(c.Key, s.prefix))
+		}
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			return keys, nil
+		}
+		token = result.NextContinuationToken
+	}
+}
+
+// バケットのオブジェクトへのリクエストを署名して送る（objectKeyが空の場合はバケットへのリクエスト）
+func (s *s3ImageStore) do(ctx context.Context, method, objectKey string, query url.Values, body []byte, contentType string) (*http.Response, error) {
+	p := "/" + s.bucket + "/" + objectKey
+	u := *s.endpoint
+	u.Path = s.endpoint.Path + p
+	u.RawPath = s.endpoint.EscapedPath() + awsURIEncode(p, false)
+	u.RawQuery = awsCanonicalQuery(query)
+
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	s.sign(req, body, s.now())
+	return s.client.Do(req)
+}
+
+// 署名バージョン4でAuthorizationヘッダーを付ける
+// https://docs.aws.amazon.com/AmazonS3/latest/API/sig-v4-header-based-auth.html
+func (s *s3ImageStore) sign(req *http.Request, body []byte, now time.Time) {
+	now = now.UTC()
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	payloadHash := sha256Hex(body)
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	signedHeaders := "host;x-amz-content-sha256;x-amz-date"
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		"host:" + req.URL.Host,
+		"x-amz-content-sha256:" + payloadHash,
+		"x-amz-date:" + amzDate,
+		"",
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	scope := date + "/" + s.region + "/s3/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + sha256Hex([]byte(canonicalRequest))
+
+	key := hmacSHA256([]byte("AWS4"+s.secretKey), date)
+	key = hmacSHA256(key, s.region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+s.accessKey+"/"+scope+
+		", SignedHeaders="+signedHeaders+", Signature="+signature)
+}
+
+func sha256Hex(b []byte) string {
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// 署名で使うURIエンコード。英数字と-._~以外はすべて%XXにする
+// パスの場合は/をそのまま残す
+func awsURIEncode(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '.', c == '_', c == '~', c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// 名前順に並べたクエリ文字列（署名とリクエストで同じものを使う）
+func awsCanonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	pairs := []string{}
+	for _, k := range keys {
+		for _, v := range query[k] {
+			pairs = append(pairs, awsURIEncode(k, true)+"="+awsURIEncode(v, true))
+		}
+	}
+	return strings.Join(pairs, "&")
+}
+
+// S3のエラーの本文からコードを取り出す
+func s3Error(resp *http.Response, method, key string) error {
+	var body struct {
+		Code    string `xml:"Code"`
+		Message string `xml:"Message"`
+	}
+	xml.NewDecoder(io.LimitReader(resp.Body, s3ErrorBodyLimit)).Decode(&body)
+	if body.Code == "" {
+		return fmt.Errorf("s3: %s %q: %s", method, key, resp.Status)
+	}
+	return fmt.Errorf("s3: %s %q: %s: %s: %s", method, key, resp.Status, body.Code, body.Message)
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"time"
+)
+
+const (
+	indexPostsKey = "index:posts"
+	// ワーカーが止まっていても古いデータを出し続けないための保険
+	indexPostsTTL = 60 * time.Second
+)
+
+// トップページの投稿一覧を作り直すワーカーへの通知
+// 連続したイベントは1回の再計算にまとめる
+var indexRebuildCh = make(chan struct{}, 1)
+
+func requestIndexRebuild() {
+	select {
+	case indexRebuildCh <- struct{}{}:
+	default:
+	}
+}
+
+// 投稿やコメントが増えたらキャッシュを捨てて作り直す
+// 作り直しが終わるまでのリクエストはDBから組み立てる
+func subscribeIndexCache() {
+	expire := func() {
+		if err := cacheStore.Delete(context.Background(), indexPostsKey); err != nil {
+			logger("cache").Error("failed to expire index cache", "err", err)
+		}
+		requestIndexRebuild()
+	}
+	subscribe(events, func(PostCreated) { expire() })
+	subscribe(events, func(CommentCreated) { expire() })
+	subscribe(events, func(UserBanned) { expire() })
+	subscribe(events, func(UserUnbanned) { expire() })
+}
+
+// トップページに表示する投稿一覧（ユーザー情報と最新コメント込み）を組み立てる
+func buildIndexPosts(ctx context.Context) ([]Post, error) {
+	results, err := fetchTimelinePosts(ctx, pageCursor{})
+	if err != nil {
+		return nil, err
+	}
+	return makePosts(ctx, results, "", config.CommentPreviewCount)
+}
+
+func storeIndexPosts(ctx context.Context, posts []Post) error {
+	return cacheSet(ctx, indexPostsKey, posts, indexPostsTTL)
+}
+
+var indexPostsFlight flightGroup[[]Post]
+
+// キャッシュ済みのトップページの投稿一覧を返す
+// ない場合はDBから組み立てて、ワーカーに作り直しを依頼する
+// 同時に来たリクエストは1回の組み立てを共有する
+func getIndexPosts(ctx context.Context) ([]Post, error) {
+	if posts, err := cacheGet[[]Post](ctx, indexPostsKey); err == nil {
+		return posts, nil
+	}
+
+	requestIndexRebuild()
+	return indexPostsFlight.Do(indexPostsKey, func() ([]Post, error) {
+		return buildIndexPosts(context.WithoutCancel(ctx))
+	})
+}
+
+// ctxが終了するまでトップページの投稿一覧を作り直し続ける
+func runIndexWorker(ctx context.Context) {
+	rebuild := func() {
+		posts, err := buildIndexPosts(ctx)
+		if err != nil {
+			logger("cache").Error("failed to build index posts", "err", err)
+			return
+		}
+		if err := storeIndexPosts(ctx, posts); err != nil {
+			logger("cache").Error("failed to store index posts", "err", err)
+		}
+	}
+
+	rebuild()
+
+	// 定期的な作り直しはindex_warmジョブが依頼する
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-indexRebuildCh:
+			rebuild()
+		}
+	}
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 進み具合を問い合わせられるよう残しておく/initializeのタスクの数
+const initTaskHistory = 10
+
+const (
+	initTaskRunning  = "running"
+	initTaskDone     = "done"
+	initTaskFailed   = "failed"
+	initTaskCanceled = "canceled"
+	initStepPending  = "pending"
+)
+
+// /initializeでDBを戻した後に裏で行う重い処理
+// 初期化のタイムアウトに収まるよう、/initializeはDBとキャッシュを戻したらタスクのIDを返してすぐに終わる
+type initTask struct {
+	ID         string     `json:"id"`
+	Status     string     `json:"status"`
+	StartedAt  time.Time  `json:"started_at"`
+	FinishedAt time.Time  `json:"finished_at,omitzero"`
+	Steps      []initStep `json:"steps"`
+}
+
+type initStep struct {
+	Name       string  `json:"name"`
+	Status     string  `json:"status"`
+	DurationMS float64 `json:"duration_ms"`
+	Error      string  `json:"error,omitempty"`
+}
+
+// 裏で行う処理。上から順に1つずつ行い、失敗したらそこで止める
+// 投稿一覧はコメント数を使うので、集計を直してから作る
+// 画像は保存先に書き出してからキャッシュに入れる
+var initSteps = []struct {
+	name string
+	run  func(ctx context.Context) error
+}{
+	{"user_stats", func(context.Context) error { return rebuildUserStats() }},
+	{"trending_scores", func(context.Context) error { return rebuildTrendingScores() }},
+	{"tag_counts", func(context.Context) error { return rebuildTagCounts() }},
+	{"index_warm", warmIndexPosts},
+	{"image_export", exportImageBlobs},
+	{"image_warm", warmIndexImages},
+}
+
+var initTasks = struct {
+	sync.Mutex
+	tasks []*initTask
+	// 実行中のタスクを止める（/initializeが続けて呼ばれた場合は前のタスクを止める）
+	cancel context.CancelFunc
+}{}
+
+// 裏で行う処理を始めて、そのタスクを返す
+func startInitTask() initTask {
+	ctx, cancel := context.WithCancel(context.Background())
+	t := &initTask{
+		ID:        secureRandomStr(8),
+		Status:    initTaskRunning,
+		StartedAt: time.Now(),
+	}
+	for _, s := range initSteps {
+		t.Steps = append(t.Steps, initStep{Name: s.name, Status: initStepPending})
+	}
+
+	initTasks.Lock()
+	if initTasks.cancel != nil {
+		initTasks.cancel()
+	}
+	initTasks.cancel = cancel
+	initTasks.tasks = append(initTasks.tasks, t)
+	if len(initTasks.tasks) > initTaskHistory {
+		initTasks.tasks = initTasks.tasks[len(initTasks.tasks)-initTaskHistory:]
+	}
+	snapshot := t.snapshot()
+	initTasks.Unlock()
+
+	go runInitTask(ctx, cancel, t)
+	return snapshot
+}
+
+func runInitTask(ctx context.Context, cancel context.CancelFunc, t *initTask) {
+	defer cancel()
+
+	status := initTaskDone
+	for i, s := range initSteps {
+		if ctx.Err() != nil {
+			status = initTaskCanceled
+			break
+		}
+		updateInitStep(t, i, initTaskRunning, 0, nil)
+		start := time.Now()
+		err := s.run(ctx)
+		if err != nil {
+			logger("initialize").Error("initialize task failed", "task_id", t.ID, "step", s.name, "err", err)
+			updateInitStep(t, i, initTaskFailed, time.Since(start), err)
+			status = initTaskFailed
+			break
+		}
+		updateInitStep(t, i, initTaskDone, time.Since(start), nil)
+	}
+
+	initTasks.Lock()
+	defer initTasks.Unlock()
+	t.Status = status
+	t.FinishedAt = time.Now()
+}
+
+func updateInitStep(t *initTask, i int, status string, d time.Duration, err error) {
+	initTasks.Lock()
+	defer initTasks.Unlock()
+	t.Steps[i].Status = status
+	t.Steps[i].DurationMS = durationMS(d)
+	if err != nil {
+		t.Steps[i].Error = err.Error()
+	}
+}
+
+// initTasksのロックを取った状態で呼ぶ
+func (t *initTask) snapshot() initTask {
+	s := *t
+	s.Steps = slices.Clone(t.Steps)
+	return s
+}
+
+// IDのタスク。IDが空なら最後に始めたタスク
+func findInitTask(id string) (initTask, bool) {
+	initTasks.Lock()
+	defer initTasks.Unlock()
+	for i := len(initTasks.tasks) - 1; i >= 0; i-- {
+		if t := initTasks.tasks[i]; id == "" || t.ID == id {
+			return t.snapshot(), true
+		}
+	}
+	return initTask{}, false
+}
+
+// トップページの投稿一覧を作ってキャッシュに入れる
+func warmIndexPosts(ctx context.Context) error {
+	posts, err := buildIndexPosts(ctx)
+	if err != nil {
+		return err
+	}
+	return storeIndexPosts(ctx, posts)
+}
+
+// トップページに出る投稿の画像を画像キャッシュに入れる
+func warmIndexImages(ctx context.Context) error {
+	posts, err := getIndexPosts(ctx)
+	if err != nil {
+		return err
+	}
+	for _, p := range posts {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		key := imageCacheKey(p)
+		if _, _, found := getFromCache(key); found {
+			continue
+		}
+		data, err := fetchImage(ctx, p.ID, strings.TrimPrefix(imageExt(p.Mime), "."))
+		if err != nil {
+			return fmt.Errorf("failed to fetch image of post %d: %w", p.ID, err)
+		}
+		addToCache(key, data, imageETag(data))
+	}
+	return nil
+}
+
+// GET /initialize/status?id=...
+// /initializeが返したタスクの進み具合。idを省略した場合は最後のタスク
+func getInitializeStatus(w http.ResponseWriter, r *http.Request) error {
+	t, ok := findInitTask(r.URL.Query().Get("id"))
+	if !ok {
+		return errNotFound
+	}
+	return writeJSON(w, http.StatusOK, t)
+}
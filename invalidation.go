@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// 他のサーバーからの無効化を確認する間隔
+	invalidationPollInterval = 500 * time.Millisecond
+	// 無効化ログの保持期間
+	invalidationLogTTL = 5 * time.Minute
+	// これ以上遅れていたらログを追わずに全て捨てる
+	invalidationMaxLag = 1000
+	// 連番を増やしてからログを書くまでの間は読めないので、この間は読めなくても失われたとはみなさない
+	invalidationLogGrace = 2 * time.Second
+
+	invalidationSeqKey = "inval:seq"
+)
+
+// 複数台のアプリケーションサーバーでプロセス内キャッシュを揃えるための仕組み
+// 無効化のたびに共有キャッシュ（memcached/Redis）に連番付きのログを書き、
+// 各サーバーは連番を定期的に確認して自分の知らない無効化を適用する
+type invalidator struct {
+	mu       sync.Mutex
+	handlers map[string]func(key string)
+	lastSeq  int64
+	nodeID   string
+	// 読めなかったログの連番と、最初に読めなかった時刻
+	missingSeq   int64
+	missingSince time.Time
+}
+
+var invalidations = &invalidator{
+	handlers: make(map[string]func(key string)),
+	nodeID:   secureRandomStr(8),
+}
+
+// キャッシュの種類ごとに無効化の処理を登録する
+// keyが空の場合はその種類のキャッシュを全て捨てる
+func registerInvalidation(namespace string, fn func(key string)) {
+	invalidations.mu.Lock()
+	invalidations.handlers[namespace] = fn
+	invalidations.mu.Unlock()
+}
+
+// ローカルのキャッシュを無効化し、他のサーバーにも伝える
+func invalidate(namespace, key string) {
+	invalidations.apply(namespace, key)
+
+	seq, err := cacheStore.Incr(context.Background(), invalidationSeqKey, 1, 0)
+	if err != nil {
+		logger("cache").Error("failed to publish invalidation", "err", err)
+		return
+	}
+	entry := invalidations.nodeID + "\x00" + namespace + "\x00" + key
+	if err := cacheStore.Set(context.Background(), invalidationLogKey(seq), []byte(entry), invalidationLogTTL); err != nil {
+		logger("cache").Error("failed to publish invalidation", "err", err)
+	}
+}
+
+func invalidationLogKey(seq int64) string {
+	return fmt.Sprintf("inval:%d", seq)
+}
+
+func (iv *invalidator) apply(namespace, key string) {
+	iv.mu.Lock()
+	fn := iv.handlers[namespace]
+	iv.mu.Unlock()
+	if fn != nil {
+		fn(key)
+	}
+}
+
+func (iv *invalidator) applyAll() {
+	iv.mu.Lock()
+	handlers := make([]func(string), 0, len(iv.handlers))
+	for _, fn := range iv.handlers {
+		handlers = append(handlers, fn)
+	}
+	iv.mu.Unlock()
+	for _, fn := range handlers {
+		fn("")
+	}
+}
+
+func (iv *invalidator) currentSeq() (int64, error) {
+	b, err := cacheStore.Get(context.Background(), invalidationSeqKey)
+	if errors.Is(err, errCacheMiss) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(strings.TrimSpace(string(b)), 10, 64)
+}
+
+// 前回の確認以降に書かれた無効化を適用する
+func (iv *invalidator) poll() error {
+	seq, err := iv.currentSeq()
+	if err != nil {
+		return err
+	}
+
+	last := iv.lastSeq
+	if seq <= last {
+		iv.lastSeq = seq
+		// 共有キャッシュが再起動した場合は連番が戻るので全て捨てる
+		if seq < last {
+			iv.applyAll()
+		}
+		return nil
+	}
+	if seq-last > invalidationMaxLag {
+		iv.lastSeq = seq
+		iv.applyAll()
+		return nil
+	}
+
+	for s := last + 1; s <= seq; s++ {
+		b, err := cacheStore.Get(context.Background(), invalidationLogKey(s))
+		if err != nil {
+			if !iv.logLost(s) {
+				// 書き込み中かもしれないので、次の確認でこのログから読み直す
+				return nil
+			}
+			// ログが読めない場合は何が無効化されたか分からないので全て捨てる
+			iv.lastSeq = seq
+			iv.applyAll()
+			return nil
+		}
+		iv.lastSeq = s
+		parts := strings.SplitN(string(b), "\x00", 3)
+		if len(parts) != 3 || parts[0] == iv.nodeID {
+			continue
+		}
+		iv.apply(parts[1], parts[2])
+	}
+	return nil
+}
+
+// 連番sのログが読めないまま猶予が過ぎたか
+func (iv *invalidator) logLost(s int64) bool {
+	now := time.Now()
+	if iv.missingSeq != s {
+		iv.missingSeq, iv.missingSince = s, now
+		return false
+	}
+	return now.Sub(iv.missingSince) >= invalidationLogGrace
+}
+
+// 起動時点までの無効化は適用済みとして監視を始める
+// 以降はinvalidation_pollジョブが定期的に確認する
+func startInvalidationWatcher() {
+	seq, err := invalidations.currentSeq()
+	if err != nil {
+		logger("cache").Error("failed to read invalidation sequence", "err", err)
+	}
+	invalidations.lastSeq = seq
+}
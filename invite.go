@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/catatsuy/private-isu/webapp/golang/apperror"
+	"github.com/jmoiron/sqlx"
+)
+
+// 1つの招待コードで登録できる最大の人数
+const inviteMaxUsesLimit = 1000
+
+var errInvalidInviteCode = apperror.Validation("招待コードが正しくないか、使用回数の上限に達しています")
+
+// 招待制（registrationInvite）のときに登録に必要なコード
+type inviteCode struct {
+	Code      string    `db:"code"`
+	MaxUses   int       `db:"max_uses"`
+	UseCount  int       `db:"use_count"`
+	CreatedBy int       `db:"created_by"`
+	CreatedAt time.Time `db:"created_at"`
+}
+
+func (c inviteCode) Remaining() int {
+	return max(0, c.MaxUses-c.UseCount)
+}
+
+func createInviteCode(createdBy, maxUses int) (string, error) {
+	code := secureRandomStr(8)
+	_, err := db.Exec("INSERT INTO `invite_codes` (`code`, `max_uses`, `created_by`) VALUES (?, ?, ?)", code, maxUses, createdBy)
+	if err != nil {
+		return "", err
+	}
+	return code, nil
+}
+
+// 招待コードを1回分使う。ユーザーの作成と同じトランザクションで呼ぶ
+func useInviteCode(tx *sqlx.Tx, code string) error {
+	if code == "" {
+		return errInvalidInviteCode
+	}
+	res, err := tx.Exec("UPDATE `invite_codes` SET `use_count` = `use_count` + 1 WHERE `code` = ? AND `use_count` < `max_uses`", code)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return errInvalidInviteCode
+	}
+	return nil
+}
+
+func getAdminInvites(w http.ResponseWriter, r *http.Request) error {
+	me := currentUser(r)
+	if !isLogin(me) {
+		redirect(w, r, "/", http.StatusFound)
+		return nil
+	}
+
+	if me.Authority == 0 {
+		return errForbidden
+	}
+
+	codes := []inviteCode{}
+	err := db.SelectContext(r.Context(), &codes, "SELECT * FROM `invite_codes` ORDER BY `created_at` DESC")
+	if err != nil {
+		return err
+	}
+
+	data := newViewData(w, r).With("Invites", codes).With("MaxUsesLimit", inviteMaxUsesLimit)
+	return renderTemplate(w, r, http.StatusOK, templates.invites, "layout.html", data)
+}
+
+// 招待コードの発行（action=create）と削除（action=delete）
+func postAdminInvites(w http.ResponseWriter, r *http.Request) error {
+	me := currentUser(r)
+	if !isLogin(me) {
+		redirect(w, r, "/", http.StatusFound)
+		return nil
+	}
+
+	if me.Authority == 0 {
+		return errForbidden
+	}
+
+	if !validCSRFToken(r, r.FormValue("csrf_token")) {
+		return errInvalidCSRFToken
+	}
+
+	switch r.FormValue("action") {
+	case "create":
+		maxUses, err := strconv.Atoi(r.FormValue("max_uses"))
+		if err != nil || maxUses < 1 || maxUses > inviteMaxUsesLimit {
+			addFlash(w, r, flashError, "使用回数は1から"+strconv.Itoa(inviteMaxUsesLimit)+"の間で指定してください")
+			break
+		}
+		code, err := createInviteCode(me.ID, maxUses)
+		if err != nil {
+			return err
+		}
+		addFlash(w, r, flashSuccess, "招待コード "+code+" を発行しました")
+	case "delete":
+		res, err := db.ExecContext(context.WithoutCancel(r.Context()), "DELETE FROM `invite_codes` WHERE `code` = ?", r.FormValue("code"))
+		if err != nil {
+			return err
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			return apperror.NotFound("招待コードが見つかりません")
+		}
+		addFlash(w, r, flashSuccess, "招待コードを削除しました")
+	default:
+		return newHTTPError(http.StatusBadRequest, errors.New("unknown action"))
+	}
+
+	redirect(w, r, "/admin/invites", http.StatusFound)
+	return nil
+}
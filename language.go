@@ -0,0 +1,95 @@
+package main
+
+import (
+	"net/http"
+	"slices"
+	"strings"
+	"unicode"
+)
+
+// 投稿の言語を本文から推定する
+// 推定できない場合は空文字列を返す
+type languageDetector interface {
+	Detect(text string) string
+}
+
+// 投稿の言語の推定に使うもの。より精度の高いものに差し替えられる
+var postLanguageDetector languageDetector = scriptLanguageDetector{}
+
+// 文字の種類（用字）から言語を推定する
+// かなを含めば日本語、ハングルを含めば韓国語、漢字だけなら中国語、ラテン文字だけなら英語とみなす
+type scriptLanguageDetector struct{}
+
+func (scriptLanguageDetector) Detect(text string) string {
+	var kana, hangul, han, latin int
+	for _, r := range text {
+		switch {
+		case unicode.In(r, unicode.Hiragana, unicode.Katakana):
+			kana++
+		case unicode.Is(unicode.Hangul, r):
+			hangul++
+		case unicode.Is(unicode.Han, r):
+			han++
+		case unicode.Is(unicode.Latin, r):
+			latin++
+		}
+	}
+	switch {
+	case kana > 0:
+		return "ja"
+	case hangul > 0:
+		return "ko"
+	case han > 0:
+		return "zh"
+	case latin > 0:
+		return "en"
+	default:
+		return ""
+	}
+}
+
+// 投稿の言語の表示名
+var languageNames = map[string]string{
+	"ja": "日本語",
+	"en": "英語",
+	"zh": "中国語",
+	"ko": "韓国語",
+}
+
+// 投稿フォームの言語の選択肢
+type languageOption struct {
+	Code string
+	Name string
+}
+
+func postLanguageOptions() []languageOption {
+	options := make([]languageOption, 0, len(config.PostLanguages))
+	for _, lang := range config.PostLanguages {
+		options = append(options, languageOption{Code: lang, Name: languageNames[lang]})
+	}
+	return options
+}
+
+// 投稿の言語を決める
+// 投稿者が選んだ言語（tag）があればそれを、なければ本文から推定した言語を使う
+func postLanguage(tag, body string) string {
+	if slices.Contains(config.PostLanguages, tag) {
+		return tag
+	}
+	if lang := postLanguageDetector.Detect(body); slices.Contains(config.PostLanguages, lang) {
+		return lang
+	}
+	return ""
+}
+
+// 一覧を絞り込む言語（?lang=ja,en）。指定がなければnil（絞り込まない）
+// 扱っていない言語は無視する
+func requestLanguages(r *http.Request) []string {
+	var langs []string
+	for _, v := range strings.Split(r.URL.Query().Get("lang"), ",") {
+		if v = strings.TrimSpace(v); slices.Contains(config.PostLanguages, v) && !slices.Contains(langs, v) {
+			langs = append(langs, v)
+		}
+	}
+	return langs
+}
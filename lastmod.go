@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	// 投稿・コメント・BANのいずれかで更新される、一覧の最終更新時刻
+	siteLastModifiedKey = "lastmod:site"
+	// 最後にユーザーがBANされた時刻（投稿ページのコメントの表示に影響する）
+	bannedLastModifiedKey = "lastmod:banned"
+)
+
+func postLastModifiedKey(postID int) string {
+	return "lastmod:post:" + strconv.Itoa(postID)
+}
+
+// ユーザーの投稿・コメント、またはユーザーの投稿へのコメントで更新される
+func userLastModifiedKey(userID int) string {
+	return "lastmod:user:" + strconv.Itoa(userID)
+}
+
+func touchLastModified(ctx context.Context, keys ...string) {
+	now := []byte(strconv.FormatInt(time.Now().UnixNano(), 10))
+	for _, key := range keys {
+		if err := cacheStore.Set(ctx, key, now, 0); err != nil {
+			logger("cache").Error("failed to update last modified time", "key", key, "err", err)
+		}
+	}
+}
+
+// keysのうち最も新しい最終更新時刻
+// 記録が消えている場合は今を最終更新時刻とする
+func lastModified(ctx context.Context, keys ...string) time.Time {
+	var latest time.Time
+	for _, key := range keys {
+		var t time.Time
+		b, err := cacheStore.Get(ctx, key)
+		if n, perr := strconv.ParseInt(string(b), 10, 64); err == nil && perr == nil {
+			t = time.Unix(0, n)
+		} else {
+			touchLastModified(context.Background(), key)
+			t = time.Now()
+		}
+		if t.After(latest) {
+			latest = t
+		}
+	}
+	return latest
+}
+
+func subscribeLastModified() {
+	subscribe(events, func(e PostCreated) {
+		touchLastModified(context.Background(), siteLastModifiedKey, userLastModifiedKey(e.UserID))
+	})
+	subscribe(events, func(e CommentCreated) {
+		touchLastModified(context.Background(),
+			siteLastModifiedKey,
+			postLastModifiedKey(e.PostID),
+			userLastModifiedKey(e.UserID),
+			userLastModifiedKey(e.PostUserID),
+		)
+	})
+	subscribe(events, func(e CommentVoted) {
+		touchLastModified(context.Background(), siteLastModifiedKey, postLastModifiedKey(e.PostID))
+	})
+	subscribe(events, func(UserBanned) {
+		touchLastModified(context.Background(), siteLastModifiedKey, bannedLastModifiedKey)
+	})
+	subscribe(events, func(UserUnbanned) {
+		touchLastModified(context.Background(), siteLastModifiedKey, bannedLastModifiedKey)
+	})
+}
+
+// 未ログインのユーザーに対して、modifiedから変更がなければ304を返す
+// ページにはCSRFトークンが埋め込まれるので、ETagにはトークンも含める
+// 304を返した場合はtrueを返すので、呼び出し側は何も書かずに終了する
+func checkNotModified(w http.ResponseWriter, r *http.Request, modified time.Time) bool {
+	if isLogin(currentUser(r)) {
+		return false
+	}
+	// 表示待ちのフラッシュがある場合はページを作り直す
+	if len(currentFlashes(w, r)) > 0 {
+		return false
+	}
+
+	token := sha256.Sum256([]byte(formCSRFToken(r)))
+	etag := fmt.Sprintf(`W/"%x-%x"`, modified.UnixNano(), token[:4])
+
+	h := w.Header()
+	h.Set("Cache-Control", "private, no-cache")
+	h.Set("ETag", etag)
+	h.Set("Last-Modified", modified.UTC().Format(http.TimeFormat))
+
+	if match := r.Header.Get("If-None-Match"); match != "" {
+		if match != etag {
+			return false
+		}
+	} else {
+		since, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+		if err != nil || modified.Truncate(time.Second).After(since) {
+			return false
+		}
+	}
+
+	w.WriteHeader(http.StatusNotModified)
+	return true
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"html/template"
+	"net/http"
+	"sync"
+
+	"github.com/gorilla/sessions"
+)
+
+type contextKey int
+
+const (
+	layoutContextKey contextKey = iota
+	forwardedContextKey
+	requestLogContextKey
+)
+
+// ページのテンプレートに渡すデータ
+// newViewDataでレイアウトの共通の値を入れ、ページごとの値をWithで足す
+// レイアウトで使う値を増やすときはnewViewDataだけを変えればよい
+//
+// レイアウトの共通の値:
+//   - Me: ログイン中のユーザー
+//   - CSRFToken: フォームに埋め込むCSRFトークン
+//   - Flashes: 表示するフラッシュ
+//   - HeaderMenu: ログイン状態で変わるヘッダーのメニュー
+//     ページ全体をキャッシュできるよう、レイアウトとは別に描画する
+//   - Site: サイトの設定（タイトルやお知らせ）
+type ViewData map[string]any
+
+// ページの値を追加する
+func (v ViewData) With(key string, value any) ViewData {
+	v[key] = value
+	return v
+}
+
+// リクエスト中に一度だけ解決する値
+// フラッシュは読むと消えるので、画像やAPIのリクエストで消費しないよう
+// 実際に使われたときに解決する
+type layoutState struct {
+	sessionOnce sync.Once
+	session     *sessions.Session
+
+	meOnce sync.Once
+	me     User
+
+	csrfOnce  sync.Once
+	csrfToken string
+
+	flashOnce sync.Once
+	flashes   []Flash
+}
+
+// リクエストごとにレイアウト用のデータを保持するミドルウェア
+func withLayoutData(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := context.WithValue(r.Context(), layoutContextKey, &layoutState{})
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+func layoutStateFrom(r *http.Request) *layoutState {
+	state, _ := r.Context().Value(layoutContextKey).(*layoutState)
+	return state
+}
+
+// リクエストのセッション（リクエスト中は同じものを使い回す）
+// 同じリクエストで書き込んだ値は後から読むときにも見える
+func getSession(r *http.Request) *sessions.Session {
+	state := layoutStateFrom(r)
+	if state == nil {
+		return loadSession(r)
+	}
+	state.sessionOnce.Do(func() {
+		state.session = loadSession(r)
+	})
+	return state.session
+}
+
+// ログイン中のユーザー（リクエスト中は使い回す）
+func currentUser(r *http.Request) User {
+	state := layoutStateFrom(r)
+	if state == nil {
+		return getSessionUser(r)
+	}
+	state.meOnce.Do(func() {
+		state.me = getSessionUser(r)
+		setLogUserID(r, state.me.ID)
+	})
+	return state.me
+}
+
+// セッションのCSRFトークン（リクエスト中は使い回す）
+func currentCSRFToken(r *http.Request) string {
+	state := layoutStateFrom(r)
+	if state == nil {
+		return getCSRFToken(r)
+	}
+	state.csrfOnce.Do(func() {
+		state.csrfToken = getCSRFToken(r)
+	})
+	return state.csrfToken
+}
+
+// 表示するフラッシュ（リクエスト中は使い回す）
+func currentFlashes(w http.ResponseWriter, r *http.Request) []Flash {
+	state := layoutStateFrom(r)
+	if state == nil {
+		return getFlashes(w, r)
+	}
+	state.flashOnce.Do(func() {
+		state.flashes = getFlashes(w, r)
+	})
+	return state.flashes
+}
+
+// リクエストのレイアウトの値を入れたViewDataを作る
+func newViewData(w http.ResponseWriter, r *http.Request) ViewData {
+	me := currentUser(r)
+	return ViewData{
+		"Me":            me,
+		"CSRFToken":     formCSRFToken(r),
+		"Flashes":       currentFlashes(w, r),
+		"HeaderMenu":    renderHeaderMenu(me),
+		"Site":          currentSettings(),
+		"Online":        onlineCount(r.Context()),
+		"Canonical":     canonicalURL(r.URL.Path),
+		"Announcements": activeAnnouncements(r.Context()),
+		"ReadOnly":      isReadOnly(),
+	}
+}
+
+func renderHeaderMenu(me User) template.HTML {
+	buf := getBuffer()
+	defer putBuffer(buf)
+	if err := templates.headerMenu.ExecuteTemplate(buf, "header_menu.html", me); err != nil {
+		logger("render").Error("failed to render header menu", "err", err)
+	}
+	return template.HTML(buf.String())
+}
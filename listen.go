@@ -0,0 +1,83 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// ISUCONP_LISTEN_ADDRSの1つのアドレスで待ち受ける
+//   - host:port（[::]:8080はIPv4とIPv6の両方、0.0.0.0:8080はIPv4だけ）
+//   - tcp4:host:port、tcp6:host:port
+//   - unix:/path（前回のソケットのファイルが残っていれば消してから作る）
+func listen(addr string) (net.Listener, error) {
+	network, address := "tcp", addr
+	if n, a, ok := strings.Cut(addr, ":"); ok && (n == "tcp4" || n == "tcp6" || n == "unix") {
+		network, address = n, a
+	}
+
+	if network == "unix" {
+		if err := os.Remove(address); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return nil, err
+		}
+		l, err := net.Listen(network, address)
+		if err != nil {
+			return nil, err
+		}
+		// 別のユーザーで動くnginxなどから接続できるようにする
+		if err := os.Chmod(address, 0o666); err != nil {
+			l.Close()
+			return nil, err
+		}
+		return l, nil
+	}
+
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		return nil, fmt.Errorf("invalid listen address %q: %w", addr, err)
+	}
+	return net.Listen(network, address)
+}
+
+// 全てのアドレスで待ち受けて、serverが止まるまでリクエストを処理する
+// どれか1つでも待ち受けられなければ、何も処理せずにエラーを返す
+func serveAll(server *http.Server, addrs []string) error {
+	listeners := make([]net.Listener, 0, len(addrs))
+	for _, addr := range addrs {
+		l, err := listen(addr)
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return err
+		}
+		logger("server").Info("listening", "network", l.Addr().Network(), "addr", l.Addr().String())
+		listeners = append(listeners, l)
+	}
+
+	errs := make(chan error, len(listeners))
+	for _, l := range listeners {
+		go func() {
+			errs <- server.Serve(l)
+		}()
+	}
+	// 1つが失敗した場合は残りも止める（Shutdownの後はどれもErrServerClosedを返す）
+	var first error
+	for range listeners {
+		err := <-errs
+		if first == nil && !errors.Is(err, http.ErrServerClosed) {
+			first = err
+			server.Close()
+		}
+	}
+	return first
+}
+
+// UNIXドメインソケットで受けたリクエストか
+// 接続できるのは同じホストのプロセスだけなので、前段のプロキシとして信用する
+func isUnixSocketRequest(r *http.Request) bool {
+	addr, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr)
+	return ok && addr.Network() == "unix"
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 混雑したときに断る順番を決めるリクエストの優先度
+type requestPriority int
+
+const (
+	// 画像の再検証やクローラー、計測のビーコンなど、断っても表示に困らないもの
+	priorityLow requestPriority = iota
+	priorityNormal
+	// トップページや投稿など、最後まで断らないもの
+	priorityCore
+)
+
+const (
+	// p99を求める直近の秒数
+	loadShedWindowSeconds = 10
+	// p99を信用するのに必要な直近のリクエスト数（少ないときは混雑していない）
+	loadShedMinSamples = 100
+	// 同時に処理中のリクエスト数が上限のこの倍を超えたら通常のリクエストも断る
+	loadShedNormalFactor = 2
+	// 断ったときにクライアントへ伝える再試行までの秒数
+	loadShedRetryAfter = "5"
+)
+
+var errOverloaded = newHTTPError(http.StatusServiceUnavailable, errors.New("混雑しています。しばらくしてからお試しください"))
+
+// 1秒分の応答時間のヒストグラム
+type latencySlot struct {
+	unix    int64
+	buckets [len(routeLatencyBuckets) + 1]int64
+	max     time.Duration
+}
+
+// 同時に処理中のリクエスト数と直近の応答時間から、混雑しているかを判断する（サーバーごと）
+type loadShedder struct {
+	inFlight atomic.Int64
+	// 直近loadShedWindowSeconds秒のp99と、それを求めた時刻（秒）
+	// リクエストを記録するときに秒が変わっていたら求め直す
+	p99   atomic.Int64
+	p99At atomic.Int64
+	shed  [priorityCore + 1]atomic.Int64
+
+	mu      sync.Mutex
+	slots   [loadShedWindowSeconds]latencySlot
+	lastSec int64
+}
+
+var loadShed = &loadShedder{}
+
+// 処理したリクエストの応答時間を記録する（断ったリクエストは含めない）
+func (s *loadShedder) record(d time.Duration) {
+	now := time.Now().Unix()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	slot := &s.slots[now%loadShedWindowSeconds]
+	if slot.unix != now {
+		*slot = latencySlot{unix: now}
+	}
+	i, _ := slices.BinarySearch(routeLatencyBuckets[:], d)
+	slot.buckets[i]++
+	slot.max = max(slot.max, d)
+
+	if s.lastSec != now {
+		s.lastSec = now
+		s.p99.Store(int64(s.windowP99(now)))
+		s.p99At.Store(now)
+	}
+}
+
+// 直近の秒のヒストグラムを合わせたp99。バケットの上限の値になる
+func (s *loadShedder) windowP99(now int64) time.Duration {
+	var counts [len(routeLatencyBuckets) + 1]int64
+	var total int64
+	var maxLatency time.Duration
+	for _, slot := range s.slots {
+		if now-slot.unix >= loadShedWindowSeconds {
+			continue
+		}
+		for i, c := range slot.buckets {
+			counts[i] += c
+			total += c
+		}
+		maxLatency = max(maxLatency, slot.max)
+	}
+	if total < loadShedMinSamples {
+		return 0
+	}
+
+	target := total - total/100
+	var acc int64
+	for i, c := range counts {
+		acc += c
+		if acc >= target && i < len(routeLatencyBuckets) {
+			return routeLatencyBuckets[i]
+		}
+	}
+	return maxLatency
+}
+
+// 優先度pのリクエストを断るか
+// 上限を超えて混雑している間は優先度の低いものを断り、さらに混雑したら通常のものも断る
+func (s *loadShedder) shouldShed(p requestPriority, inFlight int64) bool {
+	if p == priorityCore {
+		return false
+	}
+	limit := int64(reloadable().LoadShedMaxInFlight)
+	if p == priorityNormal {
+		return limit > 0 && inFlight > limit*loadShedNormalFactor
+	}
+	return s.slow() || (limit > 0 && inFlight > limit)
+}
+
+// 直近のp99がISUCONP_LOAD_SHED_P99_MSを超えているか
+func (s *loadShedder) slow() bool {
+	return reloadable().LoadShedP99MS > 0 && s.recentP99() > time.Duration(reloadable().LoadShedP99MS)*time.Millisecond
+}
+
+// 直近のp99
+// 断ってばかりで記録が途絶えた場合に古いp99で断り続けないよう、古くなっていれば0を返す
+func (s *loadShedder) recentP99() time.Duration {
+	if time.Now().Unix()-s.p99At.Load() >= loadShedWindowSeconds {
+		return 0
+	}
+	return time.Duration(s.p99.Load())
+}
+
+func requestPriorityOf(r *http.Request) requestPriority {
+	p := r.URL.Path
+	switch {
+	case crawlerPattern(r.UserAgent()) != "", p == "/beacon":
+		return priorityLow
+	case strings.HasPrefix(p, "/image/") && (r.Header.Get("If-None-Match") != "" || r.Header.Get("If-Modified-Since") != ""):
+		// ブラウザが手元に持っている画像の再検証
+		return priorityLow
+	case r.Method == http.MethodGet && (p == "/" || p == "/posts" || strings.HasPrefix(p, "/posts/") || p == "/api/v1/timeline"):
+		return priorityCore
+	case strings.HasPrefix(p, "/admin/") || strings.HasPrefix(p, "/api/v1/admin/"):
+		// 混雑の様子を管理画面で確かめられるようにする
+		return priorityCore
+	default:
+		return priorityNormal
+	}
+}
+
+// 混雑しているときに優先度の低いリクエストを503で断るミドルウェア
+// ISUCONP_LOAD_SHED_MAX_IN_FLIGHTとISUCONP_LOAD_SHED_P99_MSが両方0なら断らない
+func withLoadShedding(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := loadShed.inFlight.Add(1)
+		defer loadShed.inFlight.Add(-1)
+
+		if p := requestPriorityOf(r); loadShed.shouldShed(p, n) {
+			loadShed.shed[p].Add(1)
+			w.Header().Set("Retry-After", loadShedRetryAfter)
+			handleError(w, r, errOverloaded)
+			return
+		}
+
+		start := time.Now()
+		next.ServeHTTP(w, r)
+		loadShed.record(time.Since(start))
+	})
+}
+
+// 管理画面に出す混雑の状況
+type loadShedSummary struct {
+	InFlight   int64         `json:"in_flight"`
+	RecentP99  time.Duration `json:"recent_p99_ns"`
+	ShedLow    int64         `json:"shed_low"`
+	ShedNormal int64         `json:"shed_normal"`
+}
+
+func (s *loadShedder) summary() loadShedSummary {
+	return loadShedSummary{
+		InFlight:   s.inFlight.Load(),
+		RecentP99:  s.recentP99(),
+		ShedLow:    s.shed[priorityLow].Load(),
+		ShedNormal: s.shed[priorityNormal].Load(),
+	}
+}
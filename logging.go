@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"sync/atomic"
+)
+
+// 受け取ったX-Request-IDをそのまま使う形式（nginxの$request_idなど）
+var requestIDPattern = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+// リクエストのログに付ける値
+type requestLogAttrs struct {
+	id string
+	// ログイン中のユーザーのID。currentUserで分かった時点で入る
+	userID atomic.Int64
+}
+
+// ログに出す最低のレベル。設定を読み直すと変わる
+var logLevel slog.LevelVar
+
+// ISUCONP_LOG_LEVELとISUCONP_LOG_FORMATでslogの出力先を作り、標準のロガーと差し替える
+// logパッケージで出したログも同じ形式でこのハンドラーに流れる
+func setupLogger() {
+	logLevel.Set(reloadable().LogLevel)
+	opts := &slog.HandlerOptions{AddSource: true, Level: &logLevel}
+	var h slog.Handler
+	if config.LogFormat == "json" {
+		h = slog.NewJSONHandler(os.Stderr, opts)
+	} else {
+		h = slog.NewTextHandler(os.Stderr, opts)
+	}
+	slog.SetDefault(slog.New(requestLogHandler{h}))
+}
+
+// サブシステム（cache、jobsなど）のロガー
+// setupLoggerの後のハンドラーを使うよう、ログを出すたびにslog.Defaultから作る
+func logger(subsystem string) *slog.Logger {
+	return slog.Default().With("subsystem", subsystem)
+}
+
+// ログを出すときのcontextにリクエストの値があれば、request_idとuser_idを付けるハンドラー
+type requestLogHandler struct {
+	slog.Handler
+}
+
+func (h requestLogHandler) Handle(ctx context.Context, rec slog.Record) error {
+	if a, ok := ctx.Value(requestLogContextKey).(*requestLogAttrs); ok {
+		rec.AddAttrs(slog.String("request_id", a.id))
+		if uid := a.userID.Load(); uid != 0 {
+			rec.AddAttrs(slog.Int64("user_id", uid))
+		}
+	}
+	return h.Handler.Handle(ctx, rec)
+}
+
+func (h requestLogHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return requestLogHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h requestLogHandler) WithGroup(name string) slog.Handler {
+	return requestLogHandler{h.Handler.WithGroup(name)}
+}
+
+// リクエストにIDを付けるミドルウェア
+// 前段のプロキシが付けたX-Request-IDがあればそれを使い、レスポンスにも返す
+func withRequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("X-Request-ID")
+		if !requestIDPattern.MatchString(id) {
+			id = secureRandomStr(8)
+		}
+		w.Header().Set("X-Request-ID", id)
+		ctx := context.WithValue(r.Context(), requestLogContextKey, &requestLogAttrs{id: id})
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// リクエストのログにユーザーのIDを付ける
+func setLogUserID(r *http.Request, userID int) {
+	if a, ok := r.Context().Value(requestLogContextKey).(*requestLogAttrs); ok {
+		a.userID.Store(int64(userID))
+	}
+}
+
+// ISUCONP_LOG_LEVEL（debug, info, warn, error）
+func loadLogLevel() slog.Level {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(getEnv("ISUCONP_LOG_LEVEL", "info"))); err != nil {
+		logger("config").Warn("invalid ISUCONP_LOG_LEVEL, using info", "value", os.Getenv("ISUCONP_LOG_LEVEL"))
+		return slog.LevelInfo
+	}
+	return level
+}
+
+// ISUCONP_LOG_FORMAT（開発向けのtext、本番向けのjson）
+func loadLogFormat() string {
+	format := strings.ToLower(getEnv("ISUCONP_LOG_FORMAT", "text"))
+	if format != "text" && format != "json" {
+		logger("config").Warn("invalid ISUCONP_LOG_FORMAT, using text", "value", format)
+		return "text"
+	}
+	return format
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// ログインした後に戻るページ（プレフィックスのないアプリの中のパスとクエリ）
+// 別のサイトへ飛ばされないよう、/で始まるアプリの中のパスだけを受け付ける。使えない場合は""
+func loginNextPath(next string) string {
+	if !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") || strings.Contains(next, "\\") {
+		return ""
+	}
+	u, err := url.Parse(next)
+	if err != nil || u.Scheme != "" || u.Host != "" || u.Path == "/login" {
+		return ""
+	}
+	return next
+}
+
+// ログインページへリダイレクトする。ログインした後はnextのページに戻る
+func redirectToLogin(w http.ResponseWriter, r *http.Request, next string) {
+	location := "/login"
+	if next = loginNextPath(next); next != "" && next != "/" {
+		location += "?next=" + url.QueryEscape(next)
+	}
+	redirect(w, r, location, http.StatusFound)
+}
+
+// ログインした後のリダイレクト先
+func loginRedirectPath(r *http.Request) string {
+	if next := loginNextPath(r.FormValue("next")); next != "" {
+		return next
+	}
+	return "/"
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"net/http"
+	"time"
+)
+
+// ルートごとの読み書きタイムアウトとリクエストボディの上限
+type routeLimit struct {
+	readTimeout  time.Duration
+	writeTimeout time.Duration
+	maxBodyBytes int64
+}
+
+var (
+	// 通常のリクエスト向けの制限
+	defaultRouteLimit = routeLimit{
+		readTimeout:  10 * time.Second,
+		writeTimeout: 30 * time.Second,
+		maxBodyBytes: 1 * 1024 * 1024, // 1mb
+	}
+
+	// 画像アップロード向けの制限
+	// multipartの境界やbodyフィールドの分だけ余裕を持たせる
+	uploadRouteLimit = routeLimit{
+		readTimeout:  60 * time.Second,
+		writeTimeout: 60 * time.Second,
+		maxBodyBytes: UploadLimit + 1*1024*1024,
+	}
+)
+
+// リクエストごとにタイムアウトとボディサイズの上限を設定するミドルウェア
+func withRouteLimit(l routeLimit) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			rc := http.NewResponseController(w)
+			now := time.Now()
+			// サーバー全体のタイムアウトをルートごとの値で上書きする
+			// 対応していないResponseWriterの場合はサーバーの設定がそのまま使われる
+			rc.SetReadDeadline(now.Add(l.readTimeout))
+			rc.SetWriteDeadline(now.Add(l.writeTimeout))
+
+			if r.Body != nil && l.maxBodyBytes > 0 {
+				r.Body = http.MaxBytesReader(w, r.Body, l.maxBodyBytes)
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// セッションにCSRFトークンがなければ発行して保存するミドルウェア
+// 描画中にセッションへ書き込まずに済むよう、フォームを含むページの前段で一度だけ行う
+// ダブルサブミット用のクッキーもなければ発行する
+func withCSRFToken(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		session := getSession(r)
+		if token, _ := session.Values["csrf_token"].(string); token == "" {
+			session.Values["csrf_token"] = secureRandomStr(16)
+			session.Save(r, w)
+		}
+		if csrfCookieToken(r) == "" {
+			issueCSRFCookie(w)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// 前段のキャッシュ（Varnishやnginx）向けにSurrogate-Controlを付けるミドルウェア
+// 値はルートの名前ごとにISUCONP_SURROGATE_CONTROL_<NAME>で変えられる
+// エラーのレスポンスはキャッシュさせないよう、200と304のときだけ付ける
+func withSurrogateControl(route string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		value := config.SurrogateControl[route]
+		if value == "" {
+			return next
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			next.ServeHTTP(&surrogateResponseWriter{ResponseWriter: w, value: value}, r)
+		})
+	}
+}
+
+type surrogateResponseWriter struct {
+	http.ResponseWriter
+	value       string
+	wroteHeader bool
+}
+
+func (w *surrogateResponseWriter) WriteHeader(status int) {
+	if !w.wroteHeader {
+		w.wroteHeader = true
+		if status == http.StatusOK || status == http.StatusNotModified {
+			w.Header().Set("Surrogate-Control", w.value)
+		}
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *surrogateResponseWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// http.ResponseControllerから元のResponseWriterを使えるようにする
+func (w *surrogateResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+const (
+	// 審査中の投稿
+	moderationPending = "pending"
+	// 公開しないことになった投稿（投稿者にはそのまま見える）
+	moderationRejected = "rejected"
+
+	// 審査待ちの一覧に一度に表示する数
+	moderationQueueLimit = 100
+)
+
+// 投稿を公開前に審査するか
+// 登録からISUCONP_MODERATION_NEW_ACCOUNT_DAYS日以内か、公開済みの投稿がISUCONP_MODERATION_FIRST_POSTS件未満のユーザーが対象
+// どちらも0（既定）の場合は審査しない。管理者の投稿も審査しない
+func needsModeration(ctx context.Context, u User) (bool, error) {
+	if u.Authority != 0 {
+		return false, nil
+	}
+	if days := reloadable().ModerationNewAccountDays; days > 0 && time.Since(u.CreatedAt) < time.Duration(days)*24*time.Hour {
+		return true, nil
+	}
+	if reloadable().ModerationFirstPosts > 0 {
+		var published int
+		err := db.GetContext(ctx, &published,
+			"SELECT COUNT(*) FROM `posts` p WHERE p.`user_id` = ?"+
+				" AND NOT EXISTS (SELECT 1 FROM `pending_posts` m WHERE m.`post_id` = p.`id`)",
+			u.ID,
+		)
+		if err != nil {
+			return false, err
+		}
+		return published < reloadable().ModerationFirstPosts, nil
+	}
+	return false, nil
+}
+
+// 作成した投稿を審査待ちにする。投稿の作成と同じトランザクションで行う
+func holdPostForReview(tx *sqlx.Tx, postID, userID int) error {
+	_, err := tx.Exec(
+		"INSERT INTO `pending_posts` (`post_id`, `user_id`, `status`) VALUES (?,?,?)",
+		postID, userID, moderationPending,
+	)
+	return err
+}
+
+// 審査待ちの投稿（投稿者と合わせて表示する）
+type pendingPost struct {
+	Post
+	Status string `db:"status"`
+}
+
+func fetchPendingPosts(ctx context.Context) ([]pendingPost, error) {
+	posts := []pendingPost{}
+	err := db.SelectContext(ctx, &posts,
+		"SELECT p.`id`, p.`user_id`, p.`body`, p.`mime`, p.`created_at`, m.`status`"+
+			" FROM `pending_posts` m JOIN `posts` p ON p.`id` = m.`post_id`"+
+			" WHERE m.`status` = ? ORDER BY m.`created_at`, m.`post_id` LIMIT ?",
+		moderationPending, moderationQueueLimit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return attachPendingPostUsers(ctx, posts)
+}
+
+// ユーザーの審査待ちと却下された投稿（ユーザーページで本人にだけ表示する）
+func fetchPendingPostsOf(ctx context.Context, userID int) ([]pendingPost, error) {
+	posts := []pendingPost{}
+	err := db.SelectContext(ctx, &posts,
+		"SELECT p.`id`, p.`user_id`, p.`body`, p.`mime`, p.`created_at`, m.`status`"+
+			" FROM `pending_posts` m JOIN `posts` p ON p.`id` = m.`post_id`"+
+			" WHERE m.`user_id` = ? ORDER BY m.`created_at` DESC LIMIT ?",
+		userID, moderationQueueLimit,
+	)
+	return posts, err
+}
+
+func attachPendingPostUsers(ctx context.Context, posts []pendingPost) ([]pendingPost, error) {
+	userIDs := make([]int, 0, len(posts))
+	for _, p := range posts {
+		userIDs = append(userIDs, p.UserID)
+	}
+	users, err := getUsersByIDs(ctx, userIDs)
+	if err != nil {
+		return nil, err
+	}
+	for i := range posts {
+		posts[i].User = users[posts[i].UserID]
+	}
+	return posts, nil
+}
+
+// 審査待ちの投稿を公開する
+// 投稿の作成時に見送ったイベントをここで発行して、一覧や購読の通知に反映させる
+func approvePost(ctx context.Context, postID int) error {
+	var userID int
+	err := db.GetContext(ctx, &userID, "SELECT `user_id` FROM `pending_posts` WHERE `post_id` = ?", postID)
+	if err != nil {
+		return err
+	}
+	if _, err := db.ExecContext(context.WithoutCancel(ctx), "DELETE FROM `pending_posts` WHERE `post_id` = ?", postID); err != nil {
+		return err
+	}
+	touchLastModified(ctx, postLastModifiedKey(postID))
+	events.Publish(PostCreated{PostID: postID, UserID: userID})
+	return nil
+}
+
+func rejectPost(ctx context.Context, postID int) error {
+	res, err := db.ExecContext(context.WithoutCancel(ctx), "UPDATE `pending_posts` SET `status` = ? WHERE `post_id` = ?", moderationRejected, postID)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return errNotFound
+	}
+	return nil
+}
+
+func getAdminModeration(w http.ResponseWriter, r *http.Request) error {
+	me := currentUser(r)
+	if !isLogin(me) {
+		redirect(w, r, "/", http.StatusFound)
+		return nil
+	}
+
+	if me.Authority == 0 {
+		return errForbidden
+	}
+
+	posts, err := fetchPendingPosts(r.Context())
+	if err != nil {
+		return err
+	}
+	appeals, err := fetchPendingAppeals(r.Context())
+	if err != nil {
+		return err
+	}
+
+	data := newViewData(w, r).With("Posts", posts).With("Appeals", appeals)
+	return renderTemplate(w, r, http.StatusOK, templates.moderation, "layout.html", data)
+}
+
+// チェックした投稿の承認（action=approve）と却下（action=reject）
+func postAdminModeration(w http.ResponseWriter, r *http.Request) error {
+	me := currentUser(r)
+	if !isLogin(me) {
+		redirect(w, r, "/", http.StatusFound)
+		return nil
+	}
+
+	if me.Authority == 0 {
+		return errForbidden
+	}
+
+	if !validCSRFToken(r, r.FormValue("csrf_token")) {
+		return errInvalidCSRFToken
+	}
+
+	var apply func(context.Context, int) error
+	var done string
+	switch r.FormValue("action") {
+	case "approve":
+		apply, done = approvePost, "承認"
+	case "reject":
+		apply, done = rejectPost, "却下"
+	default:
+		return newHTTPError(http.StatusBadRequest, errors.New("unknown action"))
+	}
+
+	count := 0
+	for _, id := range r.Form["post_id[]"] {
+		pid, err := strconv.Atoi(id)
+		if err != nil {
+			continue
+		}
+		if err := apply(r.Context(), pid); err != nil {
+			return err
+		}
+		count++
+	}
+	if count > 0 {
+		addFlash(w, r, flashSuccess, fmt.Sprintf("%d件の投稿を%sしました", count, done))
+	}
+
+	redirect(w, r, "/admin/moderation", http.StatusFound)
+	return nil
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net/http"
+
+	"github.com/catatsuy/private-isu/webapp/golang/apperror"
+	"github.com/jmoiron/sqlx"
+)
+
+// 登録した直後の案内の段階
+const (
+	onboardingAvatar = "avatar"
+	onboardingBio    = "bio"
+	onboardingFollow = "follow"
+	onboardingDone   = "done"
+
+	// フォローを勧めるユーザーの数
+	onboardingSuggestionCount = 5
+)
+
+// 各段階の次の段階。どの段階も飛ばせる
+var onboardingTransitions = map[string]string{
+	onboardingAvatar: onboardingBio,
+	onboardingBio:    onboardingFollow,
+	onboardingFollow: onboardingDone,
+}
+
+// 登録したユーザーの案内を始める（ユーザーを作るトランザクションの中で呼ぶ）
+func startOnboarding(tx *sqlx.Tx, userID int) error {
+	_, err := tx.Exec("INSERT INTO `user_onboarding` (`user_id`, `state`) VALUES (?, ?)", userID, onboardingAvatar)
+	return err
+}
+
+// 今の段階。案内を始める前から登録していたユーザーは案内しないのでonboardingDone
+func onboardingState(ctx context.Context, userID int) (string, error) {
+	state := ""
+	err := db.GetContext(ctx, &state, "SELECT `state` FROM `user_onboarding` WHERE `user_id` = ?", userID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return onboardingDone, nil
+	}
+	return state, err
+}
+
+// fromの段階からtoの段階へ進める
+// 別のタブで先に進めていた場合は何もしない（二重に送信しても段階を飛ばさない）
+func moveOnboarding(userID int, from, to string) error {
+	_, err := db.Exec("UPDATE `user_onboarding` SET `state` = ? WHERE `user_id` = ? AND `state` = ?", to, userID, from)
+	return err
+}
+
+// フォローを勧めるユーザー（/api/v1/suggestions/followsと同じ、最近よく投稿やコメントをしているユーザー）
+func onboardingSuggestions(ctx context.Context, me User) ([]User, error) {
+	suggestions, err := followSuggestionsFor(ctx, me, onboardingSuggestionCount)
+	if err != nil {
+		return nil, err
+	}
+	users := make([]User, 0, len(suggestions))
+	for _, s := range suggestions {
+		users = append(users, s.User)
+	}
+	return users, nil
+}
+
+// GET /welcome
+// 登録した直後の案内（アイコン、自己紹介、フォローするユーザー）。終わったユーザーはトップページへ
+func getWelcome(w http.ResponseWriter, r *http.Request) error {
+	me := currentUser(r)
+	if !isLogin(me) {
+		redirectToLogin(w, r, "/welcome")
+		return nil
+	}
+
+	state, err := onboardingState(r.Context(), me.ID)
+	if err != nil {
+		return err
+	}
+	if state == onboardingDone {
+		redirect(w, r, "/", http.StatusFound)
+		return nil
+	}
+
+	profile, err := fetchUserProfile(r.Context(), me.ID)
+	if err != nil {
+		return err
+	}
+	data := newViewData(w, r).
+		With("Step", state).
+		With("Profile", profile).
+		With("BioMaxLength", bioMaxLength)
+	if state == onboardingFollow {
+		suggestions, err := onboardingSuggestions(r.Context(), me)
+		if err != nil {
+			return err
+		}
+		data.With("Suggestions", suggestions)
+	}
+	return renderTemplate(w, r, http.StatusOK, templates.welcome, "layout.html", data)
+}
+
+// POST /welcome
+// action=nextは入力を保存して次へ、skipは保存せずに次へ、finishは残りを飛ばして終える
+func postWelcome(w http.ResponseWriter, r *http.Request) error {
+	me := currentUser(r)
+	if !isLogin(me) {
+		redirectToLogin(w, r, "/welcome")
+		return nil
+	}
+
+	if !validCSRFToken(r, r.FormValue("csrf_token")) {
+		return errInvalidCSRFToken
+	}
+
+	state, err := onboardingState(r.Context(), me.ID)
+	if err != nil {
+		return err
+	}
+	// 別のタブで進めた後の古いフォームは、今の段階を表示し直す
+	if state == onboardingDone || r.FormValue("step") != state {
+		redirect(w, r, "/welcome", http.StatusFound)
+		return nil
+	}
+
+	next := onboardingTransitions[state]
+	switch r.FormValue("action") {
+	case "next":
+		if err := applyOnboardingStep(r, me, state); err != nil {
+			if apperror.KindOf(err) != apperror.KindValidation {
+				return err
+			}
+			addErrorFlash(w, r, err)
+			redirect(w, r, "/welcome", http.StatusFound)
+			return nil
+		}
+	case "skip":
+	case "finish":
+		next = onboardingDone
+	default:
+		return newHTTPError(http.StatusBadRequest, errors.New("unknown action"))
+	}
+
+	if err := moveOnboarding(me.ID, state, next); err != nil {
+		return err
+	}
+	if next == onboardingDone {
+		redirect(w, r, "/", http.StatusFound)
+		return nil
+	}
+	redirect(w, r, "/welcome", http.StatusFound)
+	return nil
+}
+
+// 段階ごとの入力を保存する
+func applyOnboardingStep(r *http.Request, me User, state string) error {
+	switch state {
+	case onboardingAvatar:
+		f, _, err := r.FormFile("avatar")
+		if errors.Is(err, http.ErrMissingFile) {
+			return apperror.Validation("画像を選んでください")
+		}
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		mime, data, err := readUploadFile(f)
+		switch err {
+		case nil:
+		case errUploadNoFile:
+			return apperror.Validation("画像を選んでください")
+		case errUploadUnsupported:
+			return apperror.Validation("使える画像形式は" + uploadFormatNames() + "だけです")
+		case errUploadTooLarge:
+			return apperror.Validation("ファイルサイズが大きすぎます")
+		default:
+			return err
+		}
+		return saveUserAvatar(r.Context(), me.ID, mime, data)
+	case onboardingBio:
+		return saveUserBio(r.Context(), me.ID, r.FormValue("bio"))
+	case onboardingFollow:
+		for _, accountName := range r.Form["follow"] {
+			kind, value, err := normalizeSubscription(subscriptionUser, accountName)
+			if err != nil {
+				return err
+			}
+			_, err = db.ExecContext(context.WithoutCancel(r.Context()), "INSERT IGNORE INTO `subscriptions` (`user_id`, `kind`, `value`) VALUES (?, ?, ?)", me.ID, kind, value)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
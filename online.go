@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// 表示するオンライン人数を数え直す間隔
+const onlineCountTTL = 10 * time.Second
+
+// 直近ISUCONP_ONLINE_WINDOW_MINUTES分にページを見たセッションの数を数える
+//
+// 共有キャッシュに1分ごとのカウンター（online:<unix分>）を持ち、窓の中のカウンターを合計する
+// 同じセッションを何度も数えないよう、セッションごとの印（online:seen:<id>）を窓の長さだけ残し、
+// 印を新しく付けたときだけその分のカウンターを増やす
+// 印が消えるのは窓の長さが過ぎた後なので、窓の中では1つのセッションは1回しか数えられない
+var onlineTracker = struct {
+	sync.Mutex
+	// このプロセスで印を付けたセッションと印の期限（共有キャッシュへの問い合わせを減らす）
+	seen map[string]time.Time
+
+	count     int64
+	countedAt time.Time
+}{seen: make(map[string]time.Time)}
+
+func onlineWindow() time.Duration {
+	return time.Duration(config.OnlineWindowMinutes) * time.Minute
+}
+
+func onlineBucketKey(minute int64) string {
+	return "online:" + strconv.FormatInt(minute, 10)
+}
+
+// リクエストのセッションを表す値。ログイン中はユーザー、それ以外はCSRFのクッキー
+// どちらもない場合（初回の訪問）は数えない
+func onlineSessionID(r *http.Request) string {
+	var id string
+	if me := currentUser(r); isLogin(me) {
+		id = "u" + strconv.Itoa(me.ID)
+	} else if token := csrfCookieToken(r); token != "" {
+		id = "a" + token
+	} else {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(id))
+	return hex.EncodeToString(sum[:8])
+}
+
+func touchOnline(r *http.Request) {
+	sid := onlineSessionID(r)
+	if sid == "" {
+		return
+	}
+	now := time.Now()
+
+	onlineTracker.Lock()
+	if now.Before(onlineTracker.seen[sid]) {
+		onlineTracker.Unlock()
+		return
+	}
+	onlineTracker.seen[sid] = now.Add(onlineWindow())
+	onlineTracker.Unlock()
+
+	n, err := cacheStore.Incr(r.Context(), "online:seen:"+sid, 1, onlineWindow())
+	if err != nil {
+		logger("online").ErrorContext(r.Context(), "failed to track online session", "err", err)
+		return
+	}
+	if n != 1 {
+		// 他のサーバーで数えられている
+		return
+	}
+	minute := now.Unix() / 60
+	if _, err := cacheStore.Incr(r.Context(), onlineBucketKey(minute), 1, onlineWindow()+time.Minute); err != nil {
+		logger("online").ErrorContext(r.Context(), "failed to track online session", "err", err)
+	}
+}
+
+// ページを見たセッションを数えるミドルウェア
+func withOnlineTracking(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		touchOnline(r)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// 直近の窓の中のオンライン人数（onlineCountTTLの間は同じ値を返す）
+func onlineCount(ctx context.Context) int64 {
+	onlineTracker.Lock()
+	defer onlineTracker.Unlock()
+	if time.Since(onlineTracker.countedAt) < onlineCountTTL {
+		return onlineTracker.count
+	}
+
+	now := time.Now().Unix() / 60
+	keys := make([]string, 0, config.OnlineWindowMinutes)
+	for i := 0; i < config.OnlineWindowMinutes; i++ {
+		keys = append(keys, onlineBucketKey(now-int64(i)))
+	}
+	values, err := cacheStore.GetMulti(ctx, keys)
+	if err != nil {
+		logger("online").Error("failed to count online sessions", "err", err)
+		return onlineTracker.count
+	}
+	var count int64
+	for _, v := range values {
+		n, _ := strconv.ParseInt(string(v), 10, 64)
+		count += n
+	}
+	onlineTracker.count = count
+	onlineTracker.countedAt = time.Now()
+	return count
+}
+
+// 期限の切れた印を捨てる
+func purgeExpiredOnlineSessions() {
+	now := time.Now()
+	onlineTracker.Lock()
+	defer onlineTracker.Unlock()
+	for sid, expiresAt := range onlineTracker.seen {
+		if now.After(expiresAt) {
+			delete(onlineTracker.seen, sid)
+		}
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"html/template"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// キャッシュするページに埋め込んでおき、返すときにユーザーのヘッダーのメニューに置き換える
+	// フォームの印と同じく、エスケープしたユーザーの入力と一致しないよう<を含める
+	headerMenuPlaceholder = "<!--isu:header-menu-->"
+	// 最終更新時刻が変わらなくても作り直す間隔
+	// 投稿一覧のキャッシュの更新とずれて古いページが残り続けないようにする
+	indexPageTTL = 10 * time.Second
+)
+
+// 描画済みのトップページ（最新の一覧、フラッシュなし）
+// ログイン状態やユーザーで変わる部分はプレースホルダーのまま持つので、全てのユーザーで共有できる
+var indexPage = struct {
+	sync.Mutex
+	modified time.Time
+	renderAt time.Time
+	html     string
+}{}
+
+// トップページをキャッシュから返す。modifiedより古い場合は作り直す
+func writeCachedIndexPage(w http.ResponseWriter, r *http.Request, modified time.Time) error {
+	page, err := cachedIndexPage(r.Context(), modified)
+	if err != nil {
+		return err
+	}
+
+	me := currentUser(r)
+	page = strings.NewReplacer(headerMenuPlaceholder, string(renderHeaderMenu(me))).Replace(page)
+	page = fillFormPlaceholders(page, formCSRFToken(r), newIdempotencyKey())
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	_, err = w.Write([]byte(page))
+	return err
+}
+
+var indexPageFlight flightGroup[string]
+
+func cachedIndexPage(ctx context.Context, modified time.Time) (string, error) {
+	indexPage.Lock()
+	if indexPage.html != "" && indexPage.modified.Equal(modified) && time.Since(indexPage.renderAt) < indexPageTTL {
+		html := indexPage.html
+		indexPage.Unlock()
+		return html, nil
+	}
+	indexPage.Unlock()
+
+	// 作り直しは同時に来たリクエストで1回だけ行う。共有するので最初のリクエストが切れても止めない
+	return indexPageFlight.Do(strconv.FormatInt(modified.UnixNano(), 10), func() (string, error) {
+		return renderIndexPage(context.WithoutCancel(ctx), modified)
+	})
+}
+
+func renderIndexPage(ctx context.Context, modified time.Time) (string, error) {
+	posts, err := getIndexPosts(ctx)
+	if err != nil {
+		return "", err
+	}
+	postsHTML, err := renderPostFragments(posts)
+	if err != nil {
+		return "", err
+	}
+
+	buf := getBuffer()
+	defer putBuffer(buf)
+	data := ViewData{
+		"Me":            User{},
+		"CSRFToken":     csrfTokenPlaceholder,
+		"HeaderMenu":    template.HTML(headerMenuPlaceholder),
+		"Site":          currentSettings(),
+		"Online":        onlineCount(ctx),
+		"Canonical":     canonicalURL("/"),
+		"Announcements": activeAnnouncements(ctx),
+		"ReadOnly":      isReadOnly(),
+	}
+	data.With("Form", uploadFormInput{IdempotencyKey: formKeyPlaceholder}).With("Posts", postsHTML)
+	err = templates.index.ExecuteTemplate(buf, "layout.html", data)
+	if err != nil {
+		return "", err
+	}
+
+	html := buf.String()
+	indexPage.Lock()
+	indexPage.modified = modified
+	indexPage.renderAt = time.Now()
+	indexPage.html = html
+	indexPage.Unlock()
+	return html, nil
+}
+
+func clearIndexPage() {
+	indexPage.Lock()
+	indexPage.html = ""
+	indexPage.Unlock()
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// 投稿一覧のページ位置
+// ゼロ値は最新の投稿から
+type pageCursor struct {
+	maxCreatedAt time.Time
+	// 0の場合はmaxCreatedAtと同時刻の投稿も含める（GET /postsの互換のため）
+	beforeID int
+}
+
+func (c pageCursor) isZero() bool {
+	return c.maxCreatedAt.IsZero()
+}
+
+// APIで使うcursorの文字列表現（unix秒_投稿ID）
+func (c pageCursor) String() string {
+	if c.isZero() {
+		return ""
+	}
+	return fmt.Sprintf("%d_%d", c.maxCreatedAt.Unix(), c.beforeID)
+}
+
+// 投稿一覧の続きを取得するためのcursor
+func nextPageCursor(posts []Post) pageCursor {
+	if len(posts) < config.PostsPerPage {
+		return pageCursor{}
+	}
+	last := posts[len(posts)-1]
+	return pageCursor{maxCreatedAt: last.CreatedAt, beforeID: last.ID}
+}
+
+func parsePageCursor(s string) (pageCursor, error) {
+	if s == "" {
+		return pageCursor{}, nil
+	}
+	sec, id, ok := strings.Cut(s, "_")
+	if !ok {
+		return pageCursor{}, fmt.Errorf("invalid cursor: %q", s)
+	}
+	unix, err := strconv.ParseInt(sec, 10, 64)
+	if err != nil {
+		return pageCursor{}, fmt.Errorf("invalid cursor: %q", s)
+	}
+	beforeID, err := strconv.Atoi(id)
+	if err != nil {
+		return pageCursor{}, fmt.Errorf("invalid cursor: %q", s)
+	}
+	return pageCursor{maxCreatedAt: time.Unix(unix, 0), beforeID: beforeID}, nil
+}
+
+// タイムラインの1ページ分の投稿を取得する
+// BANされたユーザーの投稿をSQLで除外するので常に1ページ分まで埋まる
+func fetchTimelinePosts(ctx context.Context, cursor pageCursor) ([]Post, error) {
+	return fetchPosts(ctx, cursor, 0, nil)
+}
+
+// langsのいずれかの言語の投稿だけのタイムライン
+func fetchTimelinePostsInLanguages(ctx context.Context, cursor pageCursor, langs []string) ([]Post, error) {
+	return fetchPosts(ctx, cursor, 0, langs)
+}
+
+// ユーザーページの1ページ分の投稿を取得する
+func fetchUserPosts(ctx context.Context, userID int, cursor pageCursor) ([]Post, error) {
+	return fetchPosts(ctx, cursor, userID, nil)
+}
+
+// post_image_sizesをsとしてLEFT JOINしたときの画像サイズの列
+const postImageSizeColumns = "COALESCE(s.`width`, 0) AS `width`, COALESCE(s.`height`, 0) AS `height`"
+
+// post_languagesをlとしてLEFT JOINしたときの言語の列
+const postLanguageColumn = "COALESCE(l.`lang`, '') AS `lang`"
+
+// userIDが0の場合は全ユーザーの投稿が対象
+// langsが空でなければその言語の投稿だけにする（言語が分からない投稿は含めない）
+// 審査待ちと却下された投稿は含めない
+func fetchPosts(ctx context.Context, cursor pageCursor, userID int, langs []string) ([]Post, error) {
+	query := "SELECT p.`id`, p.`user_id`, p.`body`, p.`mime`, p.`created_at`, " + postImageSizeColumns + ", " + postLanguageColumn +
+		" FROM `posts` p JOIN `users` u ON p.`user_id` = u.`id`" +
+		" LEFT JOIN `post_image_sizes` s ON s.`post_id` = p.`id`" +
+		" LEFT JOIN `post_languages` l ON l.`post_id` = p.`id`" +
+		" WHERE u.`del_flg` = 0" +
+		" AND NOT EXISTS (SELECT 1 FROM `pending_posts` m WHERE m.`post_id` = p.`id`)"
+	args := []any{}
+
+	if userID != 0 {
+		query += " AND p.`user_id` = ?"
+		args = append(args, userID)
+	}
+
+	if len(langs) > 0 {
+		query += " AND l.`lang` IN (?" + strings.Repeat(",?", len(langs)-1) + ")"
+		for _, lang := range langs {
+			args = append(args, lang)
+		}
+	}
+
+	switch {
+	case cursor.isZero():
+	case cursor.beforeID == 0:
+		query += " AND p.`created_at` <= ?"
+		args = append(args, cursor.maxCreatedAt.Format(ISO8601Format))
+	default:
+		query += " AND (p.`created_at` < ? OR (p.`created_at` = ? AND p.`id` < ?))"
+		t := cursor.maxCreatedAt.Format(ISO8601Format)
+		args = append(args, t, t, cursor.beforeID)
+	}
+
+	query += " ORDER BY p.`created_at` DESC, p.`id` DESC LIMIT ?"
+	args = append(args, config.PostsPerPage)
+
+	results := []Post{}
+	err := db.SelectContext(ctx, &results, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// ユーザーページのコメントタブの1ページ分のコメントを取得する
+// BANされたユーザーの投稿へのコメントは除外する
+func fetchUserComments(ctx context.Context, userID int, cursor pageCursor) ([]Comment, error) {
+	query := "SELECT c.`id`, c.`post_id`, c.`user_id`, c.`comment`, c.`created_at`" +
+		" FROM `comments` c JOIN `posts` p ON c.`post_id` = p.`id` JOIN `users` u ON p.`user_id` = u.`id`" +
+		" WHERE c.`user_id` = ? AND u.`del_flg` = 0"
+	args := []any{userID}
+
+	if !cursor.isZero() {
+		query += " AND (c.`created_at` < ? OR (c.`created_at` = ? AND c.`id` < ?))"
+		t := cursor.maxCreatedAt.Format(ISO8601Format)
+		args = append(args, t, t, cursor.beforeID)
+	}
+
+	query += " ORDER BY c.`created_at` DESC, c.`id` DESC LIMIT ?"
+	args = append(args, config.PostsPerPage)
+
+	comments := []Comment{}
+	if err := db.SelectContext(ctx, &comments, query, args...); err != nil {
+		return nil, err
+	}
+	return comments, nil
+}
+
+// コメント一覧の続きを取得するためのcursor
+func nextCommentPageCursor(comments []Comment) pageCursor {
+	if len(comments) < config.PostsPerPage {
+		return pageCursor{}
+	}
+	last := comments[len(comments)-1]
+	return pageCursor{maxCreatedAt: last.CreatedAt, beforeID: last.ID}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+// アプリの中のパス（/posts/1など）に、公開するときのプレフィックス（ISUCONP_PATH_PREFIX）を付ける
+// ハンドラーやテンプレートではプレフィックスのないパスを扱い、ページやリダイレクトに出すときにこれを通す
+func appPath(p string) string {
+	return config.PathPrefix + p
+}
+
+// 公開しているパスからプレフィックスを取り除く。プレフィックスの外のパスならfalse
+func trimPathPrefix(p string) (string, bool) {
+	if config.PathPrefix == "" {
+		return p, true
+	}
+	rest, ok := strings.CutPrefix(p, config.PathPrefix)
+	if !ok || (rest != "" && !strings.HasPrefix(rest, "/")) {
+		return "", false
+	}
+	if rest == "" {
+		rest = "/"
+	}
+	return rest, true
+}
+
+// アプリの中のパスへリダイレクトする。/で始まるlocationにはプレフィックスを付ける
+func redirect(w http.ResponseWriter, r *http.Request, location string, code int) {
+	if strings.HasPrefix(location, "/") && !strings.HasPrefix(location, "//") {
+		location = appPath(location)
+	}
+	http.Redirect(w, r, location, code)
+}
+
+// アプリ全体をISUCONP_PATH_PREFIXの下で公開する
+// リクエストのパスからプレフィックスを取り除いてから渡すので、ルーティングやミドルウェアはプレフィックスを意識しない
+// プレフィックスそのもの（/iscogram）は末尾に/を付けたトップページへリダイレクトする
+func withPathPrefix(next http.Handler) http.Handler {
+	if config.PathPrefix == "" {
+		return next
+	}
+	stripped := http.StripPrefix(config.PathPrefix, next)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == config.PathPrefix:
+			http.Redirect(w, r, config.PathPrefix+"/", http.StatusMovedPermanently)
+		case strings.HasPrefix(r.URL.Path, config.PathPrefix+"/"):
+			stripped.ServeHTTP(w, r)
+		default:
+			http.NotFound(w, r)
+		}
+	})
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// 短いURLに使う文字（0-9, a-z, A-Zの順で値を表す）
+const base62Digits = "0123456789abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ"
+
+func encodeBase62(n int) string {
+	if n == 0 {
+		return "0"
+	}
+	var b []byte
+	for n > 0 {
+		b = append(b, base62Digits[n%62])
+		n /= 62
+	}
+	for i, j := 0, len(b)-1; i < j; i, j = i+1, j-1 {
+		b[i], b[j] = b[j], b[i]
+	}
+	return string(b)
+}
+
+// base62の文字列を数に戻す。使えない文字を含む場合や大きすぎる場合はfalse
+func decodeBase62(s string) (int, bool) {
+	if s == "" || len(s) > 10 {
+		return 0, false
+	}
+	n := 0
+	for i := 0; i < len(s); i++ {
+		d := strings.IndexByte(base62Digits, s[i])
+		if d < 0 {
+			return 0, false
+		}
+		n = n*62 + d
+	}
+	return n, true
+}
+
+// 共有用の短いURL（/p/{base62のID}）
+func shortPermalink(p Post) string {
+	return appPath("/p/" + encodeBase62(p.ID))
+}
+
+// 短いURLを投稿のページにリダイレクトする
+// 投稿があるかどうかは見ない（無ければ転送先が404を返す）
+func getShortPermalink(w http.ResponseWriter, r *http.Request) error {
+	pid, ok := decodeBase62(r.PathValue("id"))
+	if !ok || pid == 0 {
+		return errNotFound
+	}
+	location := "/posts/" + strconv.Itoa(pid)
+	if r.URL.RawQuery != "" {
+		location += "?" + r.URL.RawQuery
+	}
+	redirect(w, r, location, http.StatusMovedPermanently)
+	return nil
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"html/template"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/catatsuy/private-isu/webapp/golang/apperror"
+)
+
+const (
+	// 自己紹介の最大文字数
+	bioMaxLength = 160
+	// アイコンの1辺のピクセル数
+	avatarSize = 256
+)
+
+// ユーザーが自分で設定するプロフィール
+type UserProfile struct {
+	UserID int    `db:"user_id"`
+	Bio    string `db:"bio"`
+	// アップロードしたアイコンの形式（アップロードしていなければ空）
+	AvatarMime string    `db:"avatar_mime"`
+	UpdatedAt  time.Time `db:"updated_at"`
+}
+
+// プロフィール。まだ設定していないユーザーは空のプロフィールを返す
+func fetchUserProfile(ctx context.Context, userID int) (UserProfile, error) {
+	p := UserProfile{}
+	err := db.GetContext(ctx, &p, "SELECT `user_id`, `bio`, `avatar_mime`, `updated_at` FROM `user_profiles` WHERE `user_id` = ?", userID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return UserProfile{UserID: userID}, nil
+	}
+	return p, err
+}
+
+func validateBio(bio string) error {
+	if !validText(bio) {
+		return apperror.Validation("自己紹介に使えない文字が含まれています")
+	}
+	if utf8.RuneCountInString(bio) > bioMaxLength {
+		return apperror.Validationf("自己紹介は%d文字以内で入力してください", bioMaxLength)
+	}
+	return nil
+}
+
+func saveUserBio(ctx context.Context, userID int, bio string) error {
+	bio = strings.TrimSpace(bio)
+	if err := validateBio(bio); err != nil {
+		return err
+	}
+	_, err := db.ExecContext(context.WithoutCancel(ctx), "INSERT INTO `user_profiles` (`user_id`, `bio`) VALUES (?, ?) ON DUPLICATE KEY UPDATE `bio` = VALUES(`bio`)", userID, bio)
+	if err != nil {
+		return err
+	}
+	touchLastModified(ctx, userLastModifiedKey(userID))
+	return nil
+}
+
+// アップロードされた画像を正方形に切り抜いてアイコンにする
+func saveUserAvatar(ctx context.Context, userID int, mime string, data []byte) error {
+	if isHEIFMime(mime) {
+		converted, err := convertHEICToJPEG(ctx, data)
+		if err != nil {
+			return apperror.Validation("画像を変換できませんでした")
+		}
+		mime, data = "image/jpeg", converted
+	}
+	// 切り抜くときに再エンコードするので、Exifの位置情報などは残らない
+	thumb, err := makeSquareThumbnail(data, mime, avatarSize)
+	if err != nil {
+		return apperror.Validation("画像を読み込めませんでした")
+	}
+
+	old, err := fetchUserProfile(ctx, userID)
+	if err != nil {
+		return err
+	}
+	if err := imageStore.Put(ctx, avatarImageKey(userID, mime), thumb, mime); err != nil {
+		return err
+	}
+	// 形式が変わった場合は前のアイコンを消す
+	if old.AvatarMime != "" && old.AvatarMime != mime {
+		if err := imageStore.Delete(ctx, avatarImageKey(userID, old.AvatarMime)); err != nil {
+			logger("image").WarnContext(ctx, "failed to remove old avatar", "user_id", userID, "err", err)
+		}
+	}
+
+	_, err = db.ExecContext(context.WithoutCancel(ctx), "INSERT INTO `user_profiles` (`user_id`, `bio`, `avatar_mime`) VALUES (?, '', ?) ON DUPLICATE KEY UPDATE `avatar_mime` = VALUES(`avatar_mime`)", userID, mime)
+	if err != nil {
+		return err
+	}
+	touchLastModified(ctx, userLastModifiedKey(userID))
+	return nil
+}
+
+// GET /avatar/{id}.{ext}
+// アップロードされたアイコン。URLに更新日時を付けるので、変えたときはURLも変わる
+func getAvatar(w http.ResponseWriter, r *http.Request) error {
+	uid, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		return errNotFound
+	}
+	mime := getMimeType(r.PathValue("ext"))
+	if mime == "" {
+		return errNotFound
+	}
+	data, err := imageStore.Get(r.Context(), avatarImageKey(uid, mime))
+	if errors.Is(err, errImageNotFound) {
+		return errNotFound
+	}
+	if err != nil {
+		return err
+	}
+	return writeImage(w, r, mime, data, imageETag(data))
+}
+
+// ユーザーのアイコン
+// アップロードしていないユーザーは、アカウント名の頭文字とIDから決めた色のSVGを埋め込む
+func avatarURL(u User, p UserProfile) template.URL {
+	if p.AvatarMime != "" {
+		return template.URL(appPath(fmt.Sprintf("/avatar/%d%s?v=%d", u.ID, imageExt(p.AvatarMime), p.UpdatedAt.Unix())))
+	}
+	return generatedAvatarURL(u)
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// 1回の実行で削除するユーザーの最大数
+const purgeBatchSize = 100
+
+// BANしてから保持期間が過ぎたユーザーを、投稿・コメント・画像ごと削除する
+// BANした時刻が記録されていないユーザー（初期データ）は対象にしない
+func purgeBannedUsers(ctx context.Context) error {
+	retention := time.Duration(config.BanRetentionDays) * 24 * time.Hour
+
+	userIDs := []int{}
+	err := db.SelectContext(ctx, &userIDs,
+		"SELECT b.`user_id` FROM `user_bans` b JOIN `users` u ON b.`user_id` = u.`id`"+
+			" WHERE u.`del_flg` = 1 AND b.`banned_at` < ? ORDER BY b.`banned_at` LIMIT ?",
+		time.Now().Add(-retention), purgeBatchSize,
+	)
+	if err != nil {
+		return err
+	}
+
+	for _, uid := range userIDs {
+		if err := purgeUser(ctx, uid); err != nil {
+			return fmt.Errorf("failed to purge user %d: %w", uid, err)
+		}
+	}
+	return nil
+}
+
+func purgeUser(ctx context.Context, userID int) error {
+	// キャッシュと保存先から消すために投稿の画像のキーを控えておく
+	posts := []Post{}
+	err := db.SelectContext(ctx, &posts, "SELECT `id`, `mime` FROM `posts` WHERE `user_id` = ?", userID)
+	if err != nil {
+		return err
+	}
+
+	tx, err := db.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	postsOf := "(SELECT `id` FROM `posts` WHERE `user_id` = ?)"
+	sqls := []string{
+		"DELETE FROM `comment_votes` WHERE `comment_id` IN (SELECT `id` FROM `comments` WHERE `post_id` IN " + postsOf + ")",
+		"DELETE FROM `comments` WHERE `post_id` IN " + postsOf,
+		"DELETE FROM `post_views` WHERE `post_id` IN " + postsOf,
+		"DELETE FROM `post_image_sizes` WHERE `post_id` IN " + postsOf,
+		"DELETE FROM `post_languages` WHERE `post_id` IN " + postsOf,
+		"DELETE FROM `post_tags` WHERE `post_id` IN " + postsOf,
+		"DELETE FROM `post_image_hashes` WHERE `post_id` IN " + postsOf,
+		"DELETE FROM `pending_posts` WHERE `post_id` IN " + postsOf,
+		"DELETE FROM `notifications` WHERE `post_id` IN " + postsOf,
+		"DELETE FROM `post_comment_counts` WHERE `post_id` IN " + postsOf,
+		"DELETE FROM `trending_post_scores` WHERE `post_id` IN " + postsOf,
+		"DELETE FROM `posts` WHERE `user_id` = ?",
+		"DELETE FROM `comment_votes` WHERE `comment_id` IN (SELECT `id` FROM `comments` WHERE `user_id` = ?)",
+		"DELETE FROM `comments` WHERE `user_id` = ?",
+		"DELETE FROM `comment_votes` WHERE `user_id` = ?",
+		"DELETE FROM `api_tokens` WHERE `user_id` = ?",
+		"DELETE FROM `activitypub_followers` WHERE `user_id` = ?",
+		"DELETE FROM `user_stats` WHERE `user_id` = ?",
+		"DELETE FROM `user_bans` WHERE `user_id` = ?",
+		"DELETE FROM `ban_appeals` WHERE `user_id` = ?",
+		"DELETE FROM `announcement_notifications` WHERE `user_id` = ?",
+		"DELETE FROM `user_verifications` WHERE `user_id` = ?",
+		"DELETE FROM `user_fingerprints` WHERE `user_id` = ?",
+		"DELETE FROM `subscriptions` WHERE `user_id` = ?",
+		"DELETE FROM `notifications` WHERE `user_id` = ?",
+		"DELETE FROM `user_profiles` WHERE `user_id` = ?",
+		"DELETE FROM `user_onboarding` WHERE `user_id` = ?",
+		"DELETE FROM `users` WHERE `id` = ? AND `del_flg` = 1",
+	}
+	for _, q := range sqls {
+		if _, err := tx.ExecContext(ctx, q, userID); err != nil {
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	// 保存先の画像はコミットしてから消す。消せなかった画像は配信されない（fetchImageが投稿を確かめる）ので、ログに残すだけにする
+	for _, p := range posts {
+		deletePostImage(ctx, p.ID, p.Mime)
+	}
+	// user_profilesの行を消したので、アイコンも消さないと配信できないまま残る
+	deleteAvatarImages(ctx, userID)
+
+	// 他のユーザーの統計情報のずれは集計ジョブが直す
+	invalidateUserCache(ctx, User{ID: userID})
+	keys := []string{siteLastModifiedKey}
+	for _, p := range posts {
+		invalidate("image", imageCacheKey(p))
+		keys = append(keys, postLastModifiedKey(p.ID))
+	}
+	touchLastModified(ctx, keys...)
+	return nil
+}
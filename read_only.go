@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// DBの応答時間を測る間隔
+	dbLatencyProbeInterval = 5 * time.Second
+	// 続けてこの回数遅ければ読み取り専用にする
+	readOnlyEnterStreak = 3
+	// 読み取り専用の間、続けてこの回数速ければ元に戻す（行ったり来たりしないよう多めにする）
+	readOnlyLeaveStreak = 12
+	// 書き込みを断るときにクライアントへ伝える再試行までの秒数
+	readOnlyRetryAfter = "60"
+)
+
+var errReadOnly = newHTTPError(http.StatusServiceUnavailable, errors.New("現在は閲覧のみ受け付けています"))
+
+// DBの応答時間から自動で切り替える読み取り専用の状態（サーバーごと）
+var dbLatency = struct {
+	sync.Mutex
+	last       time.Duration
+	slowStreak int
+	fastStreak int
+	// 自動で読み取り専用にしているか（ロックを取らずに読めるようにする）
+	readOnly atomic.Bool
+}{}
+
+// 書き込みを止めているか。管理画面での切り替えと自動の切り替えのどちらか
+func isReadOnly() bool {
+	return currentSettings().ReadOnly || dbLatency.readOnly.Load()
+}
+
+// 直近に測ったDBの応答時間
+func lastDBLatency() time.Duration {
+	dbLatency.Lock()
+	defer dbLatency.Unlock()
+	return dbLatency.last
+}
+
+// DBに軽いクエリを送って応答時間を測り、ISUCONP_READ_ONLY_DB_LATENCY_MSを超え続けたら読み取り専用にする
+// 応答がない場合（しきい値の4倍で打ち切る）も遅いとみなす
+func probeDBLatency(ctx context.Context) error {
+	threshold := time.Duration(config.ReadOnlyDBLatencyMS) * time.Millisecond
+	ctx, cancel := context.WithTimeout(ctx, threshold*4)
+	defer cancel()
+
+	start := time.Now()
+	var one int
+	err := db.GetContext(ctx, &one, "SELECT 1")
+	latency := time.Since(start)
+
+	dbLatency.Lock()
+	defer dbLatency.Unlock()
+	dbLatency.last = latency
+	if err != nil || latency > threshold {
+		dbLatency.slowStreak++
+		dbLatency.fastStreak = 0
+	} else {
+		dbLatency.fastStreak++
+		dbLatency.slowStreak = 0
+	}
+
+	switch {
+	case !dbLatency.readOnly.Load() && dbLatency.slowStreak >= readOnlyEnterStreak:
+		logger("read_only").Warn("switching to read-only mode", "db_latency", latency)
+		dbLatency.readOnly.Store(true)
+		clearIndexPage()
+	case dbLatency.readOnly.Load() && dbLatency.fastStreak >= readOnlyLeaveStreak:
+		logger("read_only").Info("leaving read-only mode", "db_latency", latency)
+		dbLatency.readOnly.Store(false)
+		clearIndexPage()
+	}
+	// 測れなかったことはジョブの失敗として残す
+	return err
+}
+
+// 読み取り専用の間は書き込みのリクエストを503で断るミドルウェア
+// APIはJSONのエラー、ページはお知らせのページを返す
+func withReadOnlyGuard(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !isReadOnly() {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		w.Header().Set("Retry-After", readOnlyRetryAfter)
+		if strings.HasPrefix(r.URL.Path, "/api/") {
+			handleError(w, r, errReadOnly)
+			return
+		}
+		if err := renderTemplate(w, r, http.StatusServiceUnavailable, templates.readOnly, "layout.html", newViewData(w, r)); err != nil {
+			handleError(w, r, err)
+		}
+	})
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+)
+
+var errRedisNil = errors.New("redis: nil")
+
+// 必要なコマンドだけを扱う最小限のRedisクライアント（RESP2）
+type redisClient struct {
+	addr    string
+	timeout time.Duration
+	pool    chan *redisConn
+}
+
+type redisConn struct {
+	conn net.Conn
+	r    *bufio.Reader
+	w    *bufio.Writer
+}
+
+func newRedisClient(addr string, poolSize int) *redisClient {
+	return &redisClient{
+		addr:    addr,
+		timeout: 500 * time.Millisecond,
+		pool:    make(chan *redisConn, poolSize),
+	}
+}
+
+func (c *redisClient) getConn() (*redisConn, error) {
+	select {
+	case cn := <-c.pool:
+		return cn, nil
+	default:
+	}
+
+	conn, err := net.DialTimeout("tcp", c.addr, c.timeout)
+	if err != nil {
+		return nil, err
+	}
+	return &redisConn{conn: conn, r: bufio.NewReader(conn), w: bufio.NewWriter(conn)}, nil
+}
+
+func (c *redisClient) putConn(cn *redisConn) {
+	select {
+	case c.pool <- cn:
+	default:
+		cn.conn.Close()
+	}
+}
+
+// コマンドを実行して応答を返す
+// 応答は string, int64, []byte, []any, nil のいずれか
+func (c *redisClient) Do(args ...string) (any, error) {
+	cn, err := c.getConn()
+	if err != nil {
+		return nil, err
+	}
+
+	cn.conn.SetDeadline(time.Now().Add(c.timeout))
+	reply, err := cn.do(args)
+	if err != nil {
+		var redisErr redisError
+		if !errors.As(err, &redisErr) {
+			// 通信エラーの場合は接続を捨てる
+			cn.conn.Close()
+			return nil, err
+		}
+	}
+	c.putConn(cn)
+	return reply, err
+}
+
+// 複数のコマンドをまとめて送り、応答を順に返す
+// エラー応答があった場合も全ての応答を読んでから最初のエラーを返す
+func (c *redisClient) Pipeline(cmds [][]string) ([]any, error) {
+	cn, err := c.getConn()
+	if err != nil {
+		return nil, err
+	}
+
+	cn.conn.SetDeadline(time.Now().Add(c.timeout))
+	replies, err := cn.pipeline(cmds)
+	if err != nil {
+		var redisErr redisError
+		if !errors.As(err, &redisErr) {
+			cn.conn.Close()
+			return nil, err
+		}
+	}
+	c.putConn(cn)
+	return replies, err
+}
+
+// Redisが返したエラー応答
+type redisError string
+
+func (e redisError) Error() string {
+	return "redis: " + string(e)
+}
+
+func (cn *redisConn) writeCommand(args []string) {
+	fmt.Fprintf(cn.w, "*%d\r\n", len(args))
+	for _, a := range args {
+		fmt.Fprintf(cn.w, "$%d\r\n%s\r\n", len(a), a)
+	}
+}
+
+func (cn *redisConn) do(args []string) (any, error) {
+	cn.writeCommand(args)
+	if err := cn.w.Flush(); err != nil {
+		return nil, err
+	}
+	return cn.readReply()
+}
+
+func (cn *redisConn) pipeline(cmds [][]string) ([]any, error) {
+	for _, args := range cmds {
+		cn.writeCommand(args)
+	}
+	if err := cn.w.Flush(); err != nil {
+		return nil, err
+	}
+
+	replies := make([]any, 0, len(cmds))
+	var firstErr error
+	for range cmds {
+		reply, err := cn.readReply()
+		if err != nil {
+			var redisErr redisError
+			if !errors.As(err, &redisErr) {
+				return nil, err
+			}
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+		replies = append(replies, reply)
+	}
+	return replies, firstErr
+}
+
+func (cn *redisConn) readLine() (string, error) {
+	line, err := cn.r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return "", fmt.Errorf("redis: invalid reply line %q", line)
+	}
+	return line[:len(line)-2], nil
+}
+
+func (cn *redisConn) readReply() (any, error) {
+	line, err := cn.readLine()
+	if err != nil {
+		return nil, err
+	}
+
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, redisError(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(cn.r, buf); err != nil {
+			return nil, err
+		}
+		return buf[:n], nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		items := make([]any, 0, n)
+		for i := 0; i < n; i++ {
+			item, err := cn.readReply()
+			if err != nil {
+				return nil, err
+			}
+			items = append(items, item)
+		}
+		return items, nil
+	default:
+		return nil, fmt.Errorf("redis: unexpected reply %q", line)
+	}
+}
+
+// 応答をバイト列として取り出す
+func redisBytes(reply any, err error) ([]byte, error) {
+	if err != nil {
+		return nil, err
+	}
+	switch v := reply.(type) {
+	case []byte:
+		return v, nil
+	case string:
+		return []byte(v), nil
+	case nil:
+		return nil, errRedisNil
+	default:
+		return nil, fmt.Errorf("redis: unexpected reply type %T", reply)
+	}
+}
+
+// 応答を整数として取り出す
+func redisInt(reply any, err error) (int64, error) {
+	if err != nil {
+		return 0, err
+	}
+	switch v := reply.(type) {
+	case int64:
+		return v, nil
+	case []byte:
+		return strconv.ParseInt(string(v), 10, 64)
+	case nil:
+		return 0, errRedisNil
+	default:
+		return 0, fmt.Errorf("redis: unexpected reply type %T", reply)
+	}
+}
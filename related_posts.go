@@ -0,0 +1,312 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"errors"
+	"image"
+	"math/bits"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/nfnt/resize"
+)
+
+const (
+	// 詳細ページの各欄に表示する投稿の数
+	relatedPostsLimit = 6
+	// 似ている投稿を探すのに使うハッシュタグの数
+	relatedTagLimit = 5
+	// ハッシュタグや画像のハッシュの区間ごとに見る候補の数
+	relatedCandidateLimit = 20
+	// 似た画像とみなす知覚ハッシュのハミング距離
+	relatedHashMaxDistance = 10
+	// 投稿や審査の結果はすぐに反映しなくてよいので長めに持つ
+	relatedPostsTTL = 10 * time.Minute
+	// BANや/initializeでまとめて捨てられるよう、キーに含める世代のキー
+	relatedPostsGenKey = "related:gen"
+	// 索引を作る投稿の待ち行列の長さ
+	relatedIndexQueueSize = 1024
+)
+
+// 詳細ページに表示する関連する投稿
+// ByUserは同じユーザーの新しい投稿、Similarは同じハッシュタグか似た画像の投稿
+type relatedPosts struct {
+	ByUser  []Post
+	Similar []Post
+}
+
+// 公開した投稿のハッシュタグと画像のハッシュを記録する
+var relatedIndexCh = make(chan int, relatedIndexQueueSize)
+
+func relatedPostsKey(gen string, postID int) string {
+	return "related:" + gen + ":post:" + strconv.Itoa(postID)
+}
+
+func relatedPostsGeneration(ctx context.Context) string {
+	b, err := cacheStore.Get(ctx, relatedPostsGenKey)
+	if err != nil {
+		return "0"
+	}
+	return string(b)
+}
+
+// 関連する投稿のキャッシュを全て無効にする
+func clearRelatedPostsCache(ctx context.Context) error {
+	_, err := cacheStore.Incr(ctx, relatedPostsGenKey, 1, 0)
+	return err
+}
+
+// 公開した投稿を索引に加え、BANしたユーザーの投稿を勧めないようキャッシュを捨てる
+func subscribeRelatedPosts() {
+	subscribe(events, func(e PostCreated) { enqueueRelatedIndex(e.PostID) })
+	expire := func() {
+		if err := clearRelatedPostsCache(context.Background()); err != nil {
+			logger("cache").Error("failed to expire related posts", "err", err)
+		}
+	}
+	subscribe(events, func(UserBanned) { expire() })
+	subscribe(events, func(UserUnbanned) { expire() })
+}
+
+func enqueueRelatedIndex(postID int) {
+	select {
+	case relatedIndexCh <- postID:
+	default:
+		logger("related").Warn("index queue is full, dropping post", "post_id", postID)
+	}
+}
+
+// ctxが終了するまで投稿を索引に加え続ける
+func runRelatedIndexer(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case pid := <-relatedIndexCh:
+			if err := indexRelatedPost(ctx, pid); err != nil {
+				logger("related").Error("failed to index post", "post_id", pid, "err", err)
+			}
+		}
+	}
+}
+
+// 投稿のハッシュタグと画像の知覚ハッシュを記録する
+func indexRelatedPost(ctx context.Context, pid int) error {
+	var p Post
+	err := db.GetContext(ctx, &p, "SELECT `id`, `body`, `mime` FROM `posts` WHERE `id` = ?", pid)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, tag := range extractHashtags(p.Body) {
+		if _, err := db.ExecContext(ctx, "INSERT IGNORE INTO `post_tags` (`post_id`, `tag`) VALUES (?, ?)", pid, tag); err != nil {
+			return err
+		}
+	}
+
+	data, err := fetchImage(ctx, pid, strings.TrimPrefix(imageExt(p.Mime), "."))
+	if err != nil {
+		return err
+	}
+	hash, err := imageDHash(data)
+	if err != nil {
+		// 読めない画像は似た画像を探さない
+		logger("related").WarnContext(ctx, "failed to hash image", "post_id", pid, "err", err)
+		return nil
+	}
+	b := hashBands(hash)
+	_, err = db.ExecContext(ctx,
+		"REPLACE INTO `post_image_hashes` (`post_id`, `hash`, `band0`, `band1`, `band2`, `band3`) VALUES (?,?,?,?,?,?)",
+		pid, hash, b[0], b[1], b[2], b[3])
+	return err
+}
+
+// 画像の差分ハッシュ（dHash）。9×8に縮小した明るさを左右で比べて64ビットにする
+// 縮小や再圧縮では数ビットしか変わらないので、ハミング距離が近ければ似た画像とみなせる
+func imageDHash(data []byte) (uint64, error) {
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return 0, err
+	}
+	small := resize.Resize(9, 8, img, resize.Bilinear)
+	lum := func(x, y int) float64 {
+		r, g, b, _ := small.At(x, y).RGBA()
+		return 0.299*float64(r) + 0.587*float64(g) + 0.114*float64(b)
+	}
+	var hash uint64
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 8; x++ {
+			if lum(x, y) > lum(x+1, y) {
+				hash |= 1 << (y*8 + x)
+			}
+		}
+	}
+	return hash, nil
+}
+
+// ハッシュを16ビットずつ4つに分けたもの
+// ハミング距離が3以下の画像は必ずどれかが一致するので、一致するものだけを候補として調べる
+func hashBands(hash uint64) [4]uint16 {
+	return [4]uint16{uint16(hash), uint16(hash >> 16), uint16(hash >> 32), uint16(hash >> 48)}
+}
+
+type imageHashRow struct {
+	PostID int    `db:"post_id"`
+	Hash   uint64 `db:"hash"`
+}
+
+// 詳細ページの関連する投稿。キャッシュになければ作る
+func relatedPostsFor(ctx context.Context, p Post) (relatedPosts, error) {
+	key := relatedPostsKey(relatedPostsGeneration(ctx), p.ID)
+	if related, err := cacheGet[relatedPosts](ctx, key); err == nil {
+		return related, nil
+	} else if !errors.Is(err, errCacheMiss) {
+		logger("cache").WarnContext(ctx, "failed to get related posts", "err", err)
+	}
+
+	related, err := buildRelatedPosts(ctx, p)
+	if err != nil {
+		return relatedPosts{}, err
+	}
+	if err := cacheSet(ctx, key, related, relatedPostsTTL); err != nil {
+		logger("cache").ErrorContext(ctx, "failed to store related posts", "err", err)
+	}
+	return related, nil
+}
+
+func buildRelatedPosts(ctx context.Context, p Post) (relatedPosts, error) {
+	related := relatedPosts{ByUser: []Post{}}
+	err := db.SelectContext(ctx, &related.ByUser,
+		"SELECT p.`id`, p.`user_id`, p.`body`, p.`mime`, p.`created_at` FROM `posts` p"+
+			" WHERE p.`user_id` = ? AND p.`id` <> ?"+
+			" AND NOT EXISTS (SELECT 1 FROM `pending_posts` m WHERE m.`post_id` = p.`id`)"+
+			" ORDER BY p.`created_at` DESC LIMIT ?",
+		p.UserID, p.ID, relatedPostsLimit)
+	if err != nil {
+		return relatedPosts{}, err
+	}
+
+	candidates, err := similarPostIDs(ctx, p)
+	if err != nil {
+		return relatedPosts{}, err
+	}
+	candidates = slices.DeleteFunc(candidates, func(id int) bool {
+		return slices.ContainsFunc(related.ByUser, func(q Post) bool { return q.ID == id })
+	})
+	related.Similar, err = fetchRelatedCandidates(ctx, candidates)
+	if err != nil {
+		return relatedPosts{}, err
+	}
+	return related, nil
+}
+
+// 似ている投稿のID（似ている順）
+// 画像のハッシュが近い投稿を先に、続いて同じハッシュタグの多い投稿を並べる
+func similarPostIDs(ctx context.Context, p Post) ([]int, error) {
+	ids := []int{}
+
+	var hash uint64
+	err := db.GetContext(ctx, &hash, "SELECT `hash` FROM `post_image_hashes` WHERE `post_id` = ?", p.ID)
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		// 索引を作る前の投稿は、次に表示したときに使えるよう索引に加える
+		if p.Moderation == "" {
+			enqueueRelatedIndex(p.ID)
+		}
+	case err != nil:
+		return nil, err
+	default:
+		rows := []imageHashRow{}
+		b := hashBands(hash)
+		parts := make([]string, len(b))
+		args := []any{}
+		for i := range b {
+			parts[i] = "(SELECT `post_id`, `hash` FROM `post_image_hashes` WHERE `band" + strconv.Itoa(i) + "` = ? AND `post_id` <> ? ORDER BY `post_id` DESC LIMIT ?)"
+			args = append(args, b[i], p.ID, relatedCandidateLimit)
+		}
+		if err := db.SelectContext(ctx, &rows, strings.Join(parts, " UNION "), args...); err != nil {
+			return nil, err
+		}
+		slices.SortFunc(rows, func(a, b imageHashRow) int {
+			return bits.OnesCount64(a.Hash^hash) - bits.OnesCount64(b.Hash^hash)
+		})
+		for _, row := range rows {
+			if bits.OnesCount64(row.Hash^hash) <= relatedHashMaxDistance {
+				ids = append(ids, row.PostID)
+			}
+		}
+	}
+
+	tags := extractHashtags(p.Body)
+	if len(tags) > relatedTagLimit {
+		tags = tags[:relatedTagLimit]
+	}
+	shared := map[int]int{}
+	tagged := []int{}
+	for _, tag := range tags {
+		postIDs := []int{}
+		err := db.SelectContext(ctx, &postIDs,
+			"SELECT `post_id` FROM `post_tags` WHERE `tag` = ? AND `post_id` <> ? ORDER BY `post_id` DESC LIMIT ?",
+			tag, p.ID, relatedCandidateLimit)
+		if err != nil {
+			return nil, err
+		}
+		for _, id := range postIDs {
+			if shared[id] == 0 {
+				tagged = append(tagged, id)
+			}
+			shared[id]++
+		}
+	}
+	slices.SortStableFunc(tagged, func(a, b int) int {
+		if shared[a] != shared[b] {
+			return shared[b] - shared[a]
+		}
+		return b - a
+	})
+	for _, id := range tagged {
+		if !slices.Contains(ids, id) {
+			ids = append(ids, id)
+		}
+	}
+	return ids, nil
+}
+
+// 候補のうち公開済みで、BANされていないユーザーの投稿を候補の順に最大relatedPostsLimit件
+func fetchRelatedCandidates(ctx context.Context, ids []int) ([]Post, error) {
+	if len(ids) == 0 {
+		return []Post{}, nil
+	}
+	query, args, err := sqlx.In(
+		"SELECT p.`id`, p.`user_id`, p.`body`, p.`mime`, p.`created_at` FROM `posts` p"+
+			" JOIN `users` u ON u.`id` = p.`user_id` AND u.`del_flg` = 0"+
+			" WHERE p.`id` IN (?)"+
+			" AND NOT EXISTS (SELECT 1 FROM `pending_posts` m WHERE m.`post_id` = p.`id`)",
+		ids)
+	if err != nil {
+		return nil, err
+	}
+	found := []Post{}
+	if err := db.SelectContext(ctx, &found, query, args...); err != nil {
+		return nil, err
+	}
+
+	posts := []Post{}
+	for _, id := range ids {
+		if len(posts) >= relatedPostsLimit {
+			break
+		}
+		if i := slices.IndexFunc(found, func(p Post) bool { return p.ID == id }); i >= 0 {
+			posts = append(posts, found[i])
+		}
+	}
+	return posts, nil
+}
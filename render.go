@@ -0,0 +1,35 @@
+package main
+
+import (
+	"html/template"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// テンプレートをバッファに描画してから書き出す
+// 描画に失敗した場合は何も書かずにエラーを返すので、handleErrorが500を返せる
+// （途中まで書いたページが200で返ることがない）
+func renderTemplate(w http.ResponseWriter, r *http.Request, status int, tmpl *template.Template, name string, data any) error {
+	// テンプレートのVerifiedが描画中にDBに問い合わせないよう、リクエストのctxで先に読み込んでおく
+	// 読み込めなかった場合は認証済みのバッジを出さずに描画する
+	verifiedUserIDs(r.Context())
+
+	buf := getBuffer()
+	defer putBuffer(buf)
+	start := time.Now()
+	err := tmpl.ExecuteTemplate(buf, name, data)
+	requestTraceFrom(r.Context()).addRender(time.Since(start))
+	if err != nil {
+		return err
+	}
+
+	h := w.Header()
+	if h.Get("Content-Type") == "" {
+		h.Set("Content-Type", "text/html; charset=utf-8")
+	}
+	h.Set("Content-Length", strconv.Itoa(buf.Len()))
+	w.WriteHeader(status)
+	_, err = w.Write(buf.Bytes())
+	return err
+}
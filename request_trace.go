@@ -0,0 +1,208 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+const (
+	// 1件の記録に残すクエリの数（超えた分は件数と合計時間にだけ数える）
+	slowRequestMaxQueries = 50
+	// 記録に残すクエリの長さ
+	slowRequestMaxQueryLen = 200
+)
+
+// 1リクエストの中で実行したクエリとキャッシュ、テンプレートの描画の内訳
+// ISUCONP_SLOW_REQUEST_MSを超えたリクエストだけログに出す
+type requestTrace struct {
+	mu          sync.Mutex
+	queries     []tracedQuery
+	queryCount  int
+	queryTime   time.Duration
+	cacheHits   int
+	cacheMisses int
+	cacheOps    int
+	cacheTime   time.Duration
+	renderTime  time.Duration
+	renderCount int
+}
+
+type tracedQuery struct {
+	SQL        string  `json:"sql"`
+	DurationMS float64 `json:"duration_ms"`
+	Error      string  `json:"error,omitempty"`
+}
+
+type requestTraceKey struct{}
+
+// 処理中のリクエストの内訳はリクエストのctxで渡す
+// クエリやキャッシュの操作は、リクエストのctxを渡したものだけを数える
+// トランザクションの外の書き込みは、切断で途中で止まらないようcontext.WithoutCancelで包んで渡す
+func withRequestTrace(ctx context.Context, t *requestTrace) context.Context {
+	return context.WithValue(ctx, requestTraceKey{}, t)
+}
+
+// ctxのリクエストの内訳。記録していなければnil
+func requestTraceFrom(ctx context.Context) *requestTrace {
+	t, _ := ctx.Value(requestTraceKey{}).(*requestTrace)
+	return t
+}
+
+func (t *requestTrace) addQuery(query string, d time.Duration, err error) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.queryCount++
+	t.queryTime += d
+	if len(t.queries) >= slowRequestMaxQueries {
+		return
+	}
+	q := tracedQuery{
+		SQL:        truncateRunes(strings.Join(strings.Fields(query), " "), slowRequestMaxQueryLen),
+		DurationMS: durationMS(d),
+	}
+	if err != nil {
+		q.Error = err.Error()
+	}
+	t.queries = append(t.queries, q)
+}
+
+func (t *requestTrace) addCache(hits, misses int, d time.Duration) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.cacheHits += hits
+	t.cacheMisses += misses
+	t.cacheOps++
+	t.cacheTime += d
+}
+
+func (t *requestTrace) addRender(d time.Duration) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.renderTime += d
+	t.renderCount++
+}
+
+func durationMS(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
+
+// ISUCONP_SLOW_REQUEST_MSを超えたリクエストの内訳をログに出すミドルウェア
+// 全てのリクエストで内訳を取るが、ログに出すのは遅かったものだけ
+func withSlowRequestLog(next http.Handler) http.Handler {
+	if config.SlowRequestMS <= 0 {
+		return next
+	}
+	threshold := time.Duration(config.SlowRequestMS) * time.Millisecond
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t := &requestTrace{}
+		r = r.WithContext(withRequestTrace(r.Context(), t))
+
+		start := time.Now()
+		sw := &statusResponseWriter{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(sw, r)
+		if d := time.Since(start); d >= threshold {
+			logSlowRequest(r, sw.status, d, t)
+		}
+	})
+}
+
+func logSlowRequest(r *http.Request, status int, d time.Duration, t *requestTrace) {
+	route := ""
+	if rctx := chi.RouteContext(r.Context()); rctx != nil {
+		route = rctx.RoutePattern()
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	logger("http").WarnContext(r.Context(), "slow request",
+		"method", r.Method,
+		"path", r.URL.Path,
+		"route", route,
+		"status", status,
+		"duration_ms", durationMS(d),
+		slog.Group("query", "count", t.queryCount, "ms", durationMS(t.queryTime), "queries", t.queries),
+		slog.Group("cache", "hits", t.cacheHits, "misses", t.cacheMisses, "ops", t.cacheOps, "ms", durationMS(t.cacheTime)),
+		slog.Group("render", "count", t.renderCount, "ms", durationMS(t.renderTime)),
+	)
+}
+
+// キャッシュの操作を処理中のリクエストの内訳に数えるラッパー
+type tracedCache struct {
+	cacheBackend
+}
+
+// 遅いリクエストを記録する場合はキャッシュの操作も数える
+func traceCacheBackend(c cacheBackend) cacheBackend {
+	if config.SlowRequestMS <= 0 {
+		return c
+	}
+	return tracedCache{c}
+}
+
+func (c tracedCache) Get(ctx context.Context, key string) ([]byte, error) {
+	start := time.Now()
+	v, err := c.cacheBackend.Get(ctx, key)
+	hits, misses := 0, 0
+	if err == nil {
+		hits = 1
+	} else if errors.Is(err, errCacheMiss) {
+		misses = 1
+	}
+	requestTraceFrom(ctx).addCache(hits, misses, time.Since(start))
+	return v, err
+}
+
+func (c tracedCache) GetMulti(ctx context.Context, keys []string) (map[string][]byte, error) {
+	start := time.Now()
+	values, err := c.cacheBackend.GetMulti(ctx, keys)
+	if err == nil {
+		requestTraceFrom(ctx).addCache(len(values), len(keys)-len(values), time.Since(start))
+	} else {
+		requestTraceFrom(ctx).addCache(0, 0, time.Since(start))
+	}
+	return values, err
+}
+
+func (c tracedCache) Set(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	start := time.Now()
+	err := c.cacheBackend.Set(ctx, key, value, ttl)
+	requestTraceFrom(ctx).addCache(0, 0, time.Since(start))
+	return err
+}
+
+func (c tracedCache) SetMulti(ctx context.Context, items map[string][]byte, ttl time.Duration) error {
+	start := time.Now()
+	err := c.cacheBackend.SetMulti(ctx, items, ttl)
+	requestTraceFrom(ctx).addCache(0, 0, time.Since(start))
+	return err
+}
+
+func (c tracedCache) Delete(ctx context.Context, key string) error {
+	start := time.Now()
+	err := c.cacheBackend.Delete(ctx, key)
+	requestTraceFrom(ctx).addCache(0, 0, time.Since(start))
+	return err
+}
+
+func (c tracedCache) Incr(ctx context.Context, key string, delta int64, ttl time.Duration) (int64, error) {
+	start := time.Now()
+	n, err := c.cacheBackend.Incr(ctx, key, delta, ttl)
+	requestTraceFrom(ctx).addCache(0, 0, time.Since(start))
+	return n, err
+}
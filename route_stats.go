@@ -0,0 +1,260 @@
+package main
+
+import (
+	"cmp"
+	"math/rand/v2"
+	"net/http"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// 応答時間のヒストグラムのバケットの上限（最後のバケットはそれより遅いもの全て）
+var routeLatencyBuckets = [...]time.Duration{
+	1 * time.Millisecond,
+	2 * time.Millisecond,
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	20 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	200 * time.Millisecond,
+	500 * time.Millisecond,
+	1 * time.Second,
+	2 * time.Second,
+	5 * time.Second,
+}
+
+// ルートごとのリクエスト数・エラー数と応答時間のヒストグラム
+// リクエスト数とエラー数は全て数え、応答時間はISUCONP_ROUTE_STATS_SAMPLE_PERCENTの割合だけ記録する
+type routeStat struct {
+	requests     atomic.Int64
+	clientErrors atomic.Int64
+	serverErrors atomic.Int64
+	samples      atomic.Int64
+	totalNanos   atomic.Int64
+	maxNanos     atomic.Int64
+	buckets      [len(routeLatencyBuckets) + 1]atomic.Int64
+}
+
+// 起動してからのルートごとの統計（デプロイで再起動するので「前回のデプロイから」になる）
+var routeStats = struct {
+	sync.RWMutex
+	startedAt time.Time
+	routes    map[string]*routeStat
+}{startedAt: time.Now(), routes: make(map[string]*routeStat)}
+
+func routeStatFor(key string) *routeStat {
+	routeStats.RLock()
+	st := routeStats.routes[key]
+	routeStats.RUnlock()
+	if st != nil {
+		return st
+	}
+
+	routeStats.Lock()
+	defer routeStats.Unlock()
+	if st = routeStats.routes[key]; st == nil {
+		st = &routeStat{}
+		routeStats.routes[key] = st
+	}
+	return st
+}
+
+func (st *routeStat) record(status int, d time.Duration, sampled bool) {
+	st.requests.Add(1)
+	switch {
+	case status >= http.StatusInternalServerError:
+		st.serverErrors.Add(1)
+	case status >= http.StatusBadRequest:
+		st.clientErrors.Add(1)
+	}
+	if !sampled {
+		return
+	}
+
+	st.samples.Add(1)
+	st.totalNanos.Add(int64(d))
+	for {
+		cur := st.maxNanos.Load()
+		if int64(d) <= cur || st.maxNanos.CompareAndSwap(cur, int64(d)) {
+			break
+		}
+	}
+	i, _ := slices.BinarySearch(routeLatencyBuckets[:], d)
+	st.buckets[i].Add(1)
+}
+
+// ルートのパターン（/posts/{id}など）ごとに統計を取るミドルウェア
+func withRouteStats(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		sw := &statusResponseWriter{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(sw, r)
+
+		pattern := "(unmatched)"
+		if rctx := chi.RouteContext(r.Context()); rctx != nil && rctx.RoutePattern() != "" {
+			pattern = rctx.RoutePattern()
+		}
+		sampled := reloadable().RouteStatsSamplePercent >= 100 || rand.IntN(100) < reloadable().RouteStatsSamplePercent
+		routeStatFor(r.Method+" "+pattern).record(sw.status, time.Since(start), sampled)
+	})
+}
+
+// 書き込まれたステータスコードを覚えておくResponseWriter
+type statusResponseWriter struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+}
+
+func (w *statusResponseWriter) WriteHeader(status int) {
+	if !w.wroteHeader {
+		w.wroteHeader = true
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusResponseWriter) Write(b []byte) (int, error) {
+	w.wroteHeader = true
+	return w.ResponseWriter.Write(b)
+}
+
+// http.ResponseControllerから元のResponseWriterを使えるようにする
+func (w *statusResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// ルートの統計のスナップショット
+// パーセンタイルはヒストグラムから求めるので、そのバケットの上限の値になる
+type routeStatSummary struct {
+	Route        string        `json:"route"`
+	Requests     int64         `json:"requests"`
+	ClientErrors int64         `json:"client_errors"`
+	ServerErrors int64         `json:"server_errors"`
+	ErrorRate    float64       `json:"error_rate"`
+	Samples      int64         `json:"samples"`
+	Mean         time.Duration `json:"mean_ns"`
+	P50          time.Duration `json:"p50_ns"`
+	P95          time.Duration `json:"p95_ns"`
+	P99          time.Duration `json:"p99_ns"`
+	Max          time.Duration `json:"max_ns"`
+	// 遅いルートの上位（/admin/perfで強調する）
+	Slow bool `json:"slow"`
+}
+
+// 遅いルートとして強調する数
+const slowRouteCount = 5
+
+// ルートの統計をp95の遅い順に返す
+func routeStatSummaries() []routeStatSummary {
+	routeStats.RLock()
+	res := make([]routeStatSummary, 0, len(routeStats.routes))
+	for route, st := range routeStats.routes {
+		res = append(res, st.summary(route))
+	}
+	routeStats.RUnlock()
+
+	slices.SortFunc(res, func(a, b routeStatSummary) int {
+		if c := cmp.Compare(b.P95, a.P95); c != 0 {
+			return c
+		}
+		return cmp.Compare(b.Mean, a.Mean)
+	})
+	for i := range res {
+		res[i].Slow = i < slowRouteCount && res[i].Samples > 0
+	}
+	return res
+}
+
+func (st *routeStat) summary(route string) routeStatSummary {
+	s := routeStatSummary{
+		Route:        route,
+		Requests:     st.requests.Load(),
+		ClientErrors: st.clientErrors.Load(),
+		ServerErrors: st.serverErrors.Load(),
+		Samples:      st.samples.Load(),
+		Max:          time.Duration(st.maxNanos.Load()),
+	}
+	if s.Requests > 0 {
+		s.ErrorRate = float64(s.ServerErrors) / float64(s.Requests)
+	}
+	if s.Samples == 0 {
+		return s
+	}
+	s.Mean = time.Duration(st.totalNanos.Load() / s.Samples)
+
+	var counts [len(routeLatencyBuckets) + 1]int64
+	var total int64
+	for i := range counts {
+		counts[i] = st.buckets[i].Load()
+		total += counts[i]
+	}
+	percentile := func(p float64) time.Duration {
+		target := int64(float64(total)*p + 0.5)
+		var acc int64
+		for i, c := range counts {
+			acc += c
+			if acc >= max(target, 1) {
+				if i < len(routeLatencyBuckets) {
+					return routeLatencyBuckets[i]
+				}
+				return s.Max
+			}
+		}
+		return s.Max
+	}
+	s.P50, s.P95, s.P99 = percentile(0.50), percentile(0.95), percentile(0.99)
+	return s
+}
+
+// GET /api/v1/admin/perf
+// 起動してからのルートごとの応答時間とエラー数
+func getAPIAdminPerf(w http.ResponseWriter, r *http.Request) error {
+	me := currentUser(r)
+	if !isLogin(me) {
+		return errUnauthorized
+	}
+	if me.Authority == 0 {
+		return errForbidden
+	}
+	return writeJSON(w, http.StatusOK, struct {
+		Since  time.Time          `json:"since"`
+		Routes []routeStatSummary `json:"routes"`
+		// ブラウザから送られた表示速度
+		Vitals []vitalSummary `json:"vitals"`
+		// 直近WindowMinutes分にページを見たセッションの数
+		Online        int64 `json:"online"`
+		WindowMinutes int   `json:"online_window_minutes"`
+		// 混雑の状況と断ったリクエストの数
+		Load loadShedSummary `json:"load"`
+		// DBの枠の種類ごとの使われ方（制限していなければ空）
+		DBSlots []dbClassSummary `json:"db_slots"`
+	}{routeStats.startedAt, routeStatSummaries(), vitalSummaries(), onlineCount(r.Context()), config.OnlineWindowMinutes, loadShed.summary(), dbSlots.summary()})
+}
+
+func getAdminPerf(w http.ResponseWriter, r *http.Request) error {
+	me := currentUser(r)
+	if !isLogin(me) {
+		redirect(w, r, "/", http.StatusFound)
+		return nil
+	}
+
+	if me.Authority == 0 {
+		return errForbidden
+	}
+
+	data := newViewData(w, r).
+		With("Since", routeStats.startedAt).
+		With("Routes", routeStatSummaries()).
+		With("Vitals", vitalSummaries()).
+		With("SamplePercent", reloadable().RouteStatsSamplePercent).
+		With("OnlineWindowMinutes", config.OnlineWindowMinutes).
+		With("Load", loadShed.summary()).
+		With("DBSlots", dbSlots.summary())
+	return renderTemplate(w, r, http.StatusOK, templates.perf, "layout.html", data)
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"cmp"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// ビーコンのボディの上限
+const beaconMaxBytes = 4 * 1024
+
+// ブラウザから受け付ける指標と値の上限
+// clsは単位のないスコア、それ以外はミリ秒
+var vitalLimits = map[string]float64{
+	"ttfb": 60000, // 最初のバイトが届くまで
+	"fcp":  60000, // First Contentful Paint
+	"lcp":  60000, // Largest Contentful Paint
+	"inp":  60000, // Interaction to Next Paint
+	"dcl":  60000, // DOMContentLoaded
+	"load": 60000, // loadイベント
+	"cls":  10,    // Cumulative Layout Shift
+}
+
+// 指標ごとのヒストグラムのバケットの上限
+var (
+	vitalMillisBuckets = []float64{50, 100, 200, 300, 500, 800, 1000, 1500, 2000, 2500, 3000, 4000, 6000, 10000}
+	vitalScoreBuckets  = []float64{0.01, 0.025, 0.05, 0.1, 0.15, 0.25, 0.5, 1}
+)
+
+// ページの種類と指標ごとの集計
+type vitalStat struct {
+	bounds  []float64
+	count   atomic.Int64
+	buckets []atomic.Int64
+	// 合計は浮動小数なのでロックで守る
+	mu  sync.Mutex
+	sum float64
+}
+
+// 起動してからのブラウザでの表示速度（キーは「ページの種類 指標」）
+var vitalStats = struct {
+	sync.RWMutex
+	stats map[string]*vitalStat
+}{stats: make(map[string]*vitalStat)}
+
+func vitalStatFor(page, metric string) *vitalStat {
+	key := page + " " + metric
+	vitalStats.RLock()
+	st := vitalStats.stats[key]
+	vitalStats.RUnlock()
+	if st != nil {
+		return st
+	}
+
+	vitalStats.Lock()
+	defer vitalStats.Unlock()
+	if st = vitalStats.stats[key]; st == nil {
+		bounds := vitalMillisBuckets
+		if metric == "cls" {
+			bounds = vitalScoreBuckets
+		}
+		st = &vitalStat{bounds: bounds, buckets: make([]atomic.Int64, len(bounds)+1)}
+		vitalStats.stats[key] = st
+	}
+	return st
+}
+
+func (st *vitalStat) record(v float64) {
+	st.count.Add(1)
+	i, _ := slices.BinarySearch(st.bounds, v)
+	st.buckets[i].Add(1)
+	st.mu.Lock()
+	st.sum += v
+	st.mu.Unlock()
+}
+
+// ビーコンのページのパスを集計に使うページの種類にまとめる
+// 投稿やユーザーごとに分けると種類が増えすぎるので、ルートの単位にする
+// ページのパスはブラウザから見たもの（ISUCONP_PATH_PREFIXを含む）
+func beaconPageKind(path string) string {
+	path, ok := trimPathPrefix(path)
+	switch {
+	case !ok:
+		return "other"
+	case path == "/":
+		return "index"
+	case strings.HasPrefix(path, "/posts/"):
+		return "post"
+	case strings.HasPrefix(path, "/@"):
+		return "user"
+	case path == "/login" || path == "/register":
+		return "auth"
+	case strings.HasPrefix(path, "/admin/"):
+		return "admin"
+	default:
+		return "other"
+	}
+}
+
+// POST /beacon
+// ブラウザで測った表示速度（Navigation TimingやWeb Vitals）を受け取る
+// navigator.sendBeaconはContent-Typeを選べないので、ボディは常にJSONとして読む
+func postBeacon(w http.ResponseWriter, r *http.Request) error {
+	var beacon struct {
+		Page    string             `json:"page"`
+		Metrics map[string]float64 `json:"metrics"`
+	}
+	err := json.NewDecoder(io.LimitReader(r.Body, beaconMaxBytes)).Decode(&beacon)
+	if err != nil {
+		return newHTTPError(http.StatusBadRequest, errors.New("invalid beacon"))
+	}
+
+	page := beaconPageKind(beacon.Page)
+	for metric, v := range beacon.Metrics {
+		limit, ok := vitalLimits[metric]
+		if !ok || v < 0 || v > limit {
+			continue
+		}
+		vitalStatFor(page, metric).record(v)
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// ページの種類と指標ごとの集計のスナップショット
+// p75（Web Vitalsの評価に使われる値）はヒストグラムから求めるので、そのバケットの上限の値になる
+type vitalSummary struct {
+	Page   string  `json:"page"`
+	Metric string  `json:"metric"`
+	Count  int64   `json:"count"`
+	Mean   float64 `json:"mean"`
+	P75    float64 `json:"p75"`
+}
+
+func vitalSummaries() []vitalSummary {
+	vitalStats.RLock()
+	res := make([]vitalSummary, 0, len(vitalStats.stats))
+	for key, st := range vitalStats.stats {
+		page, metric, _ := strings.Cut(key, " ")
+		res = append(res, st.summary(page, metric))
+	}
+	vitalStats.RUnlock()
+
+	slices.SortFunc(res, func(a, b vitalSummary) int {
+		if c := cmp.Compare(a.Metric, b.Metric); c != 0 {
+			return c
+		}
+		return cmp.Compare(b.P75, a.P75)
+	})
+	return res
+}
+
+func (st *vitalStat) summary(page, metric string) vitalSummary {
+	s := vitalSummary{Page: page, Metric: metric, Count: st.count.Load()}
+	if s.Count == 0 {
+		return s
+	}
+	st.mu.Lock()
+	s.Mean = st.sum / float64(s.Count)
+	st.mu.Unlock()
+
+	target := max(1, int64(float64(s.Count)*0.75+0.5))
+	var acc int64
+	for i := range st.buckets {
+		acc += st.buckets[i].Load()
+		if acc >= target {
+			if i < len(st.bounds) {
+				s.P75 = st.bounds[i]
+			} else {
+				s.P75 = vitalLimits[metric]
+			}
+			break
+		}
+	}
+	return s
+}
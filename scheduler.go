@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math/rand/v2"
+	"runtime/debug"
+	"slices"
+	"sync"
+	"time"
+)
+
+// 定期的に実行するジョブ
+type job struct {
+	name     string
+	interval time.Duration
+	// 実行間隔をintervalのこの割合までばらつかせる
+	jitter float64
+	// 終了時にもう一度実行する（バッファの書き出しなど）
+	runOnStop bool
+	run       func(ctx context.Context) error
+}
+
+// ジョブごとの実行状況
+type jobStats struct {
+	Runs         int64         `json:"runs"`
+	Failures     int64         `json:"failures"`
+	Panics       int64         `json:"panics"`
+	LastRunAt    time.Time     `json:"last_run_at,omitzero"`
+	LastDuration time.Duration `json:"last_duration_ns"`
+	LastError    string        `json:"last_error,omitempty"`
+}
+
+type scheduler struct {
+	mu    sync.Mutex
+	jobs  []job
+	stats map[string]*jobStats
+}
+
+var jobs = &scheduler{stats: make(map[string]*jobStats)}
+
+// ジョブを登録する。ISUCONP_DISABLED_JOBSに含まれるジョブは登録しない
+func (s *scheduler) Register(j job) {
+	if slices.Contains(config.DisabledJobs, j.name) {
+		logger("jobs").Info("job is disabled", "job", j.name)
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.jobs = append(s.jobs, j)
+	s.stats[j.name] = &jobStats{}
+}
+
+// ctxが終了するまでジョブを実行する
+// runOnStopのジョブの最後の実行が終わるまで戻らない
+func (s *scheduler) Run(ctx context.Context) {
+	s.mu.Lock()
+	registered := slices.Clone(s.jobs)
+	s.mu.Unlock()
+
+	var wg sync.WaitGroup
+	for _, j := range registered {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.loop(ctx, j)
+		}()
+	}
+	wg.Wait()
+}
+
+func (s *scheduler) loop(ctx context.Context, j job) {
+	for {
+		wait := j.interval
+		if j.jitter > 0 {
+			wait += time.Duration(rand.Float64() * j.jitter * float64(j.interval))
+		}
+
+		select {
+		case <-ctx.Done():
+			if j.runOnStop {
+				s.runOnce(context.Background(), j)
+			}
+			return
+		case <-time.After(wait):
+			s.runOnce(ctx, j)
+		}
+	}
+}
+
+// ジョブを1回実行して結果を記録する。パニックしても他のジョブには影響させない
+func (s *scheduler) runOnce(ctx context.Context, j job) {
+	start := time.Now()
+	err, panicked := func() (err error, panicked bool) {
+		defer func() {
+			if p := recover(); p != nil {
+				logger("jobs").Error("panic in job", "job", j.name, "panic", p, "stack", string(debug.Stack()))
+				err, panicked = fmt.Errorf("panic: %v", p), true
+			}
+		}()
+		return j.run(ctx), false
+	}()
+	if err != nil && !panicked {
+		logger("jobs").Error("job failed", "job", j.name, "err", err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	st := s.stats[j.name]
+	st.Runs++
+	st.LastRunAt = start
+	st.LastDuration = time.Since(start)
+	st.LastError = ""
+	if err != nil {
+		st.Failures++
+		st.LastError = err.Error()
+	}
+	if panicked {
+		st.Panics++
+	}
+}
+
+// ジョブごとの実行状況のコピーを返す
+func (s *scheduler) Stats() map[string]jobStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	res := make(map[string]jobStats, len(s.stats))
+	for name, st := range s.stats {
+		res[name] = *st
+	}
+	return res
+}
+
+// アプリケーションの定期ジョブを登録する
+func registerJobs() {
+	jobs.Register(job{
+		name:      "counter_flush",
+		interval:  counterFlushInterval,
+		runOnStop: true,
+		run: func(context.Context) error {
+			return flushCounters()
+		},
+	})
+	jobs.Register(job{
+		name:     "invalidation_poll",
+		interval: invalidationPollInterval,
+		run: func(context.Context) error {
+			return invalidations.poll()
+		},
+	})
+	jobs.Register(job{
+		// TTLが切れる前にトップページの投稿一覧を作り直す
+		name:     "index_warm",
+		interval: indexPostsTTL / 2,
+		run: func(context.Context) error {
+			requestIndexRebuild()
+			return nil
+		},
+	})
+	jobs.Register(job{
+		name:     "stats_aggregate",
+		interval: time.Duration(config.StatsJobIntervalSec) * time.Second,
+		// 複数台が同時に動き出さないよう間隔をばらつかせる
+		jitter: 0.2,
+		run:    runStatsJobOnce,
+	})
+	jobs.Register(job{
+		name:     "follow_suggestions",
+		interval: followSuggestionsInterval,
+		jitter:   0.2,
+		run:      rebuildFollowSuggestions,
+	})
+	jobs.Register(job{
+		name:     "ban_purge",
+		interval: time.Hour,
+		run:      purgeBannedUsers,
+	})
+	jobs.Register(job{
+		name:     "image_orphan_sweep",
+		interval: orphanImageSweepInterval,
+		jitter:   0.2,
+		run:      sweepOrphanImages,
+	})
+	if config.ReadOnlyDBLatencyMS > 0 {
+		jobs.Register(job{
+			name:     "db_latency_probe",
+			interval: dbLatencyProbeInterval,
+			run:      probeDBLatency,
+		})
+	}
+	jobs.Register(job{
+		name:     "cache_janitor",
+		interval: time.Minute,
+		run: func(context.Context) error {
+			purgeExpiredMissingImages()
+			purgeExpiredUserStats()
+			purgeExpiredOnlineSessions()
+			return nil
+		},
+	})
+}
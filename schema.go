@@ -0,0 +1,237 @@
+package main
+
+import (
+	"fmt"
+)
+
+// 起動時に作成するテーブル
+// 既存のテーブル（users, posts, comments）は初期データと一緒に作られる前提
+var schemaTables = []string{
+	"CREATE TABLE IF NOT EXISTS `post_views` (" +
+		"`post_id` INT NOT NULL PRIMARY KEY," +
+		"`view_count` BIGINT NOT NULL DEFAULT 0" +
+		") DEFAULT CHARSET=utf8mb4",
+	// 投稿画像の幅と高さ（初期データの投稿には記録されていない）
+	"CREATE TABLE IF NOT EXISTS `post_image_sizes` (" +
+		"`post_id` INT NOT NULL PRIMARY KEY," +
+		"`width` INT NOT NULL," +
+		"`height` INT NOT NULL" +
+		") DEFAULT CHARSET=utf8mb4",
+	"CREATE TABLE IF NOT EXISTS `api_tokens` (" +
+		"`token_hash` CHAR(64) NOT NULL PRIMARY KEY," +
+		"`user_id` INT NOT NULL," +
+		"`created_at` TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP," +
+		"KEY `idx_user_id` (`user_id`)" +
+		") DEFAULT CHARSET=utf8mb4",
+	// 書き込み時に更新するユーザーの統計情報
+	"CREATE TABLE IF NOT EXISTS `user_stats` (" +
+		"`user_id` INT NOT NULL PRIMARY KEY," +
+		"`post_count` INT NOT NULL DEFAULT 0," +
+		"`comment_count` INT NOT NULL DEFAULT 0," +
+		"`commented_count` INT NOT NULL DEFAULT 0" +
+		") DEFAULT CHARSET=utf8mb4",
+	"CREATE TABLE IF NOT EXISTS `post_comment_counts` (" +
+		"`post_id` INT NOT NULL PRIMARY KEY," +
+		"`comment_count` INT NOT NULL DEFAULT 0" +
+		") DEFAULT CHARSET=utf8mb4",
+	// BANした時刻（保持期間が過ぎたら削除する）
+	"CREATE TABLE IF NOT EXISTS `user_bans` (" +
+		"`user_id` INT NOT NULL PRIMARY KEY," +
+		"`banned_at` TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP," +
+		"KEY `idx_banned_at` (`banned_at`)" +
+		") DEFAULT CHARSET=utf8mb4",
+	// 定期的に集計するトレンドのスコア
+	"CREATE TABLE IF NOT EXISTS `trending_post_scores` (" +
+		"`post_id` INT NOT NULL PRIMARY KEY," +
+		"`score` INT NOT NULL," +
+		"`updated_at` TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP" +
+		") DEFAULT CHARSET=utf8mb4",
+	// 定期的に集計するハッシュタグごとの投稿数
+	"CREATE TABLE IF NOT EXISTS `tag_counts` (" +
+		"`tag` VARCHAR(50) NOT NULL PRIMARY KEY," +
+		"`post_count` INT NOT NULL," +
+		"`updated_at` TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP," +
+		"KEY `idx_post_count` (`post_count`)" +
+		") DEFAULT CHARSET=utf8mb4",
+	// ActivityPubの署名に使うインスタンス共通の鍵
+	"CREATE TABLE IF NOT EXISTS `activitypub_keys` (" +
+		"`id` TINYINT NOT NULL PRIMARY KEY," +
+		"`private_key` TEXT NOT NULL" +
+		") DEFAULT CHARSET=utf8mb4",
+	"CREATE TABLE IF NOT EXISTS `activitypub_followers` (" +
+		"`user_id` INT NOT NULL," +
+		"`actor` VARCHAR(512) NOT NULL," +
+		"`inbox` VARCHAR(512) NOT NULL," +
+		"`created_at` TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP," +
+		"PRIMARY KEY (`user_id`, `actor`)" +
+		") DEFAULT CHARSET=ascii",
+	// 管理画面から変更できるサイトの設定（siteSettings）
+	"CREATE TABLE IF NOT EXISTS `site_settings` (" +
+		"`name` VARCHAR(64) NOT NULL PRIMARY KEY," +
+		"`value` TEXT NOT NULL" +
+		") DEFAULT CHARSET=utf8mb4",
+	// 投稿の言語（投稿者が選んだものか本文から推定したもの）
+	"CREATE TABLE IF NOT EXISTS `post_languages` (" +
+		"`post_id` INT NOT NULL PRIMARY KEY," +
+		"`lang` VARCHAR(8) NOT NULL," +
+		"KEY `idx_lang` (`lang`)" +
+		") DEFAULT CHARSET=ascii",
+	// ハッシュタグや検索語の購読
+	"CREATE TABLE IF NOT EXISTS `subscriptions` (" +
+		"`id` INT NOT NULL AUTO_INCREMENT PRIMARY KEY," +
+		"`user_id` INT NOT NULL," +
+		"`kind` VARCHAR(8) NOT NULL," +
+		"`value` VARCHAR(191) NOT NULL," +
+		"`created_at` TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP," +
+		"UNIQUE KEY `uniq_user_kind_value` (`user_id`, `kind`, `value`)," +
+		"KEY `idx_kind_value` (`kind`, `value`)" +
+		") DEFAULT CHARSET=utf8mb4",
+	// 購読に一致した投稿の通知（ユーザーと投稿ごとに1件）
+	"CREATE TABLE IF NOT EXISTS `notifications` (" +
+		"`id` INT NOT NULL AUTO_INCREMENT PRIMARY KEY," +
+		"`user_id` INT NOT NULL," +
+		"`post_id` INT NOT NULL," +
+		"`subscription_id` INT NOT NULL," +
+		"`created_at` TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP," +
+		"`read_at` TIMESTAMP NULL DEFAULT NULL," +
+		"UNIQUE KEY `uniq_user_post` (`user_id`, `post_id`)," +
+		"KEY `idx_post_id` (`post_id`)" +
+		") DEFAULT CHARSET=utf8mb4",
+	// 管理者が認証したユーザー（認証済みのバッジを表示する）
+	"CREATE TABLE IF NOT EXISTS `user_verifications` (" +
+		"`user_id` INT NOT NULL PRIMARY KEY," +
+		"`verified_at` TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP" +
+		") DEFAULT CHARSET=utf8mb4",
+	// 招待制のときに登録に使うコード
+	"CREATE TABLE IF NOT EXISTS `invite_codes` (" +
+		"`code` VARCHAR(32) NOT NULL PRIMARY KEY," +
+		"`max_uses` INT NOT NULL," +
+		"`use_count` INT NOT NULL DEFAULT 0," +
+		"`created_by` INT NOT NULL," +
+		"`created_at` TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP" +
+		") DEFAULT CHARSET=ascii",
+	// コメントへのいいね（1）と報告（-1）
+	"CREATE TABLE IF NOT EXISTS `comment_votes` (" +
+		"`comment_id` INT NOT NULL," +
+		"`user_id` INT NOT NULL," +
+		"`value` TINYINT NOT NULL," +
+		"`created_at` TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP," +
+		"PRIMARY KEY (`comment_id`, `user_id`)," +
+		"KEY `idx_user_id` (`user_id`)" +
+		") DEFAULT CHARSET=ascii",
+	// BANされたユーザーからの異議申し立て
+	"CREATE TABLE IF NOT EXISTS `ban_appeals` (" +
+		"`id` INT NOT NULL AUTO_INCREMENT PRIMARY KEY," +
+		"`user_id` INT NOT NULL," +
+		"`message` TEXT NOT NULL," +
+		"`status` VARCHAR(16) NOT NULL," +
+		"`created_at` TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP," +
+		"`reviewed_at` TIMESTAMP NULL," +
+		"KEY `idx_user_id` (`user_id`)," +
+		"KEY `idx_status` (`status`, `id`)" +
+		") DEFAULT CHARSET=utf8mb4",
+	// 管理者からのお知らせ
+	"CREATE TABLE IF NOT EXISTS `announcements` (" +
+		"`id` INT NOT NULL AUTO_INCREMENT PRIMARY KEY," +
+		"`body` TEXT NOT NULL," +
+		"`level` VARCHAR(16) NOT NULL," +
+		"`starts_at` DATETIME NOT NULL," +
+		"`ends_at` DATETIME NULL," +
+		"`notify` TINYINT(1) NOT NULL DEFAULT 0," +
+		"`created_by` INT NOT NULL," +
+		"`created_at` TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP," +
+		"KEY `idx_ends_at` (`ends_at`)" +
+		") DEFAULT CHARSET=utf8mb4",
+	// ユーザーに通知したお知らせと既読
+	"CREATE TABLE IF NOT EXISTS `announcement_notifications` (" +
+		"`user_id` INT NOT NULL," +
+		"`announcement_id` INT NOT NULL," +
+		"`read_at` TIMESTAMP NULL DEFAULT NULL," +
+		"PRIMARY KEY (`user_id`, `announcement_id`)" +
+		") DEFAULT CHARSET=ascii",
+	// /admin/backupで取ったバックアップの履歴
+	"CREATE TABLE IF NOT EXISTS `backups` (" +
+		"`id` INT NOT NULL AUTO_INCREMENT PRIMARY KEY," +
+		"`strategy` VARCHAR(32) NOT NULL," +
+		"`status` VARCHAR(16) NOT NULL," +
+		"`location` VARCHAR(255) NOT NULL DEFAULT ''," +
+		"`error` TEXT NOT NULL," +
+		"`started_by` INT NOT NULL," +
+		"`started_at` TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP," +
+		"`finished_at` TIMESTAMP NULL" +
+		") DEFAULT CHARSET=utf8mb4",
+	// 公開前の審査待ちと却下された投稿（公開すると行を削除する）
+	"CREATE TABLE IF NOT EXISTS `pending_posts` (" +
+		"`post_id` INT NOT NULL PRIMARY KEY," +
+		"`user_id` INT NOT NULL," +
+		"`status` VARCHAR(16) NOT NULL," +
+		"`created_at` TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP," +
+		"KEY `idx_status_created_at` (`status`, `created_at`)," +
+		"KEY `idx_user_id` (`user_id`)" +
+		") DEFAULT CHARSET=ascii",
+	// 登録や投稿をした端末とIPアドレスのハッシュ（BAN逃れの検出に使う）
+	"CREATE TABLE IF NOT EXISTS `user_fingerprints` (" +
+		"`user_id` INT NOT NULL," +
+		"`device_hash` CHAR(32) NOT NULL," +
+		"`ip_hash` CHAR(32) NOT NULL," +
+		"`first_action` VARCHAR(16) NOT NULL," +
+		"`first_seen_at` TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP," +
+		"`last_seen_at` TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP," +
+		"PRIMARY KEY (`user_id`, `device_hash`, `ip_hash`)," +
+		"KEY `idx_device_hash` (`device_hash`)," +
+		"KEY `idx_ip_hash` (`ip_hash`)" +
+		") DEFAULT CHARSET=ascii",
+	// ユーザーが設定した自己紹介とアイコン
+	"CREATE TABLE IF NOT EXISTS `user_profiles` (" +
+		"`user_id` INT NOT NULL PRIMARY KEY," +
+		"`bio` TEXT NOT NULL," +
+		"`avatar_mime` VARCHAR(16) NOT NULL DEFAULT ''," +
+		"`updated_at` TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP" +
+		") DEFAULT CHARSET=utf8mb4",
+	// 登録した直後の案内の進み具合（行の無いユーザーは案内しない）
+	"CREATE TABLE IF NOT EXISTS `user_onboarding` (" +
+		"`user_id` INT NOT NULL PRIMARY KEY," +
+		"`state` VARCHAR(16) NOT NULL," +
+		"`updated_at` TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP" +
+		") DEFAULT CHARSET=ascii",
+	// 公開した投稿のハッシュタグ（詳細ページの似ている投稿を探す）
+	"CREATE TABLE IF NOT EXISTS `post_tags` (" +
+		"`post_id` INT NOT NULL," +
+		"`tag` VARCHAR(50) NOT NULL," +
+		"PRIMARY KEY (`tag`, `post_id`)," +
+		"KEY `idx_post_id` (`post_id`)" +
+		") DEFAULT CHARSET=utf8mb4",
+	// 公開した投稿の画像の知覚ハッシュと、それを16ビットずつに分けたもの
+	"CREATE TABLE IF NOT EXISTS `post_image_hashes` (" +
+		"`post_id` INT NOT NULL PRIMARY KEY," +
+		"`hash` BIGINT UNSIGNED NOT NULL," +
+		"`band0` SMALLINT UNSIGNED NOT NULL," +
+		"`band1` SMALLINT UNSIGNED NOT NULL," +
+		"`band2` SMALLINT UNSIGNED NOT NULL," +
+		"`band3` SMALLINT UNSIGNED NOT NULL," +
+		"KEY `idx_band0` (`band0`, `post_id`)," +
+		"KEY `idx_band1` (`band1`, `post_id`)," +
+		"KEY `idx_band2` (`band2`, `post_id`)," +
+		"KEY `idx_band3` (`band3`, `post_id`)" +
+		") DEFAULT CHARSET=ascii",
+}
+
+// アプリケーションが追加で必要とするテーブルを作成する
+func dbMigrate() error {
+	for _, sql := range schemaTables {
+		if _, err := db.Exec(sql); err != nil {
+			return fmt.Errorf("failed to migrate schema: %w", err)
+		}
+	}
+
+	// 集計用のテーブルを作ったばかりなら既存のデータから集計する
+	var exists int
+	err := db.Get(&exists, "SELECT EXISTS (SELECT 1 FROM `user_stats`)")
+	if err != nil {
+		return fmt.Errorf("failed to migrate schema: %w", err)
+	}
+	if exists == 0 {
+		return rebuildUserStats()
+	}
+	return nil
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/gorilla/sessions"
+)
+
+const sessionVersionKey = "_version"
+
+// sessionMigrations[i]は版iのセッションの値を版i+1の形式に書き換える
+// セッションに保存する値の形式を変えたら、前の版からの移行を末尾に足す（デプロイ後もログインしたままにできる）
+// 版を記録する前からあるセッションは版0として扱う
+var sessionMigrations = []func(values map[any]any) error{
+	// 0 → 1: 登録時にint64で保存していたuser_idをintにそろえる
+	func(values map[any]any) error {
+		if uid, ok := values["user_id"].(int64); ok {
+			values["user_id"] = int(uid)
+		}
+		return nil
+	},
+}
+
+// セッションに保存する値の形式の今の版
+var sessionVersion = len(sessionMigrations)
+
+// 読み込んだセッションの値を今の版の形式にする
+// 書き換えた値は次にセッションを保存したときに保存される（それまでは読み込むたびに書き換える）
+func migrateSession(r *http.Request, session *sessions.Session) {
+	if session.IsNew {
+		session.Values[sessionVersionKey] = sessionVersion
+		return
+	}
+	v, _ := session.Values[sessionVersionKey].(int)
+	if v > sessionVersion {
+		// 新しい版で保存されたセッション（デプロイを戻した場合など）は読める値だけ使う
+		return
+	}
+	for ; v < sessionVersion; v++ {
+		if err := sessionMigrations[v](session.Values); err != nil {
+			// 移行できないセッションは空にする（ログアウトした状態になる）
+			logger("session").WarnContext(r.Context(), "failed to migrate session", "from", v, "err", err)
+			clear(session.Values)
+			break
+		}
+	}
+	session.Values[sessionVersionKey] = sessionVersion
+}
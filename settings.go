@@ -0,0 +1,293 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
+
+	"github.com/catatsuy/private-isu/webapp/golang/apperror"
+)
+
+const (
+	siteTitleMaxLength         = 50
+	maintenanceBannerMaxLength = 200
+)
+
+// ユーザー登録の受け付け方
+const (
+	// 誰でも登録できる
+	registrationOpen = "open"
+	// 管理者が発行した招待コードが必要
+	registrationInvite = "invite"
+	// 登録を受け付けない
+	registrationClosed = "closed"
+)
+
+func validRegistrationMode(mode string) bool {
+	switch mode {
+	case registrationOpen, registrationInvite, registrationClosed:
+		return true
+	default:
+		return false
+	}
+}
+
+// 管理画面（/admin/settings）から変更できるサイトの設定
+// 再起動せずに切り替えたいものだけを置く。起動時に決まるものはconfigに置く
+type siteSettings struct {
+	Title string
+	// 投稿できる画像の最大バイト数（UploadLimitより大きくはできない）
+	UploadLimit int64
+	// ユーザー登録の受け付け方（registrationOpenなど）
+	RegistrationMode string
+	// 空でなければ全てのページの上部に表示する
+	MaintenanceBanner string
+	// 投稿・コメント・登録などの書き込みを止めて閲覧だけにする
+	ReadOnly bool
+}
+
+func defaultSiteSettings() siteSettings {
+	return siteSettings{
+		Title:            "Iscogram",
+		UploadLimit:      UploadLimit,
+		RegistrationMode: config.RegistrationMode,
+	}
+}
+
+// 招待コードがあれば登録できる場合も含めて、登録フォームを表示するか
+func (s siteSettings) RegistrationOpen() bool {
+	return s.RegistrationMode != registrationClosed
+}
+
+func (s siteSettings) InviteOnly() bool {
+	return s.RegistrationMode == registrationInvite
+}
+
+const (
+	// 設定を読み込むクエリの制限時間
+	siteSettingsLoadTimeout = time.Second
+	// 読み込みに失敗したら、この間は読み込み直さずに既定値を使う
+	siteSettingsRetryInterval = 5 * time.Second
+)
+
+// プロセス内にキャッシュした設定。nilなら読み込んでいない
+// 変更されたらsite_settingsの無効化で全てのサーバーが読み直す
+// 読むのはロックなしで、liveConfigと同じく読み込んだ設定ごと入れ替える
+var liveSettings atomic.Pointer[siteSettings]
+
+// 読み込みの状態。DBに問い合わせている間は持たない
+var settingsLoad = struct {
+	sync.Mutex
+	// 無効化のたびに増やし、無効化より前に始めた読み込みの結果を捨てる
+	gen      int
+	failedAt time.Time
+}{}
+
+var settingsFlight flightGroup[siteSettings]
+
+var errSiteSettingsUnavailable = errors.New("site settings are not loaded")
+
+// 現在の設定。読み込めない場合は既定値を返す
+func currentSettings() siteSettings {
+	if s := liveSettings.Load(); s != nil {
+		return *s
+	}
+	s, err := reloadSiteSettings()
+	if err != nil {
+		return defaultSiteSettings()
+	}
+	return s
+}
+
+// 設定を読み込んで入れ替える。同時に来た読み込みは1回にまとめる
+// 失敗した後しばらくはDBに問い合わせない（DBが詰まっているときにリクエストごとに読み直さない）
+func reloadSiteSettings() (siteSettings, error) {
+	settingsLoad.Lock()
+	gen, failedAt := settingsLoad.gen, settingsLoad.failedAt
+	settingsLoad.Unlock()
+	if time.Since(failedAt) < siteSettingsRetryInterval {
+		return siteSettings{}, errSiteSettingsUnavailable
+	}
+
+	return settingsFlight.Do(strconv.Itoa(gen), func() (siteSettings, error) {
+		ctx, cancel := context.WithTimeout(context.Background(), siteSettingsLoadTimeout)
+		defer cancel()
+		s, err := loadSiteSettings(ctx)
+
+		settingsLoad.Lock()
+		defer settingsLoad.Unlock()
+		if err != nil {
+			logger("settings").Error("failed to load site settings", "err", err)
+			if settingsLoad.gen == gen {
+				settingsLoad.failedAt = time.Now()
+			}
+			return siteSettings{}, err
+		}
+		if settingsLoad.gen == gen {
+			liveSettings.Store(&s)
+			settingsLoad.failedAt = time.Time{}
+		}
+		return s, nil
+	})
+}
+
+func loadSiteSettings(ctx context.Context) (siteSettings, error) {
+	rows := []struct {
+		Name  string `db:"name"`
+		Value string `db:"value"`
+	}{}
+	if err := db.SelectContext(ctx, &rows, "SELECT `name`, `value` FROM `site_settings`"); err != nil {
+		return siteSettings{}, err
+	}
+
+	s := defaultSiteSettings()
+	for _, row := range rows {
+		switch row.Name {
+		case "title":
+			s.Title = row.Value
+		case "upload_limit":
+			if n, err := strconv.ParseInt(row.Value, 10, 64); err == nil && n > 0 && n <= UploadLimit {
+				s.UploadLimit = n
+			}
+		case "registration_mode":
+			if validRegistrationMode(row.Value) {
+				s.RegistrationMode = row.Value
+			}
+		case "maintenance_banner":
+			s.MaintenanceBanner = row.Value
+		case "read_only":
+			s.ReadOnly = row.Value == "1"
+		}
+	}
+	return s, nil
+}
+
+func saveSiteSettings(s siteSettings) error {
+	values := map[string]string{
+		"title":              s.Title,
+		"upload_limit":       strconv.FormatInt(s.UploadLimit, 10),
+		"registration_mode":  s.RegistrationMode,
+		"maintenance_banner": s.MaintenanceBanner,
+		"read_only":          "0",
+	}
+	if s.ReadOnly {
+		values["read_only"] = "1"
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for name, value := range values {
+		_, err := tx.Exec("INSERT INTO `site_settings` (`name`, `value`) VALUES (?, ?) ON DUPLICATE KEY UPDATE `value` = VALUES(`value`)", name, value)
+		if err != nil {
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	invalidate("site_settings", "")
+	return nil
+}
+
+// 設定が変わったら読み直す。タイトルやお知らせを含む描画済みのトップページも捨てる
+func registerSettingsInvalidation() {
+	registerInvalidation("site_settings", func(string) {
+		settingsLoad.Lock()
+		settingsLoad.gen++
+		settingsLoad.failedAt = time.Time{}
+		liveSettings.Store(nil)
+		settingsLoad.Unlock()
+		clearIndexPage()
+		// 次のリクエストを待たずに読み直す。失敗したら次のcurrentSettingsで読み直す
+		reloadSiteSettings()
+	})
+}
+
+// フォームの値から設定を組み立てる
+func parseSiteSettingsForm(r *http.Request) (siteSettings, error) {
+	s := siteSettings{
+		Title:             r.FormValue("title"),
+		RegistrationMode:  r.FormValue("registration_mode"),
+		MaintenanceBanner: r.FormValue("maintenance_banner"),
+		ReadOnly:          r.FormValue("read_only") == "1",
+	}
+
+	if s.Title == "" || utf8.RuneCountInString(s.Title) > siteTitleMaxLength || !validText(s.Title) {
+		return s, apperror.Validationf("サイト名は%d文字以内で入力してください", siteTitleMaxLength)
+	}
+	if !validRegistrationMode(s.RegistrationMode) {
+		return s, apperror.Validation("ユーザー登録の受け付け方が不正です")
+	}
+	if utf8.RuneCountInString(s.MaintenanceBanner) > maintenanceBannerMaxLength || !validText(s.MaintenanceBanner) {
+		return s, apperror.Validationf("お知らせは%d文字以内で入力してください", maintenanceBannerMaxLength)
+	}
+
+	maxMB := int64(UploadLimit / (1024 * 1024))
+	mb, err := strconv.ParseInt(r.FormValue("upload_limit_mb"), 10, 64)
+	if err != nil || mb < 1 || mb > maxMB {
+		return s, apperror.Validationf("画像の上限は1MBから%dMBの間で指定してください", maxMB)
+	}
+	s.UploadLimit = mb * 1024 * 1024
+
+	return s, nil
+}
+
+func getAdminSettings(w http.ResponseWriter, r *http.Request) error {
+	me := currentUser(r)
+	if !isLogin(me) {
+		redirect(w, r, "/", http.StatusFound)
+		return nil
+	}
+
+	if me.Authority == 0 {
+		return errForbidden
+	}
+
+	s := currentSettings()
+	data := newViewData(w, r).
+		With("Settings", s).
+		With("UploadLimitMB", s.UploadLimit/(1024*1024)).
+		With("MaxUploadLimitMB", UploadLimit/(1024*1024)).
+		With("AutoReadOnly", dbLatency.readOnly.Load()).
+		With("DBLatency", lastDBLatency())
+	return renderTemplate(w, r, http.StatusOK, templates.settings, "layout.html", data)
+}
+
+func postAdminSettings(w http.ResponseWriter, r *http.Request) error {
+	me := currentUser(r)
+	if !isLogin(me) {
+		redirect(w, r, "/", http.StatusFound)
+		return nil
+	}
+
+	if me.Authority == 0 {
+		return errForbidden
+	}
+
+	if !validCSRFToken(r, r.FormValue("csrf_token")) {
+		return errInvalidCSRFToken
+	}
+
+	s, err := parseSiteSettingsForm(r)
+	if err != nil {
+		addErrorFlash(w, r, err)
+		redirect(w, r, "/admin/settings", http.StatusFound)
+		return nil
+	}
+	if err := saveSiteSettings(s); err != nil {
+		return err
+	}
+
+	addFlash(w, r, flashSuccess, "設定を保存しました")
+	redirect(w, r, "/admin/settings", http.StatusFound)
+	return nil
+}
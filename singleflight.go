@@ -0,0 +1,46 @@
+package main
+
+import (
+	"errors"
+	"sync"
+)
+
+// 同じキーの処理が実行中なら新しく実行せずに、その結果を待って共有する
+// キャッシュが切れた瞬間に同じ重い処理が並列に走らないようにする
+type flightGroup[T any] struct {
+	mu    sync.Mutex
+	calls map[string]*flightCall[T]
+}
+
+type flightCall[T any] struct {
+	done chan struct{}
+	val  T
+	err  error
+}
+
+// keyの処理を実行するか、実行中の処理の結果を待つ
+// 結果は他の呼び出しと共有されるので、呼び出し側で書き換えてはいけない
+func (g *flightGroup[T]) Do(key string, fn func() (T, error)) (T, error) {
+	g.mu.Lock()
+	if g.calls == nil {
+		g.calls = make(map[string]*flightCall[T])
+	}
+	if c, found := g.calls[key]; found {
+		g.mu.Unlock()
+		<-c.done
+		return c.val, c.err
+	}
+	// fnがパニックした場合に待っている呼び出しへ返すエラー
+	c := &flightCall[T]{done: make(chan struct{}), err: errors.New("flight: function panicked")}
+	g.calls[key] = c
+	g.mu.Unlock()
+
+	defer func() {
+		g.mu.Lock()
+		delete(g.calls, key)
+		g.mu.Unlock()
+		close(c.done)
+	}()
+	c.val, c.err = fn()
+	return c.val, c.err
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// プロフィール用ウィジェットに返す統計情報のキャッシュ期間
+const userStatsTTL = 10 * time.Second
+
+type UserStats struct {
+	PostCount      int `db:"post_count"`
+	CommentCount   int `db:"comment_count"`
+	CommentedCount int `db:"commented_count"`
+}
+
+type userStatsEntry struct {
+	stats     UserStats
+	expiresAt time.Time
+}
+
+// ユーザーの統計情報のキャッシュ
+var userStatsCache = struct {
+	sync.RWMutex
+	data map[int]userStatsEntry
+}{
+	data: make(map[int]userStatsEntry),
+}
+
+// ユーザーの統計情報を取得
+// 書き込み時に更新しているuser_statsから読み、行がなければ集計して作る
+func fetchUserStats(ctx context.Context, userID int) (UserStats, error) {
+	var stats UserStats
+	err := db.GetContext(ctx, &stats, "SELECT `post_count`, `comment_count`, `commented_count` FROM `user_stats` WHERE `user_id` = ?", userID)
+	if !errors.Is(err, sql.ErrNoRows) {
+		return stats, err
+	}
+
+	err = db.GetContext(ctx, &stats, `
+		SELECT
+			(SELECT COUNT(*) FROM posts WHERE user_id = ?) as post_count,
+			(SELECT COUNT(*) FROM comments WHERE user_id = ?) as comment_count,
+			(SELECT COUNT(DISTINCT post_id) FROM comments WHERE post_id IN (SELECT id FROM posts WHERE user_id = ?)) as commented_count
+	`, userID, userID, userID)
+	if err != nil {
+		return UserStats{}, err
+	}
+	_, err = db.ExecContext(context.WithoutCancel(ctx),
+		"INSERT IGNORE INTO `user_stats` (`user_id`, `post_count`, `comment_count`, `commented_count`) VALUES (?,?,?,?)",
+		userID, stats.PostCount, stats.CommentCount, stats.CommentedCount,
+	)
+	return stats, err
+}
+
+// 投稿を保存したときに投稿数を増やす
+func incrUserPostCount(userID int) error {
+	_, err := db.Exec("UPDATE `user_stats` SET `post_count` = `post_count` + 1 WHERE `user_id` = ?", userID)
+	return err
+}
+
+// コメントを保存したときにコメント数と、初めてのコメントならコメントされた投稿数を増やす
+func incrCommentStats(postID, postUserID, userID int) error {
+	result, err := db.Exec(
+		"INSERT INTO `post_comment_counts` (`post_id`, `comment_count`) VALUES (?, 1) ON DUPLICATE KEY UPDATE `comment_count` = `comment_count` + 1",
+		postID,
+	)
+	if err != nil {
+		return err
+	}
+	// 挿入なら1、更新なら2が返る
+	if n, err := result.RowsAffected(); err == nil && n == 1 {
+		_, err = db.Exec("UPDATE `user_stats` SET `commented_count` = `commented_count` + 1 WHERE `user_id` = ?", postUserID)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = db.Exec("UPDATE `user_stats` SET `comment_count` = `comment_count` + 1 WHERE `user_id` = ?", userID)
+	return err
+}
+
+// 投稿とコメントから統計情報を集計し直す
+func rebuildUserStats() error {
+	// 読み込み中に行がなくならないよう、削除せずに上書きする
+	sqls := []string{
+		"DELETE pc FROM `post_comment_counts` pc LEFT JOIN `posts` p ON pc.`post_id` = p.`id` WHERE p.`id` IS NULL",
+		"INSERT INTO `post_comment_counts` (`post_id`, `comment_count`) SELECT `post_id`, COUNT(*) FROM `comments` GROUP BY `post_id`" +
+			" ON DUPLICATE KEY UPDATE `comment_count` = VALUES(`comment_count`)",
+		"DELETE s FROM `user_stats` s LEFT JOIN `users` u ON s.`user_id` = u.`id` WHERE u.`id` IS NULL",
+		"INSERT IGNORE INTO `user_stats` (`user_id`) SELECT `id` FROM `users`",
+		"UPDATE `user_stats` s LEFT JOIN (SELECT `user_id`, COUNT(*) AS c FROM `posts` GROUP BY `user_id`) p ON s.`user_id` = p.`user_id` SET s.`post_count` = COALESCE(p.c, 0)",
+		"UPDATE `user_stats` s LEFT JOIN (SELECT `user_id`, COUNT(*) AS c FROM `comments` GROUP BY `user_id`) c ON s.`user_id` = c.`user_id` SET s.`comment_count` = COALESCE(c.c, 0)",
+		"UPDATE `user_stats` s LEFT JOIN (SELECT p.`user_id`, COUNT(*) AS c FROM `post_comment_counts` pc JOIN `posts` p ON pc.`post_id` = p.`id` GROUP BY p.`user_id`) p ON s.`user_id` = p.`user_id` SET s.`commented_count` = COALESCE(p.c, 0)",
+	}
+	for _, q := range sqls {
+		if _, err := db.Exec(q); err != nil {
+			return fmt.Errorf("failed to rebuild user stats: %w", err)
+		}
+	}
+	return nil
+}
+
+// キャッシュがあればそれを、なければDBから取得してキャッシュする
+func getUserStatsCached(ctx context.Context, userID int) (UserStats, error) {
+	now := time.Now()
+
+	userStatsCache.RLock()
+	entry, found := userStatsCache.data[userID]
+	userStatsCache.RUnlock()
+	if found && now.Before(entry.expiresAt) {
+		return entry.stats, nil
+	}
+
+	stats, err := fetchUserStats(ctx, userID)
+	if err != nil {
+		return UserStats{}, err
+	}
+
+	userStatsCache.Lock()
+	userStatsCache.data[userID] = userStatsEntry{stats: stats, expiresAt: now.Add(userStatsTTL)}
+	userStatsCache.Unlock()
+
+	return stats, nil
+}
+
+// 期限の切れた統計情報のキャッシュを捨てる
+func purgeExpiredUserStats() {
+	now := time.Now()
+	userStatsCache.Lock()
+	defer userStatsCache.Unlock()
+	for id, entry := range userStatsCache.data {
+		if now.After(entry.expiresAt) {
+			delete(userStatsCache.data, id)
+		}
+	}
+}
+
+func invalidateUserStats(userID int) {
+	userStatsCache.Lock()
+	delete(userStatsCache.data, userID)
+	userStatsCache.Unlock()
+}
+
+func clearUserStats() {
+	userStatsCache.Lock()
+	userStatsCache.data = make(map[int]userStatsEntry)
+	userStatsCache.Unlock()
+}
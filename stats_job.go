@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+const (
+	// 複数台のうち1台だけが集計するためのMySQLのロック名
+	statsJobLockName = "isuconp_stats_job"
+	// トレンドのスコアに数えるコメントの期間
+	trendingWindow = 24 * time.Hour
+	// 保存するトレンドの投稿の数
+	trendingSummarySize = 1000
+)
+
+// 集計テーブルを作り直す
+// 書き込み時に更新しているカウンターのずれもここで直す
+func aggregateStats() error {
+	if err := rebuildUserStats(); err != nil {
+		return err
+	}
+	if err := rebuildTrendingScores(); err != nil {
+		return err
+	}
+	return rebuildTagCounts()
+}
+
+// 直近のコメント数をトレンドのスコアとして保存する
+func rebuildTrendingScores() error {
+	tx, err := db.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("DELETE FROM `trending_post_scores`"); err != nil {
+		return fmt.Errorf("failed to rebuild trending scores: %w", err)
+	}
+	_, err = tx.Exec(
+		"INSERT INTO `trending_post_scores` (`post_id`, `score`)"+
+			" SELECT `post_id`, COUNT(*) AS c FROM `comments` WHERE `created_at` >= ?"+
+			" GROUP BY `post_id` ORDER BY c DESC LIMIT ?",
+		time.Now().Add(-trendingWindow), trendingSummarySize,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to rebuild trending scores: %w", err)
+	}
+	return tx.Commit()
+}
+
+// 公開中の投稿のハッシュタグごとの投稿数を保存する
+// post_tagsは公開した投稿だけを記録しているので、BANされたユーザーの投稿だけを除く
+func rebuildTagCounts() error {
+	tx, err := db.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("DELETE FROM `tag_counts`"); err != nil {
+		return fmt.Errorf("failed to rebuild tag counts: %w", err)
+	}
+	_, err = tx.Exec(
+		"INSERT INTO `tag_counts` (`tag`, `post_count`)" +
+			" SELECT t.`tag`, COUNT(*) FROM `post_tags` t" +
+			" JOIN `posts` p ON p.`id` = t.`post_id` JOIN `users` u ON u.`id` = p.`user_id`" +
+			" WHERE u.`del_flg` = 0 GROUP BY t.`tag`",
+	)
+	if err != nil {
+		return fmt.Errorf("failed to rebuild tag counts: %w", err)
+	}
+	return tx.Commit()
+}
+
+// 集計する。他のサーバーが集計中の場合は何もしない
+// ロックは接続に紐づくので、同じ接続で取得と解放を行う
+func runStatsJobOnce(ctx context.Context) error {
+	conn, err := db.Connx(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	var locked int
+	if err := conn.GetContext(ctx, &locked, "SELECT GET_LOCK(?, 0)", statsJobLockName); err != nil {
+		return err
+	}
+	if locked != 1 {
+		return nil
+	}
+	defer conn.ExecContext(context.Background(), "SELECT RELEASE_LOCK(?)", statsJobLockName)
+
+	return aggregateStats()
+}
@@ -0,0 +1,339 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/catatsuy/private-isu/webapp/golang/apperror"
+	"github.com/jmoiron/sqlx"
+)
+
+const (
+	// 1人が登録できる購読の数
+	maxSubscriptionsPerUser = 50
+	// ハッシュタグや検索語の最大文字数
+	subscriptionValueMaxLength = 50
+	// 照合を待つ投稿の数。溢れた投稿の通知は作らない
+	subscriptionMatchQueueSize = 1024
+)
+
+// 購読の種類
+const (
+	// ハッシュタグ（#を除いて小文字にしたもの）
+	subscriptionTag = "tag"
+	// 保存した検索語（空白で区切った語を全て含む投稿）
+	subscriptionQuery = "query"
+	// ユーザーのフォロー（そのユーザーの投稿。値はアカウント名）
+	subscriptionUser = "user"
+)
+
+var subscriptionAccountNamePattern = regexp.MustCompile("^" + accountNamePattern + "$")
+
+// ハッシュタグか検索語の購読
+type Subscription struct {
+	ID     int    `db:"id"`
+	UserID int    `db:"user_id"`
+	Kind   string `db:"kind"`
+	Value  string `db:"value"`
+}
+
+// 表示用の文字列（ハッシュタグは#を付ける）
+func (s Subscription) Label() string {
+	switch s.Kind {
+	case subscriptionTag:
+		return "#" + s.Value
+	case subscriptionUser:
+		return "@" + s.Value
+	}
+	return s.Value
+}
+
+// 本文に含まれるハッシュタグ（#を除いて小文字にしたもの、重複なし）
+func extractHashtags(body string) []string {
+	var tags []string
+	for _, field := range strings.FieldsFunc(body, func(r rune) bool {
+		return unicode.IsSpace(r) || (r != '#' && r != '_' && unicode.IsPunct(r))
+	}) {
+		for _, t := range strings.Split(field, "#")[1:] {
+			t = strings.ToLower(t)
+			if t == "" || utf8.RuneCountInString(t) > subscriptionValueMaxLength {
+				continue
+			}
+			if !slices.Contains(tags, t) {
+				tags = append(tags, t)
+			}
+		}
+	}
+	return tags
+}
+
+// 本文が検索語の全ての語を含むか（大文字小文字は区別しない）
+func matchesQuery(body, query string) bool {
+	terms := strings.Fields(strings.ToLower(query))
+	if len(terms) == 0 {
+		return false
+	}
+	body = strings.ToLower(body)
+	for _, term := range terms {
+		if !strings.Contains(body, term) {
+			return false
+		}
+	}
+	return true
+}
+
+// フォームの値を購読の種類と値に正規化する
+func normalizeSubscription(kind, value string) (string, string, error) {
+	value = strings.TrimSpace(value)
+	if kind == subscriptionTag {
+		value = strings.ToLower(strings.TrimLeft(value, "#"))
+		if value == "" || strings.IndexFunc(value, func(r rune) bool { return !unicode.IsLetter(r) && !unicode.IsNumber(r) && r != '_' }) >= 0 {
+			return "", "", apperror.Validation("ハッシュタグには文字と数字と_だけが使えます")
+		}
+	} else if kind == subscriptionUser {
+		value = strings.TrimLeft(value, "@")
+		if !subscriptionAccountNamePattern.MatchString(value) {
+			return "", "", apperror.Validation("アカウント名を入力してください")
+		}
+	} else if kind != subscriptionQuery || value == "" || !validText(value) {
+		return "", "", apperror.Validation("検索語を入力してください")
+	}
+	if utf8.RuneCountInString(value) > subscriptionValueMaxLength {
+		return "", "", apperror.Validationf("%d文字以内で入力してください", subscriptionValueMaxLength)
+	}
+	return kind, value, nil
+}
+
+func fetchSubscriptions(ctx context.Context, userID int) ([]Subscription, error) {
+	subs := []Subscription{}
+	err := db.SelectContext(ctx, &subs, "SELECT `id`, `user_id`, `kind`, `value` FROM `subscriptions` WHERE `user_id` = ? ORDER BY `id`", userID)
+	return subs, err
+}
+
+// 照合を待つ投稿のID
+var subscriptionMatchCh = make(chan int, subscriptionMatchQueueSize)
+
+// 投稿されたら購読と照合する。照合はリクエストとは別のゴルーチンで行う
+func subscribeSubscriptionMatcher() {
+	subscribe(events, func(e PostCreated) {
+		select {
+		case subscriptionMatchCh <- e.PostID:
+		default:
+			logger("subscription").Warn("match queue is full, dropping post", "post_id", e.PostID)
+		}
+	})
+}
+
+// ctxが終了するまで投稿を購読と照合し続ける
+func runSubscriptionMatcher(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case pid := <-subscriptionMatchCh:
+			if err := matchPostSubscriptions(ctx, pid); err != nil {
+				logger("subscription").Error("failed to match subscriptions", "post_id", pid, "err", err)
+			}
+		}
+	}
+}
+
+// 投稿に一致する購読のユーザーに通知を作る
+// 同じ投稿の通知は購読がいくつ一致してもユーザーごとに1件にする
+func matchPostSubscriptions(ctx context.Context, postID int) error {
+	p := Post{}
+	if err := db.Get(&p, "SELECT `id`, `user_id`, `body` FROM `posts` WHERE `id` = ?", postID); err != nil {
+		return err
+	}
+
+	matched := []Subscription{}
+	if tags := extractHashtags(p.Body); len(tags) > 0 {
+		query, args, err := sqlx.In("SELECT `id`, `user_id`, `kind`, `value` FROM `subscriptions` WHERE `kind` = ? AND `value` IN (?)", subscriptionTag, tags)
+		if err != nil {
+			return err
+		}
+		if err := db.Select(&matched, query, args...); err != nil {
+			return err
+		}
+	}
+
+	poster, err := getUserByID(ctx, p.UserID)
+	if err != nil {
+		return err
+	}
+	follows := []Subscription{}
+	if err := db.Select(&follows, "SELECT `id`, `user_id`, `kind`, `value` FROM `subscriptions` WHERE `kind` = ? AND `value` = ?", subscriptionUser, poster.AccountName); err != nil {
+		return err
+	}
+	matched = append(matched, follows...)
+
+	queries := []Subscription{}
+	if err := db.Select(&queries, "SELECT `id`, `user_id`, `kind`, `value` FROM `subscriptions` WHERE `kind` = ?", subscriptionQuery); err != nil {
+		return err
+	}
+	for _, s := range queries {
+		if matchesQuery(p.Body, s.Value) {
+			matched = append(matched, s)
+		}
+	}
+
+	for _, s := range matched {
+		// 自分の投稿は通知しない
+		if s.UserID == p.UserID {
+			continue
+		}
+		_, err := db.Exec("INSERT IGNORE INTO `notifications` (`user_id`, `post_id`, `subscription_id`) VALUES (?, ?, ?)", s.UserID, p.ID, s.ID)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 購読に一致した投稿（新しい通知から順）
+// beforeIDが0でなければそれより古い通知だけにする
+func fetchSubscriptionPosts(ctx context.Context, userID, beforeID int) ([]Post, int, error) {
+	rows := []struct {
+		NotificationID int `db:"notification_id"`
+		Post
+	}{}
+	query := "SELECT n.`id` AS `notification_id`, p.`id`, p.`user_id`, p.`body`, p.`mime`, p.`created_at`, " + postImageSizeColumns + ", " + postLanguageColumn +
+		" FROM `notifications` n JOIN `posts` p ON n.`post_id` = p.`id` JOIN `users` u ON p.`user_id` = u.`id`" +
+		" LEFT JOIN `post_image_sizes` s ON s.`post_id` = p.`id`" +
+		" LEFT JOIN `post_languages` l ON l.`post_id` = p.`id`" +
+		" WHERE n.`user_id` = ? AND u.`del_flg` = 0"
+	args := []any{userID}
+	if beforeID > 0 {
+		query += " AND n.`id` < ?"
+		args = append(args, beforeID)
+	}
+	query += " ORDER BY n.`id` DESC LIMIT ?"
+	args = append(args, config.PostsPerPage)
+	if err := db.SelectContext(ctx, &rows, query, args...); err != nil {
+		return nil, 0, err
+	}
+
+	posts := make([]Post, 0, len(rows))
+	for _, row := range rows {
+		posts = append(posts, row.Post)
+	}
+	next := 0
+	if len(rows) == config.PostsPerPage {
+		next = rows[len(rows)-1].NotificationID
+	}
+	return posts, next, nil
+}
+
+// 購読の管理と、購読に一致した投稿の一覧
+// 表示した通知は既読にする
+func getSubscriptions(w http.ResponseWriter, r *http.Request) error {
+	me := currentUser(r)
+	if !isLogin(me) {
+		redirectToLogin(w, r, r.URL.RequestURI())
+		return nil
+	}
+
+	subs, err := fetchSubscriptions(r.Context(), me.ID)
+	if err != nil {
+		return err
+	}
+
+	beforeID := 0
+	if v := r.URL.Query().Get("before"); v != "" {
+		beforeID, err = strconv.Atoi(v)
+		if err != nil {
+			return newHTTPError(http.StatusBadRequest, err)
+		}
+	}
+	results, next, err := fetchSubscriptionPosts(r.Context(), me.ID, beforeID)
+	if err != nil {
+		return err
+	}
+	posts, err := makePosts(r.Context(), results, "", config.CommentPreviewCount)
+	if err != nil {
+		return err
+	}
+	postsHTML, err := renderPosts(posts, formCSRFToken(r))
+	if err != nil {
+		return err
+	}
+
+	// 全員に通知されたお知らせも購読の通知と一緒に表示する
+	announcements, err := fetchUnreadAnnouncements(r.Context(), me.ID)
+	if err != nil {
+		return err
+	}
+
+	if _, err := db.ExecContext(context.WithoutCancel(r.Context()), "UPDATE `notifications` SET `read_at` = NOW() WHERE `user_id` = ? AND `read_at` IS NULL", me.ID); err != nil {
+		return err
+	}
+	if len(announcements) > 0 {
+		if err := markAnnouncementsRead(me.ID); err != nil {
+			return err
+		}
+	}
+
+	data := newViewData(w, r).
+		With("Subscriptions", subs).
+		With("UnreadAnnouncements", announcements).
+		With("Posts", postsHTML).
+		With("NextBefore", next)
+	return renderTemplate(w, r, http.StatusOK, templates.subscriptions, "layout.html", data)
+}
+
+// 購読の追加（action=add）と削除（action=delete）
+func postSubscriptions(w http.ResponseWriter, r *http.Request) error {
+	me := currentUser(r)
+	if !isLogin(me) {
+		redirectToLogin(w, r, "/subscriptions")
+		return nil
+	}
+
+	if !validCSRFToken(r, r.FormValue("csrf_token")) {
+		return errInvalidCSRFToken
+	}
+
+	switch r.FormValue("action") {
+	case "add":
+		kind, value, err := normalizeSubscription(r.FormValue("kind"), r.FormValue("value"))
+		if err != nil {
+			addErrorFlash(w, r, err)
+			break
+		}
+		count := 0
+		if err := db.GetContext(r.Context(), &count, "SELECT COUNT(*) FROM `subscriptions` WHERE `user_id` = ?", me.ID); err != nil {
+			return err
+		}
+		if count >= maxSubscriptionsPerUser {
+			addFlash(w, r, flashError, fmt.Sprintf("購読は%d件までです", maxSubscriptionsPerUser))
+			break
+		}
+		_, err = db.ExecContext(context.WithoutCancel(r.Context()), "INSERT IGNORE INTO `subscriptions` (`user_id`, `kind`, `value`) VALUES (?, ?, ?)", me.ID, kind, value)
+		if err != nil {
+			return err
+		}
+		addFlash(w, r, flashSuccess, Subscription{Kind: kind, Value: value}.Label()+" を購読しました")
+	case "delete":
+		id, err := strconv.Atoi(r.FormValue("id"))
+		if err != nil {
+			return newHTTPError(http.StatusBadRequest, err)
+		}
+		if _, err := db.ExecContext(context.WithoutCancel(r.Context()), "DELETE FROM `subscriptions` WHERE `id` = ? AND `user_id` = ?", id, me.ID); err != nil {
+			return err
+		}
+		addFlash(w, r, flashSuccess, "購読をやめました")
+	default:
+		return newHTTPError(http.StatusBadRequest, errors.New("unknown action"))
+	}
+
+	redirect(w, r, "/subscriptions", http.StatusFound)
+	return nil
+}
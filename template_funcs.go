@@ -0,0 +1,129 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"html/template"
+	"net/url"
+	"strconv"
+	"time"
+	"unicode/utf8"
+)
+
+// 全てのテンプレートで使える関数
+// テンプレートで使う関数を増やすときはここに追加する
+// （initでテンプレートを読み込む前に用意されている必要があるので、パッケージ変数の初期化で作る）
+var templateFuncs = template.FuncMap{
+	// テンプレートに書くパスにはISUCONP_PATH_PREFIXを付ける（{{ path "/login" }}）
+	"path":             appPath,
+	"imageURL":         imageURL,
+	"squareImageURL":   squareImageURL,
+	"shortPermalink":   shortPermalink,
+	"avatarURL":        avatarURL,
+	"relativeTime":     relativeTime,
+	"csrfField":        csrfField,
+	"idempotencyField": idempotencyField,
+	"pluralize":        pluralize,
+	"postLanguages":    postLanguageOptions,
+	// 文字数のカウンターや入力欄の上限に使う
+	"maxPostBodyLength": func() int { return config.MaxPostBodyLength },
+	"maxCommentLength":  func() int { return config.MaxCommentLength },
+}
+
+// 読み込めなかったテンプレートのエラー。起動時のチェック（doctor.go）で報告する
+var templateErrors []error
+
+// templatesディレクトリのファイルをtemplateFuncs付きで読み込む
+// nameは最初に実行するテンプレート（通常はfilesの先頭のファイル名）
+// 読み込めなかった場合はtemplateErrorsに残し、描画するとエラーになる空のテンプレートを返す
+func parseTemplates(name string, files ...string) *template.Template {
+	paths := make([]string, len(files))
+	for i, f := range files {
+		paths[i] = getTemplPath(f)
+	}
+	t, err := template.New(name).Funcs(templateFuncs).ParseFiles(paths...)
+	if err != nil {
+		templateErrors = append(templateErrors, err)
+		return template.New(name)
+	}
+	return t
+}
+
+// 投稿画像の拡張子（.jpgなど）
+func imageExt(mime string) string {
+	switch mime {
+	case "image/jpeg":
+		return ".jpg"
+	case "image/png":
+		return ".png"
+	case "image/gif":
+		return ".gif"
+	default:
+		return ""
+	}
+}
+
+// 投稿画像の正方形サムネイルのURL
+func squareImageURL(p Post) string {
+	return appPath("/image/" + strconv.Itoa(p.ID) + "/square" + imageExt(p.Mime))
+}
+
+// アカウント名の頭文字とIDから決めた色のSVGのアイコン
+func generatedAvatarURL(u User) template.URL {
+	initial := "?"
+	if r, _ := utf8.DecodeRuneInString(u.AccountName); r != utf8.RuneError {
+		initial = string(r)
+	}
+	h := fnv.New32a()
+	fmt.Fprint(h, u.ID)
+	hue := h.Sum32() % 360
+
+	svg := fmt.Sprintf(`<svg xmlns="http://www.w3.org/2000/svg" viewBox="0 0 64 64">`+
+		`<rect width="64" height="64" fill="hsl(%d,55%%,55%%)"/>`+
+		`<text x="32" y="42" font-size="32" text-anchor="middle" fill="#fff" font-family="sans-serif">%s</text></svg>`,
+		hue, template.HTMLEscapeString(initial))
+	return template.URL("data:image/svg+xml;charset=utf-8," + url.PathEscape(svg))
+}
+
+// 「3分前」のような表示（JavaScriptが動かない場合の表示に使う）
+// 1週間より前は日付にする
+func relativeTime(t time.Time) string {
+	d := time.Since(t)
+	switch {
+	case d < time.Minute:
+		return "たった今"
+	case d < time.Hour:
+		return strconv.Itoa(int(d/time.Minute)) + "分前"
+	case d < 24*time.Hour:
+		return strconv.Itoa(int(d/time.Hour)) + "時間前"
+	case d < 7*24*time.Hour:
+		return strconv.Itoa(int(d/(24*time.Hour))) + "日前"
+	default:
+		return t.Format("2006-01-02")
+	}
+}
+
+// フォームに埋め込むCSRFトークンのinput
+// キャッシュするフラグメントでは後で置き換える印を出す
+func csrfField(token string) template.HTML {
+	if token == csrfTokenPlaceholder {
+		return csrfFieldPlaceholder
+	}
+	return template.HTML(`<input type="hidden" name="csrf_token" value="` + template.HTMLEscapeString(token) + `">`)
+}
+
+// フォームの再送を見分ける冪等キーのinput
+func idempotencyField(key string) template.HTML {
+	if key == formKeyPlaceholder {
+		return formKeyFieldPlaceholder
+	}
+	return template.HTML(`<input type="hidden" name="idempotency_key" value="` + template.HTMLEscapeString(key) + `">`)
+}
+
+// nが1ならsingular、それ以外はplural
+func pluralize(n int, singular, plural string) string {
+	if n == 1 {
+		return singular
+	}
+	return plural
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// 切り詰めたときに末尾に付ける記号
+const ellipsis = "…"
+
+// sを最大n文字（ルーン）に切り詰める。切り詰めた場合は末尾を…にする（…も1文字に数える）
+// 結合文字や絵文字の異体字セレクター・ZWJでつながった絵文字、国旗の途中では切らない
+func truncateRunes(s string, n int) string {
+	if n <= 0 {
+		return ""
+	}
+	if utf8.RuneCountInString(s) <= n {
+		return s
+	}
+
+	runes := []rune(s)
+	cut := n - 1
+	for cut > 0 && !isClusterBoundary(runes, cut) {
+		cut--
+	}
+	return strings.TrimRightFunc(string(runes[:cut]), unicode.IsSpace) + ellipsis
+}
+
+// runes[i-1]とrunes[i]の間で切ってよいか
+// 書記素クラスタの規則のうち、日本語と絵文字でよく出てくるものだけを見る
+func isClusterBoundary(runes []rune, i int) bool {
+	prev, next := runes[i-1], runes[i]
+	switch {
+	case unicode.In(next, unicode.Mn, unicode.Me):
+		// 濁点などの結合文字
+		return false
+	case next == '\u200d' || prev == '\u200d':
+		// ZWJでつながった絵文字
+		return false
+	case unicode.Is(unicode.Variation_Selector, next):
+		return false
+	case next >= 0x1F3FB && next <= 0x1F3FF:
+		// 肌の色の修飾子
+		return false
+	case isRegionalIndicator(prev) && isRegionalIndicator(next):
+		// 国旗は地域指示記号の2文字で1つなので、前に続く地域指示記号が奇数個なら途中
+		count := 0
+		for j := i - 1; j >= 0 && isRegionalIndicator(runes[j]); j-- {
+			count++
+		}
+		return count%2 == 0
+	default:
+		return true
+	}
+}
+
+func isRegionalIndicator(r rune) bool {
+	return r >= 0x1F1E6 && r <= 0x1F1FF
+}
+
+// 一覧や通知、OGPなどに使う1行の抜粋
+// 改行や連続する空白を1つの空白にまとめてから最大n文字に切り詰める
+func previewText(s string, n int) string {
+	return truncateRunes(strings.Join(strings.Fields(s), " "), n)
+}
+
+// 保存してよいテキストか
+// 不正なUTF-8と、改行・タブ以外の制御文字を含むものは受け付けない
+func validText(s string) bool {
+	if !utf8.ValidString(s) {
+		return false
+	}
+	for _, r := range s {
+		if unicode.IsControl(r) && r != '\n' && r != '\r' && r != '\t' {
+			return false
+		}
+	}
+	return true
+}
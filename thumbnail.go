@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/draw"
+	"net/http"
+	"strconv"
+
+	"github.com/nfnt/resize"
+)
+
+// 切り抜く位置を決めるときに縮小する長辺のピクセル数
+const smartCropWorkSize = 128
+
+// 画像キャッシュでの正方形サムネイルのキー
+func squareVariantKey(cacheKey string) string {
+	return cacheKey + ".square"
+}
+
+// 投稿画像の正方形のサムネイルを返す（一覧のグリッドやアイコン用）
+func getImageSquare(w http.ResponseWriter, r *http.Request) error {
+	pid, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		return errNotFound
+	}
+	ext := r.PathValue("ext")
+	cacheKey := fmt.Sprintf("%d.%s", pid, ext)
+	key := squareVariantKey(cacheKey)
+
+	if isMissingImage(cacheKey) {
+		return errNotFound
+	}
+
+	data, etag, found := getFromCache(key)
+	if !found {
+		original, _, found := getFromCache(cacheKey)
+		if !found {
+			original, err = fetchImage(r.Context(), pid, ext)
+			if errors.Is(err, errNotFound) {
+				markMissingImage(cacheKey)
+			}
+			if err != nil {
+				return err
+			}
+		}
+
+		data, err = makeSquareThumbnail(original, getMimeType(ext), config.ThumbnailSize)
+		if err != nil {
+			logger("image").WarnContext(r.Context(), "failed to make thumbnail", "key", cacheKey, "err", err)
+			return errNotFound
+		}
+		etag = imageETag(data)
+		addToCache(key, data, etag)
+	}
+
+	return writeImage(w, r, getMimeType(ext), data, etag)
+}
+
+// 画像を正方形に切り抜いてsize×sizeに縮小する
+func makeSquareThumbnail(imgData []byte, mime string, size int) ([]byte, error) {
+	img, _, err := image.Decode(bytes.NewReader(imgData))
+	if err != nil {
+		return nil, err
+	}
+
+	crop := centerSquare(img.Bounds())
+	if config.ThumbnailCrop == "smart" {
+		crop = smartCropSquare(img)
+	}
+
+	cropped := image.NewRGBA(image.Rect(0, 0, crop.Dx(), crop.Dy()))
+	draw.Draw(cropped, cropped.Bounds(), img, crop.Min, draw.Src)
+
+	// 小さい画像は引き伸ばさない
+	side := min(size, crop.Dx())
+	thumb := resize.Resize(uint(side), uint(side), cropped, resize.Lanczos3)
+	return encodeImage(thumb, mime)
+}
+
+func centerSquare(b image.Rectangle) image.Rectangle {
+	side := min(b.Dx(), b.Dy())
+	x := b.Min.X + (b.Dx()-side)/2
+	y := b.Min.Y + (b.Dy()-side)/2
+	return image.Rect(x, y, x+side, y+side)
+}
+
+// 輪郭（明るさの変化）が最も多く含まれる正方形を選ぶ
+// 被写体は背景より細かい模様を持つことが多いので、中央で切るより被写体が残りやすい
+func smartCropSquare(img image.Image) image.Rectangle {
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	if w == h || w == 0 || h == 0 {
+		return b
+	}
+
+	// 縮小した画像で長辺方向の輪郭の量を数える
+	scale := min(1, float64(smartCropWorkSize)/float64(max(w, h)))
+	small := img
+	if scale < 1 {
+		small = resize.Resize(uint(float64(w)*scale), uint(float64(h)*scale), img, resize.Bilinear)
+	}
+	profile := edgeProfile(small, w > h)
+
+	// 正方形の窓をずらして輪郭の合計が最大になる位置を探す
+	window := min(len(profile), max(1, int(float64(min(w, h))*scale)))
+	sum := 0.0
+	for _, v := range profile[:window] {
+		sum += v
+	}
+	best, bestStart := sum, 0
+	for start := 1; start+window <= len(profile); start++ {
+		sum += profile[start+window-1] - profile[start-1]
+		if sum > best {
+			best, bestStart = sum, start
+		}
+	}
+
+	// 縮小した画像での位置を元の画像の位置に比例させて戻す
+	side := min(w, h)
+	offset := 0
+	if slack := len(profile) - window; slack > 0 {
+		offset = bestStart * (max(w, h) - side) / slack
+	}
+	if w > h {
+		return image.Rect(b.Min.X+offset, b.Min.Y, b.Min.X+offset+side, b.Max.Y)
+	}
+	return image.Rect(b.Min.X, b.Min.Y+offset, b.Max.X, b.Min.Y+offset+side)
+}
+
+// 列ごと（horizontalがfalseなら行ごと）の輪郭の強さの合計
+func edgeProfile(img image.Image, horizontal bool) []float64 {
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+
+	lum := make([]float64, w*h)
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			r, g, bl, _ := img.At(b.Min.X+x, b.Min.Y+y).RGBA()
+			lum[y*w+x] = 0.299*float64(r) + 0.587*float64(g) + 0.114*float64(bl)
+		}
+	}
+
+	n := h
+	if horizontal {
+		n = w
+	}
+	profile := make([]float64, n)
+	for y := 1; y < h; y++ {
+		for x := 1; x < w; x++ {
+			v := lum[y*w+x]
+			e := abs(v-lum[y*w+x-1]) + abs(v-lum[(y-1)*w+x])
+			if horizontal {
+				profile[x] += e
+			} else {
+				profile[y] += e
+			}
+		}
+	}
+	return profile
+}
+
+func abs(v float64) float64 {
+	if v < 0 {
+		return -v
+	}
+	return v
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+)
+
+// トレンドはstats_aggregateジョブが集計したtrending_post_scoresとtag_countsから返す
+// 集計の間隔（ISUCONP_STATS_JOB_INTERVAL_SEC）だけ遅れる
+
+const (
+	tagsDefaultLimit = 20
+	tagsMaxLimit     = 100
+)
+
+type apiTagCount struct {
+	Tag       string `json:"tag" db:"tag"`
+	PostCount int    `json:"post_count" db:"post_count"`
+}
+
+// スコアの高い順の投稿。BANされたユーザーの投稿と審査待ちの投稿は除く
+func fetchTrendingPosts(ctx context.Context, limit int) ([]Post, error) {
+	results := []Post{}
+	err := db.SelectContext(ctx, &results,
+		"SELECT p.`id`, p.`user_id`, p.`body`, p.`mime`, p.`created_at`, "+postImageSizeColumns+", "+postLanguageColumn+
+			" FROM `trending_post_scores` t JOIN `posts` p ON p.`id` = t.`post_id` JOIN `users` u ON p.`user_id` = u.`id`"+
+			" LEFT JOIN `post_image_sizes` s ON s.`post_id` = p.`id`"+
+			" LEFT JOIN `post_languages` l ON l.`post_id` = p.`id`"+
+			" WHERE u.`del_flg` = 0"+
+			" AND NOT EXISTS (SELECT 1 FROM `pending_posts` m WHERE m.`post_id` = p.`id`)"+
+			" ORDER BY t.`score` DESC, p.`id` DESC LIMIT ?",
+		limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// 投稿の多い順のハッシュタグ
+func fetchTagCounts(ctx context.Context, limit int) ([]apiTagCount, error) {
+	tags := []apiTagCount{}
+	err := db.SelectContext(ctx, &tags, "SELECT `tag`, `post_count` FROM `tag_counts` ORDER BY `post_count` DESC, `tag` LIMIT ?", limit)
+	if err != nil {
+		return nil, err
+	}
+	return tags, nil
+}
+
+// GET /api/v1/posts/trending
+// 直近のコメントの多い投稿
+func getAPITrendingPosts(w http.ResponseWriter, r *http.Request) error {
+	results, err := fetchTrendingPosts(r.Context(), config.PostsPerPage)
+	if err != nil {
+		return err
+	}
+	posts, err := makePosts(r.Context(), results, "", config.CommentPreviewCount)
+	if err != nil {
+		return err
+	}
+	return writeJSON(w, http.StatusOK, apiTimeline{Posts: newAPIPosts(posts)})
+}
+
+// GET /api/v1/tags?limit=
+// ハッシュタグと投稿数
+func getAPITags(w http.ResponseWriter, r *http.Request) error {
+	limit := tagsDefaultLimit
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			return newHTTPError(http.StatusBadRequest, errors.New("invalid limit"))
+		}
+		limit = min(n, tagsMaxLimit)
+	}
+
+	tags, err := fetchTagCounts(r.Context(), limit)
+	if err != nil {
+		return err
+	}
+	return writeJSON(w, http.StatusOK, struct {
+		Tags []apiTagCount `json:"tags"`
+	}{tags})
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net/http"
+	"slices"
+	"strings"
+	"sync/atomic"
+)
+
+// 形式判定に使う先頭のバイト数（http.DetectContentTypeが参照する長さ）
+const sniffLen = 512
+
+var (
+	errUploadNoFile      = errors.New("upload: file is required")
+	errUploadTooLarge    = errors.New("upload: file is too large")
+	errUploadUnsupported = errors.New("upload: unsupported image type")
+)
+
+// 投稿画像の処理の回数
+var uploadImageStats struct {
+	// 再エンコードせずにそのまま保存した
+	Passthrough atomic.Int64
+	// 縮小・再エンコードした
+	Reencoded atomic.Int64
+	// デコードかエンコードに失敗した
+	Failed atomic.Int64
+}
+
+// 投稿フォームの内容
+type uploadForm struct {
+	CSRFToken      string
+	IdempotencyKey string
+	Body           string
+	Language       string
+	Mime           string
+	Filedata       []byte
+
+	// ファイルパートの検証結果（CSRFトークンの検証を優先するため読み終えてから判定する）
+	fileErr error
+}
+
+// multipartを1パートずつ読み進めて投稿フォームを組み立てる
+// ParseMultipartFormのように全体をバッファせず、ファイルは上限を超えた時点で読み捨てる
+func parseUploadForm(r *http.Request) (*uploadForm, error) {
+	mr, err := r.MultipartReader()
+	if err != nil {
+		return nil, err
+	}
+
+	form := &uploadForm{fileErr: errUploadNoFile}
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		switch part.FormName() {
+		case "file":
+			if part.FileName() == "" {
+				break
+			}
+			form.Mime, form.Filedata, form.fileErr = readUploadFile(part)
+		case "body":
+			b, err := io.ReadAll(part)
+			if err != nil {
+				return nil, err
+			}
+			form.Body = string(b)
+		case "lang":
+			b, err := io.ReadAll(io.LimitReader(part, 16))
+			if err != nil {
+				return nil, err
+			}
+			form.Language = string(b)
+		case "csrf_token":
+			b, err := io.ReadAll(part)
+			if err != nil {
+				return nil, err
+			}
+			form.CSRFToken = string(b)
+		case "idempotency_key":
+			b, err := io.ReadAll(io.LimitReader(part, idempotencyKeyMaxLen+1))
+			if err != nil {
+				return nil, err
+			}
+			form.IdempotencyKey = string(b)
+		}
+		part.Close()
+	}
+
+	return form, nil
+}
+
+// ファイルパートを先頭バイトで形式判定しながら設定の上限まで読み込む
+func readUploadFile(part io.Reader) (string, []byte, error) {
+	limit := currentSettings().UploadLimit
+	lr := &io.LimitedReader{R: part, N: limit + 1}
+
+	head := make([]byte, sniffLen)
+	n, err := io.ReadFull(lr, head)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		if err == io.EOF {
+			return "", nil, errUploadNoFile
+		}
+		return "", nil, err
+	}
+	head = head[:n]
+
+	mime := sniffImageMime(head)
+	if mime == "" {
+		io.Copy(io.Discard, part)
+		return "", nil, errUploadUnsupported
+	}
+
+	var buf bytes.Buffer
+	buf.Write(head)
+	if _, err := buf.ReadFrom(lr); err != nil {
+		return "", nil, err
+	}
+
+	if int64(buf.Len()) > limit {
+		io.Copy(io.Discard, part)
+		return "", nil, errUploadTooLarge
+	}
+
+	return mime, buf.Bytes(), nil
+}
+
+// 投稿を受け付けられる画像形式
+// HEIC/HEIFは保存前にJPEGに変換する
+var supportedUploadMimeTypes = []string{"image/jpeg", "image/png", "image/gif", "image/heic", "image/heif"}
+
+// 先頭バイトから画像形式を判定する。許可されていない形式の場合は空文字列を返す
+// Content-Typeヘッダーはクライアントの申告なので信用しない
+func sniffImageMime(head []byte) string {
+	mime := detectImageMime(head)
+	if !slices.Contains(config.UploadMimeTypes, mime) {
+		return ""
+	}
+	return mime
+}
+
+func detectImageMime(head []byte) string {
+	switch ct := http.DetectContentType(head); ct {
+	case "image/jpeg", "image/png", "image/gif":
+		return ct
+	}
+
+	// HEIFはISOBMFFのftypボックスのブランドで判定する
+	if len(head) < 12 || string(head[4:8]) != "ftyp" {
+		return ""
+	}
+	switch string(head[8:12]) {
+	case "heic", "heix", "heim", "heis", "hevc", "hevx":
+		return "image/heic"
+	case "mif1", "msf1":
+		return "image/heif"
+	default:
+		return ""
+	}
+}
+
+func isHEIFMime(mime string) bool {
+	return mime == "image/heic" || mime == "image/heif"
+}
+
+// 投稿できる画像形式の表示用の一覧（例: jpgとpngとgif）
+func uploadFormatNames() string {
+	names := make([]string, 0, len(config.UploadMimeTypes))
+	for _, mime := range config.UploadMimeTypes {
+		name := strings.TrimPrefix(mime, "image/")
+		if name == "jpeg" {
+			name = "jpg"
+		}
+		names = append(names, name)
+	}
+	return strings.Join(names, "と")
+}
+
+// 画像にExifが含まれているか
+func hasExif(data []byte, mime string) bool {
+	switch mime {
+	case "image/jpeg":
+		return jpegHasExif(data)
+	case "image/png":
+		return pngHasExif(data)
+	default:
+		return false
+	}
+}
+
+// 画像データの前にあるセグメントからAPP1(Exif)を探す
+func jpegHasExif(data []byte) bool {
+	i := 2 // SOI
+	for i+4 <= len(data) {
+		if data[i] != 0xFF {
+			return false
+		}
+		marker := data[i+1]
+		// SOS以降は画像データ
+		if marker == 0xDA {
+			return false
+		}
+		size := int(binary.BigEndian.Uint16(data[i+2 : i+4]))
+		if marker == 0xE1 && bytes.HasPrefix(data[i+4:], []byte("Exif\x00")) {
+			return true
+		}
+		i += 2 + size
+	}
+	return false
+}
+
+// eXIfチャンクを探す
+func pngHasExif(data []byte) bool {
+	i := 8 // シグネチャ
+	for i+8 <= len(data) {
+		size := int(binary.BigEndian.Uint32(data[i : i+4]))
+		switch string(data[i+4 : i+8]) {
+		case "eXIf":
+			return true
+		case "IDAT", "IEND":
+			return false
+		}
+		i += 12 + size
+	}
+	return false
+}
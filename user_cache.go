@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// BANや/initializeでは明示的に捨てるので長めに持つ
+const userCacheTTL = 10 * time.Minute
+
+func userIDKey(id int) string {
+	return "user:id:" + strconv.Itoa(id)
+}
+
+// アカウント名からはユーザーIDだけを引く（アカウント名は変わらない）
+func userNameKey(accountName string) string {
+	return "user:name:" + accountName
+}
+
+// ユーザーをIDで取得する。BANされたユーザーも返すので呼び出し側でDelFlgを確認する
+// 存在しない場合はsql.ErrNoRowsを返す
+func getUserByID(ctx context.Context, id int) (User, error) {
+	if u, err := cacheGet[User](ctx, userIDKey(id)); err == nil {
+		return u, nil
+	}
+
+	u := User{}
+	if err := db.GetContext(ctx, &u, "SELECT * FROM `users` WHERE `id` = ?", id); err != nil {
+		return User{}, err
+	}
+	if err := cacheSet(ctx, userIDKey(id), u, userCacheTTL); err != nil {
+		logger("cache").Error("failed to set user cache", "err", err)
+	}
+	return u, nil
+}
+
+// getUsersByIDsでキャッシュに無いユーザーを読むクエリ
+const usersByIDsQuery = "SELECT * FROM `users` WHERE `id` IN (?)"
+
+// 複数のユーザーをIDでまとめて取得する。存在しないIDは結果に含めない
+func getUsersByIDs(ctx context.Context, ids []int) (map[int]User, error) {
+	keys := make([]string, 0, len(ids))
+	for _, id := range ids {
+		keys = append(keys, userIDKey(id))
+	}
+	cached, err := cacheGetMulti[User](ctx, keys)
+	if err != nil {
+		logger("cache").Error("failed to get user cache", "err", err)
+	}
+
+	users := make(map[int]User, len(ids))
+	missing := make([]int, 0, len(ids))
+	for i, id := range ids {
+		if u, found := cached[keys[i]]; found {
+			users[id] = u
+		} else {
+			missing = append(missing, id)
+		}
+	}
+	if len(missing) == 0 {
+		return users, nil
+	}
+
+	query, args, err := sqlx.In(usersByIDsQuery, missing)
+	if err != nil {
+		return nil, err
+	}
+	fetched := []User{}
+	if err := db.SelectContext(ctx, &fetched, query, args...); err != nil {
+		return nil, err
+	}
+
+	items := make(map[string]User, len(fetched))
+	for _, u := range fetched {
+		users[u.ID] = u
+		items[userIDKey(u.ID)] = u
+	}
+	if err := cacheSetMulti(ctx, items, userCacheTTL); err != nil {
+		logger("cache").Error("failed to set user cache", "err", err)
+	}
+	return users, nil
+}
+
+// BANされていないユーザーをアカウント名で取得する
+// 存在しないかBANされている場合はsql.ErrNoRowsを返す
+func getActiveUserByAccountName(ctx context.Context, accountName string) (User, error) {
+	u, err := getUserByAccountName(ctx, accountName)
+	if err != nil {
+		return User{}, err
+	}
+	if u.DelFlg != 0 {
+		return User{}, sql.ErrNoRows
+	}
+	return u, nil
+}
+
+func getUserByAccountName(ctx context.Context, accountName string) (User, error) {
+	if b, err := cacheStore.Get(ctx, userNameKey(accountName)); err == nil {
+		if id, err := strconv.Atoi(string(b)); err == nil {
+			u, err := getUserByID(ctx, id)
+			if err == nil && u.AccountName == accountName {
+				return u, nil
+			}
+			if err != nil && !errors.Is(err, sql.ErrNoRows) {
+				return User{}, err
+			}
+		}
+	}
+
+	u := User{}
+	if err := db.GetContext(ctx, &u, "SELECT * FROM `users` WHERE `account_name` = ?", accountName); err != nil {
+		return User{}, err
+	}
+	// 大文字小文字違いで引かれた場合も登録された表記で覚える
+	if err := cacheStore.Set(ctx, userNameKey(u.AccountName), []byte(strconv.Itoa(u.ID)), userCacheTTL); err != nil {
+		logger("cache").Error("failed to set user cache", "err", err)
+	}
+	if err := cacheSet(ctx, userIDKey(u.ID), u, userCacheTTL); err != nil {
+		logger("cache").Error("failed to set user cache", "err", err)
+	}
+	return u, nil
+}
+
+// ユーザーのキャッシュを捨てる
+func invalidateUserCache(ctx context.Context, u User) {
+	if err := cacheStore.Delete(ctx, userIDKey(u.ID)); err != nil {
+		logger("cache").Error("failed to expire user cache", "err", err)
+	}
+	if u.AccountName == "" {
+		return
+	}
+	if err := cacheStore.Delete(ctx, userNameKey(u.AccountName)); err != nil {
+		logger("cache").Error("failed to expire user cache", "err", err)
+	}
+}
+
+func subscribeUserCache() {
+	subscribe(events, func(e UserBanned) {
+		invalidateUserCache(context.Background(), User{ID: e.UserID})
+	})
+	subscribe(events, func(e UserUnbanned) {
+		invalidateUserCache(context.Background(), User{ID: e.UserID})
+	})
+}
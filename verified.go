@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// 認証済みのユーザーを読み込むクエリの制限時間
+	verifiedUsersLoadTimeout = time.Second
+	// 読み込みに失敗したら、この間は読み込み直さずに誰も認証済みでないものとして描画する
+	verifiedUsersRetryInterval = 5 * time.Second
+)
+
+// 認証済みのユーザーのID（プロセス内にキャッシュする）
+// 認証済みのユーザーは少なく変更もまれなので、まとめて読み込んで持っておく
+// idsは読み込んだ後は書き換えないので、ロックを外してから読んでよい
+var verifiedUsers = struct {
+	sync.Mutex
+	ids map[int]struct{} // nilなら読み込んでいない
+	// 無効化のたびに増やし、無効化より前に始めた読み込みの結果を捨てる
+	gen      int
+	failedAt time.Time
+}{}
+
+var verifiedUsersFlight flightGroup[map[int]struct{}]
+
+var errVerifiedUsersUnavailable = errors.New("verified users are not loaded")
+
+// 管理者が認証したユーザーか
+// テンプレートから呼ばれるので、読み込めない場合は認証済みでないものとして扱う
+func (u User) Verified() bool {
+	ids, err := verifiedUserIDs(context.Background())
+	if err != nil {
+		return false
+	}
+	_, ok := ids[u.ID]
+	return ok
+}
+
+// 認証済みのユーザーのIDの集合。読み込んでいなければ読み込む
+// 同時に来た読み込みは1回にまとめ、ロックを持ったままDBに問い合わせない
+func verifiedUserIDs(ctx context.Context) (map[int]struct{}, error) {
+	verifiedUsers.Lock()
+	ids, gen, failedAt := verifiedUsers.ids, verifiedUsers.gen, verifiedUsers.failedAt
+	verifiedUsers.Unlock()
+	if ids != nil {
+		return ids, nil
+	}
+	if time.Since(failedAt) < verifiedUsersRetryInterval {
+		return nil, errVerifiedUsersUnavailable
+	}
+
+	return verifiedUsersFlight.Do(strconv.Itoa(gen), func() (map[int]struct{}, error) {
+		// 同じ読み込みを待っている他の呼び出しがあるので、呼び出し元が切れても止めない
+		ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), verifiedUsersLoadTimeout)
+		defer cancel()
+
+		rows := []int{}
+		err := db.SelectContext(ctx, &rows, "SELECT `user_id` FROM `user_verifications`")
+
+		verifiedUsers.Lock()
+		defer verifiedUsers.Unlock()
+		if err != nil {
+			logger("verified").Error("failed to load verified users", "err", err)
+			if verifiedUsers.gen == gen {
+				verifiedUsers.failedAt = time.Now()
+			}
+			return nil, err
+		}
+		ids := make(map[int]struct{}, len(rows))
+		for _, id := range rows {
+			ids[id] = struct{}{}
+		}
+		if verifiedUsers.gen == gen {
+			verifiedUsers.ids = ids
+			verifiedUsers.failedAt = time.Time{}
+		}
+		return ids, nil
+	})
+}
+
+// 次の呼び出しで読み込み直させる
+func clearVerifiedUsers() {
+	verifiedUsers.Lock()
+	verifiedUsers.ids = nil
+	verifiedUsers.gen++
+	verifiedUsers.failedAt = time.Time{}
+	verifiedUsers.Unlock()
+}
+
+func setUserVerified(userID int, verified bool) error {
+	var err error
+	if verified {
+		_, err = db.Exec("INSERT IGNORE INTO `user_verifications` (`user_id`) VALUES (?)", userID)
+	} else {
+		_, err = db.Exec("DELETE FROM `user_verifications` WHERE `user_id` = ?", userID)
+	}
+	if err != nil {
+		return err
+	}
+	events.Publish(UserVerificationChanged{UserID: userID, Verified: verified})
+	return nil
+}
+
+// 認証済みのバッジは投稿のフラグメントにも描画されるので、変わったらまとめて捨てる
+func subscribeVerification() {
+	registerInvalidation("verified_users", func(string) {
+		clearVerifiedUsers()
+	})
+	subscribe(events, func(e UserVerificationChanged) {
+		invalidate("verified_users", "")
+		invalidate("post_fragment", "")
+		touchLastModified(context.Background(), siteLastModifiedKey, userLastModifiedKey(e.UserID))
+	})
+}
+
+// PUT /api/v1/admin/users/{accountName}/verified
+// DELETE /api/v1/admin/users/{accountName}/verified
+// PUTで認証済みにし、DELETEで取り消す
+func setAPIAdminUserVerified(w http.ResponseWriter, r *http.Request) error {
+	me := currentUser(r)
+	if !isLogin(me) {
+		return errUnauthorized
+	}
+	if me.Authority == 0 {
+		return errForbidden
+	}
+
+	if !validCSRFToken(r, requestCSRFToken(r)) {
+		return errInvalidCSRFToken
+	}
+
+	user, err := getActiveUserByAccountName(r.Context(), r.PathValue("accountName"))
+	if err != nil {
+		return err
+	}
+
+	var verified bool
+	switch r.Method {
+	case http.MethodPut:
+		verified = true
+	case http.MethodDelete:
+		verified = false
+	default:
+		return newHTTPError(http.StatusMethodNotAllowed, errors.New("method not allowed"))
+	}
+	if err := setUserVerified(user.ID, verified); err != nil {
+		return err
+	}
+
+	logger("verified").InfoContext(r.Context(), "user verification changed", "account_name", user.AccountName, "verified", verified, "by", me.AccountName)
+	return writeJSON(w, http.StatusOK, newAPIUser(user))
+}